@@ -11,19 +11,47 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/codecrafters-io/redis-starter-go/internal/aof"
 	"github.com/codecrafters-io/redis-starter-go/internal/commands"
 	"github.com/codecrafters-io/redis-starter-go/internal/server"
 	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
 )
 
 var (
-	PORT        = 6379
-	MASTER_ADDR = ""
+	PORT               = 6379
+	MASTER_ADDR        = ""
+	MAX_BULK_LEN       = parser.DefaultMaxBulkLen
+	MAX_MULTIBULK_LEN  = parser.DefaultMaxArrayLen
+	DIR                = "."
+	DB_FILENAME        = "dump.rdb"
+	APPENDONLY         = "no"
+	APPEND_FILENAME    = "appendonly.aof"
+	APPENDFSYNC        = string(aof.EverySec)
+	MAXMEMORY          = "0"
+	MAXMEMORY_POLICY   = string(storage.NoEviction)
+	MAXMEMORY_SAMPLES  = 5
+	DATABASES          = 16
+	REPL_BACKLOG_SIZE  = "1mb"
+	REPL_DISKLESS_SYNC = "yes"
 )
 
 func init() {
 	flag.IntVar(&PORT, "port", PORT, "Port number")
 	flag.StringVar(&MASTER_ADDR, "replicaof", MASTER_ADDR, "Master server address and port: \"<host port>\"")
+	flag.IntVar(&MAX_BULK_LEN, "proto-max-bulk-len", MAX_BULK_LEN, "Max length of a single bulk string in a request")
+	flag.IntVar(&MAX_MULTIBULK_LEN, "proto-max-multibulk-len", MAX_MULTIBULK_LEN, "Max number of elements in a request array")
+	flag.StringVar(&DIR, "dir", DIR, "Working directory for the dump file")
+	flag.StringVar(&DB_FILENAME, "dbfilename", DB_FILENAME, "Name of the dump file")
+	flag.StringVar(&APPENDONLY, "appendonly", APPENDONLY, "Log write commands to the append only file: \"yes\" or \"no\"")
+	flag.StringVar(&APPEND_FILENAME, "appendfilename", APPEND_FILENAME, "Name of the append only file")
+	flag.StringVar(&APPENDFSYNC, "appendfsync", APPENDFSYNC, "When to fsync the append only file: \"always\", \"everysec\" or \"no\"")
+	flag.StringVar(&MAXMEMORY, "maxmemory", MAXMEMORY, "Memory limit of the keys, like \"100mb\", 0 for none")
+	flag.StringVar(&MAXMEMORY_POLICY, "maxmemory-policy", MAXMEMORY_POLICY, "What keys to evict at the memory limit, like \"allkeys-lru\" or \"noeviction\"")
+	flag.IntVar(&MAXMEMORY_SAMPLES, "maxmemory-samples", MAXMEMORY_SAMPLES, "Number of keys sampled to pick one to evict")
+	flag.IntVar(&DATABASES, "databases", DATABASES, "Number of databases")
+	flag.StringVar(&REPL_BACKLOG_SIZE, "repl-backlog-size", REPL_BACKLOG_SIZE, "Size of the replication backlog kept for the replicas that reconnect, like \"1mb\"")
+	flag.StringVar(&REPL_DISKLESS_SYNC, "repl-diskless-sync", REPL_DISKLESS_SYNC, "Stream the RDB of a full resync to the replica instead of writing it to disk first: \"yes\" or \"no\"")
 }
 
 func main() {
@@ -42,49 +70,120 @@ func main() {
 
 	cmdParser := commands.NewCommandParser(table)
 	connHandler := server.NewConnectionHandler(cmdParser)
+	connHandler.SetProtoLimits(MAX_BULK_LEN, MAX_MULTIBULK_LEN)
 	sv := server.NewServer(connHandler)
-	storage := storage.NewStorage()
-	server.RouteBasic(sv, storage)
+	if DATABASES < 1 {
+		log.Fatalln("databases must be at least 1")
+	}
+	dbs := storage.NewDatabases(DATABASES)
+	SetMaxMemory(dbs)
+	server.RouteBasic(sv, dbs)
+
+	persistence := server.NewPersistence(sv, dbs, DIR, DB_FILENAME)
+	var aofLog *aof.AOF
+	if APPENDONLY == "yes" {
+		aofLog = OpenAOF()
+		persistence.SetAOF(aofLog)
+		if err := persistence.LoadAOF(); err != nil {
+			log.Fatalf("Failed to load %s: %s", aofLog.Path(), err.Error())
+		}
+	} else if err := persistence.Load(); err != nil {
+		log.Fatalf("Failed to load %s: %s", persistence.RdbPath(), err.Error())
+	}
+	server.RoutePersistence(sv, persistence)
 
+	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
 	if MASTER_ADDR != "" {
-		StartAsReplica(sv)
+		StartAsReplica(ctx, sv, persistence, aofLog, dbs)
 	} else {
-		StartAsMaster(sv, connHandler)
+		StartAsMaster(sv, aofLog, dbs)
 	}
 
-	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
+	go dbs.ActiveExpire(ctx)
 	sv.Listen(ctx, fmt.Sprintf(":%d", PORT))
+
+	if aofLog != nil {
+		aofLog.Close()
+	}
 }
 
-func StartAsReplica(sv *server.Server) {
-	masterAddr := strings.Split(MASTER_ADDR, " ")
-	if len(masterAddr) != 2 {
-		log.Fatalln("<MASTER_ADDR> parameter should contain address and port")
-		return
+func OpenAOF() *aof.AOF {
+	policy, err := aof.ParseFsyncPolicy(APPENDFSYNC)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+
+	aofLog, err := aof.Open(filepath.Join(DIR, APPEND_FILENAME), policy)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	return aofLog
+}
+
+func SetMaxMemory(dbs *storage.Databases) {
+	max, err := storage.ParseMemory(MAXMEMORY)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	policy, err := storage.ParseEvictionPolicy(MAXMEMORY_POLICY)
+	if err != nil {
+		log.Fatalln(err.Error())
+	}
+	if MAXMEMORY_SAMPLES < 1 {
+		log.Fatalln("maxmemory-samples must be at least 1")
 	}
+	dbs.SetMaxMemory(max, policy, MAXMEMORY_SAMPLES)
+}
 
-	c, err := net.Dial("tcp", fmt.Sprintf("%s:%s", masterAddr[0], masterAddr[1]))
+func ReplBacklogSize() int {
+	size, err := storage.ParseMemory(REPL_BACKLOG_SIZE)
 	if err != nil {
 		log.Fatalln(err.Error())
+	}
+	if size < 1 {
+		log.Fatalln("repl-backlog-size must be at least 1 byte")
+	}
+	return int(size)
+}
+
+func StartAsReplica(ctx context.Context, sv *server.Server, persistence *server.Persistence, aofLog *aof.AOF, dbs *storage.Databases) {
+	masterAddr := strings.Split(MASTER_ADDR, " ")
+	if len(masterAddr) != 2 {
+		log.Fatalln("<MASTER_ADDR> parameter should contain address and port")
 		return
 	}
 
-	replicaCtx, err := server.NewReplica(sv, c, PORT)
+	replicaCtx, err := server.NewReplica(sv, net.JoinHostPort(masterAddr[0], masterAddr[1]), PORT, ReplBacklogSize())
 	if err != nil {
 		log.Fatalln(err.Error())
 		return
 	}
 
+	replicaCtx.SetDatabases(dbs)
 	sv.SetRwProvider(replicaCtx.ReplicaRwProvider)
 	server.RouteReplica(sv, replicaCtx)
-	client, ctx := sv.AddClient(context.Background(), c)
-	go sv.Serve(ctx, client)
-
-	replicaCtx.InitHandshake()
+	replicaCtx.OnPromote(func(mc *server.MasterContext) {
+		SetupMaster(mc, aofLog, dbs)
+		if aofLog != nil {
+			if err := persistence.RewriteAOF(); err != nil {
+				log.Printf("Failed to rewrite %s after the promotion: %s", aofLog.Path(), err.Error())
+			}
+		}
+	})
+	go replicaCtx.Run(ctx)
 }
 
-func StartAsMaster(sv *server.Server, connHandler *server.ConnectionHandler) {
-	mc := server.NewMaster(connHandler)
+func StartAsMaster(sv *server.Server, aofLog *aof.AOF, dbs *storage.Databases) {
+	mc := server.NewMaster(sv, ReplBacklogSize())
+	SetupMaster(mc, aofLog, dbs)
 	sv.SetCallChain(mc.MasterCallChain(sv))
 	server.RouteMaster(sv, mc)
 }
+
+func SetupMaster(mc *server.MasterContext, aofLog *aof.AOF, dbs *storage.Databases) {
+	if aofLog != nil {
+		mc.SetAOF(aofLog)
+	}
+	mc.SetDatabases(dbs)
+	mc.SetFullSync(REPL_DISKLESS_SYNC == "yes", DIR)
+}
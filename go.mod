@@ -10,15 +10,18 @@ module github.com/codecrafters-io/redis-starter-go
 
 go 1.19
 
+require (
+	github.com/google/go-cmp v0.6.0
+	github.com/looplab/fsm v1.0.1
+	github.com/mitchellh/mapstructure v1.5.0
+)
+
 require (
 	github.com/dghubble/trie v0.1.0 // indirect
 	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/gammazero/deque v0.2.1 // indirect
-	github.com/google/go-cmp v0.6.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
-	github.com/looplab/fsm v1.0.1 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
-	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/pelletier/go-toml/v2 v2.1.0 // indirect
 	github.com/sagikazarmark/locafero v0.4.0 // indirect
 	github.com/sagikazarmark/slog-shim v0.1.0 // indirect
@@ -0,0 +1,292 @@
+// Package aof implements the append only file: a log of every write command
+// that is replayed on startup.
+package aof
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+	"github.com/codecrafters-io/redis-starter-go/pkg/rdb"
+)
+
+type FsyncPolicy string
+
+const (
+	Always   FsyncPolicy = "always"
+	EverySec FsyncPolicy = "everysec"
+	No       FsyncPolicy = "no"
+)
+
+const readBufSize = 64 * 1024
+
+func ParseFsyncPolicy(policy string) (FsyncPolicy, error) {
+	switch FsyncPolicy(policy) {
+	case Always, EverySec, No:
+		return FsyncPolicy(policy), nil
+	}
+	return "", fmt.Errorf("Unknown appendfsync policy: %s", policy)
+}
+
+type AOF struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	policy     FsyncPolicy
+	dirty      bool
+	rewriting  bool
+	rewriteBuf []byte
+	// the database selected at the end of the log and of the rewrite buffer,
+	// -1 when unknown
+	db        int
+	rewriteDB int
+	quit      chan struct{}
+}
+
+func Open(path string, policy FsyncPolicy) (*AOF, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// the log is replayed from the first database, but the one it ends in
+	// isn't known
+	a := &AOF{
+		path:   path,
+		file:   file,
+		policy: policy,
+		db:     -1,
+		quit:   make(chan struct{}),
+	}
+	if stat.Size() == 0 {
+		a.db = 0
+	}
+	if policy == EverySec {
+		go a.fsyncLoop()
+	}
+	return a, nil
+}
+
+func (a *AOF) Path() string {
+	return a.path
+}
+
+// Append writes a command in its RESP form, run in the database db, to the
+// end of the log. A SELECT is written first when the log is in another
+// database.
+func (a *AOF) Append(db int, cmd []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriting {
+		if db != a.rewriteDB {
+			a.rewriteBuf = append(a.rewriteBuf, selectCommand(db)...)
+			a.rewriteDB = db
+		}
+		a.rewriteBuf = append(a.rewriteBuf, cmd...)
+	}
+
+	if db != a.db {
+		// a failed write leaves the database unknown
+		a.db = -1
+		if _, err := a.file.Write(selectCommand(db)); err != nil {
+			return err
+		}
+		a.db = db
+	}
+	if _, err := a.file.Write(cmd); err != nil {
+		return err
+	}
+	if a.policy == Always {
+		return a.file.Sync()
+	}
+	a.dirty = true
+	return nil
+}
+
+func (a *AOF) fsyncLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-a.quit:
+			return
+		case <-t.C:
+			a.mu.Lock()
+			if a.dirty {
+				if err := a.file.Sync(); err != nil {
+					log.Printf("Error syncing the AOF: %s", err.Error())
+				}
+				a.dirty = false
+			}
+			a.mu.Unlock()
+		}
+	}
+}
+
+func (a *AOF) Close() error {
+	close(a.quit)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	return a.file.Close()
+}
+
+// StartRewrite makes the log remember commands appended from now on. It must
+// be called at the same point in time the snapshot for the rewrite is taken.
+func (a *AOF) StartRewrite() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.rewriting {
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	a.rewriting = true
+	a.rewriteBuf = nil
+	// the commands are replayed after the base, from the first database
+	a.rewriteDB = 0
+	return nil
+}
+
+func selectCommand(db int) []byte {
+	return parser.ArrayData([]parser.Data{
+		parser.BulkStringData([]byte("SELECT")),
+		parser.BulkStringData([]byte(strconv.Itoa(db))),
+	}).Marshal()
+}
+
+// FinishRewrite writes a new log that starts with the base written by
+// writeBase, followed by the commands appended since StartRewrite, and
+// atomically replaces the current log with it.
+func (a *AOF) FinishRewrite(writeBase func(w io.Writer) error) error {
+	tmp, err := a.writeBase(writeBase)
+	if err != nil {
+		a.mu.Lock()
+		a.rewriting = false
+		a.rewriteBuf = nil
+		a.mu.Unlock()
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rewriting = false
+
+	_, err = tmp.Write(a.rewriteBuf)
+	a.rewriteBuf = nil
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), a.path); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	a.file.Close()
+	a.file = tmp
+	a.db = a.rewriteDB
+	a.dirty = false
+	return nil
+}
+
+func (a *AOF) writeBase(writeBase func(w io.Writer) error) (*os.File, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(a.path), fmt.Sprintf("temp-rewriteaof-bg-%d-*.aof", os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(tmp)
+	err = writeBase(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// Load replays the log at path. If the log starts with an RDB preamble it is
+// passed to loadBase, then apply is called for every command. A command cut
+// in the middle, as left by a crash, is removed from the file. Returns the
+// number of applied commands.
+func Load(path string, loadBase func(r io.Reader) error, apply func(cmd [][]byte) error) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// the RDB and RESP decoders share this reader, so nothing is lost in
+	// their own buffers when switching between them
+	cr := &countingReader{r: f}
+	br := bufio.NewReaderSize(cr, readBufSize)
+
+	if magic, err := br.Peek(len(rdb.Magic)); err == nil && string(magic) == rdb.Magic {
+		if err := loadBase(br); err != nil {
+			return 0, fmt.Errorf("Bad RDB preamble: %s", err.Error())
+		}
+	}
+
+	dec := parser.NewDecoder(br)
+	applied := 0
+	for {
+		valid := cr.n - int64(br.Buffered())
+		cmd, err := dec.Decode()
+		if err == io.EOF {
+			return applied, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("!!! Warning: short read while loading the AOF file %s !!!", path)
+			log.Printf("AOF loaded anyway because aof-load-truncated is enabled, truncating to %d bytes", valid)
+			return applied, os.Truncate(path, valid)
+		}
+		if err != nil {
+			return applied, fmt.Errorf("Bad file format reading the append only file: %s", err.Error())
+		}
+
+		if err := apply(cmd.Flat()); err != nil {
+			log.Printf("Error replaying AOF command: %s", err.Error())
+		}
+		applied++
+	}
+}
@@ -0,0 +1,148 @@
+package aof
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+	"github.com/google/go-cmp/cmp"
+)
+
+func command(args ...string) []byte {
+	var arr []parser.Data
+	for _, arg := range args {
+		arr = append(arr, parser.BulkStringData([]byte(arg)))
+	}
+	return parser.ArrayData(arr).Marshal()
+}
+
+func load(t *testing.T, path string, loadBase func(r io.Reader) error) []string {
+	var res []string
+	_, err := Load(path, loadBase, func(cmd [][]byte) error {
+		res = append(res, string(cmd[1]))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return res
+}
+
+func TestAppendAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	a, err := Open(path, Always)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Append(0, command("SET", "a", "1"))
+	a.Append(0, command("SET", "b", "2"))
+	a.Close()
+
+	// a crash in the middle of a write leaves a partial command behind
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(command("SET", "c", "3")[:10])
+	f.Close()
+
+	want := []string{"a", "b"}
+	if res := load(t, path, nil); !cmp.Equal(res, want) {
+		t.Errorf("Wrong replayed commands. Have: %v, want: %v", res, want)
+	}
+
+	stat, _ := os.Stat(path)
+	if size := int64(len(command("SET", "a", "1")) * 2); stat.Size() != size {
+		t.Errorf("Partial command was not truncated. Have: %d bytes, want: %d", stat.Size(), size)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	a, err := Open(path, No)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer a.Close()
+
+	a.Append(0, command("SET", "old", "1"))
+	if err := a.StartRewrite(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := a.StartRewrite(); err == nil {
+		t.Error("Expected an error starting a second rewrite")
+	}
+	a.Append(0, command("SET", "during", "2"))
+
+	err = a.FinishRewrite(func(w io.Writer) error {
+		_, err := w.Write([]byte("REDIS0011base"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Append(0, command("SET", "after", "3"))
+
+	var base []byte
+	res := load(t, path, func(r io.Reader) error {
+		base = make([]byte, len("REDIS0011base"))
+		_, err := io.ReadFull(r, base)
+		return err
+	})
+
+	if string(base) != "REDIS0011base" {
+		t.Errorf("Wrong base. Have: %q, want: %q", base, "REDIS0011base")
+	}
+	want := []string{"during", "after"}
+	if !cmp.Equal(res, want) {
+		t.Errorf("Wrong replayed commands. Have: %v, want: %v", res, want)
+	}
+}
+
+func TestAppendSelectsDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	a, err := Open(path, No)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Append(0, command("SET", "a", "1"))
+	a.Append(2, command("SET", "b", "2"))
+	a.Append(2, command("SET", "c", "3"))
+	a.Close()
+
+	// the database the log ends in is not known after reopening it
+	a, err = Open(path, No)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer a.Close()
+	a.Append(2, command("SET", "d", "4"))
+	if err := a.StartRewrite(); err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Append(1, command("SET", "e", "5"))
+	a.Append(1, command("SET", "f", "6"))
+	a.Append(0, command("SET", "g", "7"))
+
+	want := []string{"a", "2", "b", "c", "2", "d", "1", "e", "f", "0", "g"}
+	if res := load(t, path, nil); !cmp.Equal(res, want) {
+		t.Errorf("Wrong replayed commands. Have: %v, want: %v", res, want)
+	}
+
+	err = a.FinishRewrite(func(w io.Writer) error {
+		_, err := w.Write([]byte("REDIS0011base"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	a.Append(1, command("SET", "h", "8"))
+
+	want = []string{"1", "e", "f", "0", "g", "1", "h"}
+	res := load(t, path, func(r io.Reader) error {
+		_, err := io.ReadFull(r, make([]byte, len("REDIS0011base")))
+		return err
+	})
+	if !cmp.Equal(res, want) {
+		t.Errorf("Wrong replayed commands after the rewrite. Have: %v, want: %v", res, want)
+	}
+}
@@ -13,16 +13,17 @@ import (
 
 type Command struct {
 	Name      string
-	Options   map[string][]string
-	Arguments []string
+	Options   map[string][][]byte
+	Arguments [][]byte
 	Type      CommandType
 }
 
 type CommandInfo struct {
-	Args    []string
-	Options map[string][]string
-	Type    CommandType
-	Policy  CommandPolicy
+	Args     []string
+	Variadic bool
+	Options  map[string][]string
+	Type     CommandType
+	Policy   CommandPolicy
 }
 
 type CommandType string
@@ -64,8 +65,11 @@ func NewCommandParser(cmdTable map[string]CommandInfo) CommandParser {
 	}
 }
 
-func (p CommandParser) ParseCommand(req []string) (Command, error) {
-	commandName := strings.ToUpper(req[0])
+func (p CommandParser) ParseCommand(req [][]byte) (Command, error) {
+	if len(req) == 0 {
+		return Command{}, errors.New("Empty command")
+	}
+	commandName := strings.ToUpper(string(req[0]))
 
 	commandName, cmdInfo, err := p.getCommandInfo(commandName)
 
@@ -98,38 +102,42 @@ func (p CommandParser) getCommandInfo(cmdName string) (string, CommandInfo, erro
 	return k, *v, nil
 }
 
-func (p CommandParser) parseOptions(input []string, cmdInfo CommandInfo) (map[string][]string, error) {
-	res := make(map[string][]string)
-	var currentOption string
+func (p CommandParser) parseOptions(input [][]byte, cmdInfo CommandInfo) (map[string][][]byte, error) {
+	res := make(map[string][][]byte)
 	for i := 0; i < len(input); i++ {
 		if len(input[i]) == 0 {
 			continue
 		}
 
-		option := strings.ToUpper(input[i])
-		if args, ok := cmdInfo.Options[option]; ok {
-			currentOption = option
-
-			if len(input) < len(args)+i+1 {
-				return res, errors.New(fmt.Sprintf("Too few argumets for option %s", currentOption))
-			}
-			res[currentOption] = input[i+1 : len(args)+1]
-			if len(args) == 0 {
-				continue
-			}
-			i += len(args) - 1
-		} else if currentOption == "" {
+		option := strings.ToUpper(string(input[i]))
+		args, ok := cmdInfo.Options[option]
+		if !ok {
 			return res, errors.New(fmt.Sprintf("No such option: %s", option))
 		}
-
+		if len(input) < len(args)+i+1 {
+			return res, errors.New(fmt.Sprintf("Too few argumets for option %s", option))
+		}
+		res[option] = input[i+1 : i+1+len(args)]
+		i += len(args)
 	}
 	return res, nil
 }
 
-func (p CommandParser) parseArguments(input []string, cmdInfo CommandInfo) ([]string, error) {
+// parseArguments takes the positional arguments. Variadic commands also take
+// everything after them up to the first known option.
+func (p CommandParser) parseArguments(input [][]byte, cmdInfo CommandInfo) ([][]byte, error) {
 	if len(input) < len(cmdInfo.Args) {
 		return nil, errors.New("Too few arguments")
 	}
 
-	return input[:len(cmdInfo.Args)], nil
+	n := len(cmdInfo.Args)
+	if cmdInfo.Variadic {
+		for n < len(input) {
+			if _, ok := cmdInfo.Options[strings.ToUpper(string(input[n]))]; ok {
+				break
+			}
+			n++
+		}
+	}
+	return input[:n], nil
 }
@@ -38,15 +38,16 @@ func setup() {
 func TestGetCommand(t *testing.T) {
 	expected := Command{
 		Name:      "SET",
-		Arguments: []string{"heheh", "asdasd"},
-		Options: map[string][]string{
-			"PX": {"123"},
+		Arguments: [][]byte{[]byte("heheh"), []byte("asdasd")},
+		Options: map[string][][]byte{
+			"PX": {[]byte("123")},
 		},
+		Type: Write,
 	}
-	cmdArr := []string{"SET", "heheh", "asdasd", "PX", "123"}
+	cmdArr := [][]byte{[]byte("SET"), []byte("heheh"), []byte("asdasd"), []byte("PX"), []byte("123")}
 
 	cmdParser := NewCommandParser(table)
-	parsedCmd, err := cmdParser.GetCommand(cmdArr)
+	parsedCmd, err := cmdParser.ParseCommand(cmdArr)
 	if err != nil {
 		t.Errorf("Error: %s", err.Error())
 		return
@@ -56,6 +57,76 @@ func TestGetCommand(t *testing.T) {
 	}
 }
 
+func TestParseBinaryArguments(t *testing.T) {
+	value := []byte{0x00, 0xff, '\r', '\n', 0xc3, 0x28, 'P', 'X'}
+	cmdArr := [][]byte{[]byte("set"), {0xfe, 0x00}, value}
+
+	cmdParser := NewCommandParser(table)
+	parsedCmd, err := cmdParser.ParseCommand(cmdArr)
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+
+	want := [][]byte{{0xfe, 0x00}, value}
+	if !cmp.Equal(want, parsedCmd.Arguments) {
+		t.Errorf("Wrong parsed arguments. Have: %v, want: %v", parsedCmd.Arguments, want)
+	}
+}
+
+func TestParseVariadicWithOptions(t *testing.T) {
+	expected := Command{
+		Name:      "HELLO",
+		Arguments: [][]byte{[]byte("3")},
+		Options: map[string][][]byte{
+			"AUTH":    {[]byte("default"), []byte("secret")},
+			"SETNAME": {[]byte("conn")},
+		},
+		Type: Info,
+	}
+	cmdArr := [][]byte{[]byte("hello"), []byte("3"), []byte("auth"), []byte("default"), []byte("secret"), []byte("setname"), []byte("conn")}
+
+	cmdParser := NewCommandParser(table)
+	parsedCmd, err := cmdParser.ParseCommand(cmdArr)
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if !cmp.Equal(expected, parsedCmd) {
+		t.Errorf("Wrong parsed command. Have: %v, want: %v", parsedCmd, expected)
+	}
+}
+
+func TestParseFlagOptions(t *testing.T) {
+	expected := Command{
+		Name:      "SET",
+		Arguments: [][]byte{[]byte("key"), []byte("value")},
+		Options: map[string][][]byte{
+			"NX":  {},
+			"GET": {},
+			"EX":  {[]byte("10")},
+		},
+		Type: Write,
+	}
+	cmdArr := [][]byte{[]byte("SET"), []byte("key"), []byte("value"), []byte("nx"), []byte("get"), []byte("ex"), []byte("10")}
+
+	cmdParser := NewCommandParser(table)
+	parsedCmd, err := cmdParser.ParseCommand(cmdArr)
+	if err != nil {
+		t.Fatalf("Error: %s", err.Error())
+	}
+	if !cmp.Equal(expected, parsedCmd) {
+		t.Errorf("Wrong parsed command. Have: %v, want: %v", parsedCmd, expected)
+	}
+}
+
+func TestParseUnknownOptionAfterOption(t *testing.T) {
+	cmdArr := [][]byte{[]byte("SET"), []byte("key"), []byte("value"), []byte("PX"), []byte("100"), []byte("bogus")}
+
+	cmdParser := NewCommandParser(table)
+	if _, err := cmdParser.ParseCommand(cmdArr); err == nil {
+		t.Errorf("Expected an error for an unknown option")
+	}
+}
+
 //	func TestParseOptions(t *testing.T) {
 //		tests := []utils.Test[[]string, map[string][]string]{
 //			{
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+const (
+	errNotInteger = "ERR value is not an integer or out of range"
+	errSyntax     = "ERR syntax error"
+)
+
+func parseInt(arg []byte) (int, error) {
+	return strconv.Atoi(string(arg))
+}
+
+// formatFloat formats the result of the INCRBYFLOAT commands, without an
+// exponent like redis does.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func keyStrings(args [][]byte) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	return keys
+}
+
+func stringsData(strs []string) []parser.Data {
+	data := make([]parser.Data, len(strs))
+	for i, str := range strs {
+		data[i] = parser.BulkStringData([]byte(str))
+	}
+	return data
+}
+
+func bulksData(bulks [][]byte) []parser.Data {
+	data := make([]parser.Data, len(bulks))
+	for i, b := range bulks {
+		data[i] = parser.BulkStringData(b)
+	}
+	return data
+}
+
+// nullReply is the null bulk string in RESP2 and the null in RESP3.
+func nullReply(req Request) []byte {
+	return parser.NullData().MarshalProto(req.Client.Proto())
+}
+
+// nullArrayReply is the null array in RESP2 and the null in RESP3.
+func nullArrayReply(req Request) []byte {
+	return nullArrayData(req).MarshalProto(req.Client.Proto())
+}
+
+// nullArrayData is nullArrayReply for replies that nest it.
+func nullArrayData(req Request) parser.Data {
+	if req.Client.Proto() >= parser.Resp3 {
+		return parser.NullData()
+	}
+	return parser.NullArrayData()
+}
+
+func wrongArgs(name string) string {
+	return "ERR wrong number of arguments for '" + strings.ToLower(name) + "' command"
+}
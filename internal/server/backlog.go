@@ -0,0 +1,52 @@
+package server
+
+// replBacklog keeps the end of the replication stream in a ring buffer, so a
+// replica that lost its connection gets what it missed instead of the whole
+// dataset.
+type replBacklog struct {
+	buf []byte
+	// where the next byte is written and how many bytes are kept
+	pos  int
+	size int
+	// the replication offset after the last byte written
+	offset int
+}
+
+func newReplBacklog(capacity int, offset int) *replBacklog {
+	return &replBacklog{buf: make([]byte, capacity), offset: offset}
+}
+
+func (b *replBacklog) write(data []byte) {
+	b.offset += len(data)
+	if len(data) > len(b.buf) {
+		data = data[len(data)-len(b.buf):]
+	}
+	n := copy(b.buf[b.pos:], data)
+	copy(b.buf, data[n:])
+	b.pos = (b.pos + len(data)) % len(b.buf)
+	b.size += len(data)
+	if b.size > len(b.buf) {
+		b.size = len(b.buf)
+	}
+}
+
+// reset empties the backlog, the stream continues at offset.
+func (b *replBacklog) reset(offset int) {
+	b.pos, b.size, b.offset = 0, 0, offset
+}
+
+// since returns the bytes of the stream after offset, false if some of them
+// are not kept anymore.
+func (b *replBacklog) since(offset int) ([]byte, bool) {
+	if offset > b.offset || offset < b.offset-b.size {
+		return nil, false
+	}
+	n := b.offset - offset
+	start := (b.pos - n + len(b.buf)) % len(b.buf)
+	res := make([]byte, 0, n)
+	if start+n <= len(b.buf) {
+		return append(res, b.buf[start:start+n]...), true
+	}
+	res = append(res, b.buf[start:]...)
+	return append(res, b.buf[:n-(len(b.buf)-start)]...), true
+}
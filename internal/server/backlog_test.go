@@ -0,0 +1,100 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/commands"
+)
+
+func since(t *testing.T, b *replBacklog, offset int) string {
+	t.Helper()
+	res, ok := b.since(offset)
+	if !ok {
+		t.Fatalf("The backlog doesn't have the stream after %d", offset)
+	}
+	return string(res)
+}
+
+func TestBacklogWraparound(t *testing.T) {
+	b := newReplBacklog(8, 100)
+	b.write([]byte("abcde"))
+	b.write([]byte("fghij"))
+
+	if b.offset != 110 {
+		t.Errorf("Wrong offset. Have: %d, want: 110", b.offset)
+	}
+	if res := since(t, b, 102); res != "cdefghij" {
+		t.Errorf("Wrong stream. Have: %q, want: %q", res, "cdefghij")
+	}
+	if res := since(t, b, 107); res != "hij" {
+		t.Errorf("Wrong stream. Have: %q, want: %q", res, "hij")
+	}
+
+	// a write larger than the buffer only keeps its end
+	b.write([]byte("0123456789"))
+	if res := since(t, b, 112); res != "23456789" {
+		t.Errorf("Wrong stream. Have: %q, want: %q", res, "23456789")
+	}
+}
+
+func TestBacklogBoundaries(t *testing.T) {
+	b := newReplBacklog(8, 0)
+	b.write([]byte("abcdefghij"))
+
+	if res := since(t, b, 10); res != "" {
+		t.Errorf("The stream after the last byte isn't empty: %q", res)
+	}
+	if res := since(t, b, 2); res != "cdefghij" {
+		t.Errorf("Wrong stream from the oldest byte. Have: %q, want: %q", res, "cdefghij")
+	}
+	if _, ok := b.since(1); ok {
+		t.Error("Returned the stream after an offset older than the buffer")
+	}
+	if _, ok := b.since(11); ok {
+		t.Error("Returned the stream after an offset not reached yet")
+	}
+
+	b.reset(20)
+	if res := since(t, b, 20); res != "" {
+		t.Errorf("The stream of an emptied backlog isn't empty: %q", res)
+	}
+	if _, ok := b.since(19); ok {
+		t.Error("Returned the stream from before the reset")
+	}
+}
+
+func TestPartialSync(t *testing.T) {
+	sv := NewServer(NewConnectionHandler(commands.NewCommandParser(table)))
+	mc := NewMaster(sv, 8)
+	mc.feed([]byte("abcdefghij"))
+	repl := sv.GetReplInfo()
+
+	// the offset is the first byte the replica wants
+	if missed, ok := mc.partialSync(repl.ReplId, 8); !ok || string(missed) != "hij" {
+		t.Errorf("Wrong partial sync. Have: %q, %v, want: %q", missed, ok, "hij")
+	}
+	if missed, ok := mc.partialSync(repl.ReplId, 11); !ok || len(missed) != 0 {
+		t.Errorf("Wrong partial sync of a replica that is up to date. Have: %q, %v", missed, ok)
+	}
+	if _, ok := mc.partialSync(repl.ReplId, 2); ok {
+		t.Error("Partial sync from before the backlog")
+	}
+	if _, ok := mc.partialSync(newReplId(), 8); ok {
+		t.Error("Partial sync of another history")
+	}
+
+	// after a promotion the history of the old master goes on up to where
+	// the new one took over
+	old := repl.ReplId
+	sv.updateReplInfo(func(repl *ReplInfo) {
+		repl.ReplId2, repl.SecondReplOffset = old, repl.ReplOffset+1
+		repl.ReplId = newReplId()
+	})
+	mc.feed([]byte("kl"))
+	if missed, ok := mc.partialSync(old, 11); !ok || string(missed) != "kl" {
+		t.Errorf("Wrong partial sync of the old history. Have: %q, %v, want: %q", missed, ok, "kl")
+	}
+	if _, ok := mc.partialSync(old, 12); ok {
+		t.Error("Partial sync of the old history past the promotion")
+	}
+}
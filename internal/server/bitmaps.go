@@ -0,0 +1,526 @@
+package server
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+const (
+	errBitOffset    = "ERR bit offset is not an integer or out of range"
+	errBitfieldType = "ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+)
+
+func (h BaseHandler) routeBitmaps(server *Server) {
+	server.AddHandler("SETBIT", h.handleSetbit)
+	server.AddHandler("GETBIT", h.handleGetbit)
+	server.AddHandler("BITCOUNT", h.handleBitcount)
+	server.AddHandler("BITPOS", h.handleBitpos)
+	server.AddHandler("BITOP", h.handleBitop)
+	server.AddHandler("BITFIELD", h.handleBitfield)
+	server.AddHandler("BITFIELD_RO", h.handleBitfield)
+}
+
+// parseBitOffset parses the offset of a bit, that must fall in a string of
+// the maximum size. With BITFIELD a #n offset is in units of width bits.
+func parseBitOffset(arg []byte, width int) (int, bool) {
+	multiplied := width > 0 && len(arg) > 0 && arg[0] == '#'
+	if multiplied {
+		arg = arg[1:]
+	}
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || n < 0 || n >= maxStringLength*8 {
+		return 0, false
+	}
+	if multiplied {
+		if n *= int64(width); n >= maxStringLength*8 {
+			return 0, false
+		}
+	}
+	return int(n), true
+}
+
+// grow returns a copy of value at least size bytes long, padded with zeros.
+func grow(value []byte, size int) []byte {
+	if size < len(value) {
+		size = len(value)
+	}
+	res := make([]byte, size)
+	copy(res, value)
+	return res
+}
+
+// getBit returns the bit at offset, counting from the most significant bit
+// of the first byte. Bits past the end are 0.
+func getBit(value []byte, offset int) byte {
+	if offset/8 >= len(value) {
+		return 0
+	}
+	return value[offset/8] >> (7 - offset%8) & 1
+}
+
+func setBit(value []byte, offset int, bit byte) {
+	mask := byte(1) << (7 - offset%8)
+	if bit == 1 {
+		value[offset/8] |= mask
+	} else {
+		value[offset/8] &^= mask
+	}
+}
+
+func (h BaseHandler) handleSetbit(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	offset, ok := parseBitOffset(args[1], 0)
+	if !ok {
+		rw.Write(parser.ErrorData(errBitOffset).Marshal())
+		return
+	}
+	if len(args[2]) != 1 || (args[2][0] != '0' && args[2][0] != '1') {
+		rw.Write(parser.ErrorData("ERR bit is not an integer or out of range").Marshal())
+		return
+	}
+
+	var prev byte
+	err := h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		prev = getBit(value, offset)
+		res := grow(value, offset/8+1)
+		setBit(res, offset, args[2][0]-'0')
+		return res, true
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(int(prev)).Marshal())
+}
+
+func (h BaseHandler) handleGetbit(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	offset, ok := parseBitOffset(args[1], 0)
+	if !ok {
+		rw.Write(parser.ErrorData(errBitOffset).Marshal())
+		return
+	}
+	value, err := h.db(req).Get(string(args[0]))
+	if err == storage.ErrWrongType {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(int(getBit(value, offset))).Marshal())
+}
+
+// bitRange turns the start and end indexes of BITCOUNT and BITPOS, in bytes
+// or in bits, into inclusive bit offsets. ok is false when it's empty.
+func bitRange(length, start, end int, inBits bool) (first, last int, ok bool) {
+	if start < 0 && end < 0 && start > end {
+		return 0, 0, false
+	}
+	total := length
+	if inBits {
+		total *= 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return 0, 0, false
+	}
+	if inBits {
+		return start, end, true
+	}
+	return start * 8, end*8 + 7, true
+}
+
+// parseBitRange parses the [start [end [BYTE|BIT]]] arguments of BITCOUNT and
+// BITPOS. BITCOUNT needs both indexes, BITPOS can do with the start.
+func parseBitRange(args [][]byte, opts map[string][][]byte, needEnd bool) (start, end int, endGiven, inBits bool, errMsg string) {
+	_, byByte := opts["BYTE"]
+	_, inBits = opts["BIT"]
+	if (byByte && inBits) || ((byByte || inBits) && len(args) != 2) || len(args) > 2 || (needEnd && len(args) == 1) {
+		return 0, 0, false, false, errSyntax
+	}
+
+	end = -1
+	var err error
+	if len(args) > 0 {
+		if start, err = parseInt(args[0]); err != nil {
+			return 0, 0, false, false, errNotInteger
+		}
+	}
+	if len(args) > 1 {
+		if end, err = parseInt(args[1]); err != nil {
+			return 0, 0, false, false, errNotInteger
+		}
+	}
+	return start, end, len(args) > 1, inBits, ""
+}
+
+// handleBitcount serves BITCOUNT key [start end [BYTE|BIT]].
+func (h BaseHandler) handleBitcount(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	start, end, _, inBits, errMsg := parseBitRange(args[1:], req.Command.Options, true)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	value, err := h.db(req).Get(string(args[0]))
+	if err == storage.ErrWrongType {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	first, last, ok := bitRange(len(value), start, end, inBits)
+	if !ok {
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	count := 0
+	for i := first / 8; i <= last/8; i++ {
+		b := value[i]
+		if i == first/8 {
+			b &= 0xff >> (first % 8)
+		}
+		if i == last/8 {
+			b &= 0xff << (7 - last%8)
+		}
+		count += bits.OnesCount8(b)
+	}
+	rw.Write(parser.IntegerData(count).Marshal())
+}
+
+// handleBitpos serves BITPOS key bit [start [end [BYTE|BIT]]]. Without an
+// end, the string is taken as padded with zeros on the right, so looking
+// for a 0 in a string of ones finds the bit after it.
+func (h BaseHandler) handleBitpos(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args[1]) != 1 || (args[1][0] != '0' && args[1][0] != '1') {
+		rw.Write(parser.ErrorData("ERR The bit argument must be 1 or 0.").Marshal())
+		return
+	}
+	bit := args[1][0] - '0'
+	start, end, endGiven, inBits, errMsg := parseBitRange(args[2:], req.Command.Options, false)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	value, err := h.db(req).Get(string(args[0]))
+	switch {
+	case err == storage.ErrWrongType:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	case err != nil:
+		rw.Write(parser.IntegerData(-int(bit)).Marshal())
+		return
+	}
+
+	first, last, ok := bitRange(len(value), start, end, inBits)
+	if !ok {
+		rw.Write(parser.IntegerData(-1).Marshal())
+		return
+	}
+	// whole bytes without the bit are skipped
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for i := first; i <= last; i++ {
+		if i%8 == 0 && i+7 <= last && value[i/8] == skip {
+			i += 7
+			continue
+		}
+		if getBit(value, i) == bit {
+			rw.Write(parser.IntegerData(i).Marshal())
+			return
+		}
+	}
+	if bit == 0 && !endGiven {
+		rw.Write(parser.IntegerData(last + 1).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(-1).Marshal())
+}
+
+var bitOps = map[string]func(a, b byte) byte{
+	"AND": func(a, b byte) byte { return a & b },
+	"OR":  func(a, b byte) byte { return a | b },
+	"XOR": func(a, b byte) byte { return a ^ b },
+}
+
+// handleBitop serves BITOP AND|OR|XOR|NOT destkey key..., the shorter strings
+// count as padded with zeros. It replies the length of the result.
+func (h BaseHandler) handleBitop(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	name := strings.ToUpper(string(args[0]))
+	op, ok := bitOps[name]
+	if !ok && name != "NOT" {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	if name == "NOT" && len(args) != 3 {
+		rw.Write(parser.ErrorData("ERR BITOP NOT must be called with a single source key.").Marshal())
+		return
+	}
+
+	n, err := h.db(req).StoreStrings(string(args[1]), keyStrings(args[2:]), func(values [][]byte) []byte {
+		length := 0
+		for _, value := range values {
+			if len(value) > length {
+				length = len(value)
+			}
+		}
+		res := grow(values[0], length)
+		if name == "NOT" {
+			for i := range res {
+				res[i] = ^res[i]
+			}
+			return res
+		}
+		for _, value := range values[1:] {
+			for i := range res {
+				var b byte
+				if i < len(value) {
+					b = value[i]
+				}
+				res[i] = op(res[i], b)
+			}
+		}
+		return res
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(n).Marshal())
+}
+
+// bitfieldOp is a GET, SET or INCRBY of BITFIELD.
+type bitfieldOp struct {
+	name   string
+	signed bool
+	width  int
+	offset int
+	value  int64
+	// WRAP, SAT or FAIL, set by the last OVERFLOW before the op
+	overflow string
+}
+
+// parseBitfieldType parses a type like i16 or u8. Signed integers go up to
+// 64 bits and unsigned ones to 63, so they all fit in an int64.
+func parseBitfieldType(arg []byte) (signed bool, width int, ok bool) {
+	if len(arg) < 2 {
+		return false, 0, false
+	}
+	switch arg[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+	default:
+		return false, 0, false
+	}
+	width, err := strconv.Atoi(string(arg[1:]))
+	if err != nil || width < 1 || width > 64 || (!signed && width == 64) {
+		return false, 0, false
+	}
+	return signed, width, true
+}
+
+func parseBitfieldOps(args [][]byte) ([]bitfieldOp, string) {
+	var ops []bitfieldOp
+	overflow := "WRAP"
+	for i := 0; i < len(args); i++ {
+		name := strings.ToUpper(string(args[i]))
+		rest := len(args) - i - 1
+		switch {
+		case name == "OVERFLOW" && rest >= 1:
+			overflow = strings.ToUpper(string(args[i+1]))
+			if overflow != "WRAP" && overflow != "SAT" && overflow != "FAIL" {
+				return nil, "ERR Invalid OVERFLOW type specified"
+			}
+			i++
+			continue
+		case name == "GET" && rest >= 2:
+		case (name == "SET" || name == "INCRBY") && rest >= 3:
+		default:
+			return nil, errSyntax
+		}
+
+		op := bitfieldOp{name: name, overflow: overflow}
+		var ok bool
+		if op.signed, op.width, ok = parseBitfieldType(args[i+1]); !ok {
+			return nil, errBitfieldType
+		}
+		if op.offset, ok = parseBitOffset(args[i+2], op.width); !ok {
+			return nil, errBitOffset
+		}
+		i += 2
+		if name != "GET" {
+			i++
+			var err error
+			if op.value, err = strconv.ParseInt(string(args[i]), 10, 64); err != nil {
+				return nil, errNotInteger
+			}
+		}
+		ops = append(ops, op)
+	}
+	return ops, ""
+}
+
+// get reads the integer of the op from value.
+func (op bitfieldOp) get(value []byte) int64 {
+	var res uint64
+	for i := 0; i < op.width; i++ {
+		res = res<<1 | uint64(getBit(value, op.offset+i))
+	}
+	if op.signed && op.width < 64 && res>>(op.width-1) == 1 {
+		res |= math.MaxUint64 << op.width
+	}
+	return int64(res)
+}
+
+func (op bitfieldOp) set(value []byte, n int64) {
+	for i := 0; i < op.width; i++ {
+		setBit(value, op.offset+i, byte(uint64(n)>>(op.width-1-i)&1))
+	}
+}
+
+// add returns value+incr in the range of the op's type, wrapped or
+// saturated. ok is false when it overflows with FAIL.
+func (op bitfieldOp) add(value, incr int64) (res int64, ok bool) {
+	var min, max int64
+	var overflows, underflows bool
+	if op.signed {
+		max = math.MaxInt64
+		if op.width < 64 {
+			max = 1<<(op.width-1) - 1
+		}
+		min = -max - 1
+		overflows = value > max || (incr > 0 && value > max-incr)
+		underflows = value < min || (incr < 0 && value < min-incr)
+	} else {
+		max = 1<<op.width - 1
+		// a negative SET value is taken as a huge unsigned one
+		overflows = value < 0 || value > max || (incr > 0 && value > max-incr)
+		underflows = incr < 0 && value+incr < 0
+	}
+	if !overflows && !underflows {
+		return value + incr, true
+	}
+
+	switch op.overflow {
+	case "SAT":
+		if overflows {
+			return max, true
+		}
+		return min, true
+	case "WRAP":
+		// the addition is done unsigned so it wraps, then the upper
+		// bits are cut or sign extended
+		sum := uint64(value) + uint64(incr)
+		if op.width < 64 {
+			mask := uint64(math.MaxUint64) << op.width
+			if op.signed && sum>>(op.width-1)&1 == 1 {
+				sum |= mask
+			} else {
+				sum &^= mask
+			}
+		}
+		return int64(sum), true
+	}
+	return 0, false
+}
+
+// handleBitfield serves BITFIELD key [GET type offset] [SET type offset
+// value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL]..., and
+// BITFIELD_RO that only takes GET. SET replies the old value and INCRBY the
+// new one, or null when FAIL stops them.
+func (h BaseHandler) handleBitfield(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	ops, errMsg := parseBitfieldOps(args[1:])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	writes := false
+	for _, op := range ops {
+		writes = writes || op.name != "GET"
+	}
+	if writes && req.Command.Name == "BITFIELD_RO" {
+		rw.Write(parser.ErrorData("ERR BITFIELD_RO only supports the GET subcommand").Marshal())
+		return
+	}
+
+	res := make([]parser.Data, 0, len(ops))
+	if !writes {
+		value, err := h.db(req).Get(string(args[0]))
+		if err == storage.ErrWrongType {
+			rw.Write(parser.ErrorData(err.Error()).Marshal())
+			return
+		}
+		for _, op := range ops {
+			res = append(res, parser.IntegerData(int(op.get(value))))
+		}
+		req.PreventPropagation()
+		rw.Write(parser.ArrayData(res).MarshalProto(req.Client.Proto()))
+		return
+	}
+
+	changed := false
+	err := h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		// the stored value isn't changed in place
+		value = grow(value, 0)
+		for _, op := range ops {
+			current := op.get(value)
+			var n int64
+			var ok bool
+			switch op.name {
+			case "GET":
+				res = append(res, parser.IntegerData(int(current)))
+				continue
+			case "SET":
+				n, ok = op.add(op.value, 0)
+			case "INCRBY":
+				n, ok = op.add(current, op.value)
+			}
+			if !ok {
+				res = append(res, parser.NullData())
+				continue
+			}
+
+			if size := (op.offset+op.width-1)/8 + 1; size > len(value) {
+				value = grow(value, size)
+			}
+			op.set(value, n)
+			changed = true
+			if op.name == "SET" {
+				n = current
+			}
+			res = append(res, parser.IntegerData(int(n)))
+		}
+		return value, changed
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if !changed {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.ArrayData(res).MarshalProto(req.Client.Proto()))
+}
@@ -0,0 +1,177 @@
+package server
+
+import "testing"
+
+func TestBitfield(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		// the same bits read signed or unsigned
+		{[]string{"BITFIELD", "s", "SET", "i8", "0", "-100", "GET", "i8", "0", "GET", "u8", "0", "GET", "u4", "0"},
+			array(integer(0), integer(-100), integer(156), integer(9))},
+		{[]string{"BITFIELD", "s", "SET", "i64", "8", "-1", "GET", "i64", "8", "GET", "u63", "8"},
+			array(integer(0), integer(-1), integer(9223372036854775807))},
+		// #n counts in units of the type width
+		{[]string{"BITFIELD", "n", "SET", "u8", "#1", "255", "GET", "u16", "0", "GET", "u8", "#1"},
+			array(integer(0), integer(255), integer(255))},
+
+		{[]string{"BITFIELD", "w", "SET", "i8", "0", "127", "INCRBY", "i8", "0", "1"}, array(integer(0), integer(-128))},
+		{[]string{"BITFIELD", "w", "INCRBY", "i8", "0", "-1"}, array(integer(127))},
+		{[]string{"BITFIELD", "w", "SET", "u8", "0", "256", "INCRBY", "u8", "0", "-1"}, array(integer(127), integer(255))},
+		{[]string{"BITFIELD", "w", "INCRBY", "u2", "100", "5"}, array(integer(1))},
+
+		{[]string{"BITFIELD", "sat", "OVERFLOW", "SAT", "SET", "i8", "0", "200", "INCRBY", "i8", "0", "1"}, array(integer(0), integer(127))},
+		{[]string{"BITFIELD", "sat", "OVERFLOW", "SAT", "INCRBY", "i8", "0", "-300"}, array(integer(-128))},
+		// a negative value is a huge unsigned one
+		{[]string{"BITFIELD", "sat", "OVERFLOW", "SAT", "SET", "u8", "8", "-1", "INCRBY", "u8", "8", "-10"}, array(integer(0), integer(245))},
+		{[]string{"BITFIELD", "sat", "OVERFLOW", "SAT", "INCRBY", "u8", "8", "-300"}, array(integer(0))},
+		{[]string{"BITFIELD", "sat", "OVERFLOW", "SAT", "INCRBY", "u8", "8", "300"}, array(integer(255))},
+
+		// FAIL leaves the value and replies null, the other ops still run
+		{[]string{"BITFIELD", "f", "SET", "u8", "0", "250", "OVERFLOW", "FAIL", "INCRBY", "u8", "0", "10", "INCRBY", "u8", "0", "5", "SET", "i4", "8", "8"},
+			array(integer(0), nullBulk, integer(255), nullBulk)},
+		{[]string{"BITFIELD", "f", "GET", "u8", "0", "GET", "i4", "8"}, array(integer(255), integer(0))},
+		// the overflow of an op is the one set before it
+		{[]string{"BITFIELD", "f", "INCRBY", "u8", "0", "1", "OVERFLOW", "SAT", "INCRBY", "u8", "0", "-1", "OVERFLOW", "WRAP", "INCRBY", "u8", "0", "1"},
+			array(integer(0), integer(0), integer(1))},
+
+		{[]string{"BITFIELD", "s", "GET", "u64", "0"}, "-" + errBitfieldType + "\r\n"},
+		{[]string{"BITFIELD", "s", "GET", "i65", "0"}, "-" + errBitfieldType + "\r\n"},
+		{[]string{"BITFIELD", "s", "GET", "i0", "0"}, "-" + errBitfieldType + "\r\n"},
+		{[]string{"BITFIELD", "s", "GET", "x8", "0"}, "-" + errBitfieldType + "\r\n"},
+		{[]string{"BITFIELD", "s", "GET", "u8", "-1"}, "-" + errBitOffset + "\r\n"},
+		{[]string{"BITFIELD", "s", "GET", "u8", "#536870912"}, "-" + errBitOffset + "\r\n"},
+		{[]string{"BITFIELD", "s", "OVERFLOW", "NONE", "GET", "u8", "0"}, "-ERR Invalid OVERFLOW type specified\r\n"},
+		{[]string{"BITFIELD", "s", "SET", "u8", "0"}, "-" + errSyntax + "\r\n"},
+		{[]string{"BITFIELD_RO", "s", "GET", "u8", "0", "SET", "u8", "0", "1"}, "-ERR BITFIELD_RO only supports the GET subcommand\r\n"},
+		{[]string{"BITFIELD_RO", "s", "GET", "i8", "0"}, array(integer(-100))},
+	}
+	for _, e := range tests {
+		c.expect(e.want, e.args...)
+	}
+	c.expect(integer(0), "EXISTS", "missing")
+	c.expect(array(integer(0)), "BITFIELD", "missing", "GET", "u8", "100")
+	c.expect(integer(0), "EXISTS", "missing")
+}
+
+func TestBitcount(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "SET", "s", "foobar")
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{}, 26},
+		{[]string{"0", "0"}, 4},
+		{[]string{"1", "1"}, 6},
+		{[]string{"-2", "-1"}, 7},
+		{[]string{"-2", "-1", "BYTE"}, 7},
+		{[]string{"-100", "-1"}, 26},
+		{[]string{"-1", "-2"}, 0},
+		{[]string{"4", "2"}, 0},
+		{[]string{"6", "100"}, 0},
+		{[]string{"1", "1", "BIT"}, 1},
+		{[]string{"5", "30", "BIT"}, 17},
+		{[]string{"-8", "-1", "BIT"}, 4},
+		{[]string{"-3", "-1", "BIT"}, 1},
+		{[]string{"-100", "-1", "BIT"}, 26},
+	}
+	for _, e := range tests {
+		c.expect(integer(e.want), append([]string{"BITCOUNT", "s"}, e.args...)...)
+	}
+	c.expect(integer(0), "BITCOUNT", "missing")
+	c.expect("-"+errSyntax+"\r\n", "BITCOUNT", "s", "0")
+	c.expect("-"+errSyntax+"\r\n", "BITCOUNT", "s", "0", "1", "BYTE", "BIT")
+	c.expect("-"+errNotInteger+"\r\n", "BITCOUNT", "s", "a", "1")
+}
+
+func TestBitpos(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "SET", "s", "\x00\xff\xf0")
+	c.expect(ok, "SET", "ones", "\xff\xff")
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"s", "1"}, 8},
+		{[]string{"s", "0"}, 0},
+		{[]string{"s", "1", "2"}, 16},
+		{[]string{"s", "1", "2", "-1", "BYTE"}, 16},
+		{[]string{"s", "1", "-1"}, 16},
+		{[]string{"s", "0", "1", "-1"}, 20},
+		{[]string{"s", "1", "7", "15", "BIT"}, 8},
+		{[]string{"s", "1", "7", "-3", "BIT"}, 8},
+		{[]string{"s", "0", "8", "-1", "BIT"}, 20},
+		{[]string{"s", "1", "-4", "-1", "BIT"}, -1},
+		{[]string{"s", "1", "-1", "-2"}, -1},
+
+		// looking for a 0 without an end goes past the string
+		{[]string{"ones", "0"}, 16},
+		{[]string{"ones", "0", "1"}, 16},
+		{[]string{"ones", "0", "-1"}, 16},
+		// but not with one, even if it's past the string
+		{[]string{"ones", "0", "0", "-1"}, -1},
+		{[]string{"ones", "0", "0", "100"}, -1},
+		{[]string{"ones", "0", "0", "15", "BIT"}, -1},
+		{[]string{"ones", "1", "-3", "-1", "BIT"}, 13},
+
+		{[]string{"missing", "0"}, 0},
+		{[]string{"missing", "1"}, -1},
+	}
+	for _, e := range tests {
+		c.expect(integer(e.want), append([]string{"BITPOS"}, e.args...)...)
+	}
+	c.expect("-ERR The bit argument must be 1 or 0.\r\n", "BITPOS", "s", "2")
+	c.expect("-"+errSyntax+"\r\n", "BITPOS", "s", "1", "0", "BIT")
+}
+
+func TestBitop(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "MSET", "a", "\x0f\x0f", "b", "\xff")
+	c.expect(integer(2), "BITOP", "NOT", "dest", "a")
+	c.expect(bulk("\xf0\xf0"), "GET", "dest")
+	c.expect("-ERR BITOP NOT must be called with a single source key.\r\n", "BITOP", "NOT", "dest", "a", "b")
+	c.expect(integer(2), "BITOP", "AND", "dest", "a", "b")
+	c.expect(bulk("\x0f\x00"), "GET", "dest")
+	c.expect(integer(2), "BITOP", "XOR", "dest", "a", "b", "missing")
+	c.expect(bulk("\xf0\x0f"), "GET", "dest")
+	c.expect("-"+errSyntax+"\r\n", "BITOP", "NAND", "dest", "a", "b")
+	// an empty result deletes the destination
+	c.expect(integer(0), "BITOP", "OR", "dest", "missing")
+	c.expect(integer(0), "EXISTS", "dest")
+}
+
+func TestSetbit(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(integer(0), "SETBIT", "k", "7", "1")
+	c.expect(bulk("\x01"), "GET", "k")
+	c.expect(integer(0), "SETBIT", "k", "17", "1")
+	c.expect(bulk("\x01\x00\x40"), "GET", "k")
+	c.expect(integer(1), "SETBIT", "k", "7", "0")
+	c.expect(integer(1), "GETBIT", "k", "17")
+	c.expect(integer(0), "GETBIT", "k", "4294967295")
+
+	for _, offset := range []string{"-1", "4294967296", "a"} {
+		c.expect("-"+errBitOffset+"\r\n", "SETBIT", "k", offset, "1")
+		c.expect("-"+errBitOffset+"\r\n", "GETBIT", "k", offset)
+	}
+	c.expect("-ERR bit is not an integer or out of range\r\n", "SETBIT", "k", "0", "2")
+	c.expect(bulk("\x00\x00\x40"), "GET", "k")
+}
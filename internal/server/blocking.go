@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// blockState is what a handler asks for when it has nothing to reply yet.
+type blockState struct {
+	db        int
+	keys      []string
+	timeout   time.Duration // 0 blocks forever
+	onTimeout []byte        // the reply if the timeout fires
+	// what the command is run again with, if not its own arguments
+	args [][]byte
+	// whether the clients blocked after this one are run again even if this
+	// one is still blocked, because they don't wait for the same thing
+	independent bool
+}
+
+// waiter is a client blocked by a command, parked until one of its keys is
+// written to.
+type waiter struct {
+	req   Request
+	block *blockState
+	reply chan []byte
+}
+
+// dbKey is a key of one of the databases.
+type dbKey struct {
+	db  int
+	key string
+}
+
+// blockingManager keeps the waiters of every key in the order they blocked
+// and the keys that were written to since they were last served.
+type blockingManager struct {
+	mu      sync.Mutex
+	waiters map[dbKey][]*waiter
+	ready   []dbKey
+	isReady map[dbKey]bool
+}
+
+func newBlockingManager() *blockingManager {
+	return &blockingManager{
+		waiters: make(map[dbKey][]*waiter),
+		isReady: make(map[dbKey]bool),
+	}
+}
+
+func (bm *blockingManager) add(w *waiter) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	for _, key := range w.block.keys {
+		k := dbKey{w.block.db, key}
+		bm.waiters[k] = append(bm.waiters[k], w)
+	}
+}
+
+// remove unregisters the waiter, returns false if it wasn't registered.
+func (bm *blockingManager) remove(w *waiter) bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	found := false
+	for _, key := range w.block.keys {
+		key := dbKey{w.block.db, key}
+		queue := bm.waiters[key]
+		for i, other := range queue {
+			if other == w {
+				queue = append(queue[:i:i], queue[i+1:]...)
+				found = true
+				break
+			}
+		}
+		if len(queue) == 0 {
+			delete(bm.waiters, key)
+		} else {
+			bm.waiters[key] = queue
+		}
+	}
+	return found
+}
+
+// keyModified marks the key as ready if some client is blocked on it.
+func (bm *blockingManager) keyModified(key dbKey) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if len(bm.waiters[key]) > 0 && !bm.isReady[key] {
+		bm.isReady[key] = true
+		bm.ready = append(bm.ready, key)
+	}
+}
+
+// next returns the first ready key with its clients, longest waiting first.
+func (bm *blockingManager) next() (dbKey, []*waiter, bool) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+
+	for len(bm.ready) > 0 {
+		key := bm.ready[0]
+		if queue := bm.waiters[key]; len(queue) > 0 {
+			return key, append([]*waiter(nil), queue...), true
+		}
+		bm.ready = bm.ready[1:]
+		delete(bm.isReady, key)
+	}
+	return dbKey{}, nil, false
+}
+
+// blocked tells whether the waiter is still registered.
+func (bm *blockingManager) blocked(w *waiter) bool {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	for _, other := range bm.waiters[dbKey{w.block.db, w.block.keys[0]}] {
+		if other == w {
+			return true
+		}
+	}
+	return false
+}
+
+// allKeys returns the keys that clients are blocked on.
+func (bm *blockingManager) allKeys() []dbKey {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	keys := make([]dbKey, 0, len(bm.waiters))
+	for k := range bm.waiters {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// served drops the key from the ready ones, until it is written to again.
+func (bm *blockingManager) served(key dbKey) {
+	bm.mu.Lock()
+	defer bm.mu.Unlock()
+	if !bm.isReady[key] {
+		return
+	}
+	delete(bm.isReady, key)
+	for i, k := range bm.ready {
+		if k == key {
+			bm.ready = append(bm.ready[:i:i], bm.ready[i+1:]...)
+			return
+		}
+	}
+}
+
+type bufferResponseWriter struct {
+	buff []byte
+}
+
+func (rw *bufferResponseWriter) Write(data []byte) {
+	rw.buff = append(rw.buff, data...)
+}
+
+func (rw *bufferResponseWriter) Release() error {
+	return nil
+}
+
+// Block parks the client after the handler returns, until one of the keys is
+// written to and the command is run again, or the timeout fires. Nothing is
+// propagated for a command that blocks.
+func (r Request) Block(keys []string, timeout time.Duration, onTimeout []byte) {
+	r.Client.block = &blockState{db: r.Client.db, keys: keys, timeout: timeout, onTimeout: onTimeout}
+	r.PreventPropagation()
+}
+
+// BlockOnStreams is Block for the commands that wait for stream entries after
+// some ID. The command is run again with args, where IDs like $ are resolved
+// so it doesn't see the entries that were there when it blocked. Clients wait
+// for different IDs, so all the clients blocked on a key are run again when
+// it is written to, not just the first ones.
+func (r Request) BlockOnStreams(args [][]byte, keys []string, timeout time.Duration, onTimeout []byte) {
+	r.Block(keys, timeout, onTimeout)
+	r.Client.block.args = args
+	r.Client.block.independent = true
+}
+
+// KeyModified is the storage listener that wakes up clients blocked on keys
+// and fails the transactions of the clients watching them.
+func (s *Server) KeyModified(db int, key string) {
+	s.blocking.keyModified(dbKey{db, key})
+	s.watches.touch(dbKey{db, key})
+}
+
+// dbsSwapped marks the keys of two swapped databases that clients are blocked
+// on or watching as modified, if they exist in one of them.
+func (s *Server) dbsSwapped(a, b int, exists func(key string) bool) {
+	for _, k := range append(s.blocking.allKeys(), s.watches.allKeys()...) {
+		if (k.db == a || k.db == b) && exists(k.key) {
+			s.KeyModified(k.db, k.key)
+		}
+	}
+}
+
+// serveBlocked runs again the commands of clients blocked on keys that were
+// written to, longest waiting first, as long as they find something to pop.
+// Must be called with execMu held for writing, like the commands themselves.
+func (s *Server) serveBlocked() {
+	for {
+		key, queue, ok := s.blocking.next()
+		if !ok {
+			return
+		}
+
+		// serving clients can write to the key and make it ready again
+		s.blocking.served(key)
+		for _, w := range queue {
+			// it can have been served through another key already
+			if !s.blocking.blocked(w) {
+				continue
+			}
+			if !s.serveWaiter(w) && !w.block.independent {
+				// still nothing for this client, so there's nothing for the
+				// ones after it either
+				break
+			}
+		}
+	}
+}
+
+// serveWaiter runs the command of the client again and hands it the reply,
+// unless it blocks again. Returns whether the client was served.
+func (s *Server) serveWaiter(w *waiter) bool {
+	rw := &bufferResponseWriter{}
+	w.req.Client.block = nil
+	w.req.Client.rewritten = false
+	w.req.Client.rewrite = nil
+	w.req.Client.callDB = w.req.Client.db
+	s.getCallChain().Call(w.req, rw)
+
+	if w.req.Client.block != nil {
+		w.req.Client.block = nil
+		return false
+	}
+	s.blocking.remove(w)
+	w.reply <- rw.buff
+	return true
+}
+
+// waitUnblocked parks the client until its command is served, the timeout
+// fires or the connection is closed. Commands that arrive in the meantime are
+// kept for later. Returns the reply, or false if the connection was closed.
+func (s *Server) waitUnblocked(ctx context.Context, client *Client, w *waiter) ([]byte, bool) {
+	var timeout <-chan time.Time
+	if w.block.timeout > 0 {
+		timer := time.NewTimer(w.block.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// unblocking takes the exec lock, so the client can't be served at the
+	// same time
+	unblock := func() bool {
+		removed := false
+		s.Atomically(func() {
+			removed = s.blocking.remove(w)
+		})
+		return removed
+	}
+
+	messages := client.messages
+	for {
+		select {
+		case reply := <-w.reply:
+			return reply, true
+		case <-client.outbox.ready:
+			client.outbox.flush(client)
+		case <-timeout:
+			if unblock() {
+				return w.block.onTimeout, true
+			}
+			return <-w.reply, true
+		case <-ctx.Done():
+			if !unblock() {
+				<-w.reply
+			}
+			return nil, false
+		case msg, ok := <-messages:
+			if ok {
+				client.pending = append(client.pending, msg)
+				continue
+			}
+			// if it was served just before the connection was closed, the
+			// reply can't be delivered anyway
+			if !unblock() {
+				<-w.reply
+			}
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// waitForBlocked waits until n clients are blocked on the key of db 0.
+func waitForBlocked(t *testing.T, ts *testServer, key string, n int) {
+	t.Helper()
+	waitFor(t, "The clients didn't block", func() bool {
+		bm := ts.sv.blocking
+		bm.mu.Lock()
+		defer bm.mu.Unlock()
+		return len(bm.waiters[dbKey{0, key}]) == n
+	})
+}
+
+func TestBlockingFifo(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	var waiters []*testClient
+	for i := 0; i < 3; i++ {
+		w := ts.connect(t)
+		w.send("BLPOP", "list", "0")
+		waitForBlocked(t, ts, "list", i+1)
+		waiters = append(waiters, w)
+	}
+
+	c.expect(integer(2), "RPUSH", "list", "a", "b")
+	if res := waiters[0].read(); res != array(bulk("list"), bulk("a")) {
+		t.Errorf("Wrong reply of the first client. Have: %q", res)
+	}
+	if res := waiters[1].read(); res != array(bulk("list"), bulk("b")) {
+		t.Errorf("Wrong reply of the second client. Have: %q", res)
+	}
+	waiters[2].noReply()
+
+	c.expect(integer(1), "RPUSH", "list", "c")
+	if res := waiters[2].read(); res != array(bulk("list"), bulk("c")) {
+		t.Errorf("Wrong reply of the third client. Have: %q", res)
+	}
+	c.expect(integer(0), "LLEN", "list")
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	start := time.Now()
+	c.expect(nullArray, "BLPOP", "list", "0.1")
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("The client was unblocked after %s", elapsed)
+	}
+	waitForBlocked(t, ts, "list", 0)
+
+	// a later push stays in the list
+	c.expect(integer(1), "RPUSH", "list", "a")
+	c.expect(integer(1), "LLEN", "list")
+}
+
+func TestBlockingDisconnect(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	gone, w, c := ts.connect(t), ts.connect(t), ts.connect(t)
+
+	gone.send("BLPOP", "list", "0")
+	waitForBlocked(t, ts, "list", 1)
+	gone.conn.Close()
+	waitForBlocked(t, ts, "list", 0)
+
+	w.send("BLPOP", "list", "0")
+	waitForBlocked(t, ts, "list", 1)
+	c.expect(integer(1), "RPUSH", "list", "a")
+	if res := w.read(); res != array(bulk("list"), bulk("a")) {
+		t.Errorf("Wrong reply of the client still connected. Have: %q", res)
+	}
+}
+
+func TestBlockingSecondKey(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	w, c := ts.connect(t), ts.connect(t)
+
+	w.send("BLPOP", "first", "second", "0")
+	waitForBlocked(t, ts, "second", 1)
+	c.expect(integer(1), "RPUSH", "second", "a")
+	if res := w.read(); res != array(bulk("second"), bulk("a")) {
+		t.Errorf("Wrong reply. Have: %q", res)
+	}
+
+	// the client doesn't wait for the other key anymore
+	waitForBlocked(t, ts, "first", 0)
+	c.expect(integer(1), "RPUSH", "first", "b")
+	c.expect(integer(1), "LLEN", "first")
+}
+
+func TestBlockingChain(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	mover, popper, c := ts.connect(t), ts.connect(t), ts.connect(t)
+
+	mover.send("BLMOVE", "src", "dst", "LEFT", "RIGHT", "0")
+	waitForBlocked(t, ts, "src", 1)
+	popper.send("BLPOP", "dst", "0")
+	waitForBlocked(t, ts, "dst", 1)
+
+	// the element moved to dst serves the client blocked on it
+	c.expect(integer(1), "RPUSH", "src", "a")
+	if res := mover.read(); res != bulk("a") {
+		t.Errorf("Wrong reply of BLMOVE. Have: %q, want: %q", res, bulk("a"))
+	}
+	if res := popper.read(); res != array(bulk("dst"), bulk("a")) {
+		t.Errorf("Wrong reply of BLPOP. Have: %q", res)
+	}
+	c.expect(integer(0), "EXISTS", "src", "dst")
+}
@@ -2,9 +2,11 @@ package server
 
 import (
 	"context"
+	"errors"
 	"io"
 	"log"
 	"net"
+	"sync"
 
 	"github.com/codecrafters-io/redis-starter-go/internal/commands"
 	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
@@ -13,85 +15,117 @@ import (
 type Message struct {
 	Raw     []byte
 	Command *commands.Command
+	Err     error
+	// the RDB file that follows FULLRESYNC
+	Payload []byte
 }
 
 type ConnectionHandler struct {
-	cmdParser commands.CommandParser
-	conns     map[string]chan Message
+	cmdParser   commands.CommandParser
+	mu          sync.Mutex
+	conns       map[string]chan Message
+	maxBulkLen  int
+	maxArrayLen int
 }
 
 func NewConnectionHandler(cmdParser commands.CommandParser) *ConnectionHandler {
 	return &ConnectionHandler{
-		cmdParser: cmdParser,
-		conns:     make(map[string]chan Message),
+		cmdParser:   cmdParser,
+		conns:       make(map[string]chan Message),
+		maxBulkLen:  parser.DefaultMaxBulkLen,
+		maxArrayLen: parser.DefaultMaxArrayLen,
 	}
 }
 
-func (ch ConnectionHandler) InitNewConn(c net.Conn) chan Message {
+func (ch *ConnectionHandler) SetProtoLimits(maxBulkLen int, maxArrayLen int) {
+	ch.maxBulkLen = maxBulkLen
+	ch.maxArrayLen = maxArrayLen
+}
+
+func (ch *ConnectionHandler) InitNewConn(c net.Conn) chan Message {
 	messages := make(chan Message, 16)
+	ch.mu.Lock()
 	ch.conns[c.RemoteAddr().String()] = messages
+	ch.mu.Unlock()
 	return messages
 }
 
-func (ch ConnectionHandler) GetMessages(remote string) chan Message {
-	messages, _ := ch.conns[remote]
+func (ch *ConnectionHandler) GetMessages(remote string) chan Message {
+	ch.mu.Lock()
+	messages := ch.conns[remote]
+	ch.mu.Unlock()
 	return messages
 }
 
-func (ch ConnectionHandler) DeleteConn(remote string) {
+func (ch *ConnectionHandler) DeleteConn(remote string) {
+	ch.mu.Lock()
 	delete(ch.conns, remote)
+	ch.mu.Unlock()
 }
 
-func (ch ConnectionHandler) Handle(ctx context.Context, c net.Conn, messages chan Message) {
-	buf := make([]byte, 4096)
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-			ln, err := c.Read(buf)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading request: %s", err.Error())
-					msg := parser.ErrorData("ERR: Error reading request!").Marshal()
-					io.WriteString(c, string(msg))
-				}
-				break
-			}
-
-			ch.forMessage(string(buf[:ln]), func(m Message, err error) {
-				if err != nil {
-					log.Println(err.Error())
-					io.WriteString(c, string(parser.ErrorData(err.Error()).Marshal()))
-				} else {
-					messages <- m
-				}
-			})
-		}
-	}
+// NewDecoder reads the requests of a client. The connection of a replica to
+// its master carries replies too, so any frame is accepted on it.
+func (ch *ConnectionHandler) NewDecoder(c net.Conn, fromMaster bool) *parser.Decoder {
+	dec := parser.NewDecoder(c)
+	dec.MaxBulkLen = ch.maxBulkLen
+	dec.MaxArrayLen = ch.maxArrayLen
+	dec.Inline = true
+	dec.Requests = !fromMaster
+	return dec
 }
 
-func (ch ConnectionHandler) forMessage(from string, do func(Message, error)) {
-	p := parser.NewParser(from)
-	for !p.IsAtEnd() {
-		parsed, err := p.Parse()
+// Handle decodes commands from the connection until it is closed. The
+// messages channel is closed when the connection can't be read anymore.
+func (ch *ConnectionHandler) Handle(ctx context.Context, c net.Conn, messages chan Message, fromMaster bool) {
+	defer close(messages)
+
+	dec := ch.NewDecoder(c, fromMaster)
+	for {
+		parsed, err := dec.Decode()
 		if err != nil {
-			log.Println(err.Error())
-		}
-		if parsed == nil {
-			do(Message{}, err)
+			if parser.IsProtocolError(err) {
+				log.Printf("Error reading request: %s", err.Error())
+				io.WriteString(c, string(parser.ErrorData("ERR "+err.Error()).Marshal()))
+				c.Close()
+			} else if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error reading request: %s", err.Error())
+			}
 			return
 		}
 
 		command, err := ch.cmdParser.ParseCommand(parsed.Flat())
 		if err != nil {
-			do(Message{}, err)
+			// replied to by the server, so the error keeps its place among
+			// the replies to pipelined commands
+			log.Println(err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case messages <- Message{Raw: parsed.Marshal(), Err: err}:
+			}
 			continue
 		}
 
-		do(Message{
-			Raw:     []byte(parsed.Marshal()),
+		var payload []byte
+		if command.Name == "FULLRESYNC" {
+			// the master follows FULLRESYNC with an RDB file, which is a bulk
+			// string without the trailing CRLF
+			payload, err = dec.DecodeBulkPayload()
+			if err != nil {
+				log.Printf("Error reading RDB payload: %s", err.Error())
+				return
+			}
+			log.Printf("Received RDB payload (%d bytes)", len(payload))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case messages <- Message{
+			Raw:     parsed.Marshal(),
 			Command: &command,
-		}, nil)
+			Payload: payload,
+		}:
+		}
 	}
 }
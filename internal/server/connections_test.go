@@ -0,0 +1,24 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectNestedRequest(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect("+PONG\r\n", "PING")
+	io.WriteString(c.conn, strings.Repeat("*1\r\n", 100_000))
+	if res, want := c.read(), "-ERR Protocol error: expected '$', got '*'\r\n"; res != want {
+		t.Errorf("Wrong reply to a nested request. Have: %q, want: %q", res, want)
+	}
+	// the rest of the frame is never read, so the peer may see a reset
+	if res, err := c.readTimeout(time.Second); err == nil {
+		t.Errorf("The connection wasn't closed, it replied: %q", res)
+	}
+}
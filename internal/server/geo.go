@@ -0,0 +1,394 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+// geoUnits are the units of the distances, in meters.
+var geoUnits = map[string]float64{
+	"M":  1,
+	"KM": 1000,
+	"FT": 0.3048,
+	"MI": 1609.34,
+}
+
+func (h BaseHandler) routeGeo(server *Server) {
+	server.AddHandler("GEOADD", h.handleGeoadd)
+	server.AddHandler("GEOPOS", h.handleGeopos)
+	server.AddHandler("GEODIST", h.handleGeodist)
+	server.AddHandler("GEOHASH", h.handleGeohash)
+	server.AddHandler("GEOSEARCH", h.handleGeosearch)
+	server.AddHandler("GEOSEARCHSTORE", h.handleGeosearch)
+}
+
+// parseLonLat parses a position, that must be in the range of the geohashes.
+func parseLonLat(lonArg, latArg []byte) (lon, lat float64, errMsg string) {
+	lon, err1 := strconv.ParseFloat(string(lonArg), 64)
+	lat, err2 := strconv.ParseFloat(string(latArg), 64)
+	if err1 != nil || err2 != nil || math.IsNaN(lon) || math.IsNaN(lat) {
+		return 0, 0, errNotFloat
+	}
+	if lon < storage.GeoLongMin || lon > storage.GeoLongMax || lat < storage.GeoLatMin || lat > storage.GeoLatMax {
+		return 0, 0, fmt.Sprintf("ERR invalid longitude,latitude pair %f,%f", lon, lat)
+	}
+	return lon, lat, ""
+}
+
+func parseGeoUnit(arg []byte) (float64, string) {
+	unit, ok := geoUnits[strings.ToUpper(string(arg))]
+	if !ok {
+		return 0, "ERR unsupported unit provided. please use M, KM, FT, MI"
+	}
+	return unit, ""
+}
+
+// formatDistance formats a distance with 4 decimals, like redis.
+func formatDistance(dist float64) []byte {
+	return []byte(strconv.FormatFloat(dist, 'f', 4, 64))
+}
+
+// geoPosData is a position as a pair of longitude and latitude. In RESP2
+// they are formatted with 17 decimals, like redis does.
+func geoPosData(lon, lat float64, proto int) parser.Data {
+	coord := func(f float64) parser.Data {
+		if proto >= parser.Resp3 {
+			return parser.DoubleData(f)
+		}
+		s := strings.TrimRight(strconv.FormatFloat(f, 'f', 17, 64), "0")
+		return parser.BulkStringData([]byte(strings.TrimSuffix(s, ".")))
+	}
+	return parser.ArrayData([]parser.Data{coord(lon), coord(lat)})
+}
+
+// handleGeoadd serves GEOADD key [NX|XX] [CH] longitude latitude member...,
+// that adds the members to the sorted set with their geohash as score.
+func (h BaseHandler) handleGeoadd(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	var nx, xx, ch bool
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "CH":
+			ch = true
+		default:
+			break flags
+		}
+	}
+
+	triples := args[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 || (nx && xx) {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	scores := make([]float64, len(triples)/3)
+	for j := range scores {
+		lon, lat, errMsg := parseLonLat(triples[3*j], triples[3*j+1])
+		if errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+			return
+		}
+		scores[j] = storage.GeoEncode(lon, lat)
+	}
+
+	added, changed := 0, 0
+	err := h.db(req).UpdateZSet(string(args[0]), !xx, func(z *storage.ZSet) {
+		for j, score := range scores {
+			member := string(triples[3*j+2])
+			current, exists := z.Score(member)
+			if (nx && exists) || (xx && !exists) {
+				continue
+			}
+			if z.Set(member, score) {
+				added++
+			} else if score != current {
+				changed++
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	if added+changed == 0 {
+		req.PreventPropagation()
+	}
+	if ch {
+		added += changed
+	}
+	rw.Write(parser.IntegerData(added).Marshal())
+}
+
+// handleGeopos replies the positions of the members, null for the missing
+// ones.
+func (h BaseHandler) handleGeopos(req Request, rw ResponseWriter) {
+	members := req.Command.Arguments[1:]
+	res := make([]parser.Data, len(members))
+	err := h.db(req).ReadZSet(string(req.Command.Arguments[0]), func(z *storage.ZSet) {
+		for i, member := range members {
+			score, ok := z.Score(string(member))
+			if !ok {
+				res[i] = nullArrayData(req)
+				continue
+			}
+			lon, lat := storage.GeoDecode(score)
+			res[i] = geoPosData(lon, lat, req.Client.Proto())
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData(res).MarshalProto(req.Client.Proto()))
+}
+
+// handleGeodist serves GEODIST key member1 member2 [M|KM|FT|MI], null if one
+// of the members is missing.
+func (h BaseHandler) handleGeodist(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 4 {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	unit := 1.0
+	if len(args) == 4 {
+		var errMsg string
+		if unit, errMsg = parseGeoUnit(args[3]); errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+			return
+		}
+	}
+
+	dist := -1.0
+	err := h.db(req).ReadZSet(string(args[0]), func(z *storage.ZSet) {
+		score1, ok1 := z.Score(string(args[1]))
+		score2, ok2 := z.Score(string(args[2]))
+		if ok1 && ok2 {
+			lon1, lat1 := storage.GeoDecode(score1)
+			lon2, lat2 := storage.GeoDecode(score2)
+			dist = storage.GeoDistance(lon1, lat1, lon2, lat2)
+		}
+	})
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case dist < 0:
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(parser.BulkStringData(formatDistance(dist / unit)).Marshal())
+	}
+}
+
+// handleGeohash replies the standard geohash strings of the members.
+func (h BaseHandler) handleGeohash(req Request, rw ResponseWriter) {
+	members := req.Command.Arguments[1:]
+	res := make([]parser.Data, len(members))
+	err := h.db(req).ReadZSet(string(req.Command.Arguments[0]), func(z *storage.ZSet) {
+		for i, member := range members {
+			if score, ok := z.Score(string(member)); ok {
+				res[i] = parser.BulkStringData([]byte(storage.GeoHash(score)))
+			} else {
+				res[i] = parser.NullData()
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData(res).MarshalProto(req.Client.Proto()))
+}
+
+// geoSearch is a parsed GEOSEARCH or GEOSEARCHSTORE.
+type geoSearch struct {
+	// the center is the position of the member with FROMMEMBER
+	member     string
+	fromMember bool
+	shape      storage.GeoShape
+	// the unit of the shape, the distances are replied in it
+	unit      float64
+	asc, desc bool
+	// 0 without COUNT
+	count                         int
+	any                           bool
+	withCoord, withDist, withHash bool
+	storeDist                     bool
+}
+
+// parseGeoSearch parses the options of GEOSEARCH and GEOSEARCHSTORE:
+// FROMMEMBER member | FROMLONLAT longitude latitude, BYRADIUS radius unit |
+// BYBOX width height unit, [ASC|DESC] [COUNT count [ANY]], and the WITH
+// options or STOREDIST.
+func parseGeoSearch(name string, opts map[string][][]byte) (geoSearch, string) {
+	var q geoSearch
+	member, fromMember := opts["FROMMEMBER"]
+	lonLat, fromLonLat := opts["FROMLONLAT"]
+	radius, byRadius := opts["BYRADIUS"]
+	box, byBox := opts["BYBOX"]
+	if fromMember == fromLonLat {
+		return q, "ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + name
+	}
+	if byRadius == byBox {
+		return q, "ERR exactly one of BYRADIUS and BYBOX can be specified for " + name
+	}
+
+	var errMsg string
+	if fromMember {
+		q.fromMember, q.member = true, string(member[0])
+	} else if q.shape.Longitude, q.shape.Latitude, errMsg = parseLonLat(lonLat[0], lonLat[1]); errMsg != "" {
+		return q, errMsg
+	}
+
+	if byRadius {
+		r, err := strconv.ParseFloat(string(radius[0]), 64)
+		if err != nil || math.IsNaN(r) {
+			return q, "ERR need numeric radius"
+		}
+		if r < 0 {
+			return q, "ERR radius cannot be negative"
+		}
+		if q.unit, errMsg = parseGeoUnit(radius[1]); errMsg != "" {
+			return q, errMsg
+		}
+		q.shape.Radius = r * q.unit
+	} else {
+		w, err1 := strconv.ParseFloat(string(box[0]), 64)
+		h, err2 := strconv.ParseFloat(string(box[1]), 64)
+		if err1 != nil || err2 != nil || math.IsNaN(w) || math.IsNaN(h) {
+			return q, "ERR need numeric width or height"
+		}
+		if w < 0 || h < 0 {
+			return q, "ERR height or width cannot be negative"
+		}
+		if q.unit, errMsg = parseGeoUnit(box[2]); errMsg != "" {
+			return q, errMsg
+		}
+		q.shape.Box, q.shape.Width, q.shape.Height = true, w*q.unit, h*q.unit
+	}
+
+	if count, ok := opts["COUNT"]; ok {
+		var err error
+		if q.count, err = parseInt(count[0]); err != nil {
+			return q, errNotInteger
+		}
+		if q.count <= 0 {
+			return q, "ERR COUNT must be > 0"
+		}
+	}
+	_, q.any = opts["ANY"]
+	if q.any && q.count == 0 {
+		return q, "ERR the ANY argument requires COUNT argument"
+	}
+	_, q.asc = opts["ASC"]
+	_, q.desc = opts["DESC"]
+	_, q.withCoord = opts["WITHCOORD"]
+	_, q.withDist = opts["WITHDIST"]
+	_, q.withHash = opts["WITHHASH"]
+	_, q.storeDist = opts["STOREDIST"]
+	return q, ""
+}
+
+// handleGeosearch serves GEOSEARCH key and GEOSEARCHSTORE destination source,
+// that stores the members found with their geohash, or their distance with
+// STOREDIST. With COUNT the closest members are taken, or the first ones
+// found with ANY.
+func (h BaseHandler) handleGeosearch(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	store := req.Command.Name == "GEOSEARCHSTORE"
+	key := args[0]
+	if store {
+		key = args[1]
+	}
+	q, errMsg := parseGeoSearch(req.Command.Name, req.Command.Options)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	var points []storage.GeoPoint
+	err := h.db(req).ReadZSet(string(key), func(z *storage.ZSet) {
+		// an empty sorted set is a missing key
+		if z.Len() == 0 {
+			return
+		}
+		if q.fromMember {
+			score, ok := z.Score(q.member)
+			if !ok {
+				errMsg = "ERR could not decode requested zset member"
+				return
+			}
+			q.shape.Longitude, q.shape.Latitude = storage.GeoDecode(score)
+		}
+		limit := 0
+		if q.any {
+			limit = q.count
+		}
+		points = z.GeoSearch(q.shape, limit)
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	switch {
+	case q.desc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Dist > points[j].Dist })
+	case q.asc || (q.count > 0 && !q.any):
+		sort.SliceStable(points, func(i, j int) bool { return points[i].Dist < points[j].Dist })
+	}
+	if q.count > 0 && len(points) > q.count {
+		points = points[:q.count]
+	}
+
+	if store {
+		z := storage.NewZSet()
+		for _, p := range points {
+			if q.storeDist {
+				z.Set(p.Member, p.Dist/q.unit)
+			} else {
+				z.Set(p.Member, p.Score)
+			}
+		}
+		h.db(req).StoreZSet(string(args[0]), z)
+		rw.Write(parser.IntegerData(z.Len()).Marshal())
+		return
+	}
+
+	proto := req.Client.Proto()
+	res := make([]parser.Data, len(points))
+	for i, p := range points {
+		member := parser.BulkStringData([]byte(p.Member))
+		if !q.withDist && !q.withHash && !q.withCoord {
+			res[i] = member
+			continue
+		}
+		item := []parser.Data{member}
+		if q.withDist {
+			item = append(item, parser.BulkStringData(formatDistance(p.Dist/q.unit)))
+		}
+		if q.withHash {
+			item = append(item, parser.IntegerData(int(p.Score)))
+		}
+		if q.withCoord {
+			item = append(item, geoPosData(p.Longitude, p.Latitude, proto))
+		}
+		res[i] = parser.ArrayData(item)
+	}
+	rw.Write(parser.ArrayData(res).MarshalProto(proto))
+}
@@ -2,10 +2,10 @@ package server
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"strconv"
 	"strings"
 	"time"
@@ -15,9 +15,11 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+const Version = "7.2.0"
+
 type BaseHandler struct {
-	storage *storage.Storage
-	server  *Server
+	dbs    *storage.Databases
+	server *Server
 }
 type MasterHandler struct {
 	server   *Server
@@ -29,13 +31,32 @@ type ReplicaHandler struct {
 	replicaCtx *ReplicaContext
 }
 
-func RouteBasic(server *Server, storage *storage.Storage) {
-	handler := BaseHandler{storage: storage, server: server}
+func RouteBasic(server *Server, dbs *storage.Databases) {
+	handler := BaseHandler{dbs: dbs, server: server}
 	server.AddHandler("ECHO", handler.handleEcho)
 	server.AddHandler("SET", handler.handleSet)
 	server.AddHandler("GET", handler.handleGet)
 	server.AddHandler("PING", handler.handlePing)
 	server.AddHandler("INFO", handler.handleInfo)
+	server.AddHandler("HELLO", handler.handleHello)
+	handler.routeKeys(server)
+	handler.routeLists(server)
+	handler.routeHashes(server)
+	handler.routeSets(server)
+	handler.routeZSets(server)
+	handler.routeStreams(server)
+	handler.routePubSub(server)
+	handler.routeTransactions(server)
+	handler.routeStrings(server)
+	handler.routeBitmaps(server)
+	handler.routeHyperLogLog(server)
+	handler.routeGeo(server)
+	dbs.SetListener(server.KeyModified)
+}
+
+// db returns the database selected by the client.
+func (h BaseHandler) db(req Request) *storage.Storage {
+	return h.dbs.DB(req.Client.db)
 }
 
 func (h BaseHandler) handleEcho(req Request, rw ResponseWriter) {
@@ -54,34 +75,46 @@ func (h BaseHandler) handleSet(req Request, rw ResponseWriter) {
 		rw.Write(parser.ErrorData("ERR: SET command requirees exactly 2 arguments").Marshal())
 		return
 	}
+	key, value := req.Command.Arguments[0], req.Command.Arguments[1]
+	opts := req.Command.Options
+
+	var args storage.SetArgs
+	_, args.NX = opts["NX"]
+	_, args.XX = opts["XX"]
+	_, args.KeepTTL = opts["KEEPTTL"]
+	_, args.Get = opts["GET"]
+
+	expireAt, expires, errMsg := expireOption(req.Command.Name, opts)
+	if errMsg == "" && ((args.NX && args.XX) || (expires && args.KeepTTL)) {
+		errMsg = errSyntax
+	}
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	args.ExpireAt = expireAt
 
-	optArgs, ok := req.Command.Options["PX"]
-	if ok {
-		if len(optArgs) != 1 {
-			rw.Write(parser.ErrorData("ERR: PX parameter requires exactly 1 argument").Marshal())
-			return
-		}
-
-		exp, err := strconv.Atoi(optArgs[0])
-		if err != nil {
-			rw.Write(parser.ErrorData("ERR: PX parameter must be integer").Marshal())
-			return
-		}
-
-		err = h.storage.SetWithTimer(req.Command.Arguments[0], req.Command.Arguments[1], exp)
-		if err != nil {
-			rw.Write(parser.ErrorData(err.Error()).Marshal())
-			return
-		}
-	} else {
-		err := h.storage.Set(req.Command.Arguments[0], req.Command.Arguments[1])
-		if err != nil {
-			rw.Write(parser.ErrorData(err.Error()).Marshal())
-			return
-		}
+	prev, ok, err := h.db(req).SetWithArgs(string(key), value, args)
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	switch {
+	case !ok:
+		req.PreventPropagation()
+	case args.ExpireAt != 0:
+		// relative expiries would drift on replicas and when the AOF is loaded
+		req.RewriteCommand([]byte("SET"), key, value, []byte("PXAT"), []byte(strconv.FormatInt(args.ExpireAt, 10)))
 	}
 
-	rw.Write(parser.StringData("OK").Marshal())
+	switch {
+	case args.Get && prev != nil:
+		rw.Write(parser.BulkStringData(prev).Marshal())
+	case args.Get || !ok:
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(parser.StringData("OK").Marshal())
+	}
 }
 
 func (h BaseHandler) handleGet(req Request, rw ResponseWriter) {
@@ -89,37 +122,116 @@ func (h BaseHandler) handleGet(req Request, rw ResponseWriter) {
 		rw.Write(parser.ErrorData("GET command requires exactly 1 argument").Marshal())
 		return
 	}
-	val, err := h.storage.Get(req.Command.Arguments[0])
+	val, err := h.db(req).Get(string(req.Command.Arguments[0]))
+	if err == storage.ErrWrongType {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
 	if err != nil {
-		rw.Write(parser.NullBulkStringData().Marshal())
+		rw.Write(nullReply(req))
 		log.Println(err.Error())
 		return
 	}
 
-	rw.Write(parser.StringData(val).Marshal())
+	rw.Write(parser.BulkStringData(val).Marshal())
 }
 
+// handlePing replies PONG, or the message if there is one. A RESP2 client
+// with subscriptions gets it like a message, as pong and the message.
 func (h BaseHandler) handlePing(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 1 {
+		rw.Write(parser.ErrorData(wrongArgs(req.Command.Name)).Marshal())
+		return
+	}
+	if req.Client.Proto() < parser.Resp3 && h.server.pubsub.subscribed(req.Client) {
+		message := []byte{}
+		if len(args) == 1 {
+			message = args[0]
+		}
+		rw.Write(parser.ArrayData(bulksData([][]byte{[]byte("pong"), message})).Marshal())
+		return
+	}
+	if len(args) == 1 {
+		rw.Write(parser.BulkStringData(args[0]).Marshal())
+		return
+	}
 	rw.Write(parser.StringData("PONG").Marshal())
 }
 
 func (h BaseHandler) handleInfo(req Request, rw ResponseWriter) {
-	var info map[string]any
-	err := mapstructure.Decode(GetReplInfo(), &info)
+	var info, memory map[string]any
+	err := mapstructure.Decode(h.server.GetReplInfo(), &info)
+	if err == nil {
+		err = mapstructure.Decode(h.dbs.MemoryStats(), &memory)
+	}
 	if err != nil {
 		rw.Write(parser.ErrorData(err.Error()).Marshal())
 		return
 	}
+	for k, v := range memory {
+		info[k] = v
+	}
 
 	var b strings.Builder
 	for k, v := range info {
 		b.WriteString(fmt.Sprintf("%s:%v\r\n", k, v))
 	}
+	for i := 0; i < h.dbs.Len(); i++ {
+		if keys, expires := h.dbs.DB(i).Len(); keys > 0 {
+			b.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d\r\n", i, keys, expires))
+		}
+	}
 
 	str := b.String()[:len(b.String())-2]
-	resStr := string(parser.BulkStringData(str).Marshal())
+	rw.Write(parser.VerbatimStringData("txt", []byte(str)).MarshalProto(req.Client.Proto()))
+}
+
+func (h BaseHandler) handleHello(req Request, rw ResponseWriter) {
+	proto := req.Client.Proto()
+	if len(req.Command.Arguments) > 1 {
+		rw.Write(parser.ErrorData(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", req.Command.Arguments[1])).Marshal())
+		return
+	}
+
+	if len(req.Command.Arguments) == 1 {
+		version, err := strconv.Atoi(string(req.Command.Arguments[0]))
+		if err != nil {
+			rw.Write(parser.ErrorData("ERR Protocol version is not an integer or out of range").Marshal())
+			return
+		}
+		if version != parser.Resp2 && version != parser.Resp3 {
+			rw.Write(parser.ErrorData("NOPROTO sorry, this protocol version is not supported").Marshal())
+			return
+		}
+		proto = version
+	}
+
+	// there are no ACL users, only the default one without a password
+	if auth, ok := req.Command.Options["AUTH"]; ok && !strings.EqualFold(string(auth[0]), "default") {
+		rw.Write(parser.ErrorData("WRONGPASS invalid username-password pair or user is disabled.").Marshal())
+		return
+	}
+
+	if name, ok := req.Command.Options["SETNAME"]; ok {
+		req.Client.name = string(name[0])
+	}
+	req.Client.proto = proto
 
-	io.WriteString(req.Conn, resStr)
+	role := "master"
+	if h.server.GetReplInfo().Role == Slave {
+		role = "replica"
+	}
+
+	rw.Write(parser.MapData([]parser.Data{
+		parser.BulkStringData([]byte("server")), parser.BulkStringData([]byte("redis")),
+		parser.BulkStringData([]byte("version")), parser.BulkStringData([]byte(Version)),
+		parser.BulkStringData([]byte("proto")), parser.IntegerData(proto),
+		parser.BulkStringData([]byte("id")), parser.IntegerData(int(req.Client.Id())),
+		parser.BulkStringData([]byte("mode")), parser.BulkStringData([]byte("standalone")),
+		parser.BulkStringData([]byte("role")), parser.BulkStringData([]byte(role)),
+		parser.BulkStringData([]byte("modules")), parser.ArrayData([]parser.Data{}),
+	}).MarshalProto(proto))
 }
 
 func RouteMaster(server *Server, mc *MasterContext) {
@@ -127,61 +239,85 @@ func RouteMaster(server *Server, mc *MasterContext) {
 	server.AddHandler("REPLCONF", handler.handleReplconf)
 	server.AddHandler("PSYNC", handler.handlePsync)
 	server.AddHandler("WAIT", handler.handleWait)
+	server.AddHandler("REPLICAOF", handler.handleReplicaof)
 }
 
 func (h MasterHandler) handleReplconf(req Request, rw ResponseWriter) {
-	repl, err := h.mc.GetReplica(req.Conn)
-	if err != nil {
-		repl = Replica{
-			Conn: req.Conn,
-			IsUp: false,
-		}
-		h.mc.SetReplica(repl)
-	}
+	// the connection is known as a replica from its first REPLCONF on
+	h.mc.updateReplica(req.Conn, func(r *Replica) {})
 
 	if lp, ok := req.Command.Options["LISTENING-PORT"]; ok {
 		host := strings.Split(req.Conn.RemoteAddr().String(), ":")[0]
 		addr := fmt.Sprintf("%s:%s", host, lp[0])
-		repl.ServerAddr = addr
-		h.mc.SetReplica(repl)
+		h.mc.updateReplica(req.Conn, func(r *Replica) {
+			r.ServerAddr = addr
+		})
 		rw.Write(parser.StringData("OK").Marshal())
 	} else if capa, ok := req.Command.Options["CAPA"]; ok {
-		repl.Capas = capa
-		h.mc.SetReplica(repl)
+		var capas []string
+		for _, c := range capa {
+			capas = append(capas, string(c))
+		}
+		h.mc.updateReplica(req.Conn, func(r *Replica) {
+			r.Capas = capas
+		})
 		rw.Write(parser.StringData("OK").Marshal())
 	} else if offsetStr, ok := req.Command.Options["ACK"]; ok {
-		offset, err := strconv.Atoi(offsetStr[0])
+		offset, err := strconv.Atoi(string(offsetStr[0]))
 		if err != nil {
 			return
 		}
-		repl.Offset = offset
-		h.mc.SetReplica(repl)
+		h.mc.updateReplica(req.Conn, func(r *Replica) {
+			r.Offset = offset
+		})
 		return
 	}
 }
 
 func (h MasterHandler) handlePsync(req Request, rw ResponseWriter) {
-	serverInfo := GetReplInfo()
 	replica, err := h.mc.GetReplica(req.Conn)
 	if err != nil {
 		rw.Write(parser.ErrorData(err.Error()).Marshal())
 		return
 	}
-
-	fullresync := fmt.Sprintf("FULLRESYNC %s %d", serverInfo.ReplId, serverInfo.ReplOffset)
-	rw.Write(parser.StringData(fullresync).Marshal())
-
-	rdb, err := base64.StdEncoding.DecodeString("UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog==")
+	offset, err := strconv.Atoi(string(req.Command.Arguments[1]))
 	if err != nil {
-		rw.Write(parser.ErrorData("ERR: Can't decode RDB file").Marshal())
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
 		return
 	}
 
-	rw.Write([]byte(fmt.Sprintf("$%d\r\n%s", len(rdb), string(rdb))))
-	replica.IsUp = true
-	h.mc.SetReplica(replica)
+	// the reply is written right away, so no command propagated after the
+	// sync point can get in before it
+	var snapshot *storage.Databases
+	h.server.Atomically(func() {
+		repl := h.server.GetReplInfo()
+		if missed, ok := h.mc.partialSync(string(req.Command.Arguments[0]), offset); ok {
+			log.Printf("Partial resynchronization of %s, sending %d bytes of the backlog", req.Conn.RemoteAddr(), len(missed))
+			io.WriteString(req.Conn, string(parser.StringData("CONTINUE "+repl.ReplId).Marshal()))
+			req.Conn.Write(missed)
+			h.mc.updateReplica(req.Conn, func(r *Replica) {
+				r.IsUp = true
+			})
+			return
+		}
+
+		fullresync := fmt.Sprintf("FULLRESYNC %s %d", repl.ReplId, repl.ReplOffset)
+		io.WriteString(req.Conn, string(parser.StringData(fullresync).Marshal()))
+		snapshot = h.mc.startFullSync(req.Conn)
+	})
 
 	h.server.StopHandling(replica.Conn) //exit handling loop, handshake is ended - no more commands expected. WIP
+	if snapshot != nil {
+		h.mc.finishFullSync(h.server, req.Conn, snapshot)
+	}
+}
+
+func (h MasterHandler) handleReplicaof(req Request, rw ResponseWriter) {
+	if isNoOne(req.Command.Arguments) {
+		rw.Write(parser.StringData("OK").Marshal())
+		return
+	}
+	rw.Write(parser.ErrorData("ERR A master can't become a replica, restart it with --replicaof").Marshal())
 }
 
 func (h MasterHandler) handleWait(req Request, rw ResponseWriter) {
@@ -191,19 +327,21 @@ func (h MasterHandler) handleWait(req Request, rw ResponseWriter) {
 		return
 	}
 
-	replNum, err := strconv.Atoi(req.Command.Arguments[0])
+	replNum, err := strconv.Atoi(string(req.Command.Arguments[0]))
 	if err != nil {
 		rw.Write(parser.ErrorData("ERR: Wrong command signature - argument #2 should be an integer").Marshal())
 		return
 	}
 
-	duration, err := strconv.Atoi(req.Command.Arguments[1])
+	duration, err := strconv.Atoi(string(req.Command.Arguments[1]))
 	if err != nil {
 		rw.Write(parser.ErrorData("ERR: Wrong command signature - argument #2 should be an integer").Marshal())
 		return
 	}
 
-	if GetReplInfo().ReplOffset == 0 {
+	// the offset of the writes so far, the acks don't count
+	target := h.server.GetReplInfo().ReplOffset
+	if target == 0 {
 		log.Println("No previous write commands, skipping")
 		rw.Write(parser.IntegerData(len(h.mc.GetReplicas())).Marshal())
 		return
@@ -219,11 +357,12 @@ func (h MasterHandler) handleWait(req Request, rw ResponseWriter) {
 			rw.Write(parser.IntegerData(replicasDone).Marshal())
 			return
 		default:
+			h.server.Atomically(h.mc.requestAcks)
 			offsets := h.mc.UpdateReplicasOffset(ctx)
 			offsetsMatch := 0
 
 			for _, offset := range offsets {
-				if offset >= replInfo.ReplOffset {
+				if offset >= target {
 					offsetsMatch++
 				}
 			}
@@ -235,7 +374,7 @@ func (h MasterHandler) handleWait(req Request, rw ResponseWriter) {
 		}
 
 	}
-	rw.Write(parser.NullBulkStringData().Marshal())
+	rw.Write(nullReply(req))
 }
 
 func RouteReplica(sv *Server, replicaContext *ReplicaContext) {
@@ -246,10 +385,12 @@ func RouteReplica(sv *Server, replicaContext *ReplicaContext) {
 	sv.AddHandler("PONG", replicaHandler.HandlePong)
 	sv.AddHandler("REPLCONF", replicaHandler.HandleReplconf)
 	sv.AddHandler("FULLRESYNC", replicaHandler.HandleFsync)
+	sv.AddHandler("CONTINUE", replicaHandler.HandleContinue)
+	sv.AddHandler("REPLICAOF", replicaHandler.HandleReplicaof)
 }
 
 func (h ReplicaHandler) HandlePong(req Request, rw ResponseWriter) {
-	if req.Conn != h.replicaCtx.masterConn {
+	if !h.replicaCtx.isMaster(req.Conn) {
 		rw.Write(parser.ErrorData("ERR: Unexpected command").Marshal())
 		return
 	}
@@ -257,7 +398,7 @@ func (h ReplicaHandler) HandlePong(req Request, rw ResponseWriter) {
 }
 
 func (h ReplicaHandler) HandleOK(req Request, rw ResponseWriter) {
-	if req.Conn != h.replicaCtx.masterConn {
+	if !h.replicaCtx.isMaster(req.Conn) {
 		rw.Write(parser.ErrorData("ERR: Unexpected command").Marshal())
 		return
 	}
@@ -269,15 +410,102 @@ func (h ReplicaHandler) HandleReplconf(req Request, rw ResponseWriter) {
 	if _, ok := req.Command.Options["GETACK"]; ok {
 		io.WriteString(req.Conn, string(parser.ArrayData( //this is special case, as said in the docs, so we are bypassing rw
 			[]parser.Data{
-				parser.BulkStringData("REPLCONF"),
-				parser.BulkStringData("ACK"),
-				parser.BulkStringData(strconv.Itoa(GetReplInfo().ReplOffset)),
+				parser.BulkStringData([]byte("REPLCONF")),
+				parser.BulkStringData([]byte("ACK")),
+				parser.BulkStringData([]byte(strconv.Itoa(h.replicaCtx.server.GetReplInfo().ReplOffset))),
 			},
 		).Marshal()))
 	}
 }
 
+// HandleFsync loads the snapshot that follows +FULLRESYNC <replid> <offset>
+// and starts the history of the master at that offset.
 func (h ReplicaHandler) HandleFsync(req Request, rw ResponseWriter) {
-	UpdateReplInfo("", 0)
-	h.replicaCtx.Event(OnFsync)
+	if !h.replicaCtx.isMaster(req.Conn) {
+		rw.Write(parser.ErrorData("ERR: Unexpected command").Marshal())
+		return
+	}
+	fields := strings.Fields(string(req.Raw[1:]))
+	if len(fields) != 3 {
+		log.Printf("Unexpected full resync reply from the master: %q", req.Raw)
+		return
+	}
+	offset, err := strconv.Atoi(fields[2])
+	if err != nil {
+		log.Printf("Unexpected full resync reply from the master: %q", req.Raw)
+		return
+	}
+
+	rc := h.replicaCtx
+	start := time.Now()
+	n, err := rc.loadSnapshot(req.Payload)
+	if err != nil {
+		// the next attempt starts over with a full resync
+		log.Printf("Error loading the RDB from the master: %s", err.Error())
+		h.replicaCtx.server.UpdateReplInfo("", 0)
+		req.Conn.Close()
+		return
+	}
+	log.Printf("Loaded %d keys from the master in %s", n, time.Since(start))
+
+	rc.mu.Lock()
+	h.replicaCtx.server.UpdateReplInfo(fields[1], offset)
+	rc.backlog.reset(offset)
+	rc.mu.Unlock()
+	rc.Event(OnFsync)
+}
+
+// HandleContinue goes on with the history the replica has after
+// +CONTINUE [<replid>]. A master that was promoted continues it under its
+// own ID.
+func (h ReplicaHandler) HandleContinue(req Request, rw ResponseWriter) {
+	if !h.replicaCtx.isMaster(req.Conn) {
+		rw.Write(parser.ErrorData("ERR: Unexpected command").Marshal())
+		return
+	}
+
+	rc := h.replicaCtx
+	rc.mu.Lock()
+	fields := strings.Fields(string(req.Raw[1:]))
+	rc.server.updateReplInfo(func(repl *ReplInfo) {
+		if len(fields) == 2 && fields[1] != repl.ReplId {
+			repl.ReplId2, repl.SecondReplOffset = repl.ReplId, repl.ReplOffset+1
+			repl.ReplId = fields[1]
+		}
+	})
+	req.Client.db = rc.db
+	rc.mu.Unlock()
+	log.Printf("Partial resynchronization accepted at offset %d", rc.server.GetReplInfo().ReplOffset)
+	rc.Event(OnContinue)
+}
+
+// HandleReplicaof promotes the replica with REPLICAOF NO ONE, or makes it
+// replicate another master.
+func (h ReplicaHandler) HandleReplicaof(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if isNoOne(args) {
+		h.replicaCtx.promote()
+		rw.Write(parser.StringData("OK").Marshal())
+		return
+	}
+	if port, err := strconv.Atoi(string(args[1])); err != nil || port < 0 || port > 65535 {
+		rw.Write(parser.ErrorData("ERR Invalid master port").Marshal())
+		return
+	}
+
+	addr := net.JoinHostPort(string(args[0]), string(args[1]))
+	rc := h.replicaCtx
+	rc.mu.Lock()
+	current := rc.masterAddr
+	rc.mu.Unlock()
+	if addr == current {
+		rw.Write(parser.StringData("OK Already connected to specified master").Marshal())
+		return
+	}
+	rc.setMaster(addr)
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+func isNoOne(args [][]byte) bool {
+	return strings.EqualFold(string(args[0]), "no") && strings.EqualFold(string(args[1]), "one")
 }
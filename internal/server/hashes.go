@@ -0,0 +1,570 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/glob"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+func (h BaseHandler) routeHashes(server *Server) {
+	server.AddHandler("HSET", h.handleHset)
+	server.AddHandler("HMSET", h.handleHset)
+	server.AddHandler("HSETNX", h.handleHsetnx)
+	server.AddHandler("HGET", h.handleHget)
+	server.AddHandler("HMGET", h.handleHmget)
+	server.AddHandler("HDEL", h.handleHdel)
+	server.AddHandler("HEXISTS", h.handleHexists)
+	server.AddHandler("HLEN", h.handleHlen)
+	server.AddHandler("HSTRLEN", h.handleHstrlen)
+	server.AddHandler("HKEYS", h.handleHgetall)
+	server.AddHandler("HVALS", h.handleHgetall)
+	server.AddHandler("HGETALL", h.handleHgetall)
+	server.AddHandler("HINCRBY", h.handleHincrby)
+	server.AddHandler("HINCRBYFLOAT", h.handleHincrbyfloat)
+	server.AddHandler("HRANDFIELD", h.handleHrandfield)
+	server.AddHandler("HSCAN", h.handleHscan)
+	server.AddHandler("HEXPIRE", h.handleHexpire)
+	server.AddHandler("HPEXPIRE", h.handleHexpire)
+	server.AddHandler("HEXPIREAT", h.handleHexpire)
+	server.AddHandler("HPEXPIREAT", h.handleHexpire)
+	server.AddHandler("HTTL", h.handleHttl)
+	server.AddHandler("HPTTL", h.handleHttl)
+	server.AddHandler("HEXPIRETIME", h.handleHttl)
+	server.AddHandler("HPEXPIRETIME", h.handleHttl)
+	server.AddHandler("HPERSIST", h.handleHpersist)
+}
+
+// parseFields parses the FIELDS numfields field... argument of the commands
+// on the expiry of fields.
+func parseFields(args [][]byte) ([]string, string) {
+	if len(args) < 2 || strings.ToUpper(string(args[0])) != "FIELDS" {
+		return nil, "ERR Mandatory argument FIELDS is missing or not at the right position"
+	}
+	n, err := parseInt(args[1])
+	if err != nil || n <= 0 {
+		return nil, "ERR Parameter `numFields` should be greater than 0"
+	}
+	if n != len(args)-2 {
+		return nil, "ERR The `numfields` parameter must match the number of arguments"
+	}
+	return keyStrings(args[2:]), ""
+}
+
+// handleHset serves HSET, which replies the number of new fields, and the
+// deprecated HMSET, which replies OK.
+func (h BaseHandler) handleHset(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args)%2 == 0 {
+		rw.Write(parser.ErrorData(wrongArgs(req.Command.Name)).Marshal())
+		return
+	}
+
+	added := 0
+	err := h.db(req).UpdateHash(string(args[0]), true, func(hash *storage.Hash) {
+		for i := 1; i < len(args); i += 2 {
+			if hash.Set(string(args[i]), args[i+1], false) {
+				added++
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if req.Command.Name == "HMSET" {
+		rw.Write(parser.StringData("OK").Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(added).Marshal())
+}
+
+func (h BaseHandler) handleHsetnx(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	added := false
+	err := h.db(req).UpdateHash(string(args[0]), true, func(hash *storage.Hash) {
+		if _, exists := hash.Get(string(args[1])); !exists {
+			added = hash.Set(string(args[1]), args[2], false)
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if !added {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+func (h BaseHandler) handleHget(req Request, rw ResponseWriter) {
+	var value []byte
+	var ok bool
+	err := h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		value, ok = hash.Get(string(req.Command.Arguments[1]))
+	})
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case !ok:
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(parser.BulkStringData(value).Marshal())
+	}
+}
+
+func (h BaseHandler) handleHmget(req Request, rw ResponseWriter) {
+	fields := req.Command.Arguments[1:]
+	values := make([]parser.Data, len(fields))
+	err := h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		for i, field := range fields {
+			if value, ok := hash.Get(string(field)); ok {
+				values[i] = parser.BulkStringData(value)
+			} else {
+				values[i] = parser.NullData()
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData(values).MarshalProto(req.Client.Proto()))
+}
+
+func (h BaseHandler) handleHdel(req Request, rw ResponseWriter) {
+	deleted := 0
+	err := h.db(req).UpdateHash(string(req.Command.Arguments[0]), false, func(hash *storage.Hash) {
+		for _, field := range req.Command.Arguments[1:] {
+			if hash.Delete(string(field)) {
+				deleted++
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if deleted == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(deleted).Marshal())
+}
+
+func (h BaseHandler) handleHexists(req Request, rw ResponseWriter) {
+	exists := false
+	err := h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		_, exists = hash.Get(string(req.Command.Arguments[1]))
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if exists {
+		rw.Write(parser.IntegerData(1).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(0).Marshal())
+}
+
+func (h BaseHandler) handleHlen(req Request, rw ResponseWriter) {
+	length := 0
+	err := h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		length = hash.Len()
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+func (h BaseHandler) handleHstrlen(req Request, rw ResponseWriter) {
+	var value []byte
+	err := h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		value, _ = hash.Get(string(req.Command.Arguments[1]))
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(len(value)).Marshal())
+}
+
+// handleHgetall serves HGETALL, a map of fields to values in RESP3, and HKEYS
+// and HVALS that reply one half of it.
+func (h BaseHandler) handleHgetall(req Request, rw ResponseWriter) {
+	name := req.Command.Name
+	var res []parser.Data
+	err := h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		hash.ForEach(func(field string, value []byte) bool {
+			if name != "HVALS" {
+				res = append(res, parser.BulkStringData([]byte(field)))
+			}
+			if name != "HKEYS" {
+				res = append(res, parser.BulkStringData(value))
+			}
+			return true
+		})
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if name == "HGETALL" {
+		rw.Write(parser.MapData(res).MarshalProto(req.Client.Proto()))
+		return
+	}
+	rw.Write(parser.ArrayData(res).Marshal())
+}
+
+func (h BaseHandler) handleHincrby(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	incr, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+
+	var res int64
+	var errMsg string
+	err = h.db(req).UpdateHash(string(args[0]), true, func(hash *storage.Hash) {
+		if value, ok := hash.Get(string(args[1])); ok {
+			current, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				errMsg = "ERR hash value is not an integer"
+				return
+			}
+			res = current
+		}
+		if (incr > 0 && res > math.MaxInt64-incr) || (incr < 0 && res < math.MinInt64-incr) {
+			errMsg = "ERR increment or decrement would overflow"
+			return
+		}
+		res += incr
+		hash.Set(string(args[1]), []byte(strconv.FormatInt(res, 10)), true)
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(int(res)).Marshal())
+}
+
+// handleHincrbyfloat is propagated as HSET with the result, so replicas don't
+// depend on how they round floats.
+func (h BaseHandler) handleHincrbyfloat(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	incr, err := strconv.ParseFloat(string(args[2]), 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		rw.Write(parser.ErrorData("ERR value is not a valid float").Marshal())
+		return
+	}
+
+	var res []byte
+	var expireAt int64
+	var errMsg string
+	err = h.db(req).UpdateHash(string(args[0]), true, func(hash *storage.Hash) {
+		var current float64
+		if value, ok := hash.Get(string(args[1])); ok {
+			var err error
+			if current, err = strconv.ParseFloat(string(value), 64); err != nil {
+				errMsg = "ERR hash value is not a float"
+				return
+			}
+		}
+		sum := current + incr
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			errMsg = "ERR increment would produce NaN or Infinity"
+			return
+		}
+		res = []byte(formatFloat(sum))
+		hash.Set(string(args[1]), res, true)
+		expireAt, _ = hash.ExpireTime(string(args[1]))
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	req.RewriteCommand([]byte("HSET"), args[0], args[1], res)
+	if expireAt != 0 {
+		req.RewriteCommand([]byte("HPEXPIREAT"), args[0], []byte(strconv.FormatInt(expireAt, 10)), []byte("FIELDS"), []byte("1"), args[1])
+	}
+	rw.Write(parser.BulkStringData(res).Marshal())
+}
+
+// handleHrandfield serves HRANDFIELD key [count [WITHVALUES]]: a positive
+// count returns distinct fields, a negative one may repeat them.
+func (h BaseHandler) handleHrandfield(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 3 || (len(args) == 3 && strings.ToUpper(string(args[2])) != "WITHVALUES") {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	hasCount, withValues := len(args) > 1, len(args) == 3
+	count := 1
+	if hasCount {
+		var err error
+		if count, err = parseInt(args[1]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if count < -math.MaxInt32 || count > math.MaxInt32 {
+			rw.Write(parser.ErrorData("ERR value is out of range").Marshal())
+			return
+		}
+	}
+
+	var fields [][2][]byte
+	err := h.db(req).ReadHash(string(args[0]), func(hash *storage.Hash) {
+		names := hash.Fields()
+		if len(names) == 0 {
+			return
+		}
+		pick := func(field string) {
+			value, _ := hash.Get(field)
+			fields = append(fields, [2][]byte{[]byte(field), value})
+		}
+
+		if count < 0 {
+			for i := 0; i < -count; i++ {
+				pick(names[rand.Intn(len(names))])
+			}
+			return
+		}
+		rand.Shuffle(len(names), func(i, j int) {
+			names[i], names[j] = names[j], names[i]
+		})
+		for i := 0; i < count && i < len(names); i++ {
+			pick(names[i])
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	if !hasCount {
+		if len(fields) == 0 {
+			rw.Write(nullReply(req))
+			return
+		}
+		rw.Write(parser.BulkStringData(fields[0][0]).Marshal())
+		return
+	}
+
+	res := make([]parser.Data, 0, len(fields))
+	for _, f := range fields {
+		switch {
+		case !withValues:
+			res = append(res, parser.BulkStringData(f[0]))
+		case req.Client.Proto() >= parser.Resp3:
+			res = append(res, parser.ArrayData(bulksData(f[:])))
+		default:
+			res = append(res, bulksData(f[:])...)
+		}
+	}
+	rw.Write(parser.ArrayData(res).Marshal())
+}
+
+func (h BaseHandler) handleHscan(req Request, rw ResponseWriter) {
+	cursor, err := strconv.ParseUint(string(req.Command.Arguments[1]), 10, 64)
+	if err != nil {
+		rw.Write(parser.ErrorData("ERR invalid cursor").Marshal())
+		return
+	}
+	count := 10
+	if opt, ok := req.Command.Options["COUNT"]; ok {
+		if count, err = parseInt(opt[0]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if count < 1 {
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+	}
+	match, hasMatch := req.Command.Options["MATCH"]
+	_, noValues := req.Command.Options["NOVALUES"]
+
+	res := []parser.Data{}
+	var next uint64
+	err = h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		var fields []string
+		fields, next = hash.Scan(cursor, count)
+		for _, field := range fields {
+			if hasMatch && !glob.Match(match[0], []byte(field), false) {
+				continue
+			}
+			res = append(res, parser.BulkStringData([]byte(field)))
+			if !noValues {
+				value, _ := hash.Get(field)
+				res = append(res, parser.BulkStringData(value))
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData([]parser.Data{
+		parser.BulkStringData([]byte(strconv.FormatUint(next, 10))),
+		parser.ArrayData(res),
+	}).Marshal())
+}
+
+// handleHexpire serves HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT, with a
+// reply for every field: -2 if it doesn't exist, 0 if the condition isn't
+// met, 1 if the expiry was set and 2 if the field was deleted because the
+// deadline already passed. Propagated as HPEXPIREAT and HDEL.
+func (h BaseHandler) handleHexpire(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if n, err := strconv.ParseInt(string(args[1]), 10, 64); err == nil && n < 0 {
+		rw.Write(parser.ErrorData("ERR invalid expire time, must be >= 0").Marshal())
+		return
+	}
+	at, err := expireTime(req.Command.Name, args[1])
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	rest := args[2:]
+	cond := storage.ExpireAlways
+	if len(rest) > 0 {
+		if flag, ok := map[string]storage.ExpireCondition{
+			"NX": storage.ExpireNX,
+			"XX": storage.ExpireXX,
+			"GT": storage.ExpireGT,
+			"LT": storage.ExpireLT,
+		}[strings.ToUpper(string(rest[0]))]; ok {
+			cond = flag
+			rest = rest[1:]
+		}
+	}
+	fields, errMsg := parseFields(rest)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	res := make([]parser.Data, len(fields))
+	for i := range res {
+		res[i] = parser.IntegerData(-2)
+	}
+	var set, deleted [][]byte
+	ts := time.Now().UnixMilli()
+	err = h.db(req).UpdateHash(string(args[0]), false, func(hash *storage.Hash) {
+		for i, field := range fields {
+			if _, ok := hash.Get(field); !ok {
+				continue
+			}
+			switch {
+			case !hash.Expire(field, at, cond):
+				res[i] = parser.IntegerData(0)
+			case at <= ts:
+				res[i] = parser.IntegerData(2)
+				deleted = append(deleted, []byte(field))
+			default:
+				res[i] = parser.IntegerData(1)
+				set = append(set, []byte(field))
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	req.PreventPropagation()
+	if len(set) > 0 {
+		cmd := [][]byte{[]byte("HPEXPIREAT"), args[0], []byte(strconv.FormatInt(at, 10)), []byte("FIELDS"), []byte(strconv.Itoa(len(set)))}
+		req.RewriteCommand(append(cmd, set...)...)
+	}
+	if len(deleted) > 0 {
+		req.RewriteCommand(append([][]byte{[]byte("HDEL"), args[0]}, deleted...)...)
+	}
+	rw.Write(parser.ArrayData(res).Marshal())
+}
+
+// handleHttl serves HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME, with a reply
+// for every field like TTL and friends for keys.
+func (h BaseHandler) handleHttl(req Request, rw ResponseWriter) {
+	fields, errMsg := parseFields(req.Command.Arguments[1:])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	res := make([]parser.Data, len(fields))
+	err := h.db(req).ReadHash(string(req.Command.Arguments[0]), func(hash *storage.Hash) {
+		for i, field := range fields {
+			at, ok := hash.ExpireTime(field)
+			switch {
+			case !ok:
+				res[i] = parser.IntegerData(-2)
+			case at == 0:
+				res[i] = parser.IntegerData(-1)
+			default:
+				res[i] = parser.IntegerData(int(ttlValue(req.Command.Name, at)))
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData(res).Marshal())
+}
+
+// handleHpersist replies for every field -2 if it doesn't exist, -1 if it has
+// no expiry and 1 if the expiry was removed.
+func (h BaseHandler) handleHpersist(req Request, rw ResponseWriter) {
+	fields, errMsg := parseFields(req.Command.Arguments[1:])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	res := make([]parser.Data, len(fields))
+	for i := range res {
+		res[i] = parser.IntegerData(-2)
+	}
+	persisted := 0
+	err := h.db(req).UpdateHash(string(req.Command.Arguments[0]), false, func(hash *storage.Hash) {
+		for i, field := range fields {
+			switch {
+			case hash.Persist(field):
+				res[i] = parser.IntegerData(1)
+				persisted++
+			default:
+				if _, ok := hash.Get(field); ok {
+					res[i] = parser.IntegerData(-1)
+				}
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if persisted == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.ArrayData(res).Marshal())
+}
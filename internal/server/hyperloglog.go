@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/hll"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+const errNotHLL = "WRONGTYPE Key is not a valid HyperLogLog string value."
+
+func (h BaseHandler) routeHyperLogLog(server *Server) {
+	server.AddHandler("PFADD", h.handlePfadd)
+	server.AddHandler("PFCOUNT", h.handlePfcount)
+	server.AddHandler("PFMERGE", h.handlePfmerge)
+}
+
+// handlePfadd serves PFADD key [element...], that replies 1 if the key was
+// created or a register changed.
+func (h BaseHandler) handlePfadd(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	changed := false
+	var errMsg string
+	err := h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		data := hll.New()
+		if exists {
+			if !hll.Valid(value) {
+				errMsg = errNotHLL
+				return nil, false
+			}
+			// the stored value isn't changed in place
+			data = append([]byte(nil), value...)
+		}
+		var err error
+		if data, changed, err = hll.Add(data, args[1:]...); err != nil {
+			errMsg = err.Error()
+			return nil, false
+		}
+		changed = changed || !exists
+		return data, changed
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if !changed {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+// mergeHLLs merges the HLLs at the keys, skipping the missing ones. dense
+// tells whether one of them uses the dense encoding.
+func mergeHLLs(db *storage.Storage, keys [][]byte) (registers []uint8, dense bool, errMsg string) {
+	registers = make([]uint8, hll.NumRegisters)
+	for _, key := range keys {
+		value, err := db.Get(string(key))
+		if err == storage.ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			return nil, false, err.Error()
+		}
+		if !hll.Valid(value) {
+			return nil, false, errNotHLL
+		}
+		dense = dense || hll.Dense(value)
+		if err := hll.Merge(registers, value); err != nil {
+			return nil, false, err.Error()
+		}
+	}
+	return registers, dense, ""
+}
+
+// handlePfcount serves PFCOUNT key..., the estimated cardinality of the union
+// of the HLLs. With a single key the estimate is cached in the value, like
+// redis does, which doesn't count as a write.
+func (h BaseHandler) handlePfcount(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 1 {
+		registers, _, errMsg := mergeHLLs(h.db(req), args)
+		if errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+			return
+		}
+		rw.Write(parser.IntegerData(int(hll.CountRegisters(registers))).Marshal())
+		return
+	}
+
+	var n uint64
+	var errMsg string
+	err := h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		if !exists {
+			return nil, false
+		}
+		if !hll.Valid(value) {
+			errMsg = errNotHLL
+			return nil, false
+		}
+		var cached bool
+		var err error
+		if n, cached, err = hll.Count(value); err != nil {
+			errMsg = err.Error()
+			return nil, false
+		}
+		if cached {
+			return nil, false
+		}
+		data := append([]byte(nil), value...)
+		hll.SetCache(data, n)
+		return data, true
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(int(n)).Marshal())
+}
+
+// handlePfmerge serves PFMERGE destkey [sourcekey...], that merges the sources
+// into the destination. It gets dense if one of them is.
+func (h BaseHandler) handlePfmerge(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	registers, dense, errMsg := mergeHLLs(h.db(req), args)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	err := h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		data := hll.New()
+		if exists {
+			data = append([]byte(nil), value...)
+		}
+		var err error
+		if data, err = hll.Store(data, registers, dense); err != nil {
+			errMsg = err.Error()
+			return nil, false
+		}
+		return data, true
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.StringData("OK").Marshal())
+}
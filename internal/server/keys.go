@@ -0,0 +1,371 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/glob"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+func (h BaseHandler) routeKeys(server *Server) {
+	server.AddHandler("EXPIRE", h.handleExpire)
+	server.AddHandler("PEXPIRE", h.handleExpire)
+	server.AddHandler("EXPIREAT", h.handleExpire)
+	server.AddHandler("PEXPIREAT", h.handleExpire)
+	server.AddHandler("TTL", h.handleTtl)
+	server.AddHandler("PTTL", h.handleTtl)
+	server.AddHandler("EXPIRETIME", h.handleTtl)
+	server.AddHandler("PEXPIRETIME", h.handleTtl)
+	server.AddHandler("PERSIST", h.handlePersist)
+	server.AddHandler("DEL", h.handleDel)
+	server.AddHandler("UNLINK", h.handleDel)
+	server.AddHandler("EXISTS", h.handleExists)
+	server.AddHandler("TYPE", h.handleType)
+	server.AddHandler("RENAME", h.handleRename)
+	server.AddHandler("RENAMENX", h.handleRename)
+	server.AddHandler("COPY", h.handleCopy)
+	server.AddHandler("KEYS", h.handleKeys)
+	server.AddHandler("RANDOMKEY", h.handleRandomkey)
+	server.AddHandler("DBSIZE", h.handleDbsize)
+	server.AddHandler("FLUSHDB", h.handleFlush)
+	server.AddHandler("FLUSHALL", h.handleFlush)
+	server.AddHandler("SCAN", h.handleScan)
+	server.AddHandler("SELECT", h.handleSelect)
+	server.AddHandler("MOVE", h.handleMove)
+	server.AddHandler("SWAPDB", h.handleSwapdb)
+}
+
+const errDBRange = "ERR DB index is out of range"
+
+// selectCommand is the SELECT of a database, as propagated.
+func selectCommand(db int) []byte {
+	return parser.ArrayData(bulksData([][]byte{[]byte("SELECT"), []byte(strconv.Itoa(db))})).Marshal()
+}
+
+// parseDB parses the index of a database, errMsg is set if it isn't an
+// integer or it is out of range.
+func (h BaseHandler) parseDB(arg []byte) (int, string) {
+	db, err := parseInt(arg)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if db < 0 || db >= h.dbs.Len() {
+		return 0, errDBRange
+	}
+	return db, ""
+}
+
+// handleExpire serves EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT, all of them
+// are propagated as PEXPIREAT so replicas and the AOF get the same deadline.
+func (h BaseHandler) handleExpire(req Request, rw ResponseWriter) {
+	key := req.Command.Arguments[0]
+	at, err := expireTime(req.Command.Name, req.Command.Arguments[1])
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	cond, err := expireCondition(req.Command.Options)
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	if !h.db(req).Expire(string(key), at, cond) {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	req.RewriteCommand([]byte("PEXPIREAT"), key, []byte(strconv.FormatInt(at, 10)))
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+// expireTime converts the time argument of the EXPIRE family, or of their
+// hash field counterparts, to a unix time in ms. The P variants take ms
+// instead of seconds and the AT variants take an absolute time.
+func expireTime(name string, arg []byte) (int64, error) {
+	invalid := errors.New("ERR invalid expire time in '" + strings.ToLower(name) + "' command")
+
+	at, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errors.New(errNotInteger)
+	}
+	if !strings.Contains(name, "PEXPIRE") {
+		if at > math.MaxInt64/1000 || at < math.MinInt64/1000 {
+			return 0, invalid
+		}
+		at *= 1000
+	}
+	if !strings.HasSuffix(name, "AT") {
+		now := time.Now().UnixMilli()
+		if at > math.MaxInt64-now {
+			return 0, invalid
+		}
+		at += now
+	}
+	return at, nil
+}
+
+func expireCondition(opts map[string][][]byte) (storage.ExpireCondition, error) {
+	cond := storage.ExpireAlways
+	for name, flag := range map[string]storage.ExpireCondition{
+		"NX": storage.ExpireNX,
+		"XX": storage.ExpireXX,
+		"GT": storage.ExpireGT,
+		"LT": storage.ExpireLT,
+	} {
+		if _, ok := opts[name]; ok {
+			cond |= flag
+		}
+	}
+
+	if cond&storage.ExpireNX != 0 && cond != storage.ExpireNX {
+		return 0, errors.New("ERR NX and XX, GT or LT options at the same time are not compatible")
+	}
+	if cond&storage.ExpireGT != 0 && cond&storage.ExpireLT != 0 {
+		return 0, errors.New("ERR GT and LT options at the same time are not compatible")
+	}
+	return cond, nil
+}
+
+// handleTtl serves TTL, PTTL, EXPIRETIME and PEXPIRETIME: -2 if the key
+// doesn't exist, -1 if it has no expiry.
+func (h BaseHandler) handleTtl(req Request, rw ResponseWriter) {
+	at, ok := h.db(req).ExpireTime(string(req.Command.Arguments[0]))
+	if !ok {
+		rw.Write(parser.IntegerData(-2).Marshal())
+		return
+	}
+	if at == 0 {
+		rw.Write(parser.IntegerData(-1).Marshal())
+		return
+	}
+
+	rw.Write(parser.IntegerData(int(ttlValue(req.Command.Name, at))).Marshal())
+}
+
+// ttlValue is the reply of TTL, PTTL, EXPIRETIME and PEXPIRETIME, or of their
+// hash field counterparts, for the deadline at.
+func ttlValue(name string, at int64) int64 {
+	var res int64
+	switch strings.TrimPrefix(name, "H") {
+	case "TTL":
+		res = (at - time.Now().UnixMilli() + 500) / 1000
+	case "PTTL":
+		res = at - time.Now().UnixMilli()
+	case "EXPIRETIME":
+		res = at / 1000
+	case "PEXPIRETIME":
+		res = at
+	}
+	if res < 0 {
+		res = 0
+	}
+	return res
+}
+
+func (h BaseHandler) handlePersist(req Request, rw ResponseWriter) {
+	if !h.db(req).Persist(string(req.Command.Arguments[0])) {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+// handleDel serves DEL and UNLINK, values are freed by the garbage collector
+// anyway.
+func (h BaseHandler) handleDel(req Request, rw ResponseWriter) {
+	deleted := h.db(req).Delete(keyStrings(req.Command.Arguments)...)
+	if deleted == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(deleted).Marshal())
+}
+
+func (h BaseHandler) handleExists(req Request, rw ResponseWriter) {
+	rw.Write(parser.IntegerData(h.db(req).Exists(keyStrings(req.Command.Arguments)...)).Marshal())
+}
+
+func (h BaseHandler) handleType(req Request, rw ResponseWriter) {
+	rw.Write(parser.StringData(h.db(req).Type(string(req.Command.Arguments[0]))).Marshal())
+}
+
+func (h BaseHandler) handleRename(req Request, rw ResponseWriter) {
+	nx := req.Command.Name == "RENAMENX"
+	renamed, err := h.db(req).Rename(string(req.Command.Arguments[0]), string(req.Command.Arguments[1]), nx)
+	if err != nil {
+		rw.Write(parser.ErrorData("ERR no such key").Marshal())
+		return
+	}
+
+	if !nx {
+		rw.Write(parser.StringData("OK").Marshal())
+		return
+	}
+	if !renamed {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+func (h BaseHandler) handleCopy(req Request, rw ResponseWriter) {
+	dst := req.Client.db
+	if db, ok := req.Command.Options["DB"]; ok {
+		var errMsg string
+		if dst, errMsg = h.parseDB(db[0]); errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+			return
+		}
+	}
+	_, replace := req.Command.Options["REPLACE"]
+
+	if !h.dbs.Copy(string(req.Command.Arguments[0]), req.Client.db, string(req.Command.Arguments[1]), dst, replace) {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+func (h BaseHandler) handleKeys(req Request, rw ResponseWriter) {
+	pattern := req.Command.Arguments[0]
+	allKeys := string(pattern) == "*"
+	keys := h.db(req).Keys(func(key string) bool {
+		return allKeys || glob.Match(pattern, []byte(key), false)
+	})
+	rw.Write(parser.ArrayData(stringsData(keys)).Marshal())
+}
+
+func (h BaseHandler) handleRandomkey(req Request, rw ResponseWriter) {
+	key, ok := h.db(req).RandomKey()
+	if !ok {
+		rw.Write(nullReply(req))
+		return
+	}
+	rw.Write(parser.BulkStringData([]byte(key)).Marshal())
+}
+
+func (h BaseHandler) handleDbsize(req Request, rw ResponseWriter) {
+	keys, _ := h.db(req).Len()
+	rw.Write(parser.IntegerData(keys).Marshal())
+}
+
+// handleFlush serves FLUSHDB, that deletes the keys of the selected
+// database, and FLUSHALL. ASYNC and SYNC make no difference.
+func (h BaseHandler) handleFlush(req Request, rw ResponseWriter) {
+	if req.Command.Name == "FLUSHALL" {
+		h.dbs.FlushAll()
+	} else {
+		h.db(req).Flush()
+	}
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+// handleSelect switches the client to another database, for the rest of the
+// connection.
+func (h BaseHandler) handleSelect(req Request, rw ResponseWriter) {
+	db, errMsg := h.parseDB(req.Command.Arguments[0])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	req.Client.db = db
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+// handleMove serves MOVE key db, that moves the key from the selected
+// database unless it exists in the other one.
+func (h BaseHandler) handleMove(req Request, rw ResponseWriter) {
+	db, errMsg := h.parseDB(req.Command.Arguments[1])
+	if errMsg == "" && db == req.Client.db {
+		errMsg = "ERR source and destination objects are the same"
+	}
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	if !h.dbs.Move(string(req.Command.Arguments[0]), req.Client.db, db) {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+// handleSwapdb serves SWAPDB index1 index2. The clients blocked on keys of
+// the databases, or watching them, see the keys of the other one from now on,
+// so the keys that exist in one of them count as written to.
+func (h BaseHandler) handleSwapdb(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	var dbs [2]int
+	for i, msg := range []string{"ERR invalid first DB index", "ERR invalid second DB index"} {
+		db, err := parseInt(args[i])
+		if err != nil {
+			rw.Write(parser.ErrorData(msg).Marshal())
+			return
+		}
+		if db < 0 || db >= h.dbs.Len() {
+			rw.Write(parser.ErrorData(errDBRange).Marshal())
+			return
+		}
+		dbs[i] = db
+	}
+
+	if dbs[0] != dbs[1] {
+		h.dbs.Swap(dbs[0], dbs[1])
+		h.server.dbsSwapped(dbs[0], dbs[1], func(key string) bool {
+			return h.dbs.DB(dbs[0]).Exists(key)+h.dbs.DB(dbs[1]).Exists(key) > 0
+		})
+	}
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+func (h BaseHandler) handleScan(req Request, rw ResponseWriter) {
+	cursor, err := strconv.ParseUint(string(req.Command.Arguments[0]), 10, 64)
+	if err != nil {
+		rw.Write(parser.ErrorData("ERR invalid cursor").Marshal())
+		return
+	}
+
+	count := 10
+	if opt, ok := req.Command.Options["COUNT"]; ok {
+		count, err = strconv.Atoi(string(opt[0]))
+		if err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if count < 1 {
+			rw.Write(parser.ErrorData("ERR syntax error").Marshal())
+			return
+		}
+	}
+
+	keys, next := h.db(req).Scan(cursor, count)
+
+	// like redis, filters apply to the keys already taken from the keyspace
+	match, hasMatch := req.Command.Options["MATCH"]
+	typ, hasType := req.Command.Options["TYPE"]
+	filtered := keys[:0]
+	for _, key := range keys {
+		if hasMatch && !glob.Match(match[0], []byte(key), false) {
+			continue
+		}
+		if hasType && !strings.EqualFold(h.db(req).Type(key), string(typ[0])) {
+			continue
+		}
+		filtered = append(filtered, key)
+	}
+
+	rw.Write(parser.ArrayData([]parser.Data{
+		parser.BulkStringData([]byte(strconv.FormatUint(next, 10))),
+		parser.ArrayData(stringsData(filtered)),
+	}).Marshal())
+}
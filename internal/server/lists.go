@@ -0,0 +1,550 @@
+package server
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+func (h BaseHandler) routeLists(server *Server) {
+	server.AddHandler("LPUSH", h.handlePush)
+	server.AddHandler("RPUSH", h.handlePush)
+	server.AddHandler("LPUSHX", h.handlePush)
+	server.AddHandler("RPUSHX", h.handlePush)
+	server.AddHandler("LPOP", h.handlePop)
+	server.AddHandler("RPOP", h.handlePop)
+	server.AddHandler("LLEN", h.handleLlen)
+	server.AddHandler("LRANGE", h.handleLrange)
+	server.AddHandler("LINDEX", h.handleLindex)
+	server.AddHandler("LSET", h.handleLset)
+	server.AddHandler("LINSERT", h.handleLinsert)
+	server.AddHandler("LREM", h.handleLrem)
+	server.AddHandler("LTRIM", h.handleLtrim)
+	server.AddHandler("LPOS", h.handleLpos)
+	server.AddHandler("LMOVE", h.handleLmove)
+	server.AddHandler("RPOPLPUSH", h.handleLmove)
+	server.AddHandler("LMPOP", h.handleLmpop)
+	server.AddHandler("BLPOP", h.handleBpop)
+	server.AddHandler("BRPOP", h.handleBpop)
+	server.AddHandler("BLMOVE", h.handleLmove)
+	server.AddHandler("BRPOPLPUSH", h.handleLmove)
+	server.AddHandler("BLMPOP", h.handleLmpop)
+}
+
+// parseDirection parses the LEFT and RIGHT arguments of LMOVE and friends,
+// left is the head of the list.
+func parseDirection(arg []byte) (left bool, ok bool) {
+	switch strings.ToUpper(string(arg)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// parseTimeout parses the timeout of the blocking commands, in seconds with
+// decimals, 0 blocks forever.
+func parseTimeout(arg []byte) (time.Duration, string) {
+	secs, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0, "ERR timeout is not a float or out of range"
+	}
+	if secs < 0 {
+		return 0, "ERR timeout is negative"
+	}
+	return time.Duration(secs * float64(time.Second)), ""
+}
+
+// popList pops up to count elements from the head or the tail of the list.
+// Returns nil if the key doesn't exist, an empty slice if count is 0.
+func popList(db *storage.Storage, key string, front bool, count int) ([][]byte, error) {
+	popped := [][]byte{}
+	err := db.UpdateList(key, false, func(l *storage.List) {
+		for len(popped) < count && l.Len() > 0 {
+			if front {
+				popped = append(popped, l.PopFront())
+			} else {
+				popped = append(popped, l.PopBack())
+			}
+		}
+	})
+	if err == storage.ErrNoSuchKey {
+		return nil, nil
+	}
+	return popped, err
+}
+
+// popFirst pops from the first of the keys that holds a list.
+func popFirst(db *storage.Storage, keys []string, front bool, count int) (string, [][]byte, error) {
+	for _, key := range keys {
+		popped, err := popList(db, key, front, count)
+		if err != nil || len(popped) > 0 {
+			return key, popped, err
+		}
+	}
+	return "", nil, nil
+}
+
+// propagatePop propagates a pop from any of the keys as the plain LPOP or
+// RPOP that it ended up being.
+func propagatePop(req Request, key string, front bool, count int) {
+	name := "RPOP"
+	if front {
+		name = "LPOP"
+	}
+	if count == 1 {
+		req.RewriteCommand([]byte(name), []byte(key))
+		return
+	}
+	req.RewriteCommand([]byte(name), []byte(key), []byte(strconv.Itoa(count)))
+}
+
+// handlePush serves LPUSH, RPUSH and their X variants that only push to
+// lists that already exist.
+func (h BaseHandler) handlePush(req Request, rw ResponseWriter) {
+	name := req.Command.Name
+	front := name == "LPUSH" || name == "LPUSHX"
+	create := name == "LPUSH" || name == "RPUSH"
+
+	length := 0
+	err := h.db(req).UpdateList(string(req.Command.Arguments[0]), create, func(l *storage.List) {
+		for _, elem := range req.Command.Arguments[1:] {
+			if front {
+				l.PushFront(elem)
+			} else {
+				l.PushBack(elem)
+			}
+		}
+		length = l.Len()
+	})
+	if err == storage.ErrNoSuchKey {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+// handlePop serves LPOP and RPOP, with a count the reply is an array.
+func (h BaseHandler) handlePop(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 2 {
+		rw.Write(parser.ErrorData(wrongArgs(req.Command.Name)).Marshal())
+		return
+	}
+
+	count, hasCount := 1, len(args) == 2
+	if hasCount {
+		var err error
+		count, err = parseInt(args[1])
+		if err != nil || count < 0 {
+			rw.Write(parser.ErrorData("ERR value is out of range, must be positive").Marshal())
+			return
+		}
+	}
+
+	popped, err := popList(h.db(req), string(args[0]), req.Command.Name == "LPOP", count)
+	if len(popped) == 0 {
+		req.PreventPropagation()
+	}
+
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case popped == nil && hasCount:
+		rw.Write(nullArrayReply(req))
+	case popped == nil:
+		rw.Write(nullReply(req))
+	case hasCount:
+		rw.Write(parser.ArrayData(bulksData(popped)).Marshal())
+	default:
+		rw.Write(parser.BulkStringData(popped[0]).Marshal())
+	}
+}
+
+func (h BaseHandler) handleLlen(req Request, rw ResponseWriter) {
+	length := 0
+	err := h.db(req).ReadList(string(req.Command.Arguments[0]), func(l *storage.List) {
+		length = l.Len()
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+func (h BaseHandler) handleLrange(req Request, rw ResponseWriter) {
+	start, err1 := parseInt(req.Command.Arguments[1])
+	stop, err2 := parseInt(req.Command.Arguments[2])
+	if err1 != nil || err2 != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+
+	var elems [][]byte
+	err := h.db(req).ReadList(string(req.Command.Arguments[0]), func(l *storage.List) {
+		elems = l.Range(start, stop)
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData(bulksData(elems)).Marshal())
+}
+
+func (h BaseHandler) handleLindex(req Request, rw ResponseWriter) {
+	index, err := parseInt(req.Command.Arguments[1])
+	if err != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+
+	var elem []byte
+	err = h.db(req).ReadList(string(req.Command.Arguments[0]), func(l *storage.List) {
+		if index < 0 {
+			index += l.Len()
+		}
+		if index >= 0 && index < l.Len() {
+			elem = l.Index(index)
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if elem == nil {
+		rw.Write(nullReply(req))
+		return
+	}
+	rw.Write(parser.BulkStringData(elem).Marshal())
+}
+
+func (h BaseHandler) handleLset(req Request, rw ResponseWriter) {
+	index, err := parseInt(req.Command.Arguments[1])
+	if err != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+
+	inRange := false
+	err = h.db(req).UpdateList(string(req.Command.Arguments[0]), false, func(l *storage.List) {
+		if index < 0 {
+			index += l.Len()
+		}
+		if inRange = index >= 0 && index < l.Len(); inRange {
+			l.Set(index, req.Command.Arguments[2])
+		}
+	})
+	switch {
+	case err == storage.ErrNoSuchKey:
+		rw.Write(parser.ErrorData("ERR no such key").Marshal())
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case !inRange:
+		rw.Write(parser.ErrorData("ERR index out of range").Marshal())
+	default:
+		rw.Write(parser.StringData("OK").Marshal())
+	}
+}
+
+func (h BaseHandler) handleLinsert(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	where := strings.ToUpper(string(args[1]))
+	if where != "BEFORE" && where != "AFTER" {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+
+	res := -1
+	err := h.db(req).UpdateList(string(args[0]), false, func(l *storage.List) {
+		for i := 0; i < l.Len(); i++ {
+			if !bytes.Equal(l.Index(i), args[2]) {
+				continue
+			}
+			if where == "AFTER" {
+				i++
+			}
+			l.Insert(i, args[3])
+			res = l.Len()
+			return
+		}
+	})
+	if err == storage.ErrNoSuchKey {
+		res = 0
+	} else if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if res <= 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(res).Marshal())
+}
+
+func (h BaseHandler) handleLrem(req Request, rw ResponseWriter) {
+	count, err := parseInt(req.Command.Arguments[1])
+	if err != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+
+	removed := 0
+	err = h.db(req).UpdateList(string(req.Command.Arguments[0]), false, func(l *storage.List) {
+		removed = l.Remove(req.Command.Arguments[2], count)
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if removed == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(removed).Marshal())
+}
+
+func (h BaseHandler) handleLtrim(req Request, rw ResponseWriter) {
+	start, err1 := parseInt(req.Command.Arguments[1])
+	stop, err2 := parseInt(req.Command.Arguments[2])
+	if err1 != nil || err2 != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+
+	err := h.db(req).UpdateList(string(req.Command.Arguments[0]), false, func(l *storage.List) {
+		l.Trim(start, stop)
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+func (h BaseHandler) handleLpos(req Request, rw ResponseWriter) {
+	opts := req.Command.Options
+	rank, count, maxlen := 1, 1, 0
+	var err error
+
+	if opt, ok := opts["RANK"]; ok {
+		if rank, err = parseInt(opt[0]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if rank == 0 {
+			rw.Write(parser.ErrorData("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the last match").Marshal())
+			return
+		}
+	}
+	_, hasCount := opts["COUNT"]
+	if hasCount {
+		if count, err = parseInt(opts["COUNT"][0]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if count < 0 {
+			rw.Write(parser.ErrorData("ERR COUNT can't be negative").Marshal())
+			return
+		}
+	}
+	if opt, ok := opts["MAXLEN"]; ok {
+		if maxlen, err = parseInt(opt[0]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if maxlen < 0 {
+			rw.Write(parser.ErrorData("ERR MAXLEN can't be negative").Marshal())
+			return
+		}
+	}
+
+	elem := req.Command.Arguments[1]
+	matches := []parser.Data{}
+	err = h.db(req).ReadList(string(req.Command.Arguments[0]), func(l *storage.List) {
+		skip := rank - 1
+		if rank < 0 {
+			skip = -rank - 1
+		}
+		for checked := 0; checked < l.Len() && (maxlen == 0 || checked < maxlen); checked++ {
+			i := checked
+			if rank < 0 {
+				i = l.Len() - 1 - checked
+			}
+			if !bytes.Equal(l.Index(i), elem) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			matches = append(matches, parser.IntegerData(i))
+			if count != 0 && len(matches) == count {
+				return
+			}
+		}
+	})
+
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case hasCount:
+		rw.Write(parser.ArrayData(matches).Marshal())
+	case len(matches) == 0:
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(matches[0].Marshal())
+	}
+}
+
+// handleBpop serves BLPOP and BRPOP: pop from the first non empty list, or
+// block until one of them is pushed to.
+func (h BaseHandler) handleBpop(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	timeout, errMsg := parseTimeout(args[len(args)-1])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	front := req.Command.Name == "BLPOP"
+	keys := keyStrings(args[:len(args)-1])
+	key, popped, err := popFirst(h.db(req), keys, front, 1)
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if len(popped) == 0 {
+		req.Block(keys, timeout, nullArrayReply(req))
+		return
+	}
+
+	propagatePop(req, key, front, 1)
+	rw.Write(parser.ArrayData([]parser.Data{
+		parser.BulkStringData([]byte(key)),
+		parser.BulkStringData(popped[0]),
+	}).Marshal())
+}
+
+// handleLmpop serves LMPOP numkeys key... LEFT|RIGHT [COUNT count] and
+// BLMPOP, which takes a timeout before numkeys.
+func (h BaseHandler) handleLmpop(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	blocking := req.Command.Name == "BLMPOP"
+	var timeout time.Duration
+	if blocking {
+		var errMsg string
+		if timeout, errMsg = parseTimeout(args[0]); errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+			return
+		}
+		args = args[1:]
+	}
+
+	numkeys, err := parseInt(args[0])
+	if err != nil || numkeys <= 0 {
+		rw.Write(parser.ErrorData("ERR numkeys should be greater than 0").Marshal())
+		return
+	}
+	if len(args) < numkeys+2 {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	keys := keyStrings(args[1 : numkeys+1])
+	front, ok := parseDirection(args[numkeys+1])
+	if !ok {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+
+	count := 1
+	rest := args[numkeys+2:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(string(rest[0])) == "COUNT":
+		if count, err = parseInt(rest[1]); err != nil || count <= 0 {
+			rw.Write(parser.ErrorData("ERR count should be greater than 0").Marshal())
+			return
+		}
+	default:
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+
+	key, popped, err := popFirst(h.db(req), keys, front, count)
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if len(popped) == 0 {
+		if blocking {
+			req.Block(keys, timeout, nullArrayReply(req))
+			return
+		}
+		req.PreventPropagation()
+		rw.Write(nullArrayReply(req))
+		return
+	}
+
+	propagatePop(req, key, front, len(popped))
+	rw.Write(parser.ArrayData([]parser.Data{
+		parser.BulkStringData([]byte(key)),
+		parser.ArrayData(bulksData(popped)),
+	}).Marshal())
+}
+
+// handleLmove serves LMOVE and RPOPLPUSH, which is LMOVE src dst RIGHT LEFT,
+// and their blocking variants that take a timeout as the last argument.
+func (h BaseHandler) handleLmove(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	blocking := strings.HasPrefix(req.Command.Name, "B")
+	var timeout time.Duration
+	if blocking {
+		var errMsg string
+		if timeout, errMsg = parseTimeout(args[len(args)-1]); errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+			return
+		}
+		args = args[:len(args)-1]
+	}
+
+	fromLeft, toLeft := false, true
+	if len(args) == 4 {
+		var ok1, ok2 bool
+		fromLeft, ok1 = parseDirection(args[2])
+		toLeft, ok2 = parseDirection(args[3])
+		if !ok1 || !ok2 {
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+	}
+
+	elem, err := h.db(req).MoveList(string(args[0]), string(args[1]), fromLeft, toLeft)
+	if err == storage.ErrNoSuchKey {
+		if blocking {
+			req.Block([]string{string(args[0])}, timeout, nullReply(req))
+			return
+		}
+		req.PreventPropagation()
+		rw.Write(nullReply(req))
+		return
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if blocking {
+		// propagated as the non blocking command, without the timeout
+		req.RewriteCommand(append([][]byte{[]byte(req.Command.Name[1:])}, args...)...)
+	}
+	rw.Write(parser.BulkStringData(elem).Marshal())
+}
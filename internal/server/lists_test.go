@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+)
+
+func TestPopCount(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+	c.expect(integer(3), "RPUSH", "list", "a", "b", "c")
+
+	tests := []utils.Test[[]string, string]{
+		{Name: "LPOP with count 0", Input: []string{"LPOP", "list", "0"}, Want: array()},
+		{Name: "RPOP with count 0", Input: []string{"RPOP", "list", "0"}, Want: array()},
+		{Name: "LPOP of a missing key with count 0", Input: []string{"LPOP", "missing", "0"}, Want: nullArray},
+		{Name: "LPOP of a missing key", Input: []string{"LPOP", "missing"}, Want: nullBulk},
+		{Name: "RPOP with count", Input: []string{"RPOP", "list", "2"}, Want: array(bulk("c"), bulk("b"))},
+		{Name: "LPOP past the end", Input: []string{"LPOP", "list", "5"}, Want: array(bulk("a"))},
+		{Name: "LPOP of an emptied list", Input: []string{"LPOP", "list", "0"}, Want: nullArray},
+	}
+	for _, e := range tests {
+		if res := c.do(e.Input...); res != e.Want {
+			t.Errorf(e.ToString(res))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/codecrafters-io/redis-starter-go/internal/commands"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+const errOOM = "OOM command not allowed when used memory > 'maxmemory'."
+
+// oomAllowedCommands are the write commands that still run when the memory
+// can't be freed, because they only delete data.
+var oomAllowedCommands = map[string]bool{
+	"DEL":              true,
+	"UNLINK":           true,
+	"FLUSHALL":         true,
+	"FLUSHDB":          true,
+	"EXPIRE":           true,
+	"PEXPIRE":          true,
+	"EXPIREAT":         true,
+	"PEXPIREAT":        true,
+	"PERSIST":          true,
+	"GETDEL":           true,
+	"GETEX":            true,
+	"LPOP":             true,
+	"RPOP":             true,
+	"LMPOP":            true,
+	"BLPOP":            true,
+	"BRPOP":            true,
+	"BLMPOP":           true,
+	"LREM":             true,
+	"LTRIM":            true,
+	"HDEL":             true,
+	"HEXPIRE":          true,
+	"HPEXPIRE":         true,
+	"HEXPIREAT":        true,
+	"HPEXPIREAT":       true,
+	"HPERSIST":         true,
+	"SREM":             true,
+	"SPOP":             true,
+	"ZREM":             true,
+	"ZREMRANGEBYLEX":   true,
+	"ZREMRANGEBYRANK":  true,
+	"ZREMRANGEBYSCORE": true,
+	"ZPOPMIN":          true,
+	"ZPOPMAX":          true,
+	"BZPOPMIN":         true,
+	"BZPOPMAX":         true,
+	"XDEL":             true,
+	"XTRIM":            true,
+	"XACK":             true,
+	"XCLAIM":           true,
+	"XAUTOCLAIM":       true,
+	"XREADGROUP":       true,
+}
+
+// deniedOnOOM tells whether the command can't run when the memory can't be
+// freed. EXEC can't if one of the queued commands can't.
+func deniedOnOOM(req Request) bool {
+	if req.Command.Name != "EXEC" {
+		return req.Command.Type == commands.Write && !oomAllowedCommands[req.Command.Name]
+	}
+	if req.Client.multi == nil {
+		return false
+	}
+	for _, msg := range req.Client.multi.queued {
+		if msg.Command.Type == commands.Write && !oomAllowedCommands[msg.Command.Name] {
+			return true
+		}
+	}
+	return false
+}
+
+// freeMemory evicts keys before a write command while the storage is over its
+// memory limit, and propagates them as DELs. Returns the error for a command
+// that can't run because the memory couldn't be freed, then an EXEC discards
+// the transaction.
+func (mc *MasterContext) freeMemory(server *Server, req Request) string {
+	if mc.dbs == nil || req.Command.Type != commands.Write {
+		return ""
+	}
+	evicted, ok := mc.dbs.FreeMemory()
+	for _, e := range evicted {
+		mc.propagate(e.DB, parser.ArrayData(bulksData([][]byte{[]byte("DEL"), []byte(e.Key)})).Marshal())
+	}
+	if ok || !deniedOnOOM(req) {
+		return ""
+	}
+	if req.Command.Name == "EXEC" {
+		req.Client.multi = nil
+		server.watches.unwatch(req.Client)
+	}
+	return errOOM
+}
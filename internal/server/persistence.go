@@ -0,0 +1,474 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/aof"
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+	"github.com/codecrafters-io/redis-starter-go/pkg/rdb"
+)
+
+type Persistence struct {
+	server     *Server
+	dbs        *storage.Databases
+	aof        *aof.AOF
+	dir        string
+	dbFilename string
+	mu         sync.Mutex
+	lastSave   time.Time
+	saving     bool
+}
+
+type PersistenceHandler struct {
+	persistence *Persistence
+}
+
+func NewPersistence(server *Server, dbs *storage.Databases, dir string, dbFilename string) *Persistence {
+	return &Persistence{
+		server:     server,
+		dbs:        dbs,
+		dir:        dir,
+		dbFilename: dbFilename,
+		lastSave:   time.Now(),
+	}
+}
+
+func (p *Persistence) RdbPath() string {
+	return filepath.Join(p.dir, p.dbFilename)
+}
+
+func (p *Persistence) LastSave() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSave
+}
+
+// Save writes the keyspace to the dump file while no command runs, so the
+// dump is a point in time snapshot. client is the one that asked for it,
+// nil if none.
+func (p *Persistence) Save(client *Client) error {
+	if err := p.startSaving(); err != nil {
+		return err
+	}
+
+	var err error
+	p.server.AtomicallyFor(client, func() {
+		err = p.writeSnapshot(p.dbs)
+	})
+	return p.finishSaving(err)
+}
+
+// BackgroundSave takes a snapshot of the keyspace and writes it without
+// blocking the caller.
+func (p *Persistence) BackgroundSave(client *Client) error {
+	if err := p.startSaving(); err != nil {
+		return err
+	}
+
+	var snapshot *storage.Databases
+	p.server.AtomicallyFor(client, func() {
+		snapshot = p.dbs.Clone()
+	})
+
+	go func() {
+		err := p.finishSaving(p.writeSnapshot(snapshot))
+		if err != nil {
+			log.Printf("Background saving error: %s", err.Error())
+			return
+		}
+		log.Println("Background saving terminated with success")
+	}()
+	return nil
+}
+
+func (p *Persistence) startSaving() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.saving {
+		return errors.New("Background save already in progress")
+	}
+	p.saving = true
+	return nil
+}
+
+func (p *Persistence) finishSaving(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.saving = false
+	if err == nil {
+		p.lastSave = time.Now()
+	}
+	return err
+}
+
+// writeSnapshot writes to a temporary file first, so a failed save never
+// leaves a truncated dump behind.
+func (p *Persistence) writeSnapshot(dbs *storage.Databases) error {
+	tmp, err := os.CreateTemp(p.dir, fmt.Sprintf("temp-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = WriteRDB(tmp, dbs)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p.RdbPath())
+}
+
+// Load reads the dump file into the storage, a missing file is not an error.
+func (p *Persistence) Load() error {
+	f, err := os.Open(p.RdbPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	start := time.Now()
+	n, err := LoadRDB(f, p.dbs)
+	if err != nil {
+		return err
+	}
+	log.Printf("DB loaded from disk: %d keys in %s", n, time.Since(start))
+	return nil
+}
+
+func (p *Persistence) SetAOF(a *aof.AOF) {
+	p.aof = a
+}
+
+// LoadAOF replays the append only file, it replaces loading the dump file
+// when the AOF is enabled.
+func (p *Persistence) LoadAOF() error {
+	start := time.Now()
+	n, err := aof.Load(p.aof.Path(), func(r io.Reader) error {
+		_, err := LoadRDB(r, p.dbs)
+		return err
+	}, p.server.Exec)
+	if err != nil {
+		return err
+	}
+	log.Printf("DB loaded from append only file: %d commands in %s", n, time.Since(start))
+	return nil
+}
+
+// BackgroundRewriteAOF compacts the append only file: the new one starts
+// with a snapshot of the keyspace in the RDB format.
+func (p *Persistence) BackgroundRewriteAOF(client *Client) error {
+	var err error
+	p.server.AtomicallyFor(client, func() {
+		err = p.RewriteAOF()
+	})
+	return err
+}
+
+// RewriteAOF is BackgroundRewriteAOF for callers that already run while no
+// command does, like the promotion of a replica, whose log is missing the
+// replication stream.
+func (p *Persistence) RewriteAOF() error {
+	if p.aof == nil {
+		return errors.New("Append only file is disabled")
+	}
+	if err := p.aof.StartRewrite(); err != nil {
+		return err
+	}
+	snapshot := p.dbs.Clone()
+
+	go func() {
+		err := p.aof.FinishRewrite(func(w io.Writer) error {
+			return WriteRDB(w, snapshot)
+		})
+		if err != nil {
+			log.Printf("Background AOF rewrite error: %s", err.Error())
+			return
+		}
+		log.Println("Background AOF rewrite terminated with success")
+	}()
+	return nil
+}
+
+// WriteRDB writes the keys of every database that isn't empty in its own
+// section.
+func WriteRDB(w io.Writer, dbs *storage.Databases) error {
+	enc := rdb.NewEncoder(w)
+	if hasHashTTL(dbs) {
+		enc.SetVersion(rdb.VersionHashTTL)
+	}
+	enc.WriteHeader()
+	enc.WriteAux("redis-ver", Version)
+	enc.WriteAux("redis-bits", "64")
+	enc.WriteAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	enc.WriteAux("aof-base", "0")
+
+	for i := 0; i < dbs.Len(); i++ {
+		st := dbs.DB(i)
+		size, expires := st.Len()
+		if size == 0 {
+			continue
+		}
+		if err := enc.SelectDB(i, size, expires); err != nil {
+			return err
+		}
+
+		var err error
+		st.ForEach(func(key string, value any, expireAt int64) bool {
+			var v any
+			v, err = rdbValue(value)
+			if err != nil {
+				return false
+			}
+			err = enc.WriteEntry(rdb.Entry{
+				Key:      []byte(key),
+				Value:    v,
+				ExpireAt: expireAt,
+			})
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// hasHashTTL tells whether some hash has fields that expire, which only the
+// later versions of the format can store.
+func hasHashTTL(dbs *storage.Databases) bool {
+	found := false
+	for i := 0; i < dbs.Len() && !found; i++ {
+		dbs.DB(i).ForEach(func(key string, value any, expireAt int64) bool {
+			h, ok := value.(*storage.Hash)
+			found = ok && h.Volatile() > 0
+			return !found
+		})
+	}
+	return found
+}
+
+// LoadRDB adds keys from the RDB stream to their databases and returns how
+// many keys were loaded. Keys that already expired are skipped.
+func LoadRDB(r io.Reader, dbs *storage.Databases) (int, error) {
+	dec := rdb.NewDecoder(r)
+	loaded := 0
+	for {
+		entry, err := dec.Next()
+		if err == io.EOF {
+			return loaded, nil
+		}
+		if err != nil {
+			return loaded, err
+		}
+
+		if entry.DB < 0 || entry.DB >= dbs.Len() {
+			log.Printf("Skipping key %q from DB %d: only %d databases are configured", entry.Key, entry.DB, dbs.Len())
+			continue
+		}
+
+		value, err := storageValue(entry.Value)
+		if err != nil {
+			return loaded, err
+		}
+		if entry.ExpireAt != 0 && entry.ExpireAt <= time.Now().UnixMilli() {
+			continue
+		}
+		dbs.DB(entry.DB).Restore(string(entry.Key), value, entry.ExpireAt)
+		loaded++
+	}
+}
+
+// rdbValue converts a value of the storage to its RDB counterpart.
+func rdbValue(value any) (any, error) {
+	switch v := value.(type) {
+	case []byte:
+		return rdb.String(v), nil
+	case *storage.List:
+		return rdb.List(v.Range(0, -1)), nil
+	case *storage.Set:
+		set := make(rdb.Set, 0, v.Len())
+		for _, member := range v.Members() {
+			set = append(set, []byte(member))
+		}
+		return set, nil
+	case *storage.ZSet:
+		zset := make(rdb.ZSet, 0, v.Len())
+		v.ForEach(func(member string, score float64) bool {
+			zset = append(zset, rdb.ZSetMember{Member: []byte(member), Score: score})
+			return true
+		})
+		return zset, nil
+	case *storage.Hash:
+		hash := make(rdb.Hash, 0, v.Len())
+		v.ForEach(func(field string, value []byte) bool {
+			at, _ := v.ExpireTime(field)
+			hash = append(hash, rdb.HashField{Field: []byte(field), Value: value, ExpireAt: at})
+			return true
+		})
+		return hash, nil
+	case *storage.Stream:
+		return rdbStream(v), nil
+	}
+	return nil, fmt.Errorf("Can't save value of type %T", value)
+}
+
+// rdbStream converts a stream with its consumer groups. Like in the file, the
+// pending entries of the group tell when they were delivered and the ones of
+// every consumer tell who owns them.
+func rdbStream(st *storage.Stream) rdb.Stream {
+	s := rdb.Stream{
+		LastID:       rdb.StreamID(st.LastID()),
+		MaxDeletedID: rdb.StreamID(st.MaxDeletedID()),
+		EntriesAdded: uint64(st.EntriesAdded()),
+	}
+	for _, e := range st.Range(storage.StreamID{}, storage.MaxStreamID, -1, false) {
+		s.Entries = append(s.Entries, rdb.StreamEntry{ID: rdb.StreamID(e.ID), Fields: e.Fields})
+	}
+
+	for _, g := range st.Groups() {
+		group := rdb.StreamGroup{
+			Name:        []byte(g.Name),
+			LastID:      rdb.StreamID(g.LastID),
+			EntriesRead: g.EntriesRead,
+		}
+		owned := make(map[string][]rdb.StreamID)
+		for _, p := range g.PendingRange(storage.StreamID{}, storage.MaxStreamID, -1, "") {
+			group.Pending = append(group.Pending, rdb.StreamPending{
+				ID:            rdb.StreamID(p.ID),
+				DeliveryTime:  p.DeliveryTime,
+				DeliveryCount: uint64(p.DeliveryCount),
+			})
+			owned[p.Consumer] = append(owned[p.Consumer], rdb.StreamID(p.ID))
+		}
+		for _, c := range g.Consumers() {
+			group.Consumers = append(group.Consumers, rdb.StreamConsumer{
+				Name:       []byte(c.Name),
+				SeenTime:   c.SeenTime,
+				ActiveTime: c.ActiveTime,
+				Pending:    owned[c.Name],
+			})
+		}
+		s.Groups = append(s.Groups, group)
+	}
+	return s
+}
+
+// storageValue converts a value read from an RDB file to its storage
+// counterpart.
+func storageValue(value any) (any, error) {
+	switch v := value.(type) {
+	case rdb.String:
+		return []byte(v), nil
+	case rdb.List:
+		return storage.NewList(v...), nil
+	case rdb.Set:
+		set := storage.NewSet()
+		for _, member := range v {
+			set.Add(string(member))
+		}
+		return set, nil
+	case rdb.ZSet:
+		zset := storage.NewZSet()
+		for _, m := range v {
+			zset.Set(string(m.Member), m.Score)
+		}
+		return zset, nil
+	case rdb.Hash:
+		hash := storage.NewHash()
+		for _, f := range v {
+			hash.Set(string(f.Field), f.Value, false)
+			if f.ExpireAt != 0 {
+				hash.Expire(string(f.Field), f.ExpireAt, storage.ExpireAlways)
+			}
+		}
+		return hash, nil
+	case rdb.Stream:
+		return storageStream(v)
+	}
+	return nil, fmt.Errorf("Unexpected value of type %T", value)
+}
+
+func storageStream(s rdb.Stream) (*storage.Stream, error) {
+	st := storage.NewStream()
+	for _, e := range s.Entries {
+		st.Add(storage.StreamID(e.ID), e.Fields)
+	}
+	st.SetID(storage.StreamID(s.LastID), int64(s.EntriesAdded), storage.StreamID(s.MaxDeletedID))
+
+	for _, g := range s.Groups {
+		st.CreateGroup(string(g.Name), storage.StreamID(g.LastID), g.EntriesRead)
+		group := st.Group(string(g.Name))
+		delivered := make(map[rdb.StreamID]rdb.StreamPending)
+		for _, p := range g.Pending {
+			delivered[p.ID] = p
+		}
+
+		for _, c := range g.Consumers {
+			consumer, _ := group.CreateConsumer(string(c.Name), c.SeenTime)
+			consumer.ActiveTime = c.ActiveTime
+			for _, id := range c.Pending {
+				p, ok := delivered[id]
+				if !ok {
+					return nil, fmt.Errorf("Pending entry %d-%d of consumer %q isn't pending in group %q", id.Ms, id.Seq, c.Name, g.Name)
+				}
+				group.Claim(storage.StreamID(id), consumer.Name, p.DeliveryTime, int64(p.DeliveryCount))
+			}
+		}
+	}
+	return st, nil
+}
+
+func RoutePersistence(server *Server, p *Persistence) {
+	handler := PersistenceHandler{p}
+	server.AddHandler("SAVE", handler.handleSave)
+	server.AddHandler("BGSAVE", handler.handleBgsave)
+	server.AddHandler("LASTSAVE", handler.handleLastsave)
+	server.AddHandler("BGREWRITEAOF", handler.handleBgrewriteaof)
+}
+
+func (h PersistenceHandler) handleSave(req Request, rw ResponseWriter) {
+	if err := h.persistence.Save(req.Client); err != nil {
+		log.Printf("Error saving DB on disk: %s", err.Error())
+		rw.Write(parser.ErrorData("ERR " + err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+func (h PersistenceHandler) handleBgsave(req Request, rw ResponseWriter) {
+	if err := h.persistence.BackgroundSave(req.Client); err != nil {
+		rw.Write(parser.ErrorData("ERR " + err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.StringData("Background saving started").Marshal())
+}
+
+func (h PersistenceHandler) handleLastsave(req Request, rw ResponseWriter) {
+	rw.Write(parser.IntegerData(int(h.persistence.LastSave().Unix())).Marshal())
+}
+
+func (h PersistenceHandler) handleBgrewriteaof(req Request, rw ResponseWriter) {
+	if err := h.persistence.BackgroundRewriteAOF(req.Client); err != nil {
+		rw.Write(parser.ErrorData("ERR " + err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.StringData("Background append only file rewriting started").Marshal())
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+)
+
+// dump writes the databases of the server like a save does.
+func dump(t *testing.T, ts *testServer) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	ts.sv.Atomically(func() {
+		err = WriteRDB(&buf, ts.dbs)
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return buf.Bytes()
+}
+
+func TestWriteRDBVersion(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(integer(2), "HSET", "hash", "f1", "v1", "f2", "v2")
+	if header := string(dump(t, ts)[:9]); header != "REDIS0011" {
+		t.Errorf("Wrong header without hash field TTLs. Have: %q, want: %q", header, "REDIS0011")
+	}
+
+	c.expect(array(integer(1)), "HPEXPIREAT", "hash", "9999999999999", "FIELDS", "1", "f2")
+	payload := dump(t, ts)
+	if header := string(payload[:9]); header != "REDIS0012" {
+		t.Errorf("Wrong header with hash field TTLs. Have: %q, want: %q", header, "REDIS0012")
+	}
+
+	dbs := storage.NewDatabases(1)
+	if _, err := LoadRDB(bytes.NewReader(payload), dbs); err != nil {
+		t.Fatal(err.Error())
+	}
+	if size, _ := dbs.DB(0).Len(); size != 1 {
+		t.Fatalf("Wrong number of loaded keys. Have: %d, want: 1", size)
+	}
+	dbs.DB(0).ForEach(func(key string, value any, expireAt int64) bool {
+		if at, _ := value.(*storage.Hash).ExpireTime("f2"); at != 9999999999999 {
+			t.Errorf("Wrong field expiry after loading. Have: %d, want: %d", at, 9999999999999)
+		}
+		return true
+	})
+}
+
+func TestSaveInTransaction(t *testing.T) {
+	ts := newTestServer(t)
+	p := NewPersistence(ts.sv, ts.dbs, t.TempDir(), "dump.rdb")
+	RoutePersistence(ts.sv, p)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "SET", "a", "1")
+	c.expect(ok, "MULTI")
+	c.expect(queued, "SET", "b", "2")
+	c.expect(queued, "SAVE")
+	c.expect(queued, "DEL", "a")
+	c.expect(array(ok, ok, integer(1)), "EXEC")
+
+	// the dump has the keys at the time of SAVE
+	dbs := storage.NewDatabases(16)
+	if err := NewPersistence(ts.sv, dbs, p.dir, p.dbFilename).Load(); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, key := range []string{"a", "b"} {
+		if dbs.DB(0).Exists(key) != 1 {
+			t.Errorf("The key %q isn't in the dump", key)
+		}
+	}
+
+	c.expect(ok, "MULTI")
+	c.expect(queued, "BGSAVE")
+	c.expect(array("+Background saving started\r\n"), "EXEC")
+	waitFor(t, "The background save didn't finish", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return !p.saving
+	})
+}
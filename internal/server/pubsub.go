@@ -0,0 +1,427 @@
+package server
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/pkg/glob"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+// outboxLimit is how many bytes of messages can wait for a subscriber before
+// it is disconnected, like the pubsub output buffer limit of redis.
+const outboxLimit = 32 << 20
+
+// outbox holds the messages published to a client until its connection
+// handler writes them, so that publishers never wait for a slow subscriber.
+type outbox struct {
+	mu     sync.Mutex
+	queued []parser.Data
+	size   int
+	ready  chan struct{}
+}
+
+func newOutbox() *outbox {
+	return &outbox{ready: make(chan struct{}, 1)}
+}
+
+// push queues the message, returns false if the limit is reached.
+func (o *outbox) push(msg parser.Data, size int) bool {
+	o.mu.Lock()
+	if o.size+size > outboxLimit {
+		o.mu.Unlock()
+		return false
+	}
+	o.queued = append(o.queued, msg)
+	o.size += size
+	o.mu.Unlock()
+
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// flush writes the queued messages to the client.
+func (o *outbox) flush(client *Client) {
+	o.mu.Lock()
+	queued := o.queued
+	o.queued = nil
+	o.size = 0
+	o.mu.Unlock()
+
+	var buf []byte
+	for _, msg := range queued {
+		buf = append(buf, msg.MarshalProto(client.Proto())...)
+	}
+	io.WriteString(client.conn, string(buf))
+}
+
+// subscriptions are the channels, patterns and shard channels of a client.
+type subscriptions struct {
+	channels      map[string]bool
+	patterns      map[string]bool
+	shardChannels map[string]bool
+}
+
+// pubsubHub keeps the subscribers of every channel and pattern. Shard
+// channels are a namespace of their own, messages published to them don't
+// match patterns.
+type pubsubHub struct {
+	mu            sync.Mutex
+	channels      map[string]map[*Client]bool
+	patterns      map[string]map[*Client]bool
+	shardChannels map[string]map[*Client]bool
+	clients       map[*Client]*subscriptions
+}
+
+func newPubsubHub() *pubsubHub {
+	return &pubsubHub{
+		channels:      make(map[string]map[*Client]bool),
+		patterns:      make(map[string]map[*Client]bool),
+		shardChannels: make(map[string]map[*Client]bool),
+		clients:       make(map[*Client]*subscriptions),
+	}
+}
+
+// subscriptionKind tells channels, patterns and shard channels apart.
+type subscriptionKind int
+
+const (
+	channelKind subscriptionKind = iota
+	patternKind
+	shardChannelKind
+)
+
+// maps returns the subscriptions of the kind of the client and the
+// subscribers of the kind in the hub.
+func (hub *pubsubHub) maps(client *Client, kind subscriptionKind) (map[string]bool, map[string]map[*Client]bool) {
+	subs, ok := hub.clients[client]
+	if !ok {
+		subs = &subscriptions{
+			channels:      make(map[string]bool),
+			patterns:      make(map[string]bool),
+			shardChannels: make(map[string]bool),
+		}
+		hub.clients[client] = subs
+	}
+	switch kind {
+	case patternKind:
+		return subs.patterns, hub.patterns
+	case shardChannelKind:
+		return subs.shardChannels, hub.shardChannels
+	}
+	return subs.channels, hub.channels
+}
+
+// count returns the number of subscriptions of the client that are counted
+// with the kind: shard channels are counted apart from the others.
+func (hub *pubsubHub) count(client *Client, kind subscriptionKind) int {
+	subs, ok := hub.clients[client]
+	switch {
+	case !ok:
+		return 0
+	case kind == shardChannelKind:
+		return len(subs.shardChannels)
+	}
+	return len(subs.channels) + len(subs.patterns)
+}
+
+// subscribe subscribes the client and returns its subscription count.
+func (hub *pubsubHub) subscribe(client *Client, kind subscriptionKind, name string) int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	own, all := hub.maps(client, kind)
+	if !own[name] {
+		own[name] = true
+		if all[name] == nil {
+			all[name] = make(map[*Client]bool)
+		}
+		all[name][client] = true
+	}
+	return hub.count(client, kind)
+}
+
+// unsubscribe unsubscribes the client from the names, or from all its
+// subscriptions of the kind if there are none, sorted. Calls fn with every
+// name and the subscription count after it. If the client had nothing to
+// unsubscribe from, fn is called once with an empty name.
+func (hub *pubsubHub) unsubscribe(client *Client, kind subscriptionKind, names []string, fn func(name string, count int)) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	own, all := hub.maps(client, kind)
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			fn("", hub.count(client, kind))
+		}
+	}
+
+	for _, name := range names {
+		if own[name] {
+			delete(own, name)
+			delete(all[name], client)
+			if len(all[name]) == 0 {
+				delete(all, name)
+			}
+		}
+		fn(name, hub.count(client, kind))
+	}
+	if hub.count(client, channelKind) == 0 && hub.count(client, shardChannelKind) == 0 {
+		delete(hub.clients, client)
+	}
+}
+
+// unsubscribeAll drops the subscriptions of a client that is gone.
+func (hub *pubsubHub) unsubscribeAll(client *Client) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if _, ok := hub.clients[client]; !ok {
+		return
+	}
+	for _, kind := range []subscriptionKind{channelKind, patternKind, shardChannelKind} {
+		own, all := hub.maps(client, kind)
+		for name := range own {
+			delete(all[name], client)
+			if len(all[name]) == 0 {
+				delete(all, name)
+			}
+		}
+	}
+	delete(hub.clients, client)
+}
+
+// subscribed tells whether the client has any subscription.
+func (hub *pubsubHub) subscribed(client *Client) bool {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	_, ok := hub.clients[client]
+	return ok
+}
+
+// publish queues the message for the subscribers of the channel, and of the
+// patterns that match it unless it is a shard channel. Returns the number of
+// clients that received it and those whose outbox is full.
+func (hub *pubsubHub) publish(kind subscriptionKind, channel []byte, message []byte) (int, []*Client) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	received := 0
+	var slow []*Client
+	deliver := func(client *Client, msg parser.Data, size int) {
+		if client.outbox.push(msg, size) {
+			received++
+		} else {
+			slow = append(slow, client)
+		}
+	}
+
+	size := len(channel) + len(message)
+	if kind == shardChannelKind {
+		msg := parser.PushData(bulksData([][]byte{[]byte("smessage"), channel, message}))
+		for client := range hub.shardChannels[string(channel)] {
+			deliver(client, msg, size)
+		}
+		return received, slow
+	}
+
+	msg := parser.PushData(bulksData([][]byte{[]byte("message"), channel, message}))
+	for client := range hub.channels[string(channel)] {
+		deliver(client, msg, size)
+	}
+	for pattern, clients := range hub.patterns {
+		if !glob.Match([]byte(pattern), channel, false) {
+			continue
+		}
+		msg := parser.PushData(bulksData([][]byte{[]byte("pmessage"), []byte(pattern), channel, message}))
+		for client := range clients {
+			deliver(client, msg, size+len(pattern))
+		}
+	}
+	return received, slow
+}
+
+// names returns the channels of the kind that have subscribers and match the
+// pattern, or all of them if it is nil.
+func (hub *pubsubHub) names(kind subscriptionKind, pattern []byte) []string {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	all := hub.channels
+	if kind == shardChannelKind {
+		all = hub.shardChannels
+	}
+	res := []string{}
+	for name := range all {
+		if pattern == nil || glob.Match(pattern, []byte(name), false) {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// numSub returns the number of subscribers of every channel.
+func (hub *pubsubHub) numSub(kind subscriptionKind, channels [][]byte) []int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	all := hub.channels
+	if kind == shardChannelKind {
+		all = hub.shardChannels
+	}
+	res := make([]int, len(channels))
+	for i, channel := range channels {
+		res[i] = len(all[string(channel)])
+	}
+	return res
+}
+
+func (hub *pubsubHub) numPat() int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	return len(hub.patterns)
+}
+
+// subscriberCommands are the commands a RESP2 client can run once it has
+// subscriptions, since anything else would be mixed up with the messages.
+var subscriberCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"SSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"SUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+	"RESET":        true,
+}
+
+// checkSubscriber returns the error for a command a subscribed client can't
+// run, empty if it can.
+func (s *Server) checkSubscriber(req Request) string {
+	if req.Client.Proto() >= parser.Resp3 || subscriberCommands[req.Command.Name] || !s.pubsub.subscribed(req.Client) {
+		return ""
+	}
+	return "ERR Can't execute '" + strings.ToLower(req.Command.Name) +
+		"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"
+}
+
+func (h BaseHandler) routePubSub(server *Server) {
+	server.AddHandler("SUBSCRIBE", h.handleSubscribe)
+	server.AddHandler("PSUBSCRIBE", h.handleSubscribe)
+	server.AddHandler("SSUBSCRIBE", h.handleSubscribe)
+	server.AddHandler("UNSUBSCRIBE", h.handleUnsubscribe)
+	server.AddHandler("PUNSUBSCRIBE", h.handleUnsubscribe)
+	server.AddHandler("SUNSUBSCRIBE", h.handleUnsubscribe)
+	server.AddHandler("PUBLISH", h.handlePublish)
+	server.AddHandler("SPUBLISH", h.handlePublish)
+	server.AddHandler("PUBSUB", h.handlePubsub)
+}
+
+// subscriptionKinds tells what the subscription commands subscribe to.
+var subscriptionKinds = map[string]subscriptionKind{
+	"SUBSCRIBE":    channelKind,
+	"UNSUBSCRIBE":  channelKind,
+	"PUBLISH":      channelKind,
+	"PSUBSCRIBE":   patternKind,
+	"PUNSUBSCRIBE": patternKind,
+	"SSUBSCRIBE":   shardChannelKind,
+	"SUNSUBSCRIBE": shardChannelKind,
+	"SPUBLISH":     shardChannelKind,
+}
+
+// handleSubscribe serves SUBSCRIBE channel..., PSUBSCRIBE pattern... and
+// SSUBSCRIBE channel..., that confirm every subscription with the number of
+// subscriptions of the client.
+func (h BaseHandler) handleSubscribe(req Request, rw ResponseWriter) {
+	kind := subscriptionKinds[req.Command.Name]
+	reply := []byte(strings.ToLower(req.Command.Name))
+	for _, name := range req.Command.Arguments {
+		count := h.server.pubsub.subscribe(req.Client, kind, string(name))
+		rw.Write(parser.PushData([]parser.Data{
+			parser.BulkStringData(reply),
+			parser.BulkStringData(name),
+			parser.IntegerData(count),
+		}).MarshalProto(req.Client.Proto()))
+	}
+}
+
+// handleUnsubscribe serves UNSUBSCRIBE, PUNSUBSCRIBE and SUNSUBSCRIBE, that
+// unsubscribe from all the subscriptions of their kind without arguments.
+func (h BaseHandler) handleUnsubscribe(req Request, rw ResponseWriter) {
+	kind := subscriptionKinds[req.Command.Name]
+	reply := []byte(strings.ToLower(req.Command.Name))
+	h.server.pubsub.unsubscribe(req.Client, kind, keyStrings(req.Command.Arguments), func(name string, count int) {
+		nameData := parser.NullData()
+		if name != "" {
+			nameData = parser.BulkStringData([]byte(name))
+		}
+		rw.Write(parser.PushData([]parser.Data{
+			parser.BulkStringData(reply),
+			nameData,
+			parser.IntegerData(count),
+		}).MarshalProto(req.Client.Proto()))
+	})
+}
+
+// handlePublish serves PUBLISH and SPUBLISH channel message, replies the
+// number of clients that received it. Subscribers that fell too far behind
+// are disconnected instead.
+func (h BaseHandler) handlePublish(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	received, slow := h.server.pubsub.publish(subscriptionKinds[req.Command.Name], args[0], args[1])
+	for _, client := range slow {
+		h.server.closeClient(client)
+	}
+	rw.Write(parser.IntegerData(received).Marshal())
+}
+
+// handlePubsub serves PUBSUB CHANNELS [pattern], NUMSUB [channel...], NUMPAT,
+// SHARDCHANNELS [pattern] and SHARDNUMSUB [channel...].
+func (h BaseHandler) handlePubsub(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	sub := strings.ToUpper(string(args[0]))
+	hub := h.server.pubsub
+	switch sub {
+	case "CHANNELS", "SHARDCHANNELS":
+		if len(args) > 2 {
+			break
+		}
+		kind := channelKind
+		if sub == "SHARDCHANNELS" {
+			kind = shardChannelKind
+		}
+		var pattern []byte
+		if len(args) == 2 {
+			pattern = args[1]
+		}
+		rw.Write(parser.ArrayData(stringsData(hub.names(kind, pattern))).Marshal())
+		return
+	case "NUMSUB", "SHARDNUMSUB":
+		kind := channelKind
+		if sub == "SHARDNUMSUB" {
+			kind = shardChannelKind
+		}
+		res := []parser.Data{}
+		for i, n := range hub.numSub(kind, args[1:]) {
+			res = append(res, parser.BulkStringData(args[i+1]), parser.IntegerData(n))
+		}
+		rw.Write(parser.MapData(res).MarshalProto(req.Client.Proto()))
+		return
+	case "NUMPAT":
+		if len(args) > 1 {
+			break
+		}
+		rw.Write(parser.IntegerData(hub.numPat()).Marshal())
+		return
+	default:
+		rw.Write(parser.ErrorData("ERR unknown subcommand '" + string(args[0]) + "'. Try PUBSUB HELP.").Marshal())
+		return
+	}
+	rw.Write(parser.ErrorData(wrongArgs("PUBSUB|" + sub)).Marshal())
+}
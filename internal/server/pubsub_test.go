@@ -0,0 +1,81 @@
+package server
+
+import (
+	"testing"
+)
+
+// push is the RESP3 form of an array of pub/sub.
+func push(elems ...string) string {
+	return ">" + array(elems...)[1:]
+}
+
+func TestSubscribe(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c, p := ts.connect(t), ts.connect(t)
+
+	c.expect(array(bulk("subscribe"), bulk("a"), integer(1)), "SUBSCRIBE", "a", "b")
+	if res, want := c.read(), array(bulk("subscribe"), bulk("b"), integer(2)); res != want {
+		t.Errorf("Wrong reply to the second channel. Have: %q, want: %q", res, want)
+	}
+	c.expect(array(bulk("psubscribe"), bulk("n*"), integer(3)), "PSUBSCRIBE", "n*")
+
+	p.expect(integer(1), "PUBLISH", "a", "hi")
+	if res, want := c.read(), array(bulk("message"), bulk("a"), bulk("hi")); res != want {
+		t.Errorf("Wrong message. Have: %q, want: %q", res, want)
+	}
+	p.expect(integer(1), "PUBLISH", "news", "hello")
+	if res, want := c.read(), array(bulk("pmessage"), bulk("n*"), bulk("news"), bulk("hello")); res != want {
+		t.Errorf("Wrong pattern message. Have: %q, want: %q", res, want)
+	}
+	p.expect(integer(0), "PUBLISH", "other", "hi")
+	c.noReply()
+
+	c.expect(array(bulk("unsubscribe"), bulk("a"), integer(2)), "UNSUBSCRIBE", "a")
+	p.expect(integer(0), "PUBLISH", "a", "hi")
+	c.send("UNSUBSCRIBE")
+	if res, want := c.read(), array(bulk("unsubscribe"), bulk("b"), integer(1)); res != want {
+		t.Errorf("Wrong reply to UNSUBSCRIBE. Have: %q, want: %q", res, want)
+	}
+	c.expect(array(bulk("punsubscribe"), bulk("n*"), integer(0)), "PUNSUBSCRIBE")
+	p.expect(integer(0), "PUBLISH", "news", "hi")
+}
+
+func TestSubscriberRestrictions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(array(bulk("subscribe"), bulk("a"), integer(1)), "SUBSCRIBE", "a")
+	c.expect("-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n", "GET", "key")
+	c.expect(array(bulk("pong"), bulk("")), "PING")
+	c.expect(array(bulk("pong"), bulk("hi")), "PING", "hi")
+
+	// the restrictions end with the last subscription
+	c.expect(array(bulk("unsubscribe"), bulk("a"), integer(0)), "UNSUBSCRIBE")
+	c.expect(nullBulk, "GET", "key")
+	c.expect("+PONG\r\n", "PING")
+}
+
+func TestResp3Push(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c, p := ts.connect(t), ts.connect(t)
+
+	c.send("HELLO", "3")
+	c.read()
+	c.expect(push(bulk("subscribe"), bulk("a"), integer(1)), "SUBSCRIBE", "a")
+	c.expect(push(bulk("psubscribe"), bulk("a*"), integer(2)), "PSUBSCRIBE", "a*")
+
+	// any command can run in between the messages, which are received
+	// once for the channel and once for the pattern
+	c.expect(null, "GET", "key")
+	p.expect(integer(2), "PUBLISH", "a", "hi")
+	if res, want := c.read(), push(bulk("message"), bulk("a"), bulk("hi")); res != want {
+		t.Errorf("Wrong message. Have: %q, want: %q", res, want)
+	}
+	if res, want := c.read(), push(bulk("pmessage"), bulk("a*"), bulk("a"), bulk("hi")); res != want {
+		t.Errorf("Wrong pattern message. Have: %q, want: %q", res, want)
+	}
+	c.expect("+PONG\r\n", "PING")
+}
@@ -1,27 +1,41 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/codecrafters-io/redis-starter-go/internal/aof"
 	"github.com/codecrafters-io/redis-starter-go/internal/commands"
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
 	"github.com/codecrafters-io/redis-starter-go/pkg/client"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
 	"github.com/looplab/fsm"
 )
 
 type ReplInfo struct {
 	Role       ServerRole `mapstructure:"role"`
 	ReplId     string     `mapstructure:"master_replid"`
+	ReplId2    string     `mapstructure:"master_replid2"`
 	ReplOffset int        `mapstructure:"master_repl_offset"`
+	// the history of ReplId2 is the one of ReplId up to this offset, the
+	// server was promoted there
+	SecondReplOffset int `mapstructure:"second_repl_offset"`
 }
 
-var replInfo ReplInfo
+// noReplId is the secondary replication ID of a server that wasn't promoted.
+const noReplId = "0000000000000000000000000000000000000000"
 
 type ServerRole string
 
@@ -31,6 +45,10 @@ type Replica struct {
 	Capas      []string
 	IsUp       bool
 	Offset     int
+	// while the replica gets the snapshot of a full resync the replication
+	// stream is buffered, it is sent after the snapshot
+	Syncing  bool
+	Buffered []byte
 }
 
 const (
@@ -43,22 +61,50 @@ const (
 )
 
 const (
-	OnStart = "onStart"
-	OnPong  = "onPong"
-	OnOk    = "onOk"
-	OnFsync = "onFsync"
+	OnStart    = "onStart"
+	OnPong     = "onPong"
+	OnOk       = "onOk"
+	OnFsync    = "onFsync"
+	OnContinue = "onContinue"
 )
 
 type ReplicaContext struct {
 	ListeningPort int
 	server        *Server
+	backlog       *replBacklog
+	dbs           *storage.Databases
+	mu            sync.Mutex
+	masterAddr    string
 	masterConn    net.Conn
 	handshakeFsm  *fsm.FSM
+	// the database the master selected when the link was lost, a partial
+	// resync continues in it
+	db int
+	// whether the handshake on the current connection is over, and the
+	// stream of the transaction the master is in the middle of
+	streaming bool
+	pendingTx []byte
+	promoted  bool
+	onPromote func(mc *MasterContext)
 }
 
 type MasterContext struct {
+	server      *Server
 	connHandler *ConnectionHandler
-	replicas    map[string]Replica
+	// guards replicas, used by the connections of the replicas, the
+	// propagation and the health check at the same time
+	mu       sync.Mutex
+	replicas map[string]Replica
+	backlog  *replBacklog
+	aof      *aof.AOF
+	dbs      *storage.Databases
+	// the database the propagated commands are applied to, -1 before the
+	// first SELECT
+	db int
+	// how the snapshot of a full resync is sent: written to a file in syncDir
+	// first, or streamed right to the replica
+	disklessSync bool
+	syncDir      string
 }
 
 const (
@@ -66,70 +112,295 @@ const (
 	Slave  ServerRole = "slave"
 )
 
-func NewMaster(connHandler *ConnectionHandler) *MasterContext {
-	replInfo = ReplInfo{
-		Role:       Master,
-		ReplId:     "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb",
-		ReplOffset: 0,
-	}
+// NewMaster starts a new replication history, backlogSize bytes of it are
+// kept for the replicas that reconnect.
+func NewMaster(server *Server, backlogSize int) *MasterContext {
+	server.updateReplInfo(func(repl *ReplInfo) {
+		*repl = ReplInfo{
+			Role:             Master,
+			ReplId:           newReplId(),
+			ReplId2:          noReplId,
+			ReplOffset:       0,
+			SecondReplOffset: -1,
+		}
+	})
+	return newMasterContext(server, newReplBacklog(backlogSize, 0))
+}
 
+func newMasterContext(server *Server, backlog *replBacklog) *MasterContext {
 	mc := MasterContext{
+		server:      server,
 		replicas:    make(map[string]Replica),
-		connHandler: connHandler,
+		connHandler: server.connHandler,
+		backlog:     backlog,
+		db:          -1,
+		syncDir:     ".",
 	}
 	go mc.HealthCheck()
 
 	return &mc
 }
 
-func (mc MasterContext) MasterCallChain(server *Server) *Node {
-	return NewNode(func(current *Node, request Request, rw ResponseWriter) error {
-		if request.Command.Type == commands.Write {
-			mc.Propagate(request.Raw)
+func newReplId() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		log.Fatalf("Failed to generate the replication ID: %s", err.Error())
+	}
+	return hex.EncodeToString(id)
+}
+
+// SetAOF makes the master log write commands to the append only file.
+func (mc *MasterContext) SetAOF(a *aof.AOF) {
+	mc.aof = a
+}
+
+// SetDatabases makes the master evict keys from the databases before write
+// commands when they are over their memory limit, and send them to the
+// replicas that do a full resync.
+func (mc *MasterContext) SetDatabases(dbs *storage.Databases) {
+	mc.dbs = dbs
+}
+
+// SetFullSync tells how the snapshot of a full resync is sent: streamed to
+// the replica if diskless, otherwise written to a temporary file in dir
+// first.
+func (mc *MasterContext) SetFullSync(diskless bool, dir string) {
+	mc.disklessSync = diskless
+	mc.syncDir = dir
+}
+
+// startFullSync returns the snapshot a replica that does a full resync must
+// get, and buffers the stream for it from now on. It must be called while no
+// command runs, at the offset sent with FULLRESYNC.
+func (mc *MasterContext) startFullSync(c net.Conn) *storage.Databases {
+	mc.updateReplica(c, func(r *Replica) {
+		r.Syncing = true
+		r.Buffered = nil
+	})
+	// the stream of the replica must start with a SELECT
+	mc.db = -1
+	return mc.dbs.Clone()
+}
+
+// finishFullSync sends the snapshot to the replica, then what was propagated
+// in the meantime, and makes it a regular replica.
+func (mc *MasterContext) finishFullSync(server *Server, c net.Conn, snapshot *storage.Databases) {
+	start := time.Now()
+	var err error
+	if mc.disklessSync {
+		err = sendDiskless(c, snapshot)
+	} else {
+		err = mc.sendFromDisk(c, snapshot)
+	}
+
+	server.Atomically(func() {
+		mc.mu.Lock()
+		defer mc.mu.Unlock()
+		replica, ok := mc.replicas[c.RemoteAddr().String()]
+		if !ok {
+			return
+		}
+		if err == nil {
+			_, err = c.Write(replica.Buffered)
 		}
-		current.Next(request, rw)
-		return nil
+		replica.Syncing = false
+		replica.Buffered = nil
+		replica.IsUp = err == nil
+		mc.replicas[c.RemoteAddr().String()] = replica
+	})
+	if err != nil {
+		log.Printf("Full resynchronization of %s failed: %s", c.RemoteAddr(), err.Error())
+		c.Close()
+		return
+	}
+	log.Printf("Full resynchronization of %s done in %s", c.RemoteAddr(), time.Since(start))
+}
+
+// sendDiskless streams the snapshot as it is encoded. Its length isn't known
+// in advance, so it is sent between random marks.
+func sendDiskless(c net.Conn, snapshot *storage.Databases) error {
+	mark := newReplId()
+	w := bufio.NewWriter(c)
+	fmt.Fprintf(w, "$EOF:%s\r\n", mark)
+	if err := WriteRDB(w, snapshot); err != nil {
+		return err
+	}
+	w.WriteString(mark)
+	return w.Flush()
+}
+
+// sendFromDisk writes the snapshot to a temporary file first, then sends it
+// as a bulk string without the trailing CRLF.
+func (mc *MasterContext) sendFromDisk(c net.Conn, snapshot *storage.Databases) error {
+	f, err := os.CreateTemp(mc.syncDir, fmt.Sprintf("temp-sync-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := WriteRDB(w, snapshot); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(c, "$%d\r\n", size); err != nil {
+		return err
+	}
+	_, err = io.Copy(c, f)
+	return err
+}
+
+// MasterCallChain runs the handlers first, so write commands are propagated
+// to replicas and the AOF the way the handlers rewrote them.
+func (mc *MasterContext) MasterCallChain(server *Server) *Node {
+	return NewNode(func(current *Node, request Request, rw ResponseWriter) error {
+		return current.Next(request, &errorRecorder{ResponseWriter: rw})
 	}).
+		SetNext(func(current *Node, request Request, rw ResponseWriter) error {
+			if errMsg := mc.freeMemory(server, request); errMsg != "" {
+				rw.Write(parser.ErrorData(errMsg).Marshal())
+				return nil
+			}
+			return current.Next(request, rw)
+		}).
 		SetNext(server.CallHandlers).
 		SetNext(func(current *Node, request Request, rw ResponseWriter) error {
-			_, isReplica := mc.replicas[request.Conn.RemoteAddr().String()]
-			if !isReplica && request.Command.Type == commands.Write {
-				return ReplOffsetMW(current, request, rw)
+			if request.Command.Type != commands.Write {
+				return current.Next(request, rw)
+			}
+
+			// a command that failed didn't change anything
+			if rec, ok := rw.(*errorRecorder); ok && rec.failed {
+				return current.Next(request, rw)
+			}
+
+			if cmd := request.Propagated(); len(cmd) > 0 {
+				mc.propagate(request.Client.callDB, cmd)
 			}
-			return nil
+			return current.Next(request, rw)
 		}).
 		First()
 }
 
+// propagate sends a write command run in the database db to the replicas and
+// the AOF, selecting the database first if it isn't the one of the previous
+// command.
+func (mc *MasterContext) propagate(db int, cmd []byte) {
+	if mc.aof != nil {
+		if err := mc.aof.Append(db, cmd); err != nil {
+			log.Printf("Error writing to the AOF: %s", err.Error())
+		}
+	}
+	if db != mc.db {
+		cmd = append(selectCommand(db), cmd...)
+		mc.db = db
+	}
+	mc.feed(cmd)
+}
+
+// feed adds to the replication stream.
+func (mc *MasterContext) feed(cmd []byte) {
+	mc.backlog.write(cmd)
+	mc.Propagate(cmd)
+	mc.server.updateReplInfo(func(repl *ReplInfo) {
+		repl.ReplOffset += len(cmd)
+	})
+}
+
+// partialSync returns what a replica that has the history replId up to
+// offset, the first byte it wants, missed. ok is false if the history is
+// another one or the backlog doesn't go back that far.
+func (mc *MasterContext) partialSync(replId string, offset int) (missed []byte, ok bool) {
+	repl := mc.server.GetReplInfo()
+	if replId != repl.ReplId && (replId != repl.ReplId2 || offset > repl.SecondReplOffset) {
+		return nil, false
+	}
+	return mc.backlog.since(offset - 1)
+}
+
+// requestAcks asks the replicas for their offset. Like in redis the request
+// is part of the replication stream, so it is counted in the offsets of the
+// master and the replicas alike.
+func (mc *MasterContext) requestAcks() {
+	mc.feed(parser.ArrayData(bulksData([][]byte{[]byte("REPLCONF"), []byte("GETACK"), []byte("*")})).Marshal())
+}
+
+// errorRecorder remembers whether the reply to a command is an error.
+type errorRecorder struct {
+	ResponseWriter
+	written bool
+	failed  bool
+}
+
+func (rw *errorRecorder) Write(data []byte) {
+	if !rw.written && len(data) > 0 {
+		rw.written = true
+		rw.failed = data[0] == byte(parser.Error) || data[0] == byte(parser.BlobError)
+	}
+	rw.ResponseWriter.Write(data)
+}
+
 func (mc *MasterContext) HealthCheck() {
 	t := time.NewTicker(time.Second * 30)
 	for range t.C {
-		for k := range mc.replicas {
-			if !mc.replicas[k].IsUp {
-				repl := mc.replicas[k]
-				c, err := net.Dial("tcp", repl.Conn.RemoteAddr().String())
-				if err == nil {
-					log.Printf("[HEALTHCHECK] Replica %s is UP again", k)
-					repl.Conn = c
-					repl.IsUp = true
-					mc.replicas[k] = repl
-				} else {
-					log.Println(err.Error())
-					continue
-				}
+		// the replicas are dialed without holding the lock
+		down := make(map[string]Replica)
+		mc.mu.Lock()
+		for k, repl := range mc.replicas {
+			if !repl.IsUp && !repl.Syncing {
+				down[k] = repl
 			}
 		}
+		mc.mu.Unlock()
+
+		for k, repl := range down {
+			c, err := net.Dial("tcp", repl.Conn.RemoteAddr().String())
+			if err != nil {
+				log.Println(err.Error())
+				continue
+			}
+			log.Printf("[HEALTHCHECK] Replica %s is UP again", k)
+			mc.mu.Lock()
+			repl, ok := mc.replicas[k]
+			if ok && !repl.IsUp && !repl.Syncing {
+				repl.Conn = c
+				repl.IsUp = true
+				mc.replicas[k] = repl
+			} else {
+				c.Close()
+			}
+			mc.mu.Unlock()
+		}
 	}
 }
 
 func (mc *MasterContext) MarkAsDown(addr string, msg string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	mc.markAsDown(addr, msg)
+}
+
+func (mc *MasterContext) markAsDown(addr string, msg string) {
 	log.Printf("[HEALTHCHECK] Replica %s is down: %s", addr, msg)
 	repl := mc.replicas[addr]
 	repl.IsUp = false
 	mc.replicas[addr] = repl
 }
 
-func (mc MasterContext) GetReplica(c net.Conn) (Replica, error) {
+func (mc *MasterContext) GetReplica(c net.Conn) (Replica, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	repl, ok := mc.replicas[c.RemoteAddr().String()]
 	if !ok {
 		return Replica{}, errors.New("No such replica")
@@ -137,11 +408,14 @@ func (mc MasterContext) GetReplica(c net.Conn) (Replica, error) {
 	return repl, nil
 }
 
-func (mc MasterContext) UpdateReplicasOffset(ctx context.Context) map[string]int {
+func (mc *MasterContext) UpdateReplicasOffset(ctx context.Context) map[string]int {
 	var mu sync.Mutex
 	var wg sync.WaitGroup
 	offsets := make(map[string]int)
-	for _, e := range mc.replicas {
+	for _, e := range mc.GetReplicas() {
+		if !e.IsUp {
+			continue
+		}
 		wg.Add(1)
 		go func(e Replica) {
 			defer wg.Done()
@@ -161,8 +435,9 @@ func (mc MasterContext) UpdateReplicasOffset(ctx context.Context) map[string]int
 	return offsets
 }
 
-func (mc MasterContext) FetchReplicaOffset(ctx context.Context, replica Replica) (int, error) {
-	client.Send(replica.Conn, []string{"REPLCONF", "GETACK", "*"})
+// FetchReplicaOffset waits for the reply of the replica to the last
+// requestAcks.
+func (mc *MasterContext) FetchReplicaOffset(ctx context.Context, replica Replica) (int, error) {
 	messages := mc.connHandler.GetMessages(replica.Conn.RemoteAddr().String())
 	select {
 	case <-ctx.Done():
@@ -172,12 +447,16 @@ func (mc MasterContext) FetchReplicaOffset(ctx context.Context, replica Replica)
 			return -1, errors.New("Messages channel is closed. Check replica's health.")
 		}
 
+		if msg.Err != nil {
+			return -1, errors.New(fmt.Sprintf("Unexpected response from the replica %s -- %s", replica.Conn.RemoteAddr().String(), msg.Err.Error()))
+		}
+
 		offsetStr, ok := msg.Command.Options["ACK"]
 		if msg.Command.Name != "REPLCONF" || !ok {
 			return -1, errors.New(fmt.Sprintf("Unexpected response from the replica %s -- %s", replica.Conn.RemoteAddr().String(), string(msg.Raw)))
 		}
 
-		offset, err := strconv.Atoi(offsetStr[0])
+		offset, err := strconv.Atoi(string(offsetStr[0]))
 		if err != nil {
 			return -1, errors.New(fmt.Sprintf("Unexpected response from the replica %s -- %s", replica.Conn.RemoteAddr().String(), string(msg.Raw)))
 		}
@@ -185,7 +464,9 @@ func (mc MasterContext) FetchReplicaOffset(ctx context.Context, replica Replica)
 	}
 }
 
-func (mc MasterContext) GetReplicas() (res []Replica) {
+func (mc *MasterContext) GetReplicas() (res []Replica) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	for _, v := range mc.replicas {
 		res = append(res, v)
 	}
@@ -193,53 +474,261 @@ func (mc MasterContext) GetReplicas() (res []Replica) {
 }
 
 func (mc *MasterContext) SetReplica(replica Replica) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	mc.replicas[replica.Conn.RemoteAddr().String()] = replica
 }
 
+// updateReplica changes the replica of the connection c with fn, adding it
+// if it isn't known yet.
+func (mc *MasterContext) updateReplica(c net.Conn, fn func(r *Replica)) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	repl, ok := mc.replicas[c.RemoteAddr().String()]
+	if !ok {
+		repl = Replica{Conn: c}
+	}
+	fn(&repl)
+	mc.replicas[c.RemoteAddr().String()] = repl
+}
+
 func (mc *MasterContext) Propagate(req []byte) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
 	log.Printf("Propagating to %d replicas", len(mc.replicas))
 	for i, r := range mc.replicas {
+		if r.Syncing {
+			r.Buffered = append(r.Buffered, req...)
+			mc.replicas[i] = r
+			continue
+		}
 		if r.IsUp {
 			log.Printf("Propagating to %s", r.Conn.RemoteAddr())
 			_, err := r.Conn.Write(req)
 			if err != nil {
-				mc.MarkAsDown(i, "Error writing to the connection")
+				mc.markAsDown(i, "Error writing to the connection")
 				continue
 			}
 		}
 	}
 }
 
-func GetReplInfo() ReplInfo {
-	return replInfo
+func (s *Server) GetReplInfo() ReplInfo {
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+	return s.repl
 }
 
-func ReplOffsetMW(current *Node, request Request, rw ResponseWriter) error {
-	replInfo.ReplOffset += len(request.Raw)
-	current.Next(request, rw)
-	return nil
+// updateReplInfo changes the replication info with fn, which must not read
+// it through GetReplInfo.
+func (s *Server) updateReplInfo(fn func(repl *ReplInfo)) {
+	s.replMu.Lock()
+	defer s.replMu.Unlock()
+	fn(&s.repl)
 }
 
-func UpdateReplInfo(replId string, replOffset int) {
-	replInfo.ReplId = replId
-	replInfo.ReplOffset = replOffset
+// UpdateReplInfo starts following the history of a master after a full
+// resync, which has nothing to do with any previous one.
+func (s *Server) UpdateReplInfo(replId string, replOffset int) {
+	s.updateReplInfo(func(repl *ReplInfo) {
+		repl.ReplId = replId
+		repl.ReplId2 = noReplId
+		repl.ReplOffset = replOffset
+		repl.SecondReplOffset = -1
+	})
 }
 
-func NewReplica(sv *Server, c net.Conn, listeningPort int) (*ReplicaContext, error) {
+// NewReplica replicates the master at masterAddr once Run is called, keeping
+// backlogSize bytes of the replication stream in case it is promoted.
+func NewReplica(sv *Server, masterAddr string, listeningPort int, backlogSize int) (*ReplicaContext, error) {
 	rc := &ReplicaContext{
 		ListeningPort: listeningPort,
 		server:        sv,
-		masterConn:    c,
+		backlog:       newReplBacklog(backlogSize, 0),
+		masterAddr:    masterAddr,
 	}
 	rc.setHandshakeFsm()
 
-	replInfo = ReplInfo{
-		Role: Slave,
-	}
+	sv.updateReplInfo(func(repl *ReplInfo) {
+		*repl = ReplInfo{
+			Role:             Slave,
+			ReplId2:          noReplId,
+			SecondReplOffset: -1,
+		}
+	})
+	sv.SetProcessedHook(rc.countOffset)
 
 	return rc, nil
 }
 
+// SetDatabases makes the replica load the snapshots of full resyncs into
+// the databases.
+func (rc *ReplicaContext) SetDatabases(dbs *storage.Databases) {
+	rc.dbs = dbs
+}
+
+// loadSnapshot replaces the keys of every database with the ones of the
+// snapshot of a full resync, before the stream that follows it is applied.
+func (rc *ReplicaContext) loadSnapshot(payload []byte) (int, error) {
+	var n int
+	var err error
+	rc.server.Atomically(func() {
+		rc.dbs.FlushAll()
+		n, err = LoadRDB(bytes.NewReader(payload), rc.dbs)
+	})
+	return n, err
+}
+
+// OnPromote registers fn to set up the master the replica becomes with
+// REPLICAOF NO ONE, before it accepts any command. fn runs while no command
+// does.
+func (rc *ReplicaContext) OnPromote(fn func(mc *MasterContext)) {
+	rc.onPromote = fn
+}
+
+// Run keeps the link to the master up until ctx is done or the replica is
+// promoted. After losing the connection the replica reconnects and asks to
+// continue the replication where it stopped.
+func (rc *ReplicaContext) Run(ctx context.Context) {
+	for {
+		rc.mu.Lock()
+		addr, promoted := rc.masterAddr, rc.promoted
+		rc.mu.Unlock()
+		if promoted {
+			return
+		}
+
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			log.Printf("Error connecting to the master %s: %s", addr, err.Error())
+		} else {
+			rc.serveMaster(ctx, c)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// serveMaster does the handshake on a new connection to the master and
+// applies the replication stream until the connection is lost.
+func (rc *ReplicaContext) serveMaster(ctx context.Context, c net.Conn) {
+	rc.mu.Lock()
+	rc.masterConn = c
+	rc.streaming = false
+	rc.pendingTx = nil
+	rc.setHandshakeFsm()
+	rc.mu.Unlock()
+
+	client, clientCtx := rc.server.AddClient(ctx, c)
+	client.master = true
+	rc.InitHandshake()
+	rc.server.Serve(clientCtx, client)
+
+	rc.mu.Lock()
+	rc.db = client.db
+	rc.mu.Unlock()
+	log.Printf("Lost the connection to the master %s", c.RemoteAddr().String())
+}
+
+func (rc *ReplicaContext) isMaster(c net.Conn) bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return c != nil && c == rc.masterConn
+}
+
+// countOffset adds what the master sent to the offset and the backlog, once
+// it was handled so REPLCONF GETACK replies with the offset before it. A
+// transaction is counted when it ends: a replica that loses the link in the
+// middle of it gets all of it again, as its new connection isn't in the
+// transaction.
+func (rc *ReplicaContext) countOffset(req Request) {
+	if !rc.isMaster(req.Conn) {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.streaming {
+		// the stream starts after the reply that ends the handshake
+		rc.streaming = rc.handshakeFsm.Current() == Done
+		return
+	}
+
+	if req.Client.multi != nil {
+		rc.pendingTx = append(rc.pendingTx, req.Raw...)
+		return
+	}
+	stream := req.Raw
+	if rc.pendingTx != nil {
+		stream = append(rc.pendingTx, req.Raw...)
+		rc.pendingTx = nil
+	}
+	rc.server.updateReplInfo(func(repl *ReplInfo) {
+		repl.ReplOffset += len(stream)
+	})
+	rc.backlog.write(stream)
+}
+
+// setMaster makes the replica replicate another master. The connection to
+// the current one is closed and Run connects to the new one, trying to
+// continue the replication from where it stopped.
+func (rc *ReplicaContext) setMaster(addr string) {
+	rc.mu.Lock()
+	rc.masterAddr = addr
+	conn := rc.masterConn
+	rc.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// promote turns the replica into a master. Its history goes on under a new
+// replication ID and the one of its master becomes the secondary ID, so the
+// other replicas of its master can continue from the backlog.
+func (rc *ReplicaContext) promote() {
+	rc.server.Atomically(func() {
+		rc.mu.Lock()
+		rc.promoted = true
+		conn := rc.masterConn
+		rc.masterConn = nil
+		rc.mu.Unlock()
+		if conn != nil {
+			conn.Close()
+		}
+
+		var repl ReplInfo
+		rc.server.updateReplInfo(func(old *ReplInfo) {
+			replId2, secondOffset := noReplId, -1
+			if old.ReplId != "" {
+				replId2, secondOffset = old.ReplId, old.ReplOffset+1
+			}
+			*old = ReplInfo{
+				Role:             Master,
+				ReplId:           newReplId(),
+				ReplId2:          replId2,
+				ReplOffset:       old.ReplOffset,
+				SecondReplOffset: secondOffset,
+			}
+			repl = *old
+		})
+		log.Printf("Promoted to master, the history of %s continues as %s", repl.ReplId2, repl.ReplId)
+
+		mc := newMasterContext(rc.server, rc.backlog)
+		if rc.onPromote != nil {
+			rc.onPromote(mc)
+		}
+		rc.server.SetRwProvider(func(c net.Conn) ResponseWriter {
+			return NewBasicResponseWriter(c)
+		})
+		rc.server.SetProcessedHook(nil)
+		rc.server.SetCallChain(mc.MasterCallChain(rc.server))
+		RouteMaster(rc.server, mc)
+	})
+}
+
 func (rc *ReplicaContext) InitHandshake() {
 	rc.handshakeFsm.Event(context.Background(), OnStart)
 }
@@ -253,31 +742,25 @@ func (rc *ReplicaContext) setHandshakeFsm() {
 			{Name: OnOk, Src: []string{ReplconfLP}, Dst: ReplconfCapa},
 			{Name: OnOk, Src: []string{ReplconfCapa}, Dst: Psync},
 			{Name: OnFsync, Src: []string{Psync}, Dst: Done},
+			{Name: OnContinue, Src: []string{Psync}, Dst: Done},
 		},
 		fsm.Callbacks{
 			Ping:         func(_ context.Context, e *fsm.Event) { pingMaster(rc.masterConn) },
 			ReplconfLP:   func(_ context.Context, e *fsm.Event) { setListeningPort(rc.masterConn, rc.ListeningPort) },
 			ReplconfCapa: func(_ context.Context, e *fsm.Event) { setCapabilities(rc.masterConn) },
-			Psync:        func(_ context.Context, e *fsm.Event) { psync(rc.masterConn) },
-			Done: func(ctx context.Context, e *fsm.Event) {
-				rc.server.SetCallChain(
-					NewNode(rc.server.CallHandlers).
-						SetNext(ReplOffsetMW).
-						First(),
-				)
-			},
+			Psync:        func(_ context.Context, e *fsm.Event) { psync(rc.masterConn, rc.server.GetReplInfo()) },
 		})
 }
 
-func (rc ReplicaContext) ReplicaRwProvider(c net.Conn) ResponseWriter {
-	if c == rc.masterConn {
+func (rc *ReplicaContext) ReplicaRwProvider(c net.Conn) ResponseWriter {
+	if rc.isMaster(c) {
 		return SilentResponseWriter{}
 	} else {
 		return NewBasicResponseWriter(c)
 	}
 }
 
-func (rc ReplicaContext) Event(name string) error {
+func (rc *ReplicaContext) Event(name string) error {
 	return rc.handshakeFsm.Event(context.Background(), name)
 }
 
@@ -296,7 +779,12 @@ func setCapabilities(c net.Conn) {
 	client.Send(c, []string{"REPLCONF", "capa", "psync2"})
 }
 
-func psync(c net.Conn) {
+// psync asks to continue the history the replica has, if it has one.
+func psync(c net.Conn, info ReplInfo) {
 	log.Println("Psync")
-	client.Send(c, []string{"PSYNC", "?", "-1"})
+	replId, offset := "?", "-1"
+	if info.ReplId != "" {
+		replId, offset = info.ReplId, strconv.Itoa(info.ReplOffset+1)
+	}
+	client.Send(c, []string{"PSYNC", replId, offset})
 }
@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/aof"
+	"github.com/codecrafters-io/redis-starter-go/internal/commands"
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/client"
+)
+
+// streamReader connects to the master as a replica and returns once the
+// snapshot of the full resync was received, what it reads next is the
+// replication stream.
+func streamReader(t *testing.T, master *testServer) *testClient {
+	t.Helper()
+	c := master.connect(t)
+	c.expect(ok, "REPLCONF", "listening-port", "0")
+	c.send("PSYNC", "?", "-1")
+	if res := c.read(); !strings.HasPrefix(res, "+FULLRESYNC") {
+		t.Fatalf("Wrong reply to PSYNC: %q", res)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	if _, err := c.dec.DecodeBulkPayload(); err != nil {
+		t.Fatal(err.Error())
+	}
+	return c
+}
+
+// readCommands returns the next n commands of a replication stream, with
+// their arguments separated by spaces.
+func (c *testClient) readCommands(n int) []string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.conn.SetReadDeadline(time.Time{})
+	var res []string
+	for i := 0; i < n; i++ {
+		data, err := c.dec.Decode()
+		if err != nil {
+			c.t.Fatalf("Missing command in the stream: %s", err.Error())
+		}
+		res = append(res, string(bytes.Join(data.Flat(), []byte(" "))))
+	}
+	return res
+}
+
+// waitForSync waits until the replica applied all the stream of the master.
+func waitForSync(t *testing.T, master *testClient, replica *testClient) {
+	t.Helper()
+	waitFor(t, "The replica didn't catch up with the master", func() bool {
+		return replica.replOffset() == master.replOffset()
+	})
+}
+
+// dropLink closes the connection of the replica to its master, it reconnects
+// and asks to continue from its offset.
+func dropLink(t *testing.T, replica *testServer) {
+	replica.rc.mu.Lock()
+	conn := replica.rc.masterConn
+	replica.rc.mu.Unlock()
+	if conn == nil {
+		t.Fatal("The replica isn't connected")
+	}
+	conn.Close()
+}
+
+// markDataset adds a key the master doesn't know to the replica, which only a
+// full resync removes.
+func markDataset(replica *testServer) {
+	replica.sv.Atomically(func() {
+		replica.dbs.DB(0).Set("replica-only", []byte("1"))
+	})
+}
+
+func TestTransactionOffsetAfterPartialResync(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	replica := startReplica(t, master)
+	m, r := master.connect(t), replica.connect(t)
+
+	m.expect(ok, "SET", "a", "1")
+	m.expect(ok, "MULTI")
+	m.expect(queued, "INCR", "a")
+	m.expect(queued, "INCR", "a")
+	m.expect(array(integer(2), integer(3)), "EXEC")
+	waitForSync(t, m, r)
+	r.expect(bulk("3"), "GET", "a")
+
+	markDataset(replica)
+	dropLink(t, replica)
+	m.expect(integer(4), "INCR", "a")
+	waitForSync(t, m, r)
+
+	r.expect(bulk("4"), "GET", "a")
+	r.expect(integer(1), "EXISTS", "replica-only")
+}
+
+// sameState checks that the master and the replica reply the same to the
+// read commands run in each database.
+func sameState(t *testing.T, master *testClient, replica *testClient, reads map[string][][]string) {
+	t.Helper()
+	for db, cmds := range reads {
+		master.expect(ok, "SELECT", db)
+		replica.expect(ok, "SELECT", db)
+		for _, cmd := range append(cmds, []string{"DBSIZE"}) {
+			if want, res := master.do(cmd...), replica.do(cmd...); res != want {
+				t.Errorf("Wrong reply of the replica to %v in db %s. Have: %q, want: %q", cmd, db, res, want)
+			}
+		}
+	}
+}
+
+func TestPartialResyncState(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	replica := startReplica(t, master)
+	m, r := master.connect(t), replica.connect(t)
+
+	m.expect(ok, "SET", "str", "1")
+	m.expect(integer(3), "RPUSH", "list", "a", "b", "c")
+	m.expect(ok, "SELECT", "3")
+	m.expect(integer(2), "HSET", "hash", "f1", "v1", "f2", "v2")
+	waitForSync(t, m, r)
+	markDataset(replica)
+
+	// the replica continues in the database selected before the link was
+	// lost
+	dropLink(t, replica)
+	m.expect(integer(1), "HSET", "hash", "f3", "v3")
+	m.expect(ok, "SET", "session", "x", "EX", "100")
+	m.expect(integer(2), "ZADD", "zset", "1", "a", "2", "b")
+	m.expect(ok, "SELECT", "0")
+	m.expect(bulk("a"), "LPOP", "list")
+	m.expect(integer(2), "INCR", "str")
+	m.expect(integer(1), "DEL", "missing", "str")
+	waitForSync(t, m, r)
+
+	r.expect(integer(1), "EXISTS", "replica-only")
+	replica.sv.Atomically(func() {
+		replica.dbs.DB(0).Delete("replica-only")
+	})
+	sameState(t, m, r, map[string][][]string{
+		"0": {{"GET", "str"}, {"LRANGE", "list", "0", "-1"}},
+		"3": {
+			{"HGET", "hash", "f1"}, {"HGET", "hash", "f3"}, {"HLEN", "hash"},
+			{"GET", "session"}, {"PEXPIRETIME", "session"},
+			{"ZRANGE", "zset", "0", "-1", "WITHSCORES"},
+		},
+	})
+	if res, want := r.replOffset(), m.replOffset(); res != want {
+		t.Errorf("Wrong replica offset. Have: %d, want: %d", res, want)
+	}
+}
+
+func TestWait(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	replica := startReplica(t, master)
+	m, r := master.connect(t), replica.connect(t)
+
+	m.expect(ok, "SET", "a", "1")
+	waitForSync(t, m, r)
+	m.expect(ok, "SET", "b", "2")
+	m.expect(integer(1), "WAIT", "1", "1000")
+	r.expect(bulk("2"), "GET", "b")
+}
+
+func TestPromoteWhileServing(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	replica := startReplica(t, master)
+	replica.rc.OnPromote(func(mc *MasterContext) {
+		mc.SetDatabases(replica.dbs)
+	})
+	m, r := master.connect(t), replica.connect(t)
+	m.expect(ok, "SET", "a", "1")
+	waitForSync(t, m, r)
+
+	// the other clients keep sending commands while the routing changes
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		c := replica.connect(t)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := client.Send(c.conn, []string{"GET", "a"}); err != nil {
+					return
+				}
+				if _, err := c.readTimeout(2 * time.Second); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	r.expect(ok, "REPLICAOF", "NO", "ONE")
+	close(done)
+	wg.Wait()
+
+	if res := r.info("replication", "role"); res != "master" {
+		t.Errorf("Wrong role after the promotion. Have: %q", res)
+	}
+	r.expect(ok, "SET", "a", "2")
+	r.expect(bulk("2"), "GET", "a")
+}
+
+func TestReplInfoWhileWriting(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	replica := startReplica(t, master)
+	m, r := master.connect(t), replica.connect(t)
+	m.expect(ok, "SET", "a", "1")
+	waitForSync(t, m, r)
+
+	// the offsets move while INFO and WAIT read them
+	writer := master.connect(t)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if err := client.Send(writer.conn, []string{"INCR", "n"}); err != nil {
+				return
+			}
+			if _, err := writer.readTimeout(2 * time.Second); err != nil {
+				return
+			}
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		m.replOffset()
+		r.replOffset()
+		m.do("WAIT", "1", "10")
+	}
+	wg.Wait()
+
+	waitForSync(t, m, r)
+	r.expect(bulk("200"), "GET", "n")
+}
+
+func TestPromoteRewritesAOF(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	replica := startReplica(t, master)
+	a, err := aof.Open(filepath.Join(t.TempDir(), "appendonly.aof"), aof.No)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { a.Close() })
+	// left by a previous run, the full resync replaced it
+	a.Append(0, []byte("*3\r\n$3\r\nSET\r\n$5\r\nstale\r\n$1\r\n1\r\n"))
+	p := NewPersistence(replica.sv, replica.dbs, t.TempDir(), "dump.rdb")
+	p.SetAOF(a)
+	replica.rc.OnPromote(func(mc *MasterContext) {
+		mc.SetAOF(a)
+		mc.SetDatabases(replica.dbs)
+		if err := p.RewriteAOF(); err != nil {
+			t.Error(err.Error())
+		}
+	})
+	m, r := master.connect(t), replica.connect(t)
+
+	m.expect(ok, "SET", "a", "1")
+	m.expect(ok, "SELECT", "1")
+	m.expect(integer(1), "RPUSH", "list", "x")
+	waitForSync(t, m, r)
+	r.expect(ok, "REPLICAOF", "NO", "ONE")
+	r.expect(ok, "SET", "b", "2")
+
+	// the log has the dataset of the promotion and the writes after it
+	dbs := storage.NewDatabases(16)
+	loaded := NewServer(NewConnectionHandler(commands.NewCommandParser(table)))
+	RouteBasic(loaded, dbs)
+	waitFor(t, "The log wasn't rewritten", func() bool {
+		dbs.FlushAll()
+		_, err := aof.Load(a.Path(), func(r io.Reader) error {
+			_, err := LoadRDB(r, dbs)
+			return err
+		}, loaded.Exec)
+		// the writes go to the old log until the new one replaces it
+		return err == nil && dbs.DB(0).Exists("stale") == 0
+	})
+	if dbs.DB(0).Exists("b") != 1 {
+		t.Error("The log is missing the write after the promotion")
+	}
+	if dbs.DB(0).Exists("a") != 1 || dbs.DB(1).Exists("list") != 1 {
+		t.Error("The log is missing the replicated keys")
+	}
+}
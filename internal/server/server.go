@@ -7,6 +7,9 @@ import (
 	"sync"
 
 	"net"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/commands"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
 )
 
 type HandlerFunc func(req Request, rw ResponseWriter)
@@ -24,19 +27,57 @@ type Server struct {
 	callChain   *Node
 	connHandler *ConnectionHandler
 	rwProvider  func(c net.Conn) ResponseWriter
-	mu          sync.RWMutex
-	clients     map[string]Client
-	quit        chan struct{}
+	// guards the clients and how commands are routed, which changes while
+	// they are served when a replica is promoted
+	mu       sync.RWMutex
+	execMu   sync.RWMutex
+	clients  map[string]*Client
+	lastId   int64
+	blocking *blockingManager
+	pubsub   *pubsubHub
+	watches  *watchManager
+	quit     chan struct{}
+	// runs the commands passed to Exec
+	execClient *Client
+	// the role of the server and its position in the replication stream,
+	// read by INFO and WAIT while the stream is applied
+	repl   ReplInfo
+	replMu sync.Mutex
+	// called with every message of a connection once it was handled
+	processed func(req Request)
 }
 
 type Client struct {
+	id    int64
+	name  string
+	proto int
+	// the selected database, and the one the current command started in,
+	// where it is propagated from
+	db           int
+	callDB       int
 	conn         net.Conn
 	messages     chan Message
 	stopHandling context.CancelFunc
+	// what the current request is propagated as, if a handler rewrote it
+	rewritten bool
+	rewrite   []byte
+	// set by a handler that has to wait for keys to be written to
+	block *blockState
+	// messages that arrived while the client was blocked
+	pending []Message
+	// what was published to the client and not written yet
+	outbox *outbox
+	// the commands queued since MULTI, nil outside of a transaction
+	multi *transaction
+	// set while EXEC runs the queued commands, holding the exec lock
+	inExec bool
+	// the connection of a replica to its master
+	master bool
 }
 
 type Request struct {
-	Conn net.Conn
+	Conn   net.Conn
+	Client *Client
 	Message
 }
 
@@ -73,6 +114,37 @@ func (rw SilentResponseWriter) Release() error {
 	return nil
 }
 
+func (c *Client) Id() int64 {
+	return c.id
+}
+
+func (c *Client) Proto() int {
+	return c.proto
+}
+
+// RewriteCommand replaces the request with the given command in what is sent
+// to replicas and written to the AOF. Calling it again adds another command.
+func (r Request) RewriteCommand(args ...[]byte) {
+	r.Client.rewritten = true
+	r.Client.rewrite = append(r.Client.rewrite, parser.ArrayData(bulksData(args)).Marshal()...)
+}
+
+// PreventPropagation keeps the request out of the replication stream and the
+// AOF, like a write command that didn't change anything.
+func (r Request) PreventPropagation() {
+	r.Client.rewritten = true
+	r.Client.rewrite = nil
+}
+
+// Propagated returns the request as it must be propagated, empty if it must
+// not be.
+func (r Request) Propagated() []byte {
+	if r.Client.rewritten {
+		return r.Client.rewrite
+	}
+	return r.Raw
+}
+
 func NewNode(nodeFunc NodeFunc) *Node {
 	return &Node{
 		handle: nodeFunc,
@@ -130,8 +202,11 @@ func NewServer(connHandler *ConnectionHandler) *Server {
 		rwProvider: func(c net.Conn) ResponseWriter {
 			return NewBasicResponseWriter(c)
 		},
-		clients: make(map[string]Client),
-		quit:    make(chan struct{}),
+		clients:  make(map[string]*Client),
+		blocking: newBlockingManager(),
+		pubsub:   newPubsubHub(),
+		watches:  newWatchManager(),
+		quit:     make(chan struct{}),
 	}
 
 	sv.SetCallChain(NewNode(sv.CallHandlers))
@@ -139,16 +214,28 @@ func NewServer(connHandler *ConnectionHandler) *Server {
 }
 
 func (s *Server) SetCallChain(first *Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.callChain = first
 }
 
-func (s *Server) AddClient(ctx context.Context, c net.Conn) (Client, context.Context) {
+func (s *Server) getCallChain() *Node {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.callChain
+}
+
+func (s *Server) AddClient(ctx context.Context, c net.Conn) (*Client, context.Context) {
 	clientCtx, cancel := context.WithCancel(ctx)
 	s.mu.Lock()
-	client := Client{
+	s.lastId++
+	client := &Client{
+		id:           s.lastId,
+		proto:        parser.Resp2,
 		conn:         c,
 		stopHandling: cancel,
 		messages:     s.connHandler.InitNewConn(c),
+		outbox:       newOutbox(),
 	}
 	s.clients[c.RemoteAddr().String()] = client
 	s.mu.Unlock()
@@ -157,10 +244,16 @@ func (s *Server) AddClient(ctx context.Context, c net.Conn) (Client, context.Con
 
 func (s *Server) StopHandling(c net.Conn) {
 	s.mu.Lock()
-	client := s.clients[c.RemoteAddr().String()]
-	client.stopHandling()
-	delete(s.clients, c.RemoteAddr().String())
+	client, ok := s.clients[c.RemoteAddr().String()]
+	if ok {
+		client.stopHandling()
+		delete(s.clients, c.RemoteAddr().String())
+	}
 	s.mu.Unlock()
+	if ok {
+		s.pubsub.unsubscribeAll(client)
+		s.watches.unwatch(client)
+	}
 }
 
 func (s *Server) Listen(ctx context.Context, addr string) {
@@ -199,15 +292,38 @@ func (s *Server) Listen(ctx context.Context, addr string) {
 }
 
 func (s *Server) AddHandler(name string, handler HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.handlers[name] = handler
 }
 
 func (s *Server) SetRwProvider(rwProvider func(c net.Conn) ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.rwProvider = rwProvider
 }
 
+// SetProcessedHook registers fn to be called with every message read from a
+// connection once it was handled, including the ones queued by MULTI or
+// rejected before running.
+func (s *Server) SetProcessedHook(fn func(req Request)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.processed = fn
+}
+
+// routing returns how the messages of c are replied to and the hook that
+// follows them.
+func (s *Server) routing(c net.Conn) (ResponseWriter, func(req Request)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rwProvider(c), s.processed
+}
+
 func (s *Server) CallHandlers(current *Node, req Request, rw ResponseWriter) error {
+	s.mu.RLock()
 	handler, ok := s.handlers[req.Command.Name]
+	s.mu.RUnlock()
 	if ok {
 		handler(req, rw)
 		current.Next(req, rw)
@@ -215,21 +331,136 @@ func (s *Server) CallHandlers(current *Node, req Request, rw ResponseWriter) err
 	return nil
 }
 
-func (s *Server) Serve(ctx context.Context, client Client) {
-	go s.connHandler.Handle(context.Background(), client.conn, client.messages)
+// Atomically runs fn while no read or write command is being executed.
+func (s *Server) Atomically(fn func()) {
+	s.execMu.Lock()
+	defer s.execMu.Unlock()
+	fn()
+}
+
+// AtomicallyFor is Atomically for a command of client, nil if there is none.
+// The commands of a transaction already run alone, so fn runs right away.
+func (s *Server) AtomicallyFor(client *Client, fn func()) {
+	if client != nil && client.inExec {
+		fn()
+		return
+	}
+	s.Atomically(fn)
+}
+
+// call runs the command. Write commands run one at a time, so they are
+// propagated in the same order they are applied. Returns the waiter if the
+// command blocked the client.
+func (s *Server) call(req Request, rw ResponseWriter) *waiter {
+	switch req.Command.Type {
+	case commands.Write:
+		s.execMu.Lock()
+		defer s.execMu.Unlock()
+	case commands.Read:
+		s.execMu.RLock()
+		defer s.execMu.RUnlock()
+	}
+
+	req.Client.rewritten = false
+	req.Client.rewrite = nil
+	req.Client.block = nil
+	req.Client.callDB = req.Client.db
+	s.getCallChain().Call(req, rw)
+
+	var w *waiter
+	if req.Client.block != nil {
+		if args := req.Client.block.args; args != nil {
+			cmd := *req.Command
+			cmd.Arguments = args
+			req.Command = &cmd
+		}
+		w = &waiter{req: req, block: req.Client.block, reply: make(chan []byte, 1)}
+		req.Client.block = nil
+		s.blocking.add(w)
+	}
+	if req.Command.Type == commands.Write {
+		s.serveBlocked()
+	}
+	return w
+}
+
+// Exec runs a command that doesn't come from any connection, like the ones
+// replayed from the AOF. Replies are discarded and the call chain is skipped.
+// The commands share a client, so a SELECT applies to the ones after it.
+func (s *Server) Exec(args [][]byte) error {
+	cmd, err := s.connHandler.cmdParser.ParseCommand(args)
+	if err != nil {
+		return err
+	}
+
+	if s.execClient == nil {
+		s.execClient = &Client{proto: parser.Resp2}
+	}
+	req := Request{
+		Client: s.execClient,
+		Message: Message{
+			Command: &cmd,
+		},
+	}
+	return NewNode(s.CallHandlers).Call(req, SilentResponseWriter{})
+}
+
+func (s *Server) Serve(ctx context.Context, client *Client) {
+	go s.connHandler.Handle(context.Background(), client.conn, client.messages, client.master)
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		case msg := <-client.messages:
-			log.Printf("[%s]: %q", client.conn.RemoteAddr().String(), msg.Raw)
-			req := Request{
-				Conn:    client.conn,
-				Message: msg,
+		var msg Message
+		if len(client.pending) > 0 {
+			msg, client.pending = client.pending[0], client.pending[1:]
+		} else {
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-client.outbox.ready:
+				client.outbox.flush(client)
+				continue
+			case msg, ok = <-client.messages:
+			}
+			if !ok {
+				s.closeClient(client)
+				return
 			}
-			rw := s.rwProvider(client.conn)
-			s.callChain.Call(req, rw)
-			rw.Release()
+		}
+
+		log.Printf("[%s]: %q", client.conn.RemoteAddr().String(), msg.Raw)
+		req := Request{
+			Conn:    client.conn,
+			Client:  client,
+			Message: msg,
+		}
+		rw, processed := s.routing(client.conn)
+		if msg.Err != nil {
+			client.abortTransaction()
+			rw.Write(parser.ErrorData(msg.Err.Error()).Marshal())
+		} else if errMsg := s.checkSubscriber(req); errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+		} else if s.queue(req, rw) {
+			// replied QUEUED, run by EXEC
+		} else if w := s.call(req, rw); w != nil {
+			reply, ok := s.waitUnblocked(ctx, client, w)
+			if !ok {
+				if ctx.Err() == nil {
+					s.closeClient(client)
+				}
+				return
+			}
+			rw.Write(reply)
+		}
+		rw.Release()
+		if processed != nil {
+			processed(req)
 		}
 	}
 }
+
+func (s *Server) closeClient(client *Client) {
+	log.Printf("Closed: %s", client.conn.RemoteAddr().String())
+	s.StopHandling(client.conn)
+	s.connHandler.DeleteConn(client.conn.RemoteAddr().String())
+	client.conn.Close()
+}
@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/commands"
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/client"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+var table map[string]commands.CommandInfo
+
+func TestMain(m *testing.M) {
+	setup()
+	code := m.Run()
+	os.Exit(code)
+}
+
+func setup() {
+	path, err := filepath.Abs("../../cmds.json")
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+
+	table, err = commands.LoadJSON(path)
+	if err != nil {
+		log.Println(err.Error())
+		os.Exit(1)
+	}
+	log.SetOutput(io.Discard)
+}
+
+// testServer is a server listening on a free local port until the end of
+// the test.
+type testServer struct {
+	sv   *Server
+	dbs  *storage.Databases
+	addr string
+	port int
+	ctx  context.Context
+	mc   *MasterContext
+	rc   *ReplicaContext
+}
+
+func newTestServer(t *testing.T) *testServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	addr := l.Addr().String()
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	sv := NewServer(NewConnectionHandler(commands.NewCommandParser(table)))
+	dbs := storage.NewDatabases(16)
+	RouteBasic(sv, dbs)
+	return &testServer{sv: sv, dbs: dbs, addr: addr, port: port, ctx: ctx}
+}
+
+// listen serves the connections once the server is set up.
+func (ts *testServer) listen(t *testing.T) {
+	go ts.sv.Listen(ts.ctx, ts.addr)
+	for i := 0; ; i++ {
+		c, err := net.Dial("tcp", ts.addr)
+		if err == nil {
+			c.Close()
+			return
+		}
+		if i == 100 {
+			t.Fatalf("The server doesn't listen on %s", ts.addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startMaster(t *testing.T, backlogSize int) *testServer {
+	ts := newTestServer(t)
+	ts.mc = NewMaster(ts.sv, backlogSize)
+	ts.mc.SetDatabases(ts.dbs)
+	ts.mc.SetFullSync(true, t.TempDir())
+	ts.sv.SetCallChain(ts.mc.MasterCallChain(ts.sv))
+	RouteMaster(ts.sv, ts.mc)
+	ts.listen(t)
+	return ts
+}
+
+func startReplica(t *testing.T, master *testServer) *testServer {
+	ts := newTestServer(t)
+	rc, err := NewReplica(ts.sv, master.addr, ts.port, 1<<20)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	ts.rc = rc
+	rc.SetDatabases(ts.dbs)
+	ts.sv.SetRwProvider(rc.ReplicaRwProvider)
+	RouteReplica(ts.sv, rc)
+	ts.listen(t)
+	go rc.Run(ts.ctx)
+	return ts
+}
+
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *parser.Decoder
+}
+
+func (ts *testServer) connect(t *testing.T) *testClient {
+	c, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { c.Close() })
+	return &testClient{t: t, conn: c, dec: parser.NewDecoder(c)}
+}
+
+func (c *testClient) send(args ...string) {
+	if err := client.Send(c.conn, args); err != nil {
+		c.t.Fatal(err.Error())
+	}
+}
+
+// read returns the next reply as it was sent.
+func (c *testClient) read() string {
+	c.t.Helper()
+	res, err := c.readTimeout(2 * time.Second)
+	if err != nil {
+		c.t.Fatalf("No reply: %s", err.Error())
+	}
+	return res
+}
+
+func (c *testClient) readTimeout(timeout time.Duration) (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	data, err := c.dec.Decode()
+	if err != nil {
+		return "", err
+	}
+	return string(data.Marshal()), nil
+}
+
+// noReply checks that nothing is sent to the client for a while.
+func (c *testClient) noReply() {
+	c.t.Helper()
+	if res, err := c.readTimeout(100 * time.Millisecond); err == nil {
+		c.t.Errorf("Unexpected reply: %q", res)
+	}
+}
+
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// expect sends a command and checks its reply.
+func (c *testClient) expect(want string, args ...string) {
+	c.t.Helper()
+	if res := c.do(args...); res != want {
+		c.t.Errorf("Wrong reply to %v. Have: %q, want: %q", args, res, want)
+	}
+}
+
+// info returns a field of the INFO section.
+func (c *testClient) info(section string, field string) string {
+	c.t.Helper()
+	res := c.do("INFO", section)
+	for _, line := range strings.Split(res, "\r\n") {
+		if strings.HasPrefix(line, field+":") {
+			return line[len(field)+1:]
+		}
+	}
+	c.t.Fatalf("No %s in the %s section", field, section)
+	return ""
+}
+
+func (c *testClient) replOffset() int {
+	c.t.Helper()
+	offset, err := strconv.Atoi(c.info("replication", "master_repl_offset"))
+	if err != nil {
+		c.t.Fatal(err.Error())
+	}
+	return offset
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	t.Helper()
+	for i := 0; !cond(); i++ {
+		if i == 500 {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func bulk(s string) string {
+	return string(parser.BulkStringData([]byte(s)).Marshal())
+}
+
+func integer(n int) string {
+	return string(parser.IntegerData(n).Marshal())
+}
+
+func array(elems ...string) string {
+	return "*" + strconv.Itoa(len(elems)) + "\r\n" + strings.Join(elems, "")
+}
+
+const (
+	ok        = "+OK\r\n"
+	queued    = "+QUEUED\r\n"
+	nullBulk  = "$-1\r\n"
+	nullArray = "*-1\r\n"
+	// the null of RESP3
+	null = "_\r\n"
+)
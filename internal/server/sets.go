@@ -0,0 +1,376 @@
+package server
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/glob"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+func (h BaseHandler) routeSets(server *Server) {
+	server.AddHandler("SADD", h.handleSadd)
+	server.AddHandler("SREM", h.handleSrem)
+	server.AddHandler("SISMEMBER", h.handleSismember)
+	server.AddHandler("SMISMEMBER", h.handleSismember)
+	server.AddHandler("SMEMBERS", h.handleSmembers)
+	server.AddHandler("SCARD", h.handleScard)
+	server.AddHandler("SPOP", h.handleSpop)
+	server.AddHandler("SRANDMEMBER", h.handleSrandmember)
+	server.AddHandler("SMOVE", h.handleSmove)
+	server.AddHandler("SINTER", h.handleSetOp)
+	server.AddHandler("SUNION", h.handleSetOp)
+	server.AddHandler("SDIFF", h.handleSetOp)
+	server.AddHandler("SINTERSTORE", h.handleSetOpStore)
+	server.AddHandler("SUNIONSTORE", h.handleSetOpStore)
+	server.AddHandler("SDIFFSTORE", h.handleSetOpStore)
+	server.AddHandler("SINTERCARD", h.handleSintercard)
+	server.AddHandler("SSCAN", h.handleSscan)
+}
+
+// setOps are the set algebra commands by the name of the one that replies the
+// result, the STORE ones have the same name with the suffix.
+var setOps = map[string]func(sets []*storage.Set) *storage.Set{
+	"SINTER": storage.InterSets,
+	"SUNION": storage.UnionSets,
+	"SDIFF":  storage.DiffSets,
+}
+
+func membersData(members []string, req Request) []byte {
+	return parser.SetData(stringsData(members)).MarshalProto(req.Client.Proto())
+}
+
+func (h BaseHandler) handleSadd(req Request, rw ResponseWriter) {
+	added := 0
+	err := h.db(req).UpdateSet(string(req.Command.Arguments[0]), true, func(set *storage.Set) {
+		for _, member := range req.Command.Arguments[1:] {
+			if set.Add(string(member)) {
+				added++
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if added == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(added).Marshal())
+}
+
+func (h BaseHandler) handleSrem(req Request, rw ResponseWriter) {
+	removed := 0
+	err := h.db(req).UpdateSet(string(req.Command.Arguments[0]), false, func(set *storage.Set) {
+		for _, member := range req.Command.Arguments[1:] {
+			if set.Remove(string(member)) {
+				removed++
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if removed == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(removed).Marshal())
+}
+
+// handleSismember serves SISMEMBER and SMISMEMBER, which replies an array
+// for all the members it is given.
+func (h BaseHandler) handleSismember(req Request, rw ResponseWriter) {
+	members := req.Command.Arguments[1:]
+	res := make([]parser.Data, len(members))
+	err := h.db(req).ReadSet(string(req.Command.Arguments[0]), func(set *storage.Set) {
+		for i, member := range members {
+			if set.Has(string(member)) {
+				res[i] = parser.IntegerData(1)
+			} else {
+				res[i] = parser.IntegerData(0)
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if req.Command.Name == "SISMEMBER" {
+		rw.Write(res[0].Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData(res).Marshal())
+}
+
+func (h BaseHandler) handleSmembers(req Request, rw ResponseWriter) {
+	var members []string
+	err := h.db(req).ReadSet(string(req.Command.Arguments[0]), func(set *storage.Set) {
+		members = set.Members()
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(membersData(members, req))
+}
+
+func (h BaseHandler) handleScard(req Request, rw ResponseWriter) {
+	length := 0
+	err := h.db(req).ReadSet(string(req.Command.Arguments[0]), func(set *storage.Set) {
+		length = set.Len()
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+// handleSpop is propagated as SREM of the members that were popped, so
+// replicas don't pick others at random.
+func (h BaseHandler) handleSpop(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 2 {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	count, hasCount := 1, len(args) == 2
+	if hasCount {
+		var err error
+		if count, err = parseInt(args[1]); err != nil || count < 0 {
+			rw.Write(parser.ErrorData("ERR value is out of range, must be positive").Marshal())
+			return
+		}
+	}
+
+	var popped []string
+	err := h.db(req).UpdateSet(string(args[0]), false, func(set *storage.Set) {
+		for len(popped) < count && set.Len() > 0 {
+			member := set.Random()
+			set.Remove(member)
+			popped = append(popped, member)
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	req.PreventPropagation()
+	if len(popped) > 0 {
+		cmd := [][]byte{[]byte("SREM"), args[0]}
+		for _, member := range popped {
+			cmd = append(cmd, []byte(member))
+		}
+		req.RewriteCommand(cmd...)
+	}
+
+	switch {
+	case hasCount:
+		rw.Write(parser.ArrayData(stringsData(popped)).Marshal())
+	case len(popped) == 0:
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(parser.BulkStringData([]byte(popped[0])).Marshal())
+	}
+}
+
+// handleSrandmember serves SRANDMEMBER key [count]: a positive count returns
+// distinct members, a negative one may repeat them.
+func (h BaseHandler) handleSrandmember(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 2 {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	count, hasCount := 1, len(args) == 2
+	if hasCount {
+		var err error
+		if count, err = parseInt(args[1]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+	}
+
+	var members []string
+	err := h.db(req).ReadSet(string(args[0]), func(set *storage.Set) {
+		if set.Len() == 0 {
+			return
+		}
+		if count < 0 {
+			for i := 0; i < -count; i++ {
+				members = append(members, set.Random())
+			}
+			return
+		}
+		all := set.Members()
+		rand.Shuffle(len(all), func(i, j int) {
+			all[i], all[j] = all[j], all[i]
+		})
+		if count < len(all) {
+			all = all[:count]
+		}
+		members = all
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	switch {
+	case hasCount:
+		rw.Write(parser.ArrayData(stringsData(members)).Marshal())
+	case len(members) == 0:
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(parser.BulkStringData([]byte(members[0])).Marshal())
+	}
+}
+
+func (h BaseHandler) handleSmove(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	moved, err := h.db(req).MoveSet(string(args[0]), string(args[1]), string(args[2]))
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if !moved {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+// handleSetOp serves SINTER, SUNION and SDIFF, missing keys are empty sets.
+func (h BaseHandler) handleSetOp(req Request, rw ResponseWriter) {
+	op := setOps[req.Command.Name]
+	var members []string
+	err := h.db(req).ReadSets(keyStrings(req.Command.Arguments), func(sets []*storage.Set) {
+		members = op(sets).Members()
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(membersData(members, req))
+}
+
+// handleSetOpStore serves SINTERSTORE, SUNIONSTORE and SDIFFSTORE, that
+// replace the destination with the result and reply its size.
+func (h BaseHandler) handleSetOpStore(req Request, rw ResponseWriter) {
+	op := setOps[strings.TrimSuffix(req.Command.Name, "STORE")]
+	args := req.Command.Arguments
+	n, err := h.db(req).StoreSets(string(args[0]), keyStrings(args[1:]), op)
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(n).Marshal())
+}
+
+// handleSintercard serves SINTERCARD numkeys key... [LIMIT limit], the
+// intersection stops growing at the limit, 0 means no limit.
+func (h BaseHandler) handleSintercard(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	numkeys, err := parseInt(args[0])
+	if err != nil || numkeys <= 0 {
+		rw.Write(parser.ErrorData("ERR numkeys should be greater than 0").Marshal())
+		return
+	}
+	if numkeys > len(args)-1 {
+		rw.Write(parser.ErrorData("ERR Number of keys can't be greater than number of args").Marshal())
+		return
+	}
+
+	limit := 0
+	rest := args[numkeys+1:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(string(rest[0])) == "LIMIT":
+		if limit, err = parseInt(rest[1]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if limit < 0 {
+			rw.Write(parser.ErrorData("ERR LIMIT can't be negative").Marshal())
+			return
+		}
+	default:
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+
+	card := 0
+	err = h.db(req).ReadSets(keyStrings(args[1:numkeys+1]), func(sets []*storage.Set) {
+		smallest := sets[0]
+		for _, set := range sets[1:] {
+			if set.Len() < smallest.Len() {
+				smallest = set
+			}
+		}
+		for _, member := range smallest.Members() {
+			inAll := true
+			for _, set := range sets {
+				if !set.Has(member) {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				card++
+				if card == limit {
+					return
+				}
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(card).Marshal())
+}
+
+func (h BaseHandler) handleSscan(req Request, rw ResponseWriter) {
+	cursor, err := strconv.ParseUint(string(req.Command.Arguments[1]), 10, 64)
+	if err != nil {
+		rw.Write(parser.ErrorData("ERR invalid cursor").Marshal())
+		return
+	}
+	count := 10
+	if opt, ok := req.Command.Options["COUNT"]; ok {
+		if count, err = parseInt(opt[0]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if count < 1 {
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+	}
+	match, hasMatch := req.Command.Options["MATCH"]
+
+	res := []string{}
+	var next uint64
+	err = h.db(req).ReadSet(string(req.Command.Arguments[0]), func(set *storage.Set) {
+		var members []string
+		members, next = set.Scan(cursor, count)
+		for _, member := range members {
+			if !hasMatch || glob.Match(match[0], []byte(member), false) {
+				res = append(res, member)
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData([]parser.Data{
+		parser.BulkStringData([]byte(strconv.FormatUint(next, 10))),
+		parser.ArrayData(stringsData(res)),
+	}).Marshal())
+}
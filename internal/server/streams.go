@@ -0,0 +1,1454 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+const (
+	errInvalidStreamID  = "ERR Invalid stream ID specified as stream command argument"
+	errStreamIDTooSmall = "ERR The ID specified in XADD is equal or smaller than the target stream top item"
+	errNoSuchKey        = "ERR no such key"
+	errXgroupNoKey      = "ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."
+
+	// how many entries an approximate trim deletes at most without a LIMIT,
+	// 100 nodes of 100 entries in redis
+	streamTrimDefaultLimit = 10000
+)
+
+func (h BaseHandler) routeStreams(server *Server) {
+	server.AddHandler("XADD", h.handleXadd)
+	server.AddHandler("XLEN", h.handleXlen)
+	server.AddHandler("XRANGE", h.handleXrange)
+	server.AddHandler("XREVRANGE", h.handleXrange)
+	server.AddHandler("XDEL", h.handleXdel)
+	server.AddHandler("XTRIM", h.handleXtrim)
+	server.AddHandler("XREAD", h.handleXread)
+	server.AddHandler("XGROUP", h.handleXgroup)
+	server.AddHandler("XREADGROUP", h.handleXreadgroup)
+	server.AddHandler("XACK", h.handleXack)
+	server.AddHandler("XPENDING", h.handleXpending)
+	server.AddHandler("XCLAIM", h.handleXclaim)
+	server.AddHandler("XAUTOCLAIM", h.handleXautoclaim)
+	server.AddHandler("XINFO", h.handleXinfo)
+}
+
+// parseStreamID parses an ID as ms-seq, or as ms with missingSeq as the
+// sequence number.
+func parseStreamID(arg []byte, missingSeq uint64) (storage.StreamID, bool) {
+	ms, seq, hasSeq := strings.Cut(string(arg), "-")
+	id := storage.StreamID{Seq: missingSeq}
+	var err error
+	if id.Ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, false
+	}
+	if hasSeq {
+		if id.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return id, false
+		}
+	}
+	return id, true
+}
+
+// parseRangeID parses a bound of XRANGE: - and + are the lowest and the
+// highest IDs, an ID without sequence number takes the lowest one of the ms
+// for the start and the highest one for the end, and ( excludes the ID.
+func parseRangeID(arg []byte, end bool) (storage.StreamID, string) {
+	switch string(arg) {
+	case "-":
+		return storage.StreamID{}, ""
+	case "+":
+		return storage.MaxStreamID, ""
+	}
+
+	exclusive := len(arg) > 0 && arg[0] == '('
+	if exclusive {
+		arg = arg[1:]
+	}
+	var missingSeq uint64
+	if end {
+		missingSeq = math.MaxUint64
+	}
+	id, ok := parseStreamID(arg, missingSeq)
+	if !ok {
+		return id, errInvalidStreamID
+	}
+	if !exclusive {
+		return id, ""
+	}
+
+	if end {
+		if id, ok = id.Prev(); !ok {
+			return id, "ERR invalid end ID for the interval"
+		}
+	} else if id, ok = id.Next(); !ok {
+		return id, "ERR invalid start ID for the interval"
+	}
+	return id, ""
+}
+
+// nextStreamID resolves the ID argument of XADD: * takes the current time,
+// ms-* takes the next sequence number of the ms, anything else must be a
+// complete ID above the last one.
+func nextStreamID(arg []byte, last storage.StreamID) (storage.StreamID, string) {
+	if string(arg) == "*" {
+		ms := uint64(time.Now().UnixMilli())
+		if last.Ms < ms {
+			return storage.StreamID{Ms: ms}, ""
+		}
+		id, ok := last.Next()
+		if !ok {
+			return id, "ERR The stream has exhausted the last possible ID, unable to add more items"
+		}
+		return id, ""
+	}
+
+	if strings.HasSuffix(string(arg), "-*") {
+		ms, err := strconv.ParseUint(strings.TrimSuffix(string(arg), "-*"), 10, 64)
+		switch {
+		case err != nil:
+			return storage.StreamID{}, errInvalidStreamID
+		case ms > last.Ms:
+			return storage.StreamID{Ms: ms}, ""
+		case ms < last.Ms || last.Seq == math.MaxUint64:
+			return storage.StreamID{}, errStreamIDTooSmall
+		}
+		return storage.StreamID{Ms: ms, Seq: last.Seq + 1}, ""
+	}
+
+	id, ok := parseStreamID(arg, 0)
+	switch {
+	case !ok:
+		return id, errInvalidStreamID
+	case id.IsZero():
+		return id, "ERR The ID specified in XADD must be greater than 0-0"
+	case !last.Less(id):
+		return id, errStreamIDTooSmall
+	}
+	return id, ""
+}
+
+func noGroup(key string, group string) string {
+	return "NOGROUP No such key '" + key + "' or consumer group '" + group + "'"
+}
+
+func streamEntryData(e storage.StreamEntry) parser.Data {
+	return parser.ArrayData([]parser.Data{
+		parser.BulkStringData([]byte(e.ID.String())),
+		parser.ArrayData(bulksData(e.Fields)),
+	})
+}
+
+func streamEntriesData(entries []storage.StreamEntry) parser.Data {
+	res := make([]parser.Data, len(entries))
+	for i, e := range entries {
+		res[i] = streamEntryData(e)
+	}
+	return parser.ArrayData(res)
+}
+
+func streamIDData(id storage.StreamID) parser.Data {
+	return parser.BulkStringData([]byte(id.String()))
+}
+
+// streamsReply is the reply of XREAD and XREADGROUP: the entries of every
+// stream, as a map in RESP3 and as pairs in RESP2.
+func streamsReply(req Request, res []parser.Data) []byte {
+	if req.Client.Proto() >= parser.Resp3 {
+		return parser.MapData(res).Marshal()
+	}
+	pairs := make([]parser.Data, 0, len(res)/2)
+	for i := 0; i < len(res); i += 2 {
+		pairs = append(pairs, parser.ArrayData(res[i:i+2]))
+	}
+	return parser.ArrayData(pairs).Marshal()
+}
+
+// streamTrim is the MAXLEN or MINID argument of XADD and XTRIM.
+type streamTrim struct {
+	strategy string // MAXLEN, MINID or empty for no trimming
+	maxLen   int
+	minID    storage.StreamID
+	limit    int // 0 for no limit
+}
+
+// parseStreamTrim parses MAXLEN|MINID [=|~] threshold [LIMIT count] at the
+// start of args, and returns how many arguments it took. An approximate trim
+// deletes as many entries as an exact one, only up to the limit.
+func parseStreamTrim(args [][]byte) (streamTrim, int, string) {
+	t := streamTrim{strategy: strings.ToUpper(string(args[0]))}
+	i := 1
+	approx := false
+	if i < len(args) && (string(args[i]) == "~" || string(args[i]) == "=") {
+		approx = string(args[i]) == "~"
+		i++
+	}
+	if i >= len(args) {
+		return t, i, errSyntax
+	}
+
+	if t.strategy == "MAXLEN" {
+		var err error
+		if t.maxLen, err = parseInt(args[i]); err != nil {
+			return t, i, errNotInteger
+		}
+		if t.maxLen < 0 {
+			return t, i, "ERR The MAXLEN argument must be >= 0."
+		}
+	} else {
+		var ok bool
+		if t.minID, ok = parseStreamID(args[i], 0); !ok {
+			return t, i, errInvalidStreamID
+		}
+	}
+	i++
+
+	if approx {
+		t.limit = streamTrimDefaultLimit
+	}
+	if i+1 < len(args) && strings.ToUpper(string(args[i])) == "LIMIT" {
+		limit, err := parseInt(args[i+1])
+		switch {
+		case err != nil:
+			return t, i, errNotInteger
+		case limit < 0:
+			return t, i, "ERR The LIMIT argument must be >= 0."
+		case !approx:
+			return t, i, "ERR syntax error, LIMIT cannot be used without the special ~ option"
+		}
+		t.limit = limit
+		i += 2
+	}
+	return t, i, ""
+}
+
+func (t streamTrim) apply(st *storage.Stream) int {
+	switch t.strategy {
+	case "MAXLEN":
+		return st.TrimMaxLen(t.maxLen, t.limit)
+	case "MINID":
+		return st.TrimMinID(t.minID, t.limit)
+	}
+	return 0
+}
+
+// handleXadd serves XADD key [NOMKSTREAM] [MAXLEN|MINID ...] id field value...
+// It is propagated with the ID that was given to the entry.
+func (h BaseHandler) handleXadd(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	noMkStream := false
+	var trim streamTrim
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NOMKSTREAM":
+			noMkStream = true
+		case "MAXLEN", "MINID":
+			var n int
+			var errMsg string
+			if trim, n, errMsg = parseStreamTrim(args[i:]); errMsg != "" {
+				rw.Write(parser.ErrorData(errMsg).Marshal())
+				return
+			}
+			i += n - 1
+		default:
+			break options
+		}
+	}
+	if len(args)-i < 3 || (len(args)-i)%2 == 0 {
+		rw.Write(parser.ErrorData(wrongArgs(req.Command.Name)).Marshal())
+		return
+	}
+	// the ID is checked against the stream later, but a malformed one is an
+	// error even if the key isn't a stream
+	if _, errMsg := nextStreamID(args[i], storage.StreamID{}); errMsg != "" && errMsg != errStreamIDTooSmall {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	var id storage.StreamID
+	var errMsg string
+	err := h.db(req).UpdateStream(string(args[0]), !noMkStream, func(st *storage.Stream) {
+		if id, errMsg = nextStreamID(args[i], st.LastID()); errMsg != "" {
+			return
+		}
+		st.Add(id, args[i+1:])
+		trim.apply(st)
+	})
+	switch {
+	case err == storage.ErrNoSuchKey:
+		req.PreventPropagation()
+		rw.Write(nullReply(req))
+		return
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	case errMsg != "":
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	propagated := append([][]byte{[]byte(req.Command.Name)}, args...)
+	propagated[i+1] = []byte(id.String())
+	req.RewriteCommand(propagated...)
+	rw.Write(parser.BulkStringData([]byte(id.String())).Marshal())
+}
+
+func (h BaseHandler) handleXlen(req Request, rw ResponseWriter) {
+	length := 0
+	err := h.db(req).ReadStream(string(req.Command.Arguments[0]), func(st *storage.Stream) {
+		length = st.Len()
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+// handleXrange serves XRANGE key start end [COUNT count] and XREVRANGE,
+// that takes the end first.
+func (h BaseHandler) handleXrange(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	reverse := req.Command.Name == "XREVRANGE"
+	startArg, endArg := args[1], args[2]
+	if reverse {
+		startArg, endArg = endArg, startArg
+	}
+	start, errMsg := parseRangeID(startArg, false)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	end, errMsg := parseRangeID(endArg, true)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	count := -1
+	if len(args) > 3 {
+		if len(args) != 5 || strings.ToUpper(string(args[3])) != "COUNT" {
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+		var err error
+		if count, err = parseInt(args[4]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if count < 0 {
+			count = 0
+		}
+	}
+
+	entries := []storage.StreamEntry{}
+	err := h.db(req).ReadStream(string(args[0]), func(st *storage.Stream) {
+		entries = st.Range(start, end, count, reverse)
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(streamEntriesData(entries).Marshal())
+}
+
+// handleXdel serves XDEL key id..., replies the number of deleted entries.
+func (h BaseHandler) handleXdel(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	ids := make([]storage.StreamID, len(args)-1)
+	for i, arg := range args[1:] {
+		var ok bool
+		if ids[i], ok = parseStreamID(arg, 0); !ok {
+			rw.Write(parser.ErrorData(errInvalidStreamID).Marshal())
+			return
+		}
+	}
+
+	deleted := 0
+	err := h.db(req).UpdateStream(string(args[0]), false, func(st *storage.Stream) {
+		for _, id := range ids {
+			if st.Delete(id) {
+				deleted++
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if deleted == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(deleted).Marshal())
+}
+
+// handleXtrim serves XTRIM key MAXLEN|MINID [=|~] threshold [LIMIT count],
+// replies the number of deleted entries.
+func (h BaseHandler) handleXtrim(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	strategy := strings.ToUpper(string(args[1]))
+	if strategy != "MAXLEN" && strategy != "MINID" {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	trim, n, errMsg := parseStreamTrim(args[1:])
+	if errMsg == "" && n != len(args)-1 {
+		errMsg = errSyntax
+	}
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	trimmed := 0
+	err := h.db(req).UpdateStream(string(args[0]), false, func(st *storage.Stream) {
+		trimmed = trim.apply(st)
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if trimmed == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(trimmed).Marshal())
+}
+
+// streamRead is the part of XREAD and XREADGROUP before the STREAMS option.
+type streamRead struct {
+	count   int // negative for no limit
+	block   bool
+	timeout time.Duration
+	noAck   bool
+	keys    []string
+	ids     [][]byte
+}
+
+// parseStreamRead parses [COUNT count] [BLOCK ms] [NOACK] STREAMS key... id...
+// noAck tells whether NOACK is accepted.
+func parseStreamRead(name string, args [][]byte, noAck bool) (streamRead, string) {
+	r := streamRead{count: -1}
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return r, "ERR Unbalanced '" + strings.ToLower(name) + "' list of streams: for each stream key an ID or '$' must be specified."
+			}
+			r.keys = keyStrings(rest[:len(rest)/2])
+			r.ids = rest[len(rest)/2:]
+			return r, ""
+		case opt == "COUNT" && i+1 < len(args):
+			i++
+			count, err := parseInt(args[i])
+			if err != nil {
+				return r, errNotInteger
+			}
+			if count > 0 {
+				r.count = count
+			}
+		case opt == "BLOCK" && i+1 < len(args):
+			i++
+			ms, err := parseInt(args[i])
+			if err != nil {
+				return r, "ERR timeout is not an integer or out of range"
+			}
+			if ms < 0 {
+				return r, "ERR timeout is negative"
+			}
+			r.block = true
+			r.timeout = time.Duration(ms) * time.Millisecond
+		case opt == "NOACK" && noAck:
+			r.noAck = true
+		default:
+			return r, errSyntax
+		}
+	}
+	return r, errSyntax
+}
+
+// handleXread serves XREAD [COUNT count] [BLOCK ms] STREAMS key... id...,
+// that replies the entries after the IDs. $ is the last ID of the stream and
+// + its last entry. Without entries it replies null, or blocks until there
+// are some.
+func (h BaseHandler) handleXread(req Request, rw ResponseWriter) {
+	r, errMsg := parseStreamRead(req.Command.Name, req.Command.Arguments, false)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	// the IDs the entries are read after, resolved to run again the
+	// command when blocked
+	resolved := append([][]byte(nil), req.Command.Arguments...)
+	offset := len(resolved) - len(r.ids)
+	res := []parser.Data{}
+	for i, key := range r.keys {
+		var after storage.StreamID
+		var ok bool
+		switch string(r.ids[i]) {
+		case "$", "+":
+		default:
+			if after, ok = parseStreamID(r.ids[i], 0); !ok {
+				rw.Write(parser.ErrorData(errInvalidStreamID).Marshal())
+				return
+			}
+		}
+
+		var entries []storage.StreamEntry
+		err := h.db(req).ReadStream(key, func(st *storage.Stream) {
+			switch string(r.ids[i]) {
+			case "$":
+				after = st.LastID()
+				return
+			case "+":
+				last := st.Range(storage.StreamID{}, storage.MaxStreamID, 1, true)
+				if len(last) == 0 {
+					after = st.LastID()
+					return
+				}
+				entries = last
+				return
+			}
+			if start, ok := after.Next(); ok {
+				entries = st.Range(start, storage.MaxStreamID, r.count, false)
+			}
+		})
+		if err != nil && err != storage.ErrNoSuchKey {
+			rw.Write(parser.ErrorData(err.Error()).Marshal())
+			return
+		}
+		resolved[offset+i] = []byte(after.String())
+		if len(entries) > 0 {
+			res = append(res, parser.BulkStringData([]byte(key)), streamEntriesData(entries))
+		}
+	}
+
+	switch {
+	case len(res) > 0:
+		rw.Write(streamsReply(req, res))
+	case r.block:
+		req.BlockOnStreams(resolved, r.keys, r.timeout, nullArrayReply(req))
+	default:
+		rw.Write(nullArrayReply(req))
+	}
+}
+
+// xclaimCommand is how a change of a pending entry is propagated, so that
+// replicas and the AOF agree with the master on its delivery.
+func xclaimCommand(key string, g *storage.ConsumerGroup, p *storage.PendingEntry) [][]byte {
+	return [][]byte{
+		[]byte("XCLAIM"), []byte(key), []byte(g.Name), []byte(p.Consumer), []byte("0"), []byte(p.ID.String()),
+		[]byte("TIME"), []byte(strconv.FormatInt(p.DeliveryTime, 10)),
+		[]byte("RETRYCOUNT"), []byte(strconv.FormatInt(p.DeliveryCount, 10)),
+		[]byte("FORCE"), []byte("JUSTID"), []byte("LASTID"), []byte(g.LastID.String()),
+	}
+}
+
+// createConsumer creates the consumer of the group if needed, and propagates
+// its creation.
+func createConsumer(req Request, key string, g *storage.ConsumerGroup, name string, now int64) *storage.Consumer {
+	c, created := g.CreateConsumer(name, now)
+	if created {
+		req.RewriteCommand([]byte("XGROUP"), []byte("CREATECONSUMER"), []byte(key), []byte(g.Name), []byte(name))
+	}
+	return c
+}
+
+// handleXreadgroup serves XREADGROUP GROUP group consumer [COUNT count]
+// [BLOCK ms] [NOACK] STREAMS key... id.... The > ID delivers the entries the
+// group didn't deliver yet, it blocks like XREAD if there are none. Other IDs
+// read again the pending entries of the consumer after them.
+func (h BaseHandler) handleXreadgroup(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) < 3 || strings.ToUpper(string(args[0])) != "GROUP" {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	group, consumer := string(args[1]), string(args[2])
+	r, errMsg := parseStreamRead(req.Command.Name, args[3:], true)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	ids := make([]storage.StreamID, len(r.ids))
+	for i, arg := range r.ids {
+		switch string(arg) {
+		case ">":
+			continue
+		case "$":
+			rw.Write(parser.ErrorData("ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.").Marshal())
+			return
+		}
+		var ok bool
+		if ids[i], ok = parseStreamID(arg, 0); !ok {
+			rw.Write(parser.ErrorData(errInvalidStreamID).Marshal())
+			return
+		}
+	}
+
+	// nothing is changed when the command blocks, blocked clients are run
+	// again whenever the key is written to
+	ready := false
+	for i, key := range r.keys {
+		found := true
+		err := h.db(req).ReadStream(key, func(st *storage.Stream) {
+			g := st.Group(group)
+			if g == nil {
+				found = false
+				return
+			}
+			if string(r.ids[i]) != ">" {
+				ready = true
+			} else if start, ok := g.LastID.Next(); ok && len(st.Range(start, storage.MaxStreamID, 1, false)) > 0 {
+				ready = true
+			}
+		})
+		if err == storage.ErrNoSuchKey || !found {
+			rw.Write(parser.ErrorData(noGroup(key, group) + " in XREADGROUP with GROUP option").Marshal())
+			return
+		}
+		if err != nil {
+			rw.Write(parser.ErrorData(err.Error()).Marshal())
+			return
+		}
+	}
+	if !ready {
+		if r.block {
+			req.BlockOnStreams(args, r.keys, r.timeout, nullArrayReply(req))
+		} else {
+			rw.Write(nullArrayReply(req))
+		}
+		return
+	}
+
+	req.PreventPropagation()
+	now := time.Now().UnixMilli()
+	res := []parser.Data{}
+	for i, key := range r.keys {
+		var data []parser.Data
+		err := h.db(req).UpdateStream(key, false, func(st *storage.Stream) {
+			g := st.Group(group)
+			c := createConsumer(req, key, g, consumer, now)
+			c.SeenTime = now
+			if string(r.ids[i]) == ">" {
+				data = readNewEntries(req, key, st, g, c, r, now)
+			} else {
+				data = readPendingEntries(req, key, st, g, c, ids[i], r.count, now)
+			}
+		})
+		if err != nil {
+			rw.Write(parser.ErrorData(err.Error()).Marshal())
+			return
+		}
+		if data != nil {
+			res = append(res, parser.BulkStringData([]byte(key)), parser.ArrayData(data))
+		}
+	}
+	if len(res) == 0 {
+		rw.Write(nullArrayReply(req))
+		return
+	}
+	rw.Write(streamsReply(req, res))
+}
+
+// readNewEntries delivers the entries the group didn't deliver yet to the
+// consumer, returns nil if there are none.
+func readNewEntries(req Request, key string, st *storage.Stream, g *storage.ConsumerGroup, c *storage.Consumer, r streamRead, now int64) []parser.Data {
+	entries := st.ReadGroup(g, c, r.count, r.noAck, now)
+	if len(entries) == 0 {
+		return nil
+	}
+	data := make([]parser.Data, len(entries))
+	for i, e := range entries {
+		data[i] = streamEntryData(e)
+		if !r.noAck {
+			req.RewriteCommand(xclaimCommand(key, g, g.Pending(e.ID))...)
+		}
+	}
+	req.RewriteCommand([]byte("XGROUP"), []byte("SETID"), []byte(key), []byte(g.Name), []byte(g.LastID.String()),
+		[]byte("ENTRIESREAD"), []byte(strconv.FormatInt(g.EntriesRead, 10)))
+	return data
+}
+
+// readPendingEntries delivers again the pending entries of the consumer after
+// the ID. Entries deleted from the stream are replied without fields.
+func readPendingEntries(req Request, key string, st *storage.Stream, g *storage.ConsumerGroup, c *storage.Consumer, after storage.StreamID, count int, now int64) []parser.Data {
+	data := []parser.Data{}
+	start, ok := after.Next()
+	if !ok {
+		return data
+	}
+	for _, p := range g.PendingRange(start, storage.MaxStreamID, count, c.Name) {
+		entry, ok := st.Entry(p.ID)
+		if !ok {
+			data = append(data, parser.ArrayData([]parser.Data{streamIDData(p.ID), nullArrayData(req)}))
+			continue
+		}
+		p.DeliveryTime = now
+		p.DeliveryCount++
+		req.RewriteCommand(xclaimCommand(key, g, p)...)
+		data = append(data, streamEntryData(entry))
+	}
+	return data
+}
+
+// handleXack serves XACK key group id..., replies the number of entries that
+// were pending.
+func (h BaseHandler) handleXack(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	ids := make([]storage.StreamID, len(args)-2)
+	for i, arg := range args[2:] {
+		var ok bool
+		if ids[i], ok = parseStreamID(arg, 0); !ok {
+			rw.Write(parser.ErrorData(errInvalidStreamID).Marshal())
+			return
+		}
+	}
+
+	acked := 0
+	err := h.db(req).UpdateStream(string(args[0]), false, func(st *storage.Stream) {
+		g := st.Group(string(args[1]))
+		if g == nil {
+			return
+		}
+		for _, id := range ids {
+			if g.Ack(id) {
+				acked++
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if acked == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(acked).Marshal())
+}
+
+// handleXpending serves XPENDING key group, that replies a summary of the
+// pending entries, and XPENDING key group [IDLE min-idle] start end count
+// [consumer] that lists them.
+func (h BaseHandler) handleXpending(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	key, group := string(args[0]), string(args[1])
+
+	extended := len(args) > 2
+	var minIdle int64
+	var start, end storage.StreamID
+	count := 0
+	consumer := ""
+	if extended {
+		i := 2
+		if strings.ToUpper(string(args[i])) == "IDLE" && i+1 < len(args) {
+			idle, err := parseInt(args[i+1])
+			if err != nil {
+				rw.Write(parser.ErrorData(errNotInteger).Marshal())
+				return
+			}
+			minIdle = int64(idle)
+			i += 2
+		}
+		if len(args)-i != 3 && len(args)-i != 4 {
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+		var errMsg string
+		if start, errMsg = parseRangeID(args[i], false); errMsg == "" {
+			end, errMsg = parseRangeID(args[i+1], true)
+		}
+		if errMsg != "" {
+			rw.Write(parser.ErrorData(errMsg).Marshal())
+			return
+		}
+		var err error
+		if count, err = parseInt(args[i+2]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if count < 0 {
+			count = 0
+		}
+		if len(args)-i == 4 {
+			consumer = string(args[i+3])
+		}
+	}
+
+	var res parser.Data
+	found := true
+	err := h.db(req).ReadStream(key, func(st *storage.Stream) {
+		g := st.Group(group)
+		if g == nil {
+			found = false
+			return
+		}
+		if extended {
+			res = pendingEntriesData(g, start, end, count, consumer, minIdle)
+		} else {
+			res = pendingSummaryData(req, g)
+		}
+	})
+	if err == storage.ErrNoSuchKey || !found {
+		rw.Write(parser.ErrorData(noGroup(key, group)).Marshal())
+		return
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(res.MarshalProto(req.Client.Proto()))
+}
+
+// pendingSummaryData is the number of pending entries, the lowest and the
+// highest of their IDs, and the number of entries of every consumer that has
+// some.
+func pendingSummaryData(req Request, g *storage.ConsumerGroup) parser.Data {
+	pending := g.PendingRange(storage.StreamID{}, storage.MaxStreamID, -1, "")
+	if len(pending) == 0 {
+		return parser.ArrayData([]parser.Data{parser.IntegerData(0), parser.NullData(), parser.NullData(), nullArrayData(req)})
+	}
+
+	consumers := []parser.Data{}
+	for _, c := range g.Consumers() {
+		if n := g.PendingCount(c.Name); n > 0 {
+			consumers = append(consumers, parser.ArrayData([]parser.Data{
+				parser.BulkStringData([]byte(c.Name)),
+				parser.BulkStringData([]byte(strconv.Itoa(n))),
+			}))
+		}
+	}
+	return parser.ArrayData([]parser.Data{
+		parser.IntegerData(len(pending)),
+		streamIDData(pending[0].ID),
+		streamIDData(pending[len(pending)-1].ID),
+		parser.ArrayData(consumers),
+	})
+}
+
+// pendingEntriesData lists the pending entries in the range that have been
+// idle for minIdle ms at least, with their consumer, idle time and number of
+// deliveries.
+func pendingEntriesData(g *storage.ConsumerGroup, start, end storage.StreamID, count int, consumer string, minIdle int64) parser.Data {
+	now := time.Now().UnixMilli()
+	res := []parser.Data{}
+	for _, p := range g.PendingRange(start, end, -1, consumer) {
+		if len(res) == count {
+			break
+		}
+		idle := now - p.DeliveryTime
+		if idle < minIdle {
+			continue
+		}
+		res = append(res, parser.ArrayData([]parser.Data{
+			streamIDData(p.ID),
+			parser.BulkStringData([]byte(p.Consumer)),
+			parser.IntegerData(int(idle)),
+			parser.IntegerData(int(p.DeliveryCount)),
+		}))
+	}
+	return parser.ArrayData(res)
+}
+
+// xclaimOptions are the options of XCLAIM after the IDs.
+type xclaimOptions struct {
+	deliveryTime int64
+	retryCount   int64 // negative to increment the count
+	force        bool
+	justID       bool
+	lastID       storage.StreamID
+}
+
+func parseXclaimOptions(args [][]byte, now int64) (xclaimOptions, string) {
+	opts := xclaimOptions{deliveryTime: now, retryCount: -1}
+	for i := 0; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "FORCE":
+			opts.force = true
+		case opt == "JUSTID":
+			opts.justID = true
+		case (opt == "IDLE" || opt == "TIME" || opt == "RETRYCOUNT") && i+1 < len(args):
+			i++
+			n, err := parseInt(args[i])
+			if err != nil {
+				return opts, errNotInteger
+			}
+			switch opt {
+			case "IDLE":
+				opts.deliveryTime = now - int64(n)
+			case "TIME":
+				opts.deliveryTime = int64(n)
+			default:
+				opts.retryCount = int64(n)
+			}
+		case opt == "LASTID" && i+1 < len(args):
+			i++
+			var ok bool
+			if opts.lastID, ok = parseStreamID(args[i], 0); !ok {
+				return opts, errInvalidStreamID
+			}
+		default:
+			return opts, "ERR Unrecognized XCLAIM option '" + string(args[i]) + "'"
+		}
+	}
+	if opts.deliveryTime < 0 || opts.deliveryTime > now {
+		opts.deliveryTime = now
+	}
+	return opts, ""
+}
+
+// handleXclaim serves XCLAIM key group consumer min-idle-time id... [IDLE ms]
+// [TIME ms] [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID id]. It gives the
+// pending entries that have been idle for long enough to the consumer, and
+// drops those that were deleted from the stream.
+func (h BaseHandler) handleXclaim(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	key, group, consumer := string(args[0]), string(args[1]), string(args[2])
+	minIdle, err := parseInt(args[3])
+	if err != nil {
+		rw.Write(parser.ErrorData("ERR Invalid min-idle-time argument for XCLAIM").Marshal())
+		return
+	}
+
+	i := 4
+	ids := []storage.StreamID{}
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i], 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		rw.Write(parser.ErrorData(errInvalidStreamID).Marshal())
+		return
+	}
+	now := time.Now().UnixMilli()
+	opts, errMsg := parseXclaimOptions(args[i:], now)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	req.PreventPropagation()
+	res := []parser.Data{}
+	found := true
+	err = h.db(req).UpdateStream(key, false, func(st *storage.Stream) {
+		g := st.Group(group)
+		if g == nil {
+			found = false
+			return
+		}
+		if g.LastID.Less(opts.lastID) {
+			g.LastID = opts.lastID
+		}
+		c := createConsumer(req, key, g, consumer, now)
+		c.SeenTime = now
+
+		for _, id := range ids {
+			p := g.Pending(id)
+			entry, exists := st.Entry(id)
+			if !exists {
+				if p != nil {
+					g.Ack(id)
+					req.RewriteCommand([]byte("XACK"), []byte(key), []byte(group), []byte(id.String()))
+				}
+				continue
+			}
+			if p == nil && !opts.force {
+				continue
+			}
+
+			var deliveryCount int64
+			if p != nil {
+				if now-p.DeliveryTime < int64(minIdle) {
+					continue
+				}
+				deliveryCount = p.DeliveryCount
+			}
+			switch {
+			case opts.retryCount >= 0:
+				deliveryCount = opts.retryCount
+			case !opts.justID:
+				deliveryCount++
+			}
+			p = g.Claim(id, consumer, opts.deliveryTime, deliveryCount)
+			c.ActiveTime = now
+			req.RewriteCommand(xclaimCommand(key, g, p)...)
+
+			if opts.justID {
+				res = append(res, streamIDData(id))
+			} else {
+				res = append(res, streamEntryData(entry))
+			}
+		}
+	})
+	if err == storage.ErrNoSuchKey || !found {
+		rw.Write(parser.ErrorData(noGroup(key, group)).Marshal())
+		return
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData(res).Marshal())
+}
+
+// handleXautoclaim serves XAUTOCLAIM key group consumer min-idle-time start
+// [COUNT count] [JUSTID]. It claims like XCLAIM the pending entries from the
+// start ID, looking at ten times count of them at most, and replies the ID to
+// continue from, the claimed entries and the IDs of the deleted ones.
+func (h BaseHandler) handleXautoclaim(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	key, group, consumer := string(args[0]), string(args[1]), string(args[2])
+	minIdle, err := parseInt(args[3])
+	if err != nil {
+		rw.Write(parser.ErrorData("ERR Invalid min-idle-time argument for XAUTOCLAIM").Marshal())
+		return
+	}
+	start, errMsg := parseRangeID(args[4], false)
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	count := 100
+	justID := false
+	for i := 5; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "COUNT" && i+1 < len(args):
+			i++
+			if count, err = parseInt(args[i]); err != nil {
+				rw.Write(parser.ErrorData(errNotInteger).Marshal())
+				return
+			}
+			if count < 1 || count > math.MaxInt32/10 {
+				rw.Write(parser.ErrorData("ERR COUNT must be > 0").Marshal())
+				return
+			}
+		case opt == "JUSTID":
+			justID = true
+		default:
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+	}
+
+	req.PreventPropagation()
+	now := time.Now().UnixMilli()
+	next := storage.StreamID{}
+	claimed := []parser.Data{}
+	deleted := []parser.Data{}
+	found := true
+	err = h.db(req).UpdateStream(key, false, func(st *storage.Stream) {
+		g := st.Group(group)
+		if g == nil {
+			found = false
+			return
+		}
+		c := createConsumer(req, key, g, consumer, now)
+		c.SeenTime = now
+
+		attempts := count * 10
+		pending := g.PendingRange(start, storage.MaxStreamID, -1, "")
+		for _, p := range pending {
+			if attempts == 0 || len(claimed) == count {
+				next = p.ID
+				break
+			}
+			attempts--
+
+			entry, exists := st.Entry(p.ID)
+			if !exists {
+				g.Ack(p.ID)
+				req.RewriteCommand([]byte("XACK"), []byte(key), []byte(group), []byte(p.ID.String()))
+				deleted = append(deleted, streamIDData(p.ID))
+				continue
+			}
+			if now-p.DeliveryTime < int64(minIdle) {
+				continue
+			}
+
+			deliveryCount := p.DeliveryCount
+			if !justID {
+				deliveryCount++
+			}
+			p = g.Claim(p.ID, consumer, now, deliveryCount)
+			c.ActiveTime = now
+			req.RewriteCommand(xclaimCommand(key, g, p)...)
+			if justID {
+				claimed = append(claimed, streamIDData(p.ID))
+			} else {
+				claimed = append(claimed, streamEntryData(entry))
+			}
+		}
+	})
+	if err == storage.ErrNoSuchKey || !found {
+		rw.Write(parser.ErrorData(noGroup(key, group)).Marshal())
+		return
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.ArrayData([]parser.Data{
+		streamIDData(next),
+		parser.ArrayData(claimed),
+		parser.ArrayData(deleted),
+	}).Marshal())
+}
+
+// handleXgroup serves the XGROUP subcommands CREATE, SETID, DESTROY,
+// CREATECONSUMER and DELCONSUMER.
+func (h BaseHandler) handleXgroup(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	sub := strings.ToUpper(string(args[0]))
+	arity := map[string][2]int{
+		"CREATE":         {4, 7},
+		"SETID":          {4, 6},
+		"DESTROY":        {3, 3},
+		"CREATECONSUMER": {4, 4},
+		"DELCONSUMER":    {4, 4},
+	}
+	bounds, ok := arity[sub]
+	if !ok {
+		rw.Write(parser.ErrorData("ERR unknown subcommand '" + string(args[0]) + "'. Try XGROUP HELP.").Marshal())
+		return
+	}
+	if len(args) < bounds[0] || len(args) > bounds[1] {
+		rw.Write(parser.ErrorData(wrongArgs("XGROUP|" + sub)).Marshal())
+		return
+	}
+
+	switch sub {
+	case "CREATE", "SETID":
+		h.xgroupSetID(req, rw, sub == "CREATE")
+		return
+	}
+
+	key, group := string(args[1]), string(args[2])
+	var res int
+	found := true
+	err := h.db(req).UpdateStream(key, false, func(st *storage.Stream) {
+		if sub == "DESTROY" {
+			if st.DestroyGroup(group) {
+				res = 1
+			}
+			return
+		}
+		g := st.Group(group)
+		if g == nil {
+			found = false
+			return
+		}
+		consumer := string(args[3])
+		if sub == "CREATECONSUMER" {
+			if _, created := g.CreateConsumer(consumer, time.Now().UnixMilli()); created {
+				res = 1
+			}
+		} else {
+			res, _ = g.DeleteConsumer(consumer)
+		}
+	})
+	switch {
+	case err == storage.ErrNoSuchKey:
+		rw.Write(parser.ErrorData(errXgroupNoKey).Marshal())
+		return
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	case !found:
+		rw.Write(parser.ErrorData(noConsumerGroup(key, group)).Marshal())
+		return
+	}
+	if res == 0 && sub != "DELCONSUMER" {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(res).Marshal())
+}
+
+func noConsumerGroup(key string, group string) string {
+	return "NOGROUP No such consumer group '" + group + "' for key name '" + key + "'"
+}
+
+// xgroupSetID serves XGROUP CREATE key group id|$ [MKSTREAM] [ENTRIESREAD n]
+// and XGROUP SETID key group id|$ [ENTRIESREAD n]. $ is propagated as the ID
+// it stands for.
+func (h BaseHandler) xgroupSetID(req Request, rw ResponseWriter, create bool) {
+	args := req.Command.Arguments
+	key, group := string(args[1]), string(args[2])
+	mkStream := false
+	entriesRead := int64(storage.InvalidEntriesRead)
+	for i := 4; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "MKSTREAM" && create:
+			mkStream = true
+		case opt == "ENTRIESREAD" && i+1 < len(args):
+			i++
+			n, err := parseInt(args[i])
+			if err != nil {
+				rw.Write(parser.ErrorData(errNotInteger).Marshal())
+				return
+			}
+			if n < storage.InvalidEntriesRead {
+				rw.Write(parser.ErrorData("ERR value for ENTRIESREAD must be positive or -1").Marshal())
+				return
+			}
+			entriesRead = int64(n)
+		default:
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+	}
+
+	var id storage.StreamID
+	lastID := string(args[3]) == "$"
+	if !lastID {
+		var ok bool
+		if id, ok = parseStreamID(args[3], 0); !ok {
+			rw.Write(parser.ErrorData(errInvalidStreamID).Marshal())
+			return
+		}
+	}
+
+	errMsg := ""
+	err := h.db(req).UpdateStream(key, mkStream, func(st *storage.Stream) {
+		if lastID {
+			id = st.LastID()
+		}
+		if create {
+			if !st.CreateGroup(group, id, entriesRead) {
+				errMsg = "BUSYGROUP Consumer Group name already exists"
+			}
+			return
+		}
+		g := st.Group(group)
+		if g == nil {
+			errMsg = noConsumerGroup(key, group)
+			return
+		}
+		g.SetID(id, entriesRead)
+	})
+	switch {
+	case err == storage.ErrNoSuchKey:
+		errMsg = errXgroupNoKey
+	case err != nil:
+		errMsg = err.Error()
+	}
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	if lastID {
+		propagated := append([][]byte{[]byte(req.Command.Name)}, args...)
+		propagated[4] = []byte(id.String())
+		req.RewriteCommand(propagated...)
+	}
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+// handleXinfo serves XINFO STREAM key [FULL [COUNT count]], XINFO GROUPS key
+// and XINFO CONSUMERS key group.
+func (h BaseHandler) handleXinfo(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	sub := strings.ToUpper(string(args[0]))
+	var fn func(st *storage.Stream) (parser.Data, string)
+	switch {
+	case sub == "STREAM" && len(args) >= 2:
+		full := false
+		count := 10
+		rest := args[2:]
+		if len(rest) > 0 {
+			if strings.ToUpper(string(rest[0])) != "FULL" || len(rest) == 2 || len(rest) > 3 ||
+				(len(rest) == 3 && strings.ToUpper(string(rest[1])) != "COUNT") {
+				rw.Write(parser.ErrorData(errSyntax).Marshal())
+				return
+			}
+			full = true
+			if len(rest) == 3 {
+				var err error
+				if count, err = parseInt(rest[2]); err != nil {
+					rw.Write(parser.ErrorData(errNotInteger).Marshal())
+					return
+				}
+				if count <= 0 {
+					count = -1
+				}
+			}
+		}
+		fn = func(st *storage.Stream) (parser.Data, string) {
+			if full {
+				return streamInfoFullData(st, count), ""
+			}
+			return streamInfoData(st), ""
+		}
+	case sub == "GROUPS" && len(args) == 2:
+		fn = func(st *storage.Stream) (parser.Data, string) {
+			groups := []parser.Data{}
+			for _, g := range st.Groups() {
+				groups = append(groups, parser.MapData([]parser.Data{
+					parser.BulkStringData([]byte("name")), parser.BulkStringData([]byte(g.Name)),
+					parser.BulkStringData([]byte("consumers")), parser.IntegerData(len(g.Consumers())),
+					parser.BulkStringData([]byte("pending")), parser.IntegerData(g.PendingLen()),
+					parser.BulkStringData([]byte("last-delivered-id")), streamIDData(g.LastID),
+					parser.BulkStringData([]byte("entries-read")), entriesReadData(g),
+					parser.BulkStringData([]byte("lag")), lagData(st, g),
+				}))
+			}
+			return parser.ArrayData(groups), ""
+		}
+	case sub == "CONSUMERS" && len(args) == 3:
+		group := string(args[2])
+		fn = func(st *storage.Stream) (parser.Data, string) {
+			g := st.Group(group)
+			if g == nil {
+				return parser.Data{}, noConsumerGroup(string(args[1]), group)
+			}
+			now := time.Now().UnixMilli()
+			consumers := []parser.Data{}
+			for _, c := range g.Consumers() {
+				inactive := int64(-1)
+				if c.ActiveTime != -1 {
+					inactive = now - c.ActiveTime
+				}
+				consumers = append(consumers, parser.MapData([]parser.Data{
+					parser.BulkStringData([]byte("name")), parser.BulkStringData([]byte(c.Name)),
+					parser.BulkStringData([]byte("pending")), parser.IntegerData(g.PendingCount(c.Name)),
+					parser.BulkStringData([]byte("idle")), parser.IntegerData(int(now - c.SeenTime)),
+					parser.BulkStringData([]byte("inactive")), parser.IntegerData(int(inactive)),
+				}))
+			}
+			return parser.ArrayData(consumers), ""
+		}
+	case sub == "STREAM" || sub == "GROUPS" || sub == "CONSUMERS":
+		rw.Write(parser.ErrorData(wrongArgs("XINFO|" + sub)).Marshal())
+		return
+	default:
+		rw.Write(parser.ErrorData("ERR unknown subcommand '" + string(args[0]) + "'. Try XINFO HELP.").Marshal())
+		return
+	}
+
+	var res parser.Data
+	var errMsg string
+	err := h.db(req).ReadStream(string(args[1]), func(st *storage.Stream) {
+		res, errMsg = fn(st)
+	})
+	switch {
+	case err == storage.ErrNoSuchKey:
+		errMsg = errNoSuchKey
+	case err != nil:
+		errMsg = err.Error()
+	}
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+	rw.Write(res.MarshalProto(req.Client.Proto()))
+}
+
+func entriesReadData(g *storage.ConsumerGroup) parser.Data {
+	if g.EntriesRead == storage.InvalidEntriesRead {
+		return parser.NullData()
+	}
+	return parser.IntegerData(int(g.EntriesRead))
+}
+
+func lagData(st *storage.Stream, g *storage.ConsumerGroup) parser.Data {
+	lag, ok := st.Lag(g)
+	if !ok {
+		return parser.NullData()
+	}
+	return parser.IntegerData(int(lag))
+}
+
+// streamInfoHeader is the part of XINFO STREAM shared by the full form. The
+// radix tree is the one redis would have, with nodes of 100 entries.
+func streamInfoHeader(st *storage.Stream) []parser.Data {
+	keys := (st.Len() + 99) / 100
+	return []parser.Data{
+		parser.BulkStringData([]byte("length")), parser.IntegerData(st.Len()),
+		parser.BulkStringData([]byte("radix-tree-keys")), parser.IntegerData(keys),
+		parser.BulkStringData([]byte("radix-tree-nodes")), parser.IntegerData(keys + 1),
+		parser.BulkStringData([]byte("last-generated-id")), streamIDData(st.LastID()),
+		parser.BulkStringData([]byte("max-deleted-entry-id")), streamIDData(st.MaxDeletedID()),
+		parser.BulkStringData([]byte("entries-added")), parser.IntegerData(int(st.EntriesAdded())),
+		parser.BulkStringData([]byte("recorded-first-entry-id")), streamIDData(st.FirstID()),
+	}
+}
+
+func streamInfoData(st *storage.Stream) parser.Data {
+	first, last := parser.NullData(), parser.NullData()
+	if st.Len() > 0 {
+		first = streamEntryData(st.Range(storage.StreamID{}, storage.MaxStreamID, 1, false)[0])
+		last = streamEntryData(st.Range(storage.StreamID{}, storage.MaxStreamID, 1, true)[0])
+	}
+	return parser.MapData(append(streamInfoHeader(st),
+		parser.BulkStringData([]byte("groups")), parser.IntegerData(len(st.Groups())),
+		parser.BulkStringData([]byte("first-entry")), first,
+		parser.BulkStringData([]byte("last-entry")), last,
+	))
+}
+
+// streamInfoFullData lists up to count entries, and the same number of
+// pending entries of every group and consumer. A negative count lists all.
+func streamInfoFullData(st *storage.Stream, count int) parser.Data {
+	groups := []parser.Data{}
+	for _, g := range st.Groups() {
+		pending := []parser.Data{}
+		for _, p := range g.PendingRange(storage.StreamID{}, storage.MaxStreamID, count, "") {
+			pending = append(pending, parser.ArrayData([]parser.Data{
+				streamIDData(p.ID),
+				parser.BulkStringData([]byte(p.Consumer)),
+				parser.IntegerData(int(p.DeliveryTime)),
+				parser.IntegerData(int(p.DeliveryCount)),
+			}))
+		}
+
+		consumers := []parser.Data{}
+		for _, c := range g.Consumers() {
+			consumerPending := []parser.Data{}
+			for _, p := range g.PendingRange(storage.StreamID{}, storage.MaxStreamID, count, c.Name) {
+				consumerPending = append(consumerPending, parser.ArrayData([]parser.Data{
+					streamIDData(p.ID),
+					parser.IntegerData(int(p.DeliveryTime)),
+					parser.IntegerData(int(p.DeliveryCount)),
+				}))
+			}
+			consumers = append(consumers, parser.MapData([]parser.Data{
+				parser.BulkStringData([]byte("name")), parser.BulkStringData([]byte(c.Name)),
+				parser.BulkStringData([]byte("seen-time")), parser.IntegerData(int(c.SeenTime)),
+				parser.BulkStringData([]byte("active-time")), parser.IntegerData(int(c.ActiveTime)),
+				parser.BulkStringData([]byte("pel-count")), parser.IntegerData(g.PendingCount(c.Name)),
+				parser.BulkStringData([]byte("pending")), parser.ArrayData(consumerPending),
+			}))
+		}
+
+		groups = append(groups, parser.MapData([]parser.Data{
+			parser.BulkStringData([]byte("name")), parser.BulkStringData([]byte(g.Name)),
+			parser.BulkStringData([]byte("last-delivered-id")), streamIDData(g.LastID),
+			parser.BulkStringData([]byte("entries-read")), entriesReadData(g),
+			parser.BulkStringData([]byte("lag")), lagData(st, g),
+			parser.BulkStringData([]byte("pel-count")), parser.IntegerData(g.PendingLen()),
+			parser.BulkStringData([]byte("pending")), parser.ArrayData(pending),
+			parser.BulkStringData([]byte("consumers")), parser.ArrayData(consumers),
+		}))
+	}
+
+	entries := st.Range(storage.StreamID{}, storage.MaxStreamID, count, false)
+	return parser.MapData(append(streamInfoHeader(st),
+		parser.BulkStringData([]byte("entries")), streamEntriesData(entries),
+		parser.BulkStringData([]byte("groups")), parser.ArrayData(groups),
+	))
+}
@@ -0,0 +1,553 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+const (
+	errOverflow = "ERR increment or decrement would overflow"
+	// the biggest string SETRANGE can make, like proto-max-bulk-len
+	maxStringLength = 512 * 1024 * 1024
+)
+
+func (h BaseHandler) routeStrings(server *Server) {
+	server.AddHandler("INCR", h.handleIncr)
+	server.AddHandler("INCRBY", h.handleIncr)
+	server.AddHandler("DECR", h.handleIncr)
+	server.AddHandler("DECRBY", h.handleIncr)
+	server.AddHandler("INCRBYFLOAT", h.handleIncrbyfloat)
+	server.AddHandler("APPEND", h.handleAppend)
+	server.AddHandler("STRLEN", h.handleStrlen)
+	server.AddHandler("GETRANGE", h.handleGetrange)
+	server.AddHandler("SETRANGE", h.handleSetrange)
+	server.AddHandler("GETDEL", h.handleGetdel)
+	server.AddHandler("GETEX", h.handleGetex)
+	server.AddHandler("GETSET", h.handleGetset)
+	server.AddHandler("SETNX", h.handleSetnx)
+	server.AddHandler("SETEX", h.handleSetex)
+	server.AddHandler("PSETEX", h.handleSetex)
+	server.AddHandler("MSET", h.handleMset)
+	server.AddHandler("MSETNX", h.handleMset)
+	server.AddHandler("MGET", h.handleMget)
+	server.AddHandler("LCS", h.handleLcs)
+}
+
+// parseStrictInt parses an integer the way redis does for the values of
+// strings: without spaces, a plus sign or leading zeros.
+func parseStrictInt(arg []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	return n, err == nil && strconv.FormatInt(n, 10) == string(arg)
+}
+
+// expireOption parses the EX, PX, EXAT and PXAT options of the command into
+// a deadline in unix milliseconds. given tells whether one of them was there.
+func expireOption(name string, opts map[string][][]byte) (at int64, given bool, errMsg string) {
+	invalid := "ERR invalid expire time in '" + strings.ToLower(name) + "' command"
+	count := 0
+	for _, opt := range []string{"EX", "PX", "EXAT", "PXAT"} {
+		optArgs, ok := opts[opt]
+		if !ok {
+			continue
+		}
+		count++
+
+		n, err := strconv.ParseInt(string(optArgs[0]), 10, 64)
+		if err != nil {
+			return 0, false, errNotInteger
+		}
+		if n <= 0 || ((opt == "EX" || opt == "EXAT") && n > math.MaxInt64/1000) {
+			return 0, false, invalid
+		}
+
+		switch opt {
+		case "EX":
+			n = time.Now().UnixMilli() + n*1000
+		case "PX":
+			n = time.Now().UnixMilli() + n
+		case "EXAT":
+			n *= 1000
+		}
+		if n <= 0 {
+			return 0, false, invalid
+		}
+		at = n
+	}
+	if count > 1 {
+		return 0, false, errSyntax
+	}
+	return at, count == 1, ""
+}
+
+// handleIncr serves INCR, INCRBY, DECR and DECRBY. The value must be the
+// canonical form of a 64 bit integer, and the key keeps its expiry.
+func (h BaseHandler) handleIncr(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	incr := int64(1)
+	if len(args) > 1 {
+		var ok bool
+		if incr, ok = parseStrictInt(args[1]); !ok {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+	}
+	if strings.HasPrefix(req.Command.Name, "DECR") {
+		if incr == math.MinInt64 {
+			rw.Write(parser.ErrorData("ERR decrement would overflow").Marshal())
+			return
+		}
+		incr = -incr
+	}
+
+	var res int64
+	var errMsg string
+	err := h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		if exists {
+			current, ok := parseStrictInt(value)
+			if !ok {
+				errMsg = errNotInteger
+				return nil, false
+			}
+			res = current
+		}
+		if (incr > 0 && res > math.MaxInt64-incr) || (incr < 0 && res < math.MinInt64-incr) {
+			errMsg = errOverflow
+			return nil, false
+		}
+		res += incr
+		return []byte(strconv.FormatInt(res, 10)), true
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(int(res)).Marshal())
+}
+
+// handleIncrbyfloat is propagated as SET with the result, so replicas don't
+// depend on how they round floats.
+func (h BaseHandler) handleIncrbyfloat(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	incr, err := strconv.ParseFloat(string(args[1]), 64)
+	if err != nil || math.IsNaN(incr) || math.IsInf(incr, 0) {
+		rw.Write(parser.ErrorData(errNotFloat).Marshal())
+		return
+	}
+
+	var res []byte
+	var errMsg string
+	err = h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		var current float64
+		if exists {
+			var err error
+			if current, err = strconv.ParseFloat(string(value), 64); err != nil {
+				errMsg = errNotFloat
+				return nil, false
+			}
+		}
+		sum := current + incr
+		if math.IsNaN(sum) || math.IsInf(sum, 0) {
+			errMsg = "ERR increment would produce NaN or Infinity"
+			return nil, false
+		}
+		res = []byte(formatFloat(sum))
+		return res, true
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	req.RewriteCommand([]byte("SET"), args[0], res, []byte("KEEPTTL"))
+	rw.Write(parser.BulkStringData(res).Marshal())
+}
+
+func (h BaseHandler) handleAppend(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	length := 0
+	err := h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		res := make([]byte, 0, len(value)+len(args[1]))
+		res = append(append(res, value...), args[1]...)
+		length = len(res)
+		return res, true
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+func (h BaseHandler) handleStrlen(req Request, rw ResponseWriter) {
+	value, err := h.db(req).Get(string(req.Command.Arguments[0]))
+	if err == storage.ErrWrongType {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(len(value)).Marshal())
+}
+
+// handleGetrange serves GETRANGE key start end, with inclusive indexes that
+// count from the end when negative.
+func (h BaseHandler) handleGetrange(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	start, err1 := parseInt(args[1])
+	end, err2 := parseInt(args[2])
+	if err1 != nil || err2 != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+	value, err := h.db(req).Get(string(args[0]))
+	if err == storage.ErrWrongType {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	if start < 0 && end < 0 && start > end {
+		rw.Write(parser.BulkStringData([]byte{}).Marshal())
+		return
+	}
+	length := len(value)
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if length == 0 || start > end {
+		rw.Write(parser.BulkStringData([]byte{}).Marshal())
+		return
+	}
+	rw.Write(parser.BulkStringData(value[start : end+1]).Marshal())
+}
+
+// handleSetrange serves SETRANGE key offset value, that overwrites the string
+// from offset on, padding it with zero bytes. An empty value changes nothing.
+func (h BaseHandler) handleSetrange(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	offset, err := parseInt(args[1])
+	if err != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+	if offset < 0 {
+		rw.Write(parser.ErrorData("ERR offset is out of range").Marshal())
+		return
+	}
+
+	patch := args[2]
+	length := 0
+	var errMsg string
+	err = h.db(req).UpdateString(string(args[0]), func(value []byte, exists bool) ([]byte, bool) {
+		if len(patch) == 0 {
+			length = len(value)
+			return nil, false
+		}
+		if offset > maxStringLength-len(patch) {
+			errMsg = "ERR string exceeds maximum allowed size (proto-max-bulk-len)"
+			return nil, false
+		}
+		size := len(value)
+		if offset+len(patch) > size {
+			size = offset + len(patch)
+		}
+		res := make([]byte, size)
+		copy(res, value)
+		copy(res[offset:], patch)
+		length = len(res)
+		return res, true
+	})
+	if err == nil && errMsg != "" {
+		err = errors.New(errMsg)
+	}
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if len(patch) == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+func (h BaseHandler) handleGetdel(req Request, rw ResponseWriter) {
+	value, err := h.db(req).GetDel(string(req.Command.Arguments[0]))
+	switch err {
+	case nil:
+		rw.Write(parser.BulkStringData(value).Marshal())
+	case storage.ErrNoSuchKey:
+		req.PreventPropagation()
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	}
+}
+
+// handleGetex serves GETEX key [EX|PX|EXAT|PXAT time|PERSIST]. The new
+// expiry is propagated as PEXPIREAT or PERSIST.
+func (h BaseHandler) handleGetex(req Request, rw ResponseWriter) {
+	key := req.Command.Arguments[0]
+	at, given, errMsg := expireOption(req.Command.Name, req.Command.Options)
+	_, persist := req.Command.Options["PERSIST"]
+	if errMsg == "" && given && persist {
+		errMsg = errSyntax
+	}
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	value, err := h.db(req).GetEx(string(key), at, persist)
+	switch err {
+	case nil:
+	case storage.ErrNoSuchKey:
+		req.PreventPropagation()
+		rw.Write(nullReply(req))
+		return
+	default:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+
+	switch {
+	case given:
+		req.RewriteCommand([]byte("PEXPIREAT"), key, []byte(strconv.FormatInt(at, 10)))
+	case persist:
+		req.RewriteCommand([]byte("PERSIST"), key)
+	default:
+		req.PreventPropagation()
+	}
+	rw.Write(parser.BulkStringData(value).Marshal())
+}
+
+func (h BaseHandler) handleGetset(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	prev, _, err := h.db(req).SetWithArgs(string(args[0]), args[1], storage.SetArgs{Get: true})
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case prev == nil:
+		rw.Write(nullReply(req))
+	default:
+		rw.Write(parser.BulkStringData(prev).Marshal())
+	}
+}
+
+func (h BaseHandler) handleSetnx(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	_, ok, _ := h.db(req).SetWithArgs(string(args[0]), args[1], storage.SetArgs{NX: true})
+	if !ok {
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(1).Marshal())
+}
+
+// handleSetex serves SETEX key seconds value and PSETEX key milliseconds
+// value. They are propagated as SET with an absolute deadline.
+func (h BaseHandler) handleSetex(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	invalid := "ERR invalid expire time in '" + strings.ToLower(req.Command.Name) + "' command"
+	ttl, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+	if req.Command.Name == "SETEX" {
+		if ttl > math.MaxInt64/1000 {
+			rw.Write(parser.ErrorData(invalid).Marshal())
+			return
+		}
+		ttl *= 1000
+	}
+	at := time.Now().UnixMilli() + ttl
+	if ttl <= 0 || at <= 0 {
+		rw.Write(parser.ErrorData(invalid).Marshal())
+		return
+	}
+
+	h.db(req).SetWithArgs(string(args[0]), args[2], storage.SetArgs{ExpireAt: at})
+	req.RewriteCommand([]byte("SET"), args[0], args[2], []byte("PXAT"), []byte(strconv.FormatInt(at, 10)))
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+// handleMset serves MSET, and MSETNX that sets nothing if one of the keys
+// exists.
+func (h BaseHandler) handleMset(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args)%2 != 0 {
+		rw.Write(parser.ErrorData(wrongArgs(req.Command.Name)).Marshal())
+		return
+	}
+	keys := make([]string, 0, len(args)/2)
+	values := make([][]byte, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, string(args[i]))
+		values = append(values, args[i+1])
+	}
+
+	ok := h.db(req).MSet(keys, values, req.Command.Name == "MSETNX")
+	switch {
+	case req.Command.Name == "MSET":
+		rw.Write(parser.StringData("OK").Marshal())
+	case ok:
+		rw.Write(parser.IntegerData(1).Marshal())
+	default:
+		req.PreventPropagation()
+		rw.Write(parser.IntegerData(0).Marshal())
+	}
+}
+
+// handleMget replies null for the keys that don't hold a string.
+func (h BaseHandler) handleMget(req Request, rw ResponseWriter) {
+	values := make([]parser.Data, len(req.Command.Arguments))
+	for i, key := range req.Command.Arguments {
+		if value, err := h.db(req).Get(string(key)); err == nil {
+			values[i] = parser.BulkStringData(value)
+		} else {
+			values[i] = parser.NullData()
+		}
+	}
+	rw.Write(parser.ArrayData(values).MarshalProto(req.Client.Proto()))
+}
+
+// handleLcs serves LCS key1 key2 [LEN] [IDX] [MINMATCHLEN len]
+// [WITHMATCHLEN]. It replies the longest common subsequence of the strings,
+// its length, or the ranges that match in both, from the last one.
+func (h BaseHandler) handleLcs(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	opts := req.Command.Options
+	_, getLen := opts["LEN"]
+	_, getIdx := opts["IDX"]
+	_, withMatchLen := opts["WITHMATCHLEN"]
+	minMatchLen := 0
+	if optArgs, ok := opts["MINMATCHLEN"]; ok {
+		var err error
+		if minMatchLen, err = parseInt(optArgs[0]); err != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		if minMatchLen < 0 {
+			minMatchLen = 0
+		}
+	}
+	if getLen && getIdx {
+		rw.Write(parser.ErrorData("ERR If you want both the length and indexes, please just use IDX.").Marshal())
+		return
+	}
+
+	a, errA := h.db(req).Get(string(args[0]))
+	b, errB := h.db(req).Get(string(args[1]))
+	if errA == storage.ErrWrongType || errB == storage.ErrWrongType {
+		rw.Write(parser.ErrorData("ERR The specified keys must contain string values").Marshal())
+		return
+	}
+
+	// lcs[i][j] is the length of the LCS of a[:i] and b[:j]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+		for j := 1; i > 0 && j <= len(b); j++ {
+			switch {
+			case a[i-1] == b[j-1]:
+				lcs[i][j] = lcs[i-1][j-1] + 1
+			case lcs[i-1][j] > lcs[i][j-1]:
+				lcs[i][j] = lcs[i-1][j]
+			default:
+				lcs[i][j] = lcs[i][j-1]
+			}
+		}
+	}
+	length := lcs[len(a)][len(b)]
+	if getLen {
+		rw.Write(parser.IntegerData(length).Marshal())
+		return
+	}
+
+	// walks back from the end, collecting the common bytes and the ranges
+	// of consecutive ones
+	res := make([]byte, length)
+	var matches []parser.Data
+	idx := length
+	i, j := len(a), len(b)
+	aStart, aEnd, bStart, bEnd := len(a), 0, 0, 0
+	for i > 0 && j > 0 {
+		emit := false
+		if a[i-1] == b[j-1] {
+			res[idx-1] = a[i-1]
+			switch {
+			case aStart == len(a):
+				aStart, aEnd, bStart, bEnd = i-1, i-1, j-1, j-1
+			case aStart == i && bStart == j:
+				aStart--
+				bStart--
+			default:
+				emit = true
+			}
+			if aStart == 0 || bStart == 0 {
+				emit = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if lcs[i-1][j] > lcs[i][j-1] {
+				i--
+			} else {
+				j--
+			}
+			if aStart != len(a) {
+				emit = true
+			}
+		}
+
+		if emit {
+			matchLen := aEnd - aStart + 1
+			if minMatchLen == 0 || matchLen >= minMatchLen {
+				match := []parser.Data{
+					parser.ArrayData([]parser.Data{parser.IntegerData(aStart), parser.IntegerData(aEnd)}),
+					parser.ArrayData([]parser.Data{parser.IntegerData(bStart), parser.IntegerData(bEnd)}),
+				}
+				if withMatchLen {
+					match = append(match, parser.IntegerData(matchLen))
+				}
+				matches = append(matches, parser.ArrayData(match))
+			}
+			aStart = len(a)
+		}
+	}
+
+	if !getIdx {
+		rw.Write(parser.BulkStringData(res).Marshal())
+		return
+	}
+	if matches == nil {
+		matches = []parser.Data{}
+	}
+	rw.Write(parser.MapData([]parser.Data{
+		parser.BulkStringData([]byte("matches")), parser.ArrayData(matches),
+		parser.BulkStringData([]byte("len")), parser.IntegerData(length),
+	}).MarshalProto(req.Client.Proto()))
+}
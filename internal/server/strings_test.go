@@ -0,0 +1,206 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetNull(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(nullBulk, "GET", "missing")
+	c.send("HELLO", "3")
+	c.read()
+	c.expect(null, "GET", "missing")
+	c.expect(ok, "SET", "a", "1")
+	c.expect(array(null, bulk("1")), "MGET", "missing", "a")
+}
+
+func TestIncrErrors(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "SET", "max", "9223372036854775807")
+	c.expect(ok, "SET", "min", "-9223372036854775808")
+	c.expect(ok, "SET", "big", "9223372036854775808")
+	c.expect(ok, "SET", "spaced", " 1")
+	c.expect(ok, "SET", "float", "1.5")
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"INCR", "max"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"INCRBY", "min", "-1"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"DECR", "min"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"DECRBY", "max", "-1"}, "-ERR increment or decrement would overflow\r\n"},
+		{[]string{"DECRBY", "n", "-9223372036854775808"}, "-ERR decrement would overflow\r\n"},
+		{[]string{"INCR", "big"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCR", "spaced"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCR", "float"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCRBY", "n", "1.0"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCRBY", "n", "+1"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"DECRBY", "n", "abc"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"INCRBY", "max", "-9223372036854775807"}, integer(0)},
+		{[]string{"DECRBY", "min", "-9223372036854775807"}, integer(-1)},
+	}
+	for _, e := range tests {
+		c.expect(e.want, e.args...)
+	}
+	// a failed increment leaves the value
+	c.expect(bulk("1.5"), "GET", "float")
+	c.expect(integer(0), "EXISTS", "n")
+}
+
+func TestIncrbyfloat(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(bulk("10.5"), "INCRBYFLOAT", "f", "10.5")
+	c.expect(bulk("5000"), "INCRBYFLOAT", "f", "4989.5e0")
+	c.expect(ok, "SET", "word", "abc")
+	c.expect(ok, "SET", "huge", "1.7e308")
+	c.expect(ok, "SET", "nan", "nan")
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"INCRBYFLOAT", "word", "1"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"INCRBYFLOAT", "f", "abc"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"INCRBYFLOAT", "f", "inf"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"INCRBYFLOAT", "f", "-inf"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"INCRBYFLOAT", "f", "nan"}, "-ERR value is not a valid float\r\n"},
+		{[]string{"INCRBYFLOAT", "huge", "1.7e308"}, "-ERR increment would produce NaN or Infinity\r\n"},
+		{[]string{"INCRBYFLOAT", "nan", "1"}, "-ERR increment would produce NaN or Infinity\r\n"},
+	}
+	for _, e := range tests {
+		c.expect(e.want, e.args...)
+	}
+	c.expect(bulk("1.7e308"), "GET", "huge")
+}
+
+func TestGetrange(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "SET", "s", "Hello World")
+	tests := []struct {
+		start, end string
+		want       string
+	}{
+		{"0", "4", "Hello"},
+		{"0", "-1", "Hello World"},
+		{"-5", "-1", "World"},
+		{"-100", "4", "Hello"},
+		{"6", "100", "World"},
+		{"-1", "-5", ""},
+		{"4", "2", ""},
+		{"11", "20", ""},
+		// like in redis both ends are clamped to the first byte
+		{"-100", "-50", "H"},
+	}
+	for _, e := range tests {
+		c.expect(bulk(e.want), "GETRANGE", "s", e.start, e.end)
+	}
+	c.expect(bulk(""), "GETRANGE", "missing", "0", "-1")
+	c.expect("-ERR value is not an integer or out of range\r\n", "GETRANGE", "s", "a", "1")
+}
+
+func TestSetrange(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "SET", "s", "Hello")
+	c.expect(integer(5), "SETRANGE", "s", "1", "EY")
+	c.expect(bulk("HEYlo"), "GET", "s")
+	// past the end the string is padded with zero bytes
+	c.expect(integer(9), "SETRANGE", "s", "7", "!!")
+	c.expect(bulk("HEYlo\x00\x00!!"), "GET", "s")
+	c.expect(integer(3), "SETRANGE", "new", "2", "x")
+	c.expect(bulk("\x00\x00x"), "GET", "new")
+
+	c.expect("-ERR offset is out of range\r\n", "SETRANGE", "s", "-1", "x")
+	c.expect("-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n", "SETRANGE", "s", "536870912", "x")
+	// an empty value doesn't create the key
+	c.expect(integer(0), "SETRANGE", "missing", "10", "")
+	c.expect(integer(0), "EXISTS", "missing")
+	c.expect(integer(9), "SETRANGE", "s", "100", "")
+}
+
+// deadline returns the last argument of a propagated command, a time in
+// milliseconds.
+func deadline(t *testing.T, cmd string) int64 {
+	t.Helper()
+	fields := strings.Fields(cmd)
+	at, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		t.Fatalf("No deadline in %q", cmd)
+	}
+	return at
+}
+
+func TestRelativeExpiryPropagation(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	stream := streamReader(t, master)
+	c := master.connect(t)
+
+	c.expect(ok, "SET", "a", "1")
+	start := time.Now().UnixMilli()
+	c.expect(bulk("1"), "GETEX", "a", "EX", "100")
+	c.expect(ok, "SETEX", "b", "100", "2")
+	c.expect(ok, "PSETEX", "c", "100000", "3")
+	c.expect(bulk("1"), "GETEX", "a", "PERSIST")
+	// without an option GETEX doesn't write
+	c.expect(bulk("1"), "GETEX", "a")
+	c.expect(ok, "SET", "d", "4")
+
+	want := []string{"SELECT 0", "SET a 1", "PEXPIREAT a", "SET b 2 PXAT", "SET c 3 PXAT", "PERSIST a", "SET d 4"}
+	res := stream.readCommands(len(want))
+	for i, cmd := range res {
+		if !strings.HasPrefix(cmd, want[i]) {
+			t.Fatalf("Wrong replication stream. Have: %q, want: %q", res, want)
+		}
+	}
+	for _, cmd := range res[2:5] {
+		if at := deadline(t, cmd); at < start+100_000 || at > time.Now().UnixMilli()+100_000 {
+			t.Errorf("Wrong deadline in %q", cmd)
+		}
+	}
+}
+
+func TestLcs(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "MSET", "a", "ohmytext", "b", "mynewtext")
+	c.expect(bulk("mytext"), "LCS", "a", "b")
+	c.expect(integer(6), "LCS", "a", "b", "LEN")
+	matches := func(ranges ...string) string {
+		return array(bulk("matches"), array(ranges...), bulk("len"), integer(6))
+	}
+	c.expect(matches(
+		array(array(integer(4), integer(7)), array(integer(5), integer(8))),
+		array(array(integer(2), integer(3)), array(integer(0), integer(1))),
+	), "LCS", "a", "b", "IDX")
+	c.expect(matches(
+		array(array(integer(4), integer(7)), array(integer(5), integer(8)), integer(4)),
+	), "LCS", "a", "b", "IDX", "MINMATCHLEN", "4", "WITHMATCHLEN")
+	c.expect(matches(
+		array(array(integer(4), integer(7)), array(integer(5), integer(8)), integer(4)),
+		array(array(integer(2), integer(3)), array(integer(0), integer(1)), integer(2)),
+	), "LCS", "a", "b", "IDX", "WITHMATCHLEN")
+	c.expect(matches(), "LCS", "a", "b", "IDX", "MINMATCHLEN", "5")
+
+	c.expect(bulk(""), "LCS", "a", "missing")
+	c.expect("-ERR If you want both the length and indexes, please just use IDX.\r\n", "LCS", "a", "b", "LEN", "IDX")
+	c.expect(integer(1), "RPUSH", "list", "x")
+	c.expect("-ERR The specified keys must contain string values\r\n", "LCS", "a", "list")
+}
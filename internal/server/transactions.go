@@ -0,0 +1,259 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/commands"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+// transaction is the state of a client between MULTI and EXEC.
+type transaction struct {
+	queued []Message
+	// set when a command couldn't be queued, EXEC fails then
+	aborted bool
+}
+
+// immediateCommands run right away inside a transaction instead of being
+// queued.
+var immediateCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"QUIT":    true,
+	"RESET":   true,
+}
+
+// watchManager keeps the keys watched by every client, and whether one of
+// them was written to since.
+type watchManager struct {
+	mu      sync.Mutex
+	keys    map[dbKey]map[*Client]bool
+	clients map[*Client]*watchState
+}
+
+type watchState struct {
+	keys  []dbKey
+	dirty bool
+}
+
+func newWatchManager() *watchManager {
+	return &watchManager{
+		keys:    make(map[dbKey]map[*Client]bool),
+		clients: make(map[*Client]*watchState),
+	}
+}
+
+func (wm *watchManager) watch(client *Client, db int, keys []string) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	state, ok := wm.clients[client]
+	if !ok {
+		state = &watchState{}
+		wm.clients[client] = state
+	}
+	for _, key := range keys {
+		key := dbKey{db, key}
+		if wm.keys[key] == nil {
+			wm.keys[key] = make(map[*Client]bool)
+		}
+		if !wm.keys[key][client] {
+			wm.keys[key][client] = true
+			state.keys = append(state.keys, key)
+		}
+	}
+}
+
+// touch marks the clients watching the key as dirty.
+func (wm *watchManager) touch(key dbKey) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	for client := range wm.keys[key] {
+		wm.clients[client].dirty = true
+	}
+}
+
+// watched returns the keys watched by the client.
+func (wm *watchManager) watched(client *Client) []dbKey {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	if state, ok := wm.clients[client]; ok {
+		return state.keys
+	}
+	return nil
+}
+
+// allKeys returns the keys watched by any client.
+func (wm *watchManager) allKeys() []dbKey {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	keys := make([]dbKey, 0, len(wm.keys))
+	for k := range wm.keys {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (wm *watchManager) dirty(client *Client) bool {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	state, ok := wm.clients[client]
+	return ok && state.dirty
+}
+
+func (wm *watchManager) unwatch(client *Client) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	state, ok := wm.clients[client]
+	if !ok {
+		return
+	}
+	for _, key := range state.keys {
+		delete(wm.keys[key], client)
+		if len(wm.keys[key]) == 0 {
+			delete(wm.keys, key)
+		}
+	}
+	delete(wm.clients, client)
+}
+
+// queue takes the command if the client is in a transaction, replying
+// QUEUED. Returns whether it did.
+func (s *Server) queue(req Request, rw ResponseWriter) bool {
+	tx := req.Client.multi
+	if tx == nil || immediateCommands[req.Command.Name] {
+		return false
+	}
+	tx.queued = append(tx.queued, req.Message)
+	rw.Write(parser.StringData("QUEUED").Marshal())
+	return true
+}
+
+// abortTransaction makes EXEC fail, after a command of the transaction was
+// rejected.
+func (c *Client) abortTransaction() {
+	if c.multi != nil {
+		c.multi.aborted = true
+	}
+}
+
+func (h BaseHandler) routeTransactions(server *Server) {
+	server.AddHandler("MULTI", h.handleMulti)
+	server.AddHandler("EXEC", h.handleExec)
+	server.AddHandler("DISCARD", h.handleDiscard)
+	server.AddHandler("WATCH", h.handleWatch)
+	server.AddHandler("UNWATCH", h.handleUnwatch)
+}
+
+func (h BaseHandler) handleMulti(req Request, rw ResponseWriter) {
+	if req.Client.multi != nil {
+		rw.Write(parser.ErrorData("ERR MULTI calls can not be nested").Marshal())
+		return
+	}
+	req.Client.multi = &transaction{}
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+func (h BaseHandler) handleDiscard(req Request, rw ResponseWriter) {
+	if req.Client.multi == nil {
+		rw.Write(parser.ErrorData("ERR DISCARD without MULTI").Marshal())
+		return
+	}
+	req.Client.multi = nil
+	h.server.watches.unwatch(req.Client)
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+// handleWatch serves WATCH key..., that makes the next EXEC of the client fail
+// if one of the keys is written to, deleted or expires before it.
+func (h BaseHandler) handleWatch(req Request, rw ResponseWriter) {
+	if req.Client.multi != nil {
+		rw.Write(parser.ErrorData("ERR WATCH inside MULTI is not allowed").Marshal())
+		return
+	}
+	keys := keyStrings(req.Command.Arguments)
+	// drops the keys that already expired, so their deletion doesn't count
+	h.db(req).Exists(keys...)
+	h.server.watches.watch(req.Client, req.Client.db, keys)
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+func (h BaseHandler) handleUnwatch(req Request, rw ResponseWriter) {
+	h.server.watches.unwatch(req.Client)
+	rw.Write(parser.StringData("OK").Marshal())
+}
+
+// handleExec runs the queued commands and replies an array of their replies,
+// or null if a watched key was modified. It holds the exec lock for writing
+// like any write command, so nothing runs in between. The write commands of
+// the transaction are propagated together, between MULTI and EXEC.
+func (h BaseHandler) handleExec(req Request, rw ResponseWriter) {
+	client := req.Client
+	tx := client.multi
+	if tx == nil {
+		rw.Write(parser.ErrorData("ERR EXEC without MULTI").Marshal())
+		return
+	}
+	client.multi = nil
+	defer h.server.watches.unwatch(client)
+
+	if tx.aborted {
+		rw.Write(parser.ErrorData("EXECABORT Transaction discarded because of previous errors.").Marshal())
+		return
+	}
+	// watched keys that expired since are only deleted when looked up
+	for _, k := range h.server.watches.watched(client) {
+		h.dbs.DB(k.db).Exists(k.key)
+	}
+	if h.server.watches.dirty(client) {
+		req.PreventPropagation()
+		rw.Write(nullArrayReply(req))
+		return
+	}
+
+	client.inExec = true
+	defer func() { client.inExec = false }()
+
+	var propagated []byte
+	// a queued SELECT changes the database of the commands after it
+	db := client.db
+	replies := []byte("*" + strconv.Itoa(len(tx.queued)) + "\r\n")
+	for _, msg := range tx.queued {
+		sub := Request{Conn: req.Conn, Client: client, Message: msg}
+		client.rewritten = false
+		client.rewrite = nil
+		client.block = nil
+		rec := &errorRecorder{ResponseWriter: &bufferResponseWriter{}}
+		NewNode(h.server.CallHandlers).Call(sub, rec)
+
+		reply := rec.ResponseWriter.(*bufferResponseWriter).buff
+		if client.block != nil {
+			// blocking commands don't wait inside a transaction
+			reply = client.block.onTimeout
+			client.block = nil
+		}
+		replies = append(replies, reply...)
+		if cmd := sub.Propagated(); msg.Command.Type == commands.Write && !rec.failed && len(cmd) > 0 {
+			if client.db != db {
+				propagated = append(propagated, selectCommand(client.db)...)
+				db = client.db
+			}
+			propagated = append(propagated, cmd...)
+		}
+	}
+	// like any propagated command, the transaction ends in the database it
+	// started in
+	if db != client.callDB {
+		propagated = append(propagated, selectCommand(client.callDB)...)
+	}
+
+	req.PreventPropagation()
+	if len(propagated) > 0 {
+		req.RewriteCommand([]byte("MULTI"))
+		client.rewrite = append(client.rewrite, propagated...)
+		req.RewriteCommand([]byte("EXEC"))
+	}
+	rw.Write(replies)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExecAbort(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c := ts.connect(t)
+
+	c.expect(ok, "MULTI")
+	c.expect(queued, "SET", "a", "1")
+	c.expect("-Too few arguments\r\n", "SET", "b")
+	c.expect("-Unknown command: NOSUCH\r\n", "NOSUCH")
+	c.expect(queued, "SET", "c", "3")
+	c.expect("-EXECABORT Transaction discarded because of previous errors.\r\n", "EXEC")
+
+	c.expect(integer(0), "EXISTS", "a", "c")
+	c.expect("-ERR EXEC without MULTI\r\n", "EXEC")
+}
+
+func TestWatch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c, other := ts.connect(t), ts.connect(t)
+
+	tests := []struct {
+		name  string
+		dirty func()
+	}{
+		{"write", func() {
+			other.expect(ok, "SET", "key", "changed")
+		}},
+		{"expiry", func() {
+			other.expect(integer(1), "PEXPIRE", "key", "10")
+			time.Sleep(50 * time.Millisecond)
+		}},
+		{"swapdb", func() {
+			other.expect(ok, "SWAPDB", "0", "1")
+		}},
+	}
+	for _, e := range tests {
+		c.expect(ok, "FLUSHALL")
+		c.expect(ok, "SET", "key", "value")
+		c.expect(ok, "WATCH", "key")
+		e.dirty()
+		c.expect(ok, "MULTI")
+		c.expect(queued, "SET", "result", "1")
+		if res := c.do("EXEC"); res != nullArray {
+			t.Errorf("Wrong reply to EXEC after a %s. Have: %q, want: %q", e.name, res, nullArray)
+		}
+		c.expect(integer(0), "EXISTS", "result")
+	}
+
+	// a key that wasn't touched doesn't abort the transaction, and EXEC
+	// unwatches it
+	c.expect(ok, "WATCH", "key")
+	other.expect(ok, "SET", "unrelated", "1")
+	c.expect(ok, "MULTI")
+	c.expect(queued, "SET", "result", "1")
+	c.expect(array(ok), "EXEC")
+	other.expect(ok, "SET", "key", "changed")
+	c.expect(ok, "MULTI")
+	c.expect(queued, "SET", "result", "2")
+	c.expect(array(ok), "EXEC")
+}
+
+func TestTransactionPropagation(t *testing.T) {
+	master := startMaster(t, 1<<20)
+	stream := streamReader(t, master)
+	c := master.connect(t)
+
+	c.expect(ok, "SELECT", "1")
+	c.expect(ok, "MULTI")
+	c.expect(queued, "SET", "a", "1")
+	c.expect(queued, "SELECT", "2")
+	c.expect(queued, "INCR", "b")
+	c.expect(queued, "GET", "b")
+	c.expect(queued, "DEL", "missing")
+	c.expect(array(ok, ok, integer(1), bulk("1"), integer(0)), "EXEC")
+	// a transaction without writes isn't propagated
+	c.expect(ok, "MULTI")
+	c.expect(queued, "GET", "b")
+	c.expect(array(bulk("1")), "EXEC")
+	c.expect(ok, "SET", "c", "3")
+
+	// the transaction ends in the database it started in, the client stays
+	// in the one it selected
+	want := []string{
+		"SELECT 1", "MULTI", "SET a 1", "SELECT 2", "INCR b", "SELECT 1", "EXEC",
+		"SELECT 2", "SET c 3",
+	}
+	if res := stream.readCommands(len(want)); !cmp.Equal(res, want) {
+		t.Errorf("Wrong replication stream. Have: %q, want: %q", res, want)
+	}
+}
+
+func TestBlockingInTransaction(t *testing.T) {
+	ts := newTestServer(t)
+	ts.listen(t)
+	c, other := ts.connect(t), ts.connect(t)
+
+	c.expect(integer(1), "RPUSH", "list", "a")
+	c.expect(ok, "MULTI")
+	c.expect(queued, "BLPOP", "list", "0")
+	c.expect(queued, "BLPOP", "list", "0")
+	c.expect(queued, "BLMOVE", "list", "dst", "LEFT", "LEFT", "0")
+	c.expect(queued, "BZPOPMIN", "zset", "0")
+	// the commands that would block reply like after their timeout
+	c.expect(array(array(bulk("list"), bulk("a")), nullArray, nullBulk, nullArray), "EXEC")
+
+	// nothing is left waiting for the keys
+	other.expect(integer(1), "RPUSH", "list", "b")
+	c.expect(array(bulk("b")), "LRANGE", "list", "0", "-1")
+	c.expect("+PONG\r\n", "PING")
+}
@@ -0,0 +1,723 @@
+package server
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/redis-starter-go/internal/storage"
+	"github.com/codecrafters-io/redis-starter-go/pkg/parser"
+)
+
+const (
+	errNotFloat      = "ERR value is not a valid float"
+	errMinMaxFloat   = "ERR min or max is not a float"
+	errMinMaxLex     = "ERR min or max not valid string range item"
+	errNaNScore      = "ERR resulting score is not a number (NaN)"
+	errLimitWithRank = "ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"
+)
+
+func (h BaseHandler) routeZSets(server *Server) {
+	server.AddHandler("ZADD", h.handleZadd)
+	server.AddHandler("ZINCRBY", h.handleZincrby)
+	server.AddHandler("ZSCORE", h.handleZscore)
+	server.AddHandler("ZMSCORE", h.handleZscore)
+	server.AddHandler("ZRANK", h.handleZrank)
+	server.AddHandler("ZREVRANK", h.handleZrank)
+	server.AddHandler("ZCARD", h.handleZcard)
+	server.AddHandler("ZCOUNT", h.handleZcount)
+	server.AddHandler("ZLEXCOUNT", h.handleZcount)
+	server.AddHandler("ZREM", h.handleZrem)
+	server.AddHandler("ZREMRANGEBYRANK", h.handleZremrange)
+	server.AddHandler("ZREMRANGEBYSCORE", h.handleZremrange)
+	server.AddHandler("ZREMRANGEBYLEX", h.handleZremrange)
+	server.AddHandler("ZRANGE", h.handleZrange)
+	server.AddHandler("ZREVRANGE", h.handleZrange)
+	server.AddHandler("ZRANGEBYSCORE", h.handleZrange)
+	server.AddHandler("ZREVRANGEBYSCORE", h.handleZrange)
+	server.AddHandler("ZRANGEBYLEX", h.handleZrange)
+	server.AddHandler("ZREVRANGEBYLEX", h.handleZrange)
+	server.AddHandler("ZRANGESTORE", h.handleZrangestore)
+	server.AddHandler("ZPOPMIN", h.handleZpop)
+	server.AddHandler("ZPOPMAX", h.handleZpop)
+	server.AddHandler("BZPOPMIN", h.handleBzpop)
+	server.AddHandler("BZPOPMAX", h.handleBzpop)
+	server.AddHandler("ZUNION", h.handleZsetOp)
+	server.AddHandler("ZINTER", h.handleZsetOp)
+	server.AddHandler("ZUNIONSTORE", h.handleZsetOp)
+	server.AddHandler("ZINTERSTORE", h.handleZsetOp)
+}
+
+// parseScore parses a score, the infinities are valid but NaN isn't.
+func parseScore(arg []byte) (float64, bool) {
+	score, err := strconv.ParseFloat(string(arg), 64)
+	return score, err == nil && !math.IsNaN(score)
+}
+
+// parseScoreRange parses the min and max of the BYSCORE ranges, where a
+// leading ( excludes the score.
+func parseScoreRange(min, max []byte) (storage.ScoreRange, bool) {
+	var r storage.ScoreRange
+	var ok1, ok2 bool
+	r.Min, r.MinEx, ok1 = parseScoreBound(min)
+	r.Max, r.MaxEx, ok2 = parseScoreBound(max)
+	return r, ok1 && ok2
+}
+
+func parseScoreBound(arg []byte) (float64, bool, bool) {
+	exclusive := len(arg) > 0 && arg[0] == '('
+	if exclusive {
+		arg = arg[1:]
+	}
+	score, ok := parseScore(arg)
+	return score, exclusive, ok
+}
+
+// parseLexRange parses the min and max of the BYLEX ranges: - and + are the
+// infinities, anything else starts with ( for an excluded member or [ for an
+// included one.
+func parseLexRange(min, max []byte) (storage.LexRange, bool) {
+	var r storage.LexRange
+	var ok1, ok2 bool
+	r.Min, ok1 = parseLexBound(min)
+	r.Max, ok2 = parseLexBound(max)
+	return r, ok1 && ok2
+}
+
+func parseLexBound(arg []byte) (storage.LexBound, bool) {
+	switch {
+	case string(arg) == "-":
+		return storage.LexBound{Inf: -1}, true
+	case string(arg) == "+":
+		return storage.LexBound{Inf: 1}, true
+	case len(arg) > 0 && (arg[0] == '(' || arg[0] == '['):
+		return storage.LexBound{Value: string(arg[1:]), Exclusive: arg[0] == '('}, true
+	}
+	return storage.LexBound{}, false
+}
+
+// zmembersData is the reply of the commands that return ranges of members.
+// With scores they are pairs of member and score in RESP3 and a flat array in
+// RESP2.
+func zmembersData(members []storage.ZMember, withScores bool, proto int) []byte {
+	res := make([]parser.Data, 0, len(members))
+	for _, m := range members {
+		member := parser.BulkStringData([]byte(m.Member))
+		switch {
+		case !withScores:
+			res = append(res, member)
+		case proto >= parser.Resp3:
+			res = append(res, parser.ArrayData([]parser.Data{member, parser.DoubleData(m.Score)}))
+		default:
+			res = append(res, member, parser.DoubleData(m.Score))
+		}
+	}
+	return parser.ArrayData(res).MarshalProto(proto)
+}
+
+// handleZadd serves ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member...
+// It replies the number of new members, or of changed ones with CH, and the
+// new score with INCR.
+func (h BaseHandler) handleZadd(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	var nx, xx, gt, lt, ch, incr bool
+	i := 1
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+
+	pairs := args[i:]
+	switch {
+	case len(pairs) == 0 || len(pairs)%2 != 0:
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	case nx && xx:
+		rw.Write(parser.ErrorData("ERR XX and NX options at the same time are not compatible").Marshal())
+		return
+	case (gt && lt) || (nx && (gt || lt)):
+		rw.Write(parser.ErrorData("ERR GT, LT, and/or NX options at the same time are not compatible").Marshal())
+		return
+	case incr && len(pairs) > 2:
+		rw.Write(parser.ErrorData("ERR INCR option supports a single increment-element pair").Marshal())
+		return
+	}
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		var ok bool
+		if scores[j], ok = parseScore(pairs[2*j]); !ok {
+			rw.Write(parser.ErrorData(errNotFloat).Marshal())
+			return
+		}
+	}
+
+	added, changed := 0, 0
+	var res float64
+	aborted, nan := false, false
+	err := h.db(req).UpdateZSet(string(args[0]), !xx, func(z *storage.ZSet) {
+		for j, score := range scores {
+			member := string(pairs[2*j+1])
+			current, exists := z.Score(member)
+			if (nx && exists) || (xx && !exists) {
+				aborted = true
+				continue
+			}
+			if incr {
+				if score += current; math.IsNaN(score) {
+					nan = true
+					return
+				}
+			}
+			if exists && ((gt && score <= current) || (lt && score >= current)) {
+				aborted = true
+				continue
+			}
+			if z.Set(member, score) {
+				added++
+			} else if score != current {
+				changed++
+			}
+			res = score
+		}
+	})
+	if err == storage.ErrNoSuchKey {
+		err, aborted = nil, true
+	}
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	case nan:
+		rw.Write(parser.ErrorData(errNaNScore).Marshal())
+		return
+	}
+
+	if added+changed == 0 {
+		req.PreventPropagation()
+	}
+	switch {
+	case incr && aborted:
+		rw.Write(nullReply(req))
+	case incr:
+		rw.Write(parser.DoubleData(res).MarshalProto(req.Client.Proto()))
+	case ch:
+		rw.Write(parser.IntegerData(added + changed).Marshal())
+	default:
+		rw.Write(parser.IntegerData(added).Marshal())
+	}
+}
+
+func (h BaseHandler) handleZincrby(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	incr, ok := parseScore(args[1])
+	if !ok {
+		rw.Write(parser.ErrorData(errNotFloat).Marshal())
+		return
+	}
+
+	var res float64
+	nan := false
+	err := h.db(req).UpdateZSet(string(args[0]), true, func(z *storage.ZSet) {
+		current, _ := z.Score(string(args[2]))
+		if res = current + incr; math.IsNaN(res) {
+			nan = true
+			return
+		}
+		z.Set(string(args[2]), res)
+	})
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case nan:
+		rw.Write(parser.ErrorData(errNaNScore).Marshal())
+	default:
+		rw.Write(parser.DoubleData(res).MarshalProto(req.Client.Proto()))
+	}
+}
+
+// handleZscore serves ZSCORE and ZMSCORE, which replies an array for all the
+// members it is given.
+func (h BaseHandler) handleZscore(req Request, rw ResponseWriter) {
+	members := req.Command.Arguments[1:]
+	res := make([]parser.Data, len(members))
+	err := h.db(req).ReadZSet(string(req.Command.Arguments[0]), func(z *storage.ZSet) {
+		for i, member := range members {
+			if score, ok := z.Score(string(member)); ok {
+				res[i] = parser.DoubleData(score)
+			} else {
+				res[i] = parser.NullData()
+			}
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if req.Command.Name == "ZSCORE" {
+		rw.Write(res[0].MarshalProto(req.Client.Proto()))
+		return
+	}
+	rw.Write(parser.ArrayData(res).MarshalProto(req.Client.Proto()))
+}
+
+// handleZrank serves ZRANK and ZREVRANK key member [WITHSCORE].
+func (h BaseHandler) handleZrank(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 3 || (len(args) == 3 && strings.ToUpper(string(args[2])) != "WITHSCORE") {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	withScore := len(args) == 3
+
+	var rank int
+	var score float64
+	found := false
+	err := h.db(req).ReadZSet(string(args[0]), func(z *storage.ZSet) {
+		rank, found = z.Rank(string(args[1]), req.Command.Name == "ZREVRANK")
+		score, _ = z.Score(string(args[1]))
+	})
+	switch {
+	case err != nil:
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+	case !found && withScore:
+		rw.Write(nullArrayReply(req))
+	case !found:
+		rw.Write(nullReply(req))
+	case withScore:
+		rw.Write(parser.ArrayData([]parser.Data{parser.IntegerData(rank), parser.DoubleData(score)}).MarshalProto(req.Client.Proto()))
+	default:
+		rw.Write(parser.IntegerData(rank).Marshal())
+	}
+}
+
+func (h BaseHandler) handleZcard(req Request, rw ResponseWriter) {
+	length := 0
+	err := h.db(req).ReadZSet(string(req.Command.Arguments[0]), func(z *storage.ZSet) {
+		length = z.Len()
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(length).Marshal())
+}
+
+// handleZcount serves ZCOUNT and ZLEXCOUNT.
+func (h BaseHandler) handleZcount(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	var count func(z *storage.ZSet) int
+	if req.Command.Name == "ZCOUNT" {
+		r, ok := parseScoreRange(args[1], args[2])
+		if !ok {
+			rw.Write(parser.ErrorData(errMinMaxFloat).Marshal())
+			return
+		}
+		count = func(z *storage.ZSet) int { return z.Count(r) }
+	} else {
+		r, ok := parseLexRange(args[1], args[2])
+		if !ok {
+			rw.Write(parser.ErrorData(errMinMaxLex).Marshal())
+			return
+		}
+		count = func(z *storage.ZSet) int { return z.LexCount(r) }
+	}
+
+	n := 0
+	err := h.db(req).ReadZSet(string(args[0]), func(z *storage.ZSet) {
+		n = count(z)
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(parser.IntegerData(n).Marshal())
+}
+
+func (h BaseHandler) handleZrem(req Request, rw ResponseWriter) {
+	removed := 0
+	err := h.db(req).UpdateZSet(string(req.Command.Arguments[0]), false, func(z *storage.ZSet) {
+		for _, member := range req.Command.Arguments[1:] {
+			if z.Remove(string(member)) {
+				removed++
+			}
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if removed == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(removed).Marshal())
+}
+
+// handleZremrange serves ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX.
+func (h BaseHandler) handleZremrange(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	var inRange func(z *storage.ZSet) []storage.ZMember
+	switch req.Command.Name {
+	case "ZREMRANGEBYRANK":
+		start, err1 := parseInt(args[1])
+		stop, err2 := parseInt(args[2])
+		if err1 != nil || err2 != nil {
+			rw.Write(parser.ErrorData(errNotInteger).Marshal())
+			return
+		}
+		inRange = func(z *storage.ZSet) []storage.ZMember { return z.Range(start, stop, false) }
+	case "ZREMRANGEBYSCORE":
+		r, ok := parseScoreRange(args[1], args[2])
+		if !ok {
+			rw.Write(parser.ErrorData(errMinMaxFloat).Marshal())
+			return
+		}
+		inRange = func(z *storage.ZSet) []storage.ZMember { return z.RangeByScore(r, false, 0, -1) }
+	default:
+		r, ok := parseLexRange(args[1], args[2])
+		if !ok {
+			rw.Write(parser.ErrorData(errMinMaxLex).Marshal())
+			return
+		}
+		inRange = func(z *storage.ZSet) []storage.ZMember { return z.RangeByLex(r, false, 0, -1) }
+	}
+
+	removed := 0
+	err := h.db(req).UpdateZSet(string(args[0]), false, func(z *storage.ZSet) {
+		for _, m := range inRange(z) {
+			z.Remove(m.Member)
+			removed++
+		}
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if removed == 0 {
+		req.PreventPropagation()
+	}
+	rw.Write(parser.IntegerData(removed).Marshal())
+}
+
+// zrangeQuery is a ZRANGE, or one of the older commands it replaces, parsed.
+type zrangeQuery struct {
+	by          string // BYSCORE, BYLEX or empty for ranks
+	rev         bool
+	start, stop int
+	scores      storage.ScoreRange
+	lex         storage.LexRange
+	offset      int
+	count       int // negative without a LIMIT
+	withScores  bool
+}
+
+// parseZrange parses the arguments of the ZRANGE family that follow the key:
+// min max [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES]. The older
+// commands have BYSCORE, BYLEX and REV in their name.
+func parseZrange(name string, args [][]byte) (zrangeQuery, string) {
+	q := zrangeQuery{count: -1}
+	switch name {
+	case "ZREVRANGE":
+		q.rev = true
+	case "ZRANGEBYSCORE":
+		q.by = "BYSCORE"
+	case "ZREVRANGEBYSCORE":
+		q.by, q.rev = "BYSCORE", true
+	case "ZRANGEBYLEX":
+		q.by = "BYLEX"
+	case "ZREVRANGEBYLEX":
+		q.by, q.rev = "BYLEX", true
+	}
+
+	modern := name == "ZRANGE" || name == "ZRANGESTORE"
+	hasLimit := false
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch {
+		case opt == "WITHSCORES" && name != "ZRANGESTORE":
+			q.withScores = true
+		case opt == "LIMIT" && i+2 < len(args):
+			var err1, err2 error
+			q.offset, err1 = parseInt(args[i+1])
+			q.count, err2 = parseInt(args[i+2])
+			if err1 != nil || err2 != nil {
+				return q, errNotInteger
+			}
+			hasLimit = true
+			i += 2
+		case modern && (opt == "BYSCORE" || opt == "BYLEX"):
+			q.by = opt
+		case modern && opt == "REV":
+			q.rev = true
+		default:
+			return q, errSyntax
+		}
+	}
+	if hasLimit && q.by == "" {
+		return q, errLimitWithRank
+	}
+	if q.withScores && q.by == "BYLEX" {
+		return q, "ERR syntax error, WITHSCORES not supported in combination with BYLEX"
+	}
+
+	// in reverse the ranges by score and by member start from the max
+	min, max := args[0], args[1]
+	if q.rev && q.by != "" {
+		min, max = max, min
+	}
+	var ok bool
+	switch q.by {
+	case "BYSCORE":
+		if q.scores, ok = parseScoreRange(min, max); !ok {
+			return q, errMinMaxFloat
+		}
+	case "BYLEX":
+		if q.lex, ok = parseLexRange(min, max); !ok {
+			return q, errMinMaxLex
+		}
+	default:
+		var err1, err2 error
+		q.start, err1 = parseInt(min)
+		q.stop, err2 = parseInt(max)
+		if err1 != nil || err2 != nil {
+			return q, errNotInteger
+		}
+	}
+	return q, ""
+}
+
+func (q zrangeQuery) run(z *storage.ZSet) []storage.ZMember {
+	if q.offset < 0 {
+		return []storage.ZMember{}
+	}
+	switch q.by {
+	case "BYSCORE":
+		return z.RangeByScore(q.scores, q.rev, q.offset, q.count)
+	case "BYLEX":
+		return z.RangeByLex(q.lex, q.rev, q.offset, q.count)
+	}
+	return z.Range(q.start, q.stop, q.rev)
+}
+
+func (h BaseHandler) handleZrange(req Request, rw ResponseWriter) {
+	q, errMsg := parseZrange(req.Command.Name, req.Command.Arguments[1:])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	var members []storage.ZMember
+	err := h.db(req).ReadZSet(string(req.Command.Arguments[0]), func(z *storage.ZSet) {
+		members = q.run(z)
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(zmembersData(members, q.withScores, req.Client.Proto()))
+}
+
+// handleZrangestore serves ZRANGESTORE dst src min max ..., which replaces
+// dst with the range and replies its size.
+func (h BaseHandler) handleZrangestore(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	q, errMsg := parseZrange(req.Command.Name, args[2:])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	res := storage.NewZSet()
+	err := h.db(req).ReadZSet(string(args[1]), func(z *storage.ZSet) {
+		for _, m := range q.run(z) {
+			res.Set(m.Member, m.Score)
+		}
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	h.db(req).StoreZSet(string(args[0]), res)
+	rw.Write(parser.IntegerData(res.Len()).Marshal())
+}
+
+// handleZpop serves ZPOPMIN and ZPOPMAX key [count].
+func (h BaseHandler) handleZpop(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	if len(args) > 2 {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	count, hasCount := 1, len(args) == 2
+	if hasCount {
+		var err error
+		if count, err = parseInt(args[1]); err != nil || count < 0 {
+			rw.Write(parser.ErrorData("ERR value is out of range, must be positive").Marshal())
+			return
+		}
+	}
+
+	var popped []storage.ZMember
+	err := h.db(req).UpdateZSet(string(args[0]), false, func(z *storage.ZSet) {
+		popped = z.Pop(count, req.Command.Name == "ZPOPMAX")
+	})
+	if err != nil && err != storage.ErrNoSuchKey {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	if len(popped) == 0 {
+		req.PreventPropagation()
+	}
+
+	// without a count the pair isn't nested, not even in RESP3
+	proto := req.Client.Proto()
+	if !hasCount {
+		proto = parser.Resp2
+	}
+	rw.Write(zmembersData(popped, true, proto))
+}
+
+// handleBzpop serves BZPOPMIN and BZPOPMAX: pop from the first non empty
+// sorted set, or block until one of them is written to. Propagated as the
+// non blocking command.
+func (h BaseHandler) handleBzpop(req Request, rw ResponseWriter) {
+	args := req.Command.Arguments
+	timeout, errMsg := parseTimeout(args[len(args)-1])
+	if errMsg != "" {
+		rw.Write(parser.ErrorData(errMsg).Marshal())
+		return
+	}
+
+	max := req.Command.Name == "BZPOPMAX"
+	keys := keyStrings(args[:len(args)-1])
+	for _, key := range keys {
+		var popped []storage.ZMember
+		err := h.db(req).UpdateZSet(key, false, func(z *storage.ZSet) {
+			popped = z.Pop(1, max)
+		})
+		if err == storage.ErrNoSuchKey {
+			continue
+		}
+		if err != nil {
+			rw.Write(parser.ErrorData(err.Error()).Marshal())
+			return
+		}
+
+		req.RewriteCommand([]byte(req.Command.Name[1:]), []byte(key))
+		rw.Write(parser.ArrayData([]parser.Data{
+			parser.BulkStringData([]byte(key)),
+			parser.BulkStringData([]byte(popped[0].Member)),
+			parser.DoubleData(popped[0].Score),
+		}).MarshalProto(req.Client.Proto()))
+		return
+	}
+	req.Block(keys, timeout, nullArrayReply(req))
+}
+
+// handleZsetOp serves ZUNION and ZINTER numkeys key... [WEIGHTS weight...]
+// [AGGREGATE SUM|MIN|MAX] [WITHSCORES], and the STORE variants that take the
+// destination first and reply the size of the result.
+func (h BaseHandler) handleZsetOp(req Request, rw ResponseWriter) {
+	name := req.Command.Name
+	args := req.Command.Arguments
+	store := strings.HasSuffix(name, "STORE")
+	var dst string
+	if store {
+		dst, args = string(args[0]), args[1:]
+	}
+
+	numkeys, err := parseInt(args[0])
+	if err != nil {
+		rw.Write(parser.ErrorData(errNotInteger).Marshal())
+		return
+	}
+	if numkeys < 1 {
+		rw.Write(parser.ErrorData("ERR at least 1 input key is needed for '" + strings.ToLower(name) + "' command").Marshal())
+		return
+	}
+	if numkeys > len(args)-1 {
+		rw.Write(parser.ErrorData(errSyntax).Marshal())
+		return
+	}
+	keys := keyStrings(args[1 : numkeys+1])
+
+	weights := make([]float64, numkeys)
+	for i := range weights {
+		weights[i] = 1
+	}
+	agg := storage.AggregateSum
+	withScores := false
+	for i := numkeys + 1; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); {
+		case opt == "WEIGHTS" && i+numkeys < len(args):
+			for j := range weights {
+				var ok bool
+				if weights[j], ok = parseScore(args[i+1+j]); !ok {
+					rw.Write(parser.ErrorData("ERR weight value is not a float").Marshal())
+					return
+				}
+			}
+			i += numkeys
+		case opt == "AGGREGATE" && i+1 < len(args):
+			switch strings.ToUpper(string(args[i+1])) {
+			case "SUM":
+				agg = storage.AggregateSum
+			case "MIN":
+				agg = storage.AggregateMin
+			case "MAX":
+				agg = storage.AggregateMax
+			default:
+				rw.Write(parser.ErrorData(errSyntax).Marshal())
+				return
+			}
+			i++
+		case opt == "WITHSCORES" && !store:
+			withScores = true
+		default:
+			rw.Write(parser.ErrorData(errSyntax).Marshal())
+			return
+		}
+	}
+
+	op := func(zsets []*storage.ZSet) *storage.ZSet {
+		if strings.HasPrefix(name, "ZUNION") {
+			return storage.UnionZSets(zsets, weights, agg)
+		}
+		return storage.InterZSets(zsets, weights, agg)
+	}
+
+	if store {
+		n, err := h.db(req).StoreZSets(dst, keys, op)
+		if err != nil {
+			rw.Write(parser.ErrorData(err.Error()).Marshal())
+			return
+		}
+		rw.Write(parser.IntegerData(n).Marshal())
+		return
+	}
+
+	var members []storage.ZMember
+	err = h.db(req).ReadZSets(keys, func(zsets []*storage.ZSet) {
+		members = op(zsets).Range(0, -1, false)
+	})
+	if err != nil {
+		rw.Write(parser.ErrorData(err.Error()).Marshal())
+		return
+	}
+	rw.Write(zmembersData(members, withScores, req.Client.Proto()))
+}
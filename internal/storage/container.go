@@ -0,0 +1,372 @@
+package storage
+
+// container is a value made of elements, the key is deleted once it has no
+// elements left.
+type container interface {
+	Len() int
+}
+
+// view calls fn with the value of the key, or with an empty value if the key
+// doesn't exist.
+func view[T container](s *Storage, key string, empty func() T, fn func(v T)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.lookup(key)
+	if !ok {
+		fn(empty())
+		return nil
+	}
+	v, ok := value.(T)
+	if !ok {
+		return ErrWrongType
+	}
+	fn(v)
+	return nil
+}
+
+// update calls fn with the value of the key. A missing key is created with
+// create, or ErrNoSuchKey is returned if create is nil.
+func update[T container](s *Storage, key string, create func() T, fn func(v T)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var v T
+	value, ok := s.lookup(key)
+	switch {
+	case ok:
+		if v, ok = value.(T); !ok {
+			return ErrWrongType
+		}
+	case create == nil:
+		return ErrNoSuchKey
+	default:
+		v = create()
+		s.put(key, v)
+	}
+
+	fn(v)
+	if v.Len() == 0 {
+		s.remove(key)
+	} else {
+		s.trackFieldExpires(key, v)
+		s.modified(key)
+	}
+	return nil
+}
+
+func newList() *List {
+	return &List{}
+}
+
+// ReadList calls fn with the list at key, an empty one if the key doesn't
+// exist. fn must not modify the list.
+func (s *Storage) ReadList(key string, fn func(l *List)) error {
+	return view(s, key, newList, fn)
+}
+
+// UpdateList calls fn with the list at key, creating it if create is set.
+// Without create a missing key is ErrNoSuchKey.
+func (s *Storage) UpdateList(key string, create bool, fn func(l *List)) error {
+	if create {
+		return update(s, key, newList, fn)
+	}
+	return update(s, key, nil, fn)
+}
+
+// ReadHash calls fn with the hash at key, an empty one if the key doesn't
+// exist. fn must not modify the hash.
+func (s *Storage) ReadHash(key string, fn func(h *Hash)) error {
+	return view(s, key, NewHash, fn)
+}
+
+// UpdateHash calls fn with the hash at key, creating it if create is set.
+// Without create a missing key is ErrNoSuchKey. Fields whose deadline set by
+// fn already passed are deleted right away.
+func (s *Storage) UpdateHash(key string, create bool, fn func(h *Hash)) error {
+	expiring := func(h *Hash) {
+		fn(h)
+		h.expireFields(now())
+	}
+	if create {
+		return update(s, key, NewHash, expiring)
+	}
+	return update(s, key, nil, expiring)
+}
+
+// ReadSet calls fn with the set at key, an empty one if the key doesn't
+// exist. fn must not modify the set.
+func (s *Storage) ReadSet(key string, fn func(set *Set)) error {
+	return view(s, key, newSet, fn)
+}
+
+// UpdateSet calls fn with the set at key, creating it if create is set.
+// Without create a missing key is ErrNoSuchKey.
+func (s *Storage) UpdateSet(key string, create bool, fn func(set *Set)) error {
+	if create {
+		return update(s, key, newSet, fn)
+	}
+	return update(s, key, nil, fn)
+}
+
+func newSet() *Set {
+	return NewSet()
+}
+
+// ReadSets calls fn with the sets at keys, empty ones for the keys that don't
+// exist. fn must not modify the sets.
+func (s *Storage) ReadSets(keys []string, fn func(sets []*Set)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sets, err := s.lookupSets(keys)
+	if err != nil {
+		return err
+	}
+	fn(sets)
+	return nil
+}
+
+// StoreSets replaces dst with the set that op computes from the sets at keys,
+// atomically. An empty result deletes dst. Returns the size of the result.
+func (s *Storage) StoreSets(dst string, keys []string, op func(sets []*Set) *Set) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sets, err := s.lookupSets(keys)
+	if err != nil {
+		return 0, err
+	}
+	res := op(sets)
+	s.remove(dst)
+	if res.Len() > 0 {
+		s.put(dst, res)
+	}
+	return res.Len(), nil
+}
+
+func (s *Storage) lookupSets(keys []string) ([]*Set, error) {
+	sets := make([]*Set, len(keys))
+	for i, key := range keys {
+		value, ok := s.lookup(key)
+		if !ok {
+			sets[i] = NewSet()
+			continue
+		}
+		if sets[i], ok = value.(*Set); !ok {
+			return nil, ErrWrongType
+		}
+	}
+	return sets, nil
+}
+
+// ReadZSet calls fn with the sorted set at key, an empty one if the key
+// doesn't exist. fn must not modify the sorted set.
+func (s *Storage) ReadZSet(key string, fn func(z *ZSet)) error {
+	return view(s, key, NewZSet, fn)
+}
+
+// UpdateZSet calls fn with the sorted set at key, creating it if create is
+// set. Without create a missing key is ErrNoSuchKey.
+func (s *Storage) UpdateZSet(key string, create bool, fn func(z *ZSet)) error {
+	if create {
+		return update(s, key, NewZSet, fn)
+	}
+	return update(s, key, nil, fn)
+}
+
+// ReadZSets calls fn with the sorted sets at keys, empty ones for the keys
+// that don't exist. Sets are taken as sorted sets where every score is 1. fn
+// must not modify the sorted sets.
+func (s *Storage) ReadZSets(keys []string, fn func(zsets []*ZSet)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zsets, err := s.lookupZSets(keys)
+	if err != nil {
+		return err
+	}
+	fn(zsets)
+	return nil
+}
+
+// StoreZSets replaces dst with the sorted set that op computes from the
+// sorted sets at keys, read like in ReadZSets, atomically. An empty result
+// deletes dst. Returns the size of the result.
+func (s *Storage) StoreZSets(dst string, keys []string, op func(zsets []*ZSet) *ZSet) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	zsets, err := s.lookupZSets(keys)
+	if err != nil {
+		return 0, err
+	}
+	res := op(zsets)
+	s.remove(dst)
+	if res.Len() > 0 {
+		s.put(dst, res)
+	}
+	return res.Len(), nil
+}
+
+// StoreZSet replaces dst with the sorted set, or deletes it if the sorted set
+// is empty.
+func (s *Storage) StoreZSet(dst string, z *ZSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(dst)
+	if z.Len() > 0 {
+		s.put(dst, z)
+	}
+}
+
+func (s *Storage) lookupZSets(keys []string) ([]*ZSet, error) {
+	zsets := make([]*ZSet, len(keys))
+	for i, key := range keys {
+		value, ok := s.lookup(key)
+		if !ok {
+			zsets[i] = NewZSet()
+			continue
+		}
+		switch v := value.(type) {
+		case *ZSet:
+			zsets[i] = v
+		case *Set:
+			zsets[i] = NewZSet()
+			for member := range v.members {
+				zsets[i].Set(member, 1)
+			}
+		default:
+			return nil, ErrWrongType
+		}
+	}
+	return zsets, nil
+}
+
+// ReadStream calls fn with the stream at key, or returns ErrNoSuchKey if the
+// key doesn't exist. fn must not modify the stream.
+func (s *Storage) ReadStream(key string, fn func(st *Stream)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.lookup(key)
+	if !ok {
+		return ErrNoSuchKey
+	}
+	st, ok := value.(*Stream)
+	if !ok {
+		return ErrWrongType
+	}
+	fn(st)
+	return nil
+}
+
+// UpdateStream calls fn with the stream at key, creating it if create is set.
+// Without create a missing key is ErrNoSuchKey. Streams aren't containers:
+// the key is kept when fn deletes all the entries.
+func (s *Storage) UpdateStream(key string, create bool, fn func(st *Stream)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var st *Stream
+	value, ok := s.lookup(key)
+	switch {
+	case ok:
+		if st, ok = value.(*Stream); !ok {
+			return ErrWrongType
+		}
+	case !create:
+		return ErrNoSuchKey
+	default:
+		st = NewStream()
+		s.put(key, st)
+	}
+
+	fn(st)
+	s.modified(key)
+	return nil
+}
+
+// MoveSet moves the member from the set at src to the one at dst, atomically.
+// Returns false if src doesn't have the member.
+func (s *Storage) MoveSet(src string, dst string, member string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sets, err := s.lookupSets([]string{src, dst})
+	if err != nil {
+		return false, err
+	}
+	from, to := sets[0], sets[1]
+	if !from.Remove(member) {
+		return false, nil
+	}
+	if src == dst {
+		from.Add(member)
+		return true, nil
+	}
+
+	if from.Len() == 0 {
+		s.remove(src)
+	} else {
+		s.modified(src)
+	}
+	to.Add(member)
+	if _, exists := s.storage[dst]; exists {
+		s.modified(dst)
+	} else {
+		s.put(dst, to)
+	}
+	return true, nil
+}
+
+// MoveList pops an element from one end of src and pushes it to one end of
+// dst, atomically. Returns ErrNoSuchKey if src doesn't exist.
+func (s *Storage) MoveList(src string, dst string, fromFront bool, toFront bool) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.lookup(src)
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	from, ok := value.(*List)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	to, created := from, false
+	if src != dst {
+		value, ok = s.lookup(dst)
+		if !ok {
+			to, created = newList(), true
+		} else if to, ok = value.(*List); !ok {
+			return nil, ErrWrongType
+		}
+	}
+
+	var elem []byte
+	if fromFront {
+		elem = from.PopFront()
+	} else {
+		elem = from.PopBack()
+	}
+	if toFront {
+		to.PushFront(elem)
+	} else {
+		to.PushBack(elem)
+	}
+
+	if from.Len() == 0 {
+		s.remove(src)
+	} else {
+		s.modified(src)
+	}
+	if created {
+		s.put(dst, to)
+	} else {
+		s.modified(dst)
+	}
+	return elem, nil
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Databases are the numbered keyspaces of the server, every client works on
+// the one it selected.
+type Databases struct {
+	mu  sync.RWMutex
+	dbs []*Storage
+	// called with every key that is written or deleted
+	listener func(db int, key string)
+
+	maxMemory int64
+	policy    EvictionPolicy
+	samples   int
+	evicted   int64
+}
+
+func NewDatabases(n int) *Databases {
+	d := &Databases{
+		dbs:     make([]*Storage, n),
+		policy:  NoEviction,
+		samples: 5,
+	}
+	for i := range d.dbs {
+		d.dbs[i] = NewStorage()
+	}
+	return d
+}
+
+// Len returns the number of databases.
+func (d *Databases) Len() int {
+	return len(d.dbs)
+}
+
+// DB returns the database at index, that must be in range.
+func (d *Databases) DB(index int) *Storage {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.dbs[index]
+}
+
+// SetListener registers fn to be called with every key that is written or
+// deleted, and its database. fn is called with the database locked, so it
+// must not use it.
+func (d *Databases) SetListener(fn func(db int, key string)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.listener = fn
+	d.setListeners()
+}
+
+// setListeners tells every database its index, for the listener.
+func (d *Databases) setListeners() {
+	for i, db := range d.dbs {
+		i := i
+		if d.listener == nil {
+			db.SetListener(nil)
+			continue
+		}
+		db.SetListener(func(key string) { d.listener(i, key) })
+	}
+}
+
+// Swap exchanges the keys of two databases.
+func (d *Databases) Swap(i, j int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dbs[i], d.dbs[j] = d.dbs[j], d.dbs[i]
+	d.setListeners()
+}
+
+// Move moves the key with its expiry from the database src to dst, that must
+// be different. Returns false if the key doesn't exist in src or already
+// exists in dst.
+func (d *Databases) Move(key string, src, dst int) bool {
+	from, to, unlock := d.lockPair(src, dst)
+	defer unlock()
+
+	value, ok := from.lookup(key)
+	if !ok {
+		return false
+	}
+	if _, exists := to.lookup(key); exists {
+		return false
+	}
+	expireAt, volatile := from.expires[key]
+	from.remove(key)
+	to.put(key, value)
+	if volatile {
+		to.expires[key] = expireAt
+	}
+	return true
+}
+
+// Copy copies the value and the expiry of src in the database srcDB to dst
+// in dstDB, replacing dst only if replace is set. Returns whether the value
+// was copied.
+func (d *Databases) Copy(src string, srcDB int, dst string, dstDB int, replace bool) bool {
+	if srcDB == dstDB {
+		return d.DB(srcDB).Copy(src, dst, replace)
+	}
+	from, to, unlock := d.lockPair(srcDB, dstDB)
+	defer unlock()
+
+	value, ok := from.lookup(src)
+	if !ok {
+		return false
+	}
+	if _, exists := to.lookup(dst); exists && !replace {
+		return false
+	}
+	to.remove(dst)
+	to.put(dst, cloneValue(value))
+	if expireAt, volatile := from.expires[src]; volatile {
+		to.expires[dst] = expireAt
+	}
+	return true
+}
+
+// lockPair locks two different databases for writing, always in the same
+// order so two calls can't deadlock.
+func (d *Databases) lockPair(i, j int) (*Storage, *Storage, func()) {
+	d.mu.RLock()
+	a, b := d.dbs[i], d.dbs[j]
+	d.mu.RUnlock()
+
+	first, second := a, b
+	if i > j {
+		first, second = b, a
+	}
+	first.mu.Lock()
+	second.mu.Lock()
+	return a, b, func() {
+		second.mu.Unlock()
+		first.mu.Unlock()
+	}
+}
+
+// FlushAll deletes the keys of every database.
+func (d *Databases) FlushAll() {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	for _, db := range d.dbs {
+		db.Flush()
+	}
+}
+
+// Clone returns a point-in-time copy of every database.
+func (d *Databases) Clone() *Databases {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	clone := &Databases{dbs: make([]*Storage, len(d.dbs))}
+	for i, db := range d.dbs {
+		clone.dbs[i] = db.Clone()
+	}
+	return clone
+}
+
+// ActiveExpire deletes expired keys of every database in the background
+// until ctx is done.
+func (d *Databases) ActiveExpire(ctx context.Context) {
+	t := time.NewTicker(activeExpireInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			d.mu.RLock()
+			dbs := append([]*Storage(nil), d.dbs...)
+			d.mu.RUnlock()
+			for _, db := range dbs {
+				db.activeExpireCycle()
+			}
+		}
+	}
+}
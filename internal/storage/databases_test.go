@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMove(t *testing.T) {
+	d := NewDatabases(3)
+	d.DB(0).SetWithArgs("key", []byte("value"), SetArgs{ExpireAt: now() + 60_000})
+	d.DB(2).Set("taken", []byte("other"))
+	d.DB(0).Set("taken", []byte("value"))
+
+	if !d.Move("key", 0, 1) {
+		t.Fatal("Move failed")
+	}
+	if d.DB(0).Exists("key") != 0 {
+		t.Error("The key is still in the source database")
+	}
+	if v, _ := d.DB(1).Get("key"); string(v) != "value" {
+		t.Errorf("Wrong moved value. Have: %q, want: %q", v, "value")
+	}
+	if _, expires := d.DB(1).Len(); expires != 1 {
+		t.Error("The expiry was not moved")
+	}
+
+	if d.Move("missing", 0, 1) {
+		t.Error("Moved a missing key")
+	}
+	if d.Move("taken", 0, 2) {
+		t.Error("Moved over an existing key")
+	}
+	if v, _ := d.DB(2).Get("taken"); string(v) != "other" {
+		t.Errorf("The existing key was changed. Have: %q, want: %q", v, "other")
+	}
+}
+
+func TestCopyBetweenDatabases(t *testing.T) {
+	d := NewDatabases(2)
+	d.DB(0).Set("src", []byte("value"))
+	d.DB(1).Set("dst", []byte("old"))
+
+	if d.Copy("src", 0, "dst", 1, false) {
+		t.Error("Copied over an existing key without replace")
+	}
+	if !d.Copy("src", 0, "dst", 1, true) {
+		t.Fatal("Copy with replace failed")
+	}
+	if v, _ := d.DB(1).Get("dst"); string(v) != "value" {
+		t.Errorf("Wrong copied value. Have: %q, want: %q", v, "value")
+	}
+	if d.DB(0).Exists("src") != 1 {
+		t.Error("The source key was deleted")
+	}
+}
+
+func TestSwap(t *testing.T) {
+	d := NewDatabases(2)
+	var modified []int
+	d.SetListener(func(db int, key string) {
+		modified = append(modified, db)
+	})
+	d.DB(0).Set("key", []byte("value"))
+	d.Swap(0, 1)
+
+	if d.DB(1).Exists("key") != 1 || d.DB(0).Exists("key") != 0 {
+		t.Error("The databases were not swapped")
+	}
+	d.DB(1).Delete("key")
+	d.DB(0).Set("other", []byte("value"))
+	if want := []int{0, 1, 0}; !cmp.Equal(modified, want) {
+		t.Errorf("Wrong databases passed to the listener. Have: %v, want: %v", modified, want)
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	d := NewDatabases(3)
+	for i := 0; i < d.Len(); i++ {
+		d.DB(i).Set("key", []byte("value"))
+	}
+	d.FlushAll()
+	for i := 0; i < d.Len(); i++ {
+		if size, _ := d.DB(i).Len(); size != 0 {
+			t.Errorf("Database %d has %d keys after the flush", i, size)
+		}
+	}
+}
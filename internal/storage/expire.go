@@ -0,0 +1,180 @@
+package storage
+
+import "time"
+
+// ExpireCondition restricts when Expire changes the deadline of a key, the
+// conditions can be combined.
+type ExpireCondition int
+
+const (
+	ExpireNX ExpireCondition = 1 << iota // only if the key has no expiry
+	ExpireXX                             // only if the key has an expiry
+	ExpireGT                             // only if the new deadline is later, no expiry counts as infinite
+	ExpireLT                             // only if the new deadline is earlier, no expiry counts as infinite
+
+	ExpireAlways ExpireCondition = 0
+)
+
+// allows tells whether the deadline can be changed to at, given the current
+// one if volatile is set.
+func (c ExpireCondition) allows(current int64, volatile bool, at int64) bool {
+	return !((c&ExpireNX != 0 && volatile) ||
+		(c&ExpireXX != 0 && !volatile) ||
+		(c&ExpireGT != 0 && (!volatile || at <= current)) ||
+		(c&ExpireLT != 0 && volatile && at >= current))
+}
+
+// Like activeExpireCycle in redis: every interval a sample of keys with an
+// expiry is checked, and while many of them turn out to be expired the
+// sampling goes on, within the time budget.
+const (
+	activeExpireInterval  = 100 * time.Millisecond
+	activeExpireBudget    = 25 * time.Millisecond
+	activeExpireSamples   = 20
+	activeExpireThreshold = 25 // percent of expired keys in a sample to keep going
+)
+
+func now() int64 {
+	return time.Now().UnixMilli()
+}
+
+// Expire sets the deadline of the key, a unix time in ms. A deadline in the
+// past deletes the key. Returns false if the key doesn't exist or the
+// condition isn't met.
+func (s *Storage) Expire(key string, at int64, cond ExpireCondition) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expireIfNeeded(key, now()) {
+		return false
+	}
+	if _, ok := s.storage[key]; !ok {
+		return false
+	}
+
+	current, volatile := s.expires[key]
+	if !cond.allows(current, volatile, at) {
+		return false
+	}
+
+	s.expires[key] = at
+	if !s.expireIfNeeded(key, now()) {
+		s.modified(key)
+	}
+	return true
+}
+
+// ExpireTime returns the deadline of the key as a unix time in ms, 0 if the
+// key doesn't expire. ok is false if the key doesn't exist.
+func (s *Storage) ExpireTime(key string) (at int64, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expireIfNeeded(key, now()) {
+		return 0, false
+	}
+	if _, ok := s.storage[key]; !ok {
+		return 0, false
+	}
+	return s.expires[key], true
+}
+
+// Persist removes the expiry of the key, returns false if the key doesn't
+// exist or has no expiry.
+func (s *Storage) Persist(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.expireIfNeeded(key, now()) {
+		return false
+	}
+	if _, ok := s.expires[key]; !ok {
+		return false
+	}
+	delete(s.expires, key)
+	s.modified(key)
+	return true
+}
+
+func (s *Storage) activeExpireCycle() {
+	start := time.Now()
+	for time.Since(start) < activeExpireBudget {
+		sampled, expired := s.sampleExpired(activeExpireSamples)
+		if sampled == 0 || expired*100 < sampled*activeExpireThreshold {
+			return
+		}
+	}
+}
+
+// sampleExpired checks up to n keys with an expiry, or hashes with fields
+// that expire, relying on the random iteration order of maps, and deletes
+// what expired.
+func (s *Storage) sampleExpired(n int) (sampled int, expired int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := now()
+	for key := range s.expires {
+		if sampled == n {
+			break
+		}
+		sampled++
+		if s.expireIfNeeded(key, ts) {
+			expired++
+		}
+	}
+	for key := range s.volatileHashes {
+		if sampled == n {
+			break
+		}
+		sampled++
+		if s.expireFieldsIfNeeded(key, ts) {
+			expired++
+		}
+	}
+	return sampled, expired
+}
+
+func (s *Storage) isExpired(key string, ts int64) bool {
+	at, ok := s.expires[key]
+	return ok && at <= ts
+}
+
+// expireIfNeeded deletes the key if its deadline passed and tells whether it
+// did. Must be called with the lock held for writing.
+func (s *Storage) expireIfNeeded(key string, ts int64) bool {
+	if !s.isExpired(key, ts) {
+		return false
+	}
+	return s.remove(key)
+}
+
+// expireFieldsIfNeeded deletes the fields of the hash at key whose deadline
+// passed, and the key if no field is left. Tells whether it deleted anything.
+// Must be called with the lock held for writing.
+func (s *Storage) expireFieldsIfNeeded(key string, ts int64) bool {
+	if _, ok := s.volatileHashes[key]; !ok {
+		return false
+	}
+	h := s.storage[key].value.(*Hash)
+	if h.expireFields(ts) == 0 {
+		return false
+	}
+	if h.Len() == 0 {
+		s.remove(key)
+		return true
+	}
+	s.trackFieldExpires(key, h)
+	s.modified(key)
+	return true
+}
+
+// trackFieldExpires remembers whether the value at key is a hash with fields
+// that expire, for the active expiry.
+func (s *Storage) trackFieldExpires(key string, value any) {
+	if h, ok := value.(*Hash); ok && len(h.expires) > 0 {
+		s.volatileHashes[key] = struct{}{}
+	} else {
+		delete(s.volatileHashes, key)
+	}
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+)
+
+func TestLazyExpiry(t *testing.T) {
+	s := NewStorage()
+	s.SetWithArgs("key", []byte("old"), SetArgs{ExpireAt: now() + 20})
+	s.Set("key", []byte("new"))
+
+	time.Sleep(30 * time.Millisecond)
+	if v, err := s.Get("key"); err != nil || string(v) != "new" {
+		t.Errorf("Overwritten key expired with the old deadline")
+	}
+
+	s.Expire("key", now()+10, ExpireAlways)
+	time.Sleep(20 * time.Millisecond)
+	if _, err := s.Get("key"); err == nil {
+		t.Errorf("Expired key is still returned")
+	}
+	if keys, expires := s.Len(); keys != 0 || expires != 0 {
+		t.Errorf("Wrong size after lazy expiry. Have: %d, %d, want: 0, 0", keys, expires)
+	}
+}
+
+func TestExpireConditions(t *testing.T) {
+	later := now() + 60_000
+	tests := []utils.Test[ExpireCondition, []bool]{
+		// results for a key without an expiry and for one that expires later
+		{Name: "Always", Input: ExpireAlways, Want: []bool{true, true}},
+		{Name: "NX", Input: ExpireNX, Want: []bool{true, false}},
+		{Name: "XX", Input: ExpireXX, Want: []bool{false, true}},
+		{Name: "GT", Input: ExpireGT, Want: []bool{false, false}},
+		{Name: "LT", Input: ExpireLT, Want: []bool{true, true}},
+		{Name: "XX LT", Input: ExpireXX | ExpireLT, Want: []bool{false, true}},
+	}
+
+	for _, test := range tests {
+		s := NewStorage()
+		s.Set("persistent", []byte("v"))
+		s.SetWithArgs("volatile", []byte("v"), SetArgs{ExpireAt: later})
+
+		res := []bool{
+			s.Expire("persistent", now()+1000, test.Input),
+			s.Expire("volatile", now()+1000, test.Input),
+		}
+		if fmt.Sprint(res) != fmt.Sprint(test.Want) {
+			t.Errorf(test.ToString(res))
+		}
+	}
+}
+
+func TestActiveExpire(t *testing.T) {
+	s := NewStorage()
+	for i := 0; i < 1000; i++ {
+		s.SetWithArgs(fmt.Sprintf("key:%d", i), []byte("v"), SetArgs{ExpireAt: now() + 10})
+	}
+	s.Set("persistent", []byte("v"))
+
+	time.Sleep(20 * time.Millisecond)
+	s.activeExpireCycle()
+
+	if keys, expires := s.Len(); keys != 1 || expires != 0 {
+		t.Errorf("Wrong size after the expire cycle. Have: %d, %d, want: 1, 0", keys, expires)
+	}
+}
@@ -0,0 +1,303 @@
+package storage
+
+import "math"
+
+// The geo commands keep the positions in sorted sets, the score of a member
+// is the 52 bit geohash of its position: the bits of the latitude and the
+// longitude, scaled to the ranges below, interleaved.
+const (
+	GeoLongMin = -180
+	GeoLongMax = 180
+	// the latitudes of the web mercator projection
+	GeoLatMin = -85.05112878
+	GeoLatMax = 85.05112878
+
+	geoStepMax = 26
+	// the radius redis uses, so the distances are the same
+	earthRadius = 6372797.560856
+	mercatorMax = 20037726.37
+
+	geoAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// GeoPoint is a member of a geo index found by a search.
+type GeoPoint struct {
+	Member    string
+	Score     float64
+	Longitude float64
+	Latitude  float64
+	// the distance from the center of the search, in meters
+	Dist float64
+}
+
+// GeoShape is the area of a search around a center: a circle of Radius
+// meters, or with Box a rectangle of Width by Height meters.
+type GeoShape struct {
+	Longitude, Latitude float64
+	Box                 bool
+	Radius              float64
+	Width, Height       float64
+}
+
+// geoArea is the cell of a geohash.
+type geoArea struct {
+	lonMin, lonMax float64
+	latMin, latMax float64
+}
+
+// GeoEncode returns the score of a position.
+func GeoEncode(lon, lat float64) float64 {
+	return float64(geoEncode(lon, lat, geoStepMax))
+}
+
+// GeoDecode returns the position of the center of the cell of a score.
+func GeoDecode(score float64) (lon, lat float64) {
+	area := geoDecode(uint64(score), geoStepMax)
+	lon = math.Max(GeoLongMin, math.Min(GeoLongMax, (area.lonMin+area.lonMax)/2))
+	lat = math.Max(GeoLatMin, math.Min(GeoLatMax, (area.latMin+area.latMax)/2))
+	return lon, lat
+}
+
+// GeoHash returns the standard 11 characters geohash of a score. The score
+// uses the mercator latitudes, the standard geohash uses -90 to 90, so the
+// position is decoded and encoded again.
+func GeoHash(score float64) string {
+	lon, lat := GeoDecode(score)
+	bits := interleave(uint32((lat+90)/180*(1<<geoStepMax)), uint32((lon+180)/360*(1<<geoStepMax)))
+
+	res := make([]byte, 11)
+	for i := range res {
+		// 52 bits make 10 characters and a bit, the last one is 0
+		idx := 0
+		if i < 10 {
+			idx = int(bits>>(52-(i+1)*5)) & 0x1f
+		}
+		res[i] = geoAlphabet[idx]
+	}
+	return string(res)
+}
+
+// GeoDistance returns the distance in meters between two positions, with
+// the haversine formula.
+func GeoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	v := math.Sin((degRad(lon2) - degRad(lon1)) / 2)
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadius * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+func degRad(deg float64) float64 {
+	return deg * (math.Pi / 180)
+}
+
+func radDeg(rad float64) float64 {
+	return rad / (math.Pi / 180)
+}
+
+// contains reports whether the position is in the shape, and its distance
+// from the center.
+func (shape GeoShape) contains(lon, lat float64) (float64, bool) {
+	if !shape.Box {
+		dist := GeoDistance(shape.Longitude, shape.Latitude, lon, lat)
+		return dist, dist <= shape.Radius
+	}
+	// the latitude distance is the cheapest, it goes first
+	if geoLatDistance(lat, shape.Latitude) > shape.Height/2 {
+		return 0, false
+	}
+	if GeoDistance(lon, lat, shape.Longitude, lat) > shape.Width/2 {
+		return 0, false
+	}
+	return GeoDistance(shape.Longitude, shape.Latitude, lon, lat), true
+}
+
+// GeoSearch returns the members in the shape, stopping at limit if it's not
+// 0. They come from the cell of the geohash around the center and its
+// neighbors, which are picked so they cover the shape, like redis does.
+func (z *ZSet) GeoSearch(shape GeoShape, limit int) []GeoPoint {
+	res := []GeoPoint{}
+	searched := make(map[uint64]bool)
+	step, cells := shape.cells()
+	for _, cell := range cells {
+		// with huge shapes some neighbors are the same cell
+		if searched[cell] {
+			continue
+		}
+		searched[cell] = true
+
+		shift := 52 - 2*step
+		r := ScoreRange{Min: float64(cell << shift), Max: float64((cell + 1) << shift), MaxEx: true}
+		for _, m := range z.RangeByScore(r, false, 0, -1) {
+			lon, lat := GeoDecode(m.Score)
+			dist, ok := shape.contains(lon, lat)
+			if !ok {
+				continue
+			}
+			res = append(res, GeoPoint{Member: m.Member, Score: m.Score, Longitude: lon, Latitude: lat, Dist: dist})
+			if limit > 0 && len(res) >= limit {
+				return res
+			}
+		}
+	}
+	return res
+}
+
+// cells returns the geohash cells to search for the shape: the one of the
+// center and the neighbors that overlap the bounding box of the shape, at a
+// step where the cells are about as big as the shape.
+func (shape GeoShape) cells() (uint, []uint64) {
+	lon, lat := shape.Longitude, shape.Latitude
+	minLon, minLat, maxLon, maxLat := shape.boundingBox()
+	radius := shape.Radius
+	if shape.Box {
+		radius = math.Sqrt(shape.Width*shape.Width/4 + shape.Height*shape.Height/4)
+	}
+
+	step := geoEstimateStep(radius, lat)
+	center := geoEncode(lon, lat, step)
+	// the neighbors may be too small to cover the shape near the edges of
+	// the cell
+	north := geoDecode(geoMove(center, step, 0, 1), step)
+	south := geoDecode(geoMove(center, step, 0, -1), step)
+	east := geoDecode(geoMove(center, step, 1, 0), step)
+	west := geoDecode(geoMove(center, step, -1, 0), step)
+	if step > 1 && (north.latMax < maxLat || south.latMin > minLat || east.lonMax < maxLon || west.lonMin > minLon) {
+		step--
+		center = geoEncode(lon, lat, step)
+	}
+
+	// the cells in the directions the shape doesn't reach are left out
+	area := geoDecode(center, step)
+	useless := func(dx, dy int) bool {
+		if step < 2 {
+			return false
+		}
+		return (dy < 0 && area.latMin < minLat) || (dy > 0 && area.latMax > maxLat) ||
+			(dx < 0 && area.lonMin < minLon) || (dx > 0 && area.lonMax > maxLon)
+	}
+	cells := []uint64{center}
+	// in the order of redis: north, south, east, west, north east, north
+	// west, south east and south west
+	for _, d := range [][2]int{{0, 1}, {0, -1}, {1, 0}, {-1, 0}, {1, 1}, {-1, 1}, {1, -1}, {-1, -1}} {
+		if !useless(d[0], d[1]) {
+			cells = append(cells, geoMove(center, step, d[0], d[1]))
+		}
+	}
+	return step, cells
+}
+
+// boundingBox returns the longitudes and latitudes around the shape.
+func (shape GeoShape) boundingBox() (minLon, minLat, maxLon, maxLat float64) {
+	height, width := shape.Radius, shape.Radius
+	if shape.Box {
+		height, width = shape.Height/2, shape.Width/2
+	}
+	latDelta := radDeg(height / earthRadius)
+	lonDeltaTop := radDeg(width / earthRadius / math.Cos(degRad(shape.Latitude+latDelta)))
+	lonDeltaBottom := radDeg(width / earthRadius / math.Cos(degRad(shape.Latitude-latDelta)))
+	// the widest side is toward the equator
+	lonDelta := lonDeltaTop
+	if shape.Latitude < 0 {
+		lonDelta = lonDeltaBottom
+	}
+	return shape.Longitude - lonDelta, shape.Latitude - latDelta, shape.Longitude + lonDelta, shape.Latitude + latDelta
+}
+
+// geoEstimateStep returns the step where a cell is about as big as the
+// radius, smaller toward the poles where the meridians get closer.
+func geoEstimateStep(radius, lat float64) uint {
+	if radius == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for ; radius < mercatorMax; step++ {
+		radius *= 2
+	}
+	step -= 2
+	if lat > 66 || lat < -66 {
+		step--
+		if lat > 80 || lat < -80 {
+			step--
+		}
+	}
+	if step < 1 {
+		step = 1
+	}
+	if step > geoStepMax {
+		step = geoStepMax
+	}
+	return uint(step)
+}
+
+// geoEncode returns the geohash of a position with step bits for each
+// coordinate.
+func geoEncode(lon, lat float64, step uint) uint64 {
+	latOffset := (lat - GeoLatMin) / (GeoLatMax - GeoLatMin) * float64(uint64(1)<<step)
+	lonOffset := (lon - GeoLongMin) / (GeoLongMax - GeoLongMin) * float64(uint64(1)<<step)
+	return interleave(uint32(latOffset), uint32(lonOffset))
+}
+
+func geoDecode(bits uint64, step uint) geoArea {
+	lat, lon := deinterleave(bits)
+	scale := float64(uint64(1) << step)
+	return geoArea{
+		lonMin: GeoLongMin + float64(lon)/scale*(GeoLongMax-GeoLongMin),
+		lonMax: GeoLongMin + float64(lon+1)/scale*(GeoLongMax-GeoLongMin),
+		latMin: GeoLatMin + float64(lat)/scale*(GeoLatMax-GeoLatMin),
+		latMax: GeoLatMin + float64(lat+1)/scale*(GeoLatMax-GeoLatMin),
+	}
+}
+
+// geoMove returns the neighbor cell dx cells east and dy cells north,
+// wrapping around.
+func geoMove(bits uint64, step uint, dx, dy int) uint64 {
+	const even, odd = 0x5555555555555555, 0xaaaaaaaaaaaaaaaa
+	move := func(coord uint64, mask uint64, d int) uint64 {
+		zz := ^mask >> (64 - step*2)
+		if d > 0 {
+			coord += zz + 1
+		} else if d < 0 {
+			coord = (coord | zz) - (zz + 1)
+		}
+		return coord & (mask >> (64 - step*2))
+	}
+	return move(bits&odd, odd, dx) | move(bits&even, even, dy)
+}
+
+// interleave puts the bits of x at the even positions and the ones of y at
+// the odd ones.
+func interleave(x, y uint32) uint64 {
+	return spread(x) | spread(y)<<1
+}
+
+func deinterleave(bits uint64) (x, y uint32) {
+	return squash(bits), squash(bits >> 1)
+}
+
+func spread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+func squash(x uint64) uint32 {
+	x &= 0x5555555555555555
+	x = (x | x>>1) & 0x3333333333333333
+	x = (x | x>>2) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x>>4) & 0x00ff00ff00ff00ff
+	x = (x | x>>8) & 0x0000ffff0000ffff
+	x = (x | x>>16) & 0x00000000ffffffff
+	return uint32(x)
+}
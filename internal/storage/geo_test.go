@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+// the positions of the examples of the redis documentation
+var sicily = map[string][2]float64{
+	"Palermo": {13.361389, 38.115556},
+	"Catania": {15.087269, 37.502669},
+	"edge1":   {12.758489, 38.788135},
+	"edge2":   {17.241510, 38.788135},
+}
+
+func sicilyZSet() *ZSet {
+	z := NewZSet()
+	for member, pos := range sicily {
+		z.Set(member, GeoEncode(pos[0], pos[1]))
+	}
+	return z
+}
+
+func TestGeoEncode(t *testing.T) {
+	tests := []utils.Test[string, string]{
+		{Name: "Palermo", Input: "Palermo", Want: "3479099956230698 13.36138933897018433 38.11555639549629859 sqc8b49rny0"},
+		{Name: "Catania", Input: "Catania", Want: "3479447370796909 15.08726745843887329 37.50266842333162032 sqdtr74hyu0"},
+	}
+	for _, test := range tests {
+		pos := sicily[test.Input]
+		score := GeoEncode(pos[0], pos[1])
+		lon, lat := GeoDecode(score)
+		res := fmt.Sprintf("%.0f %.17f %.17f %s", score, lon, lat, GeoHash(score))
+		if res != test.Want {
+			t.Errorf(test.ToString(res))
+		}
+	}
+}
+
+func TestGeoDistance(t *testing.T) {
+	p, c := sicily["Palermo"], sicily["Catania"]
+	plon, plat := GeoDecode(GeoEncode(p[0], p[1]))
+	clon, clat := GeoDecode(GeoEncode(c[0], c[1]))
+	if res := fmt.Sprintf("%.4f", GeoDistance(plon, plat, clon, clat)); res != "166274.1516" {
+		t.Errorf("Wrong distance. Have: %s, want: 166274.1516", res)
+	}
+}
+
+func TestGeoSearch(t *testing.T) {
+	tests := []utils.Test[GeoShape, map[string]string]{
+		{
+			Name:  "Radius",
+			Input: GeoShape{Longitude: 15, Latitude: 37, Radius: 200000},
+			Want:  map[string]string{"Catania": "56.4413", "Palermo": "190.4424"},
+		},
+		{
+			Name:  "Box",
+			Input: GeoShape{Longitude: 15, Latitude: 37, Box: true, Width: 400000, Height: 400000},
+			Want:  map[string]string{"Catania": "56.4413", "Palermo": "190.4424", "edge2": "279.7403", "edge1": "279.7405"},
+		},
+		{
+			Name:  "Nothing around",
+			Input: GeoShape{Longitude: -70, Latitude: 40, Radius: 1000},
+			Want:  map[string]string{},
+		},
+	}
+
+	z := sicilyZSet()
+	for _, test := range tests {
+		res := map[string]string{}
+		for _, p := range z.GeoSearch(test.Input, 0) {
+			res[p.Member] = fmt.Sprintf("%.4f", p.Dist/1000)
+		}
+		if !cmp.Equal(res, test.Want) {
+			t.Errorf(test.ToString(res))
+		}
+	}
+
+	if res := z.GeoSearch(GeoShape{Longitude: 15, Latitude: 37, Radius: 200000}, 1); len(res) != 1 {
+		t.Errorf("Wrong number of members with a limit. Have: %d, want: 1", len(res))
+	}
+}
+
+// TestGeoSearchCoverage checks searches of random sizes all over the map
+// against the distances of every member.
+func TestGeoSearchCoverage(t *testing.T) {
+	z := NewZSet()
+	for i := 0; i < 2000; i++ {
+		lon := rand.Float64()*360 - 180
+		lat := rand.Float64()*2*GeoLatMax - GeoLatMax
+		z.Set(strconv.Itoa(i), GeoEncode(lon, lat))
+	}
+
+	for i := 0; i < 200; i++ {
+		shape := GeoShape{
+			Longitude: rand.Float64()*360 - 180,
+			Latitude:  rand.Float64()*160 - 80,
+			Radius:    math.Pow(10, rand.Float64()*4+3),
+		}
+		want := []string{}
+		z.ForEach(func(member string, score float64) bool {
+			lon, lat := GeoDecode(score)
+			if GeoDistance(shape.Longitude, shape.Latitude, lon, lat) <= shape.Radius {
+				want = append(want, member)
+			}
+			return true
+		})
+
+		res := []string{}
+		for _, p := range z.GeoSearch(shape, 0) {
+			res = append(res, p.Member)
+		}
+		sort.Strings(want)
+		sort.Strings(res)
+		if !cmp.Equal(res, want) {
+			t.Fatalf("Wrong members around %v. Have: %v, want: %v", shape, res, want)
+		}
+	}
+}
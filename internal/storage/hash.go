@@ -0,0 +1,157 @@
+package storage
+
+// Hash is the value of a hash key: a map of fields to byte strings, where
+// every field can have its own expiry.
+type Hash struct {
+	fields map[string]*hashField
+	// every field owns a slot until it is deleted, for HSCAN
+	table slotTable
+	// unix time in ms of the fields that expire
+	expires map[string]int64
+}
+
+type hashField struct {
+	value []byte
+	slot  int
+}
+
+func NewHash() *Hash {
+	return &Hash{
+		fields:  make(map[string]*hashField),
+		expires: make(map[string]int64),
+	}
+}
+
+func (h *Hash) Len() int {
+	return len(h.fields)
+}
+
+// Volatile returns how many fields expire.
+func (h *Hash) Volatile() int {
+	return len(h.expires)
+}
+
+func (h *Hash) Get(field string) ([]byte, bool) {
+	f, ok := h.fields[field]
+	if !ok {
+		return nil, false
+	}
+	return f.value, true
+}
+
+// Set stores the value of the field and returns whether the field is new.
+// The expiry of an existing field is removed unless keepTTL is set.
+func (h *Hash) Set(field string, value []byte, keepTTL bool) bool {
+	if !keepTTL {
+		delete(h.expires, field)
+	}
+	if f, ok := h.fields[field]; ok {
+		f.value = value
+		return false
+	}
+	h.fields[field] = &hashField{value: value, slot: h.table.add(field)}
+	return true
+}
+
+// Delete removes the field and returns whether it existed.
+func (h *Hash) Delete(field string) bool {
+	f, ok := h.fields[field]
+	if !ok {
+		return false
+	}
+	h.table.release(f.slot)
+	delete(h.fields, field)
+	delete(h.expires, field)
+	return true
+}
+
+// ForEach calls fn for every field until it returns false, in no particular
+// order.
+func (h *Hash) ForEach(fn func(field string, value []byte) bool) {
+	for field, f := range h.fields {
+		if !fn(field, f.value) {
+			return
+		}
+	}
+}
+
+// Fields returns the names of all the fields.
+func (h *Hash) Fields() []string {
+	fields := make([]string, 0, len(h.fields))
+	for field := range h.fields {
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// Scan returns about count fields starting from cursor, and the cursor to
+// pass to the next call, like Storage.Scan.
+func (h *Hash) Scan(cursor uint64, count int) ([]string, uint64) {
+	fields := []string{}
+	next := h.table.scan(cursor, count, func(field string) bool {
+		fields = append(fields, field)
+		return true
+	})
+	return fields, next
+}
+
+// Expire sets the deadline of the field, a unix time in ms, if the condition
+// is met. A deadline in the past deletes the field the next time the hash is
+// accessed. Returns false if the field doesn't exist or the condition isn't
+// met.
+func (h *Hash) Expire(field string, at int64, cond ExpireCondition) bool {
+	if _, ok := h.fields[field]; !ok {
+		return false
+	}
+	current, volatile := h.expires[field]
+	if !cond.allows(current, volatile, at) {
+		return false
+	}
+	h.expires[field] = at
+	return true
+}
+
+// ExpireTime returns the deadline of the field as a unix time in ms, 0 if the
+// field doesn't expire. ok is false if the field doesn't exist.
+func (h *Hash) ExpireTime(field string) (at int64, ok bool) {
+	if _, ok := h.fields[field]; !ok {
+		return 0, false
+	}
+	return h.expires[field], true
+}
+
+// Persist removes the expiry of the field, returns false if the field
+// doesn't exist or has no expiry.
+func (h *Hash) Persist(field string) bool {
+	if _, ok := h.expires[field]; !ok {
+		return false
+	}
+	delete(h.expires, field)
+	return true
+}
+
+// expireFields deletes the fields whose deadline passed and returns how many
+// of them there were.
+func (h *Hash) expireFields(ts int64) int {
+	expired := 0
+	for field, at := range h.expires {
+		if at <= ts {
+			h.Delete(field)
+			expired++
+		}
+	}
+	return expired
+}
+
+// Clone returns a copy of the hash that shares the values, which are never
+// modified in place.
+func (h *Hash) Clone() *Hash {
+	clone := NewHash()
+	for field, f := range h.fields {
+		clone.Set(field, f.value, false)
+	}
+	for field, at := range h.expires {
+		clone.expires[field] = at
+	}
+	return clone
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHashFieldExpiry(t *testing.T) {
+	s := NewStorage()
+	s.UpdateHash("h", true, func(h *Hash) {
+		h.Set("a", []byte("1"), false)
+		h.Set("b", []byte("2"), false)
+		h.Set("c", []byte("3"), false)
+		h.Expire("a", now()+10, ExpireAlways)
+		h.Expire("b", now()+10, ExpireAlways)
+		h.Expire("c", now()-1, ExpireAlways)
+	})
+	// overwriting a field removes its expiry
+	s.UpdateHash("h", false, func(h *Hash) {
+		h.Set("b", []byte("new"), false)
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	var fields []string
+	s.ReadHash("h", func(h *Hash) {
+		fields = h.Fields()
+	})
+	if want := []string{"b"}; !cmp.Equal(fields, want) {
+		t.Errorf("Wrong fields after expiry. Have: %v, want: %v", fields, want)
+	}
+
+	s.UpdateHash("h", false, func(h *Hash) {
+		h.Expire("b", now()+10, ExpireAlways)
+	})
+	time.Sleep(20 * time.Millisecond)
+	s.activeExpireCycle()
+	if keys, _ := s.Len(); keys != 0 {
+		t.Errorf("Hash without fields left was not deleted")
+	}
+	if len(s.volatileHashes) != 0 {
+		t.Errorf("Deleted hash is still tracked for the active expiry")
+	}
+}
+
+func TestHashScan(t *testing.T) {
+	h := NewHash()
+	for i := 0; i < 100; i++ {
+		h.Set(fmt.Sprint(i), []byte("v"), false)
+	}
+
+	seen := map[string]bool{}
+	cursor := uint64(0)
+	for {
+		var fields []string
+		fields, cursor = h.Scan(cursor, 7)
+		for _, f := range fields {
+			seen[f] = true
+		}
+		// deleted fields must not move the others
+		h.Delete(fields[0])
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if len(seen) != 100 {
+		missing := []string{}
+		for i := 0; i < 100; i++ {
+			if !seen[fmt.Sprint(i)] {
+				missing = append(missing, fmt.Sprint(i))
+			}
+		}
+		t.Errorf("Scan missed fields: %v", missing)
+	}
+}
@@ -0,0 +1,182 @@
+package storage
+
+// Delete removes the keys and returns how many of them existed.
+func (s *Storage) Delete(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		if _, ok := s.lookup(key); ok {
+			s.remove(key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Exists returns how many of the keys exist, a key given twice is counted
+// twice.
+func (s *Storage) Exists(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := 0
+	for _, key := range keys {
+		if _, ok := s.lookup(key); ok {
+			found++
+		}
+	}
+	return found
+}
+
+// Type returns the name of the type of the value, "none" if the key doesn't
+// exist.
+func (s *Storage) Type(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.lookup(key)
+	if !ok {
+		return "none"
+	}
+	return typeName(value)
+}
+
+func typeName(value any) string {
+	switch value.(type) {
+	case *List:
+		return "list"
+	case *Hash:
+		return "hash"
+	case *Set:
+		return "set"
+	case *ZSet:
+		return "zset"
+	case *Stream:
+		return "stream"
+	}
+	return "string"
+}
+
+// Rename moves the value and the expiry of src to dst, replacing dst unless
+// nx is set. Returns false if nx is set and dst exists.
+func (s *Storage) Rename(src string, dst string, nx bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.lookup(src)
+	if !ok {
+		return false, ErrNoSuchKey
+	}
+	if _, exists := s.lookup(dst); exists && nx {
+		return false, nil
+	}
+	if src == dst {
+		return true, nil
+	}
+
+	expireAt, volatile := s.expires[src]
+	s.remove(src)
+	s.remove(dst)
+	s.put(dst, value)
+	if volatile {
+		s.expires[dst] = expireAt
+	}
+	return true, nil
+}
+
+// Copy copies the value and the expiry of src to dst, replacing dst only if
+// replace is set. Returns whether the value was copied.
+func (s *Storage) Copy(src string, dst string, replace bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.lookup(src)
+	if !ok || src == dst {
+		return false
+	}
+	if _, exists := s.lookup(dst); exists && !replace {
+		return false
+	}
+
+	s.remove(dst)
+	s.put(dst, cloneValue(value))
+	if expireAt, volatile := s.expires[src]; volatile {
+		s.expires[dst] = expireAt
+	}
+	return true
+}
+
+// Keys returns the keys for which match returns true.
+func (s *Storage) Keys(match func(key string) bool) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ts := now()
+	keys := []string{}
+	for key := range s.storage {
+		if !s.isExpired(key, ts) && match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// RandomKey returns a random key, ok is false if the keyspace is empty.
+func (s *Storage) RandomKey() (key string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.storage) > 0 {
+		// slots are mostly used, unless many keys were deleted
+		for i := 0; i < 16; i++ {
+			key, used := s.table.random()
+			if used && !s.expireIfNeeded(key, now()) {
+				return key, true
+			}
+		}
+		for k := range s.storage {
+			if !s.expireIfNeeded(k, now()) {
+				return k, true
+			}
+			break
+		}
+	}
+	return "", false
+}
+
+// Flush deletes every key.
+func (s *Storage) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.storage {
+		s.modified(key)
+	}
+	s.storage = make(map[string]*item)
+	s.expires = make(map[string]int64)
+	s.table = slotTable{}
+	s.volatileHashes = make(map[string]struct{})
+	s.used = 0
+	s.pool = nil
+}
+
+// Scan returns about count keys starting from cursor, and the cursor to pass
+// to the next call, 0 once the iteration is complete. Keys that exist for the
+// whole iteration are returned at least once.
+func (s *Storage) Scan(cursor uint64, count int) ([]string, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ts := now()
+	keys := []string{}
+	next := s.table.scan(cursor, count, func(key string) bool {
+		if s.expireIfNeeded(key, ts) {
+			return false
+		}
+		keys = append(keys, key)
+		return true
+	})
+	return keys, next
+}
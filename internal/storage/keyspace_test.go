@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestScanWithConcurrentWrites(t *testing.T) {
+	s := NewStorage()
+	for i := 0; i < 1000; i++ {
+		s.Set(fmt.Sprintf("stable:%d", i), []byte("v"))
+		s.Set(fmt.Sprintf("temp:%d", i), []byte("v"))
+	}
+
+	seen := make(map[string]bool)
+	var cursor uint64
+	for i := 0; ; i++ {
+		var keys []string
+		keys, cursor = s.Scan(cursor, 10)
+		for _, k := range keys {
+			seen[k] = true
+		}
+		if cursor == 0 {
+			break
+		}
+
+		// free slots and reuse them while the iteration is in progress
+		s.Delete(fmt.Sprintf("temp:%d", i))
+		s.Set(fmt.Sprintf("new:%d", i), []byte("v"))
+	}
+
+	for i := 0; i < 1000; i++ {
+		if key := fmt.Sprintf("stable:%d", i); !seen[key] {
+			t.Fatalf("Scan missed %s", key)
+		}
+	}
+}
+
+func TestRenameAndCopy(t *testing.T) {
+	s := NewStorage()
+	s.SetWithArgs("src", []byte("v"), SetArgs{ExpireAt: now() + 60_000})
+	s.Set("other", []byte("o"))
+
+	if ok, _ := s.Rename("src", "other", true); ok {
+		t.Errorf("RENAMENX replaced an existing key")
+	}
+	if _, err := s.Rename("missing", "dst", false); err != ErrNoSuchKey {
+		t.Errorf("Wrong error for a missing key. Have: %v, want: %v", err, ErrNoSuchKey)
+	}
+
+	s.Rename("src", "dst", false)
+	if at, ok := s.ExpireTime("dst"); !ok || at == 0 {
+		t.Errorf("Renamed key lost its expiry")
+	}
+	if s.Exists("src") != 0 {
+		t.Errorf("Renamed key still exists")
+	}
+
+	if s.Copy("dst", "other", false) {
+		t.Errorf("COPY replaced an existing key without REPLACE")
+	}
+	if !s.Copy("dst", "other", true) {
+		t.Errorf("COPY with REPLACE failed")
+	}
+	if v, _ := s.Get("other"); string(v) != "v" {
+		t.Errorf("Wrong copied value. Have: %q, want: %q", v, "v")
+	}
+}
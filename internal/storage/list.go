@@ -0,0 +1,206 @@
+package storage
+
+import "bytes"
+
+const minListCap = 8
+
+// List is the value of a list key: a deque of byte strings kept in a ring
+// buffer, so pushes and pops at both ends and access by index are O(1).
+type List struct {
+	buf  [][]byte
+	head int
+	len  int
+}
+
+func NewList(values ...[]byte) *List {
+	l := &List{}
+	for _, v := range values {
+		l.PushBack(v)
+	}
+	return l
+}
+
+func (l *List) Len() int {
+	return l.len
+}
+
+func (l *List) pos(i int) int {
+	return (l.head + i) % len(l.buf)
+}
+
+func (l *List) resize(capacity int) {
+	buf := make([][]byte, capacity)
+	for i := 0; i < l.len; i++ {
+		buf[i] = l.buf[l.pos(i)]
+	}
+	l.buf = buf
+	l.head = 0
+}
+
+func (l *List) grow() {
+	if l.len < len(l.buf) {
+		return
+	}
+	capacity := len(l.buf) * 2
+	if capacity < minListCap {
+		capacity = minListCap
+	}
+	l.resize(capacity)
+}
+
+func (l *List) shrink() {
+	if len(l.buf) > minListCap && l.len <= len(l.buf)/4 {
+		l.resize(len(l.buf) / 2)
+	}
+}
+
+func (l *List) PushFront(v []byte) {
+	l.grow()
+	l.head = (l.head - 1 + len(l.buf)) % len(l.buf)
+	l.buf[l.head] = v
+	l.len++
+}
+
+func (l *List) PushBack(v []byte) {
+	l.grow()
+	l.buf[l.pos(l.len)] = v
+	l.len++
+}
+
+// PopFront removes the first element, the list must not be empty.
+func (l *List) PopFront() []byte {
+	v := l.buf[l.head]
+	l.buf[l.head] = nil
+	l.head = (l.head + 1) % len(l.buf)
+	l.len--
+	l.shrink()
+	return v
+}
+
+// PopBack removes the last element, the list must not be empty.
+func (l *List) PopBack() []byte {
+	i := l.pos(l.len - 1)
+	v := l.buf[i]
+	l.buf[i] = nil
+	l.len--
+	l.shrink()
+	return v
+}
+
+// Index returns the element at i, 0 <= i < Len().
+func (l *List) Index(i int) []byte {
+	return l.buf[l.pos(i)]
+}
+
+// Set replaces the element at i, 0 <= i < Len().
+func (l *List) Set(i int, v []byte) {
+	l.buf[l.pos(i)] = v
+}
+
+// Insert puts v before the element at i, 0 <= i <= Len().
+func (l *List) Insert(i int, v []byte) {
+	l.PushBack(nil)
+	for j := l.len - 1; j > i; j-- {
+		l.buf[l.pos(j)] = l.buf[l.pos(j-1)]
+	}
+	l.buf[l.pos(i)] = v
+}
+
+// RemoveAt deletes the element at i, 0 <= i < Len().
+func (l *List) RemoveAt(i int) {
+	for j := i; j < l.len-1; j++ {
+		l.buf[l.pos(j)] = l.buf[l.pos(j+1)]
+	}
+	l.PopBack()
+}
+
+// Remove deletes up to count elements equal to v, from the head if count is
+// positive, from the tail if it is negative, all of them if it is 0. Returns
+// the number of removed elements.
+func (l *List) Remove(v []byte, count int) int {
+	removed := 0
+	if count < 0 {
+		for i := l.len - 1; i >= 0 && removed != -count; i-- {
+			if bytes.Equal(l.Index(i), v) {
+				l.RemoveAt(i)
+				removed++
+			}
+		}
+		return removed
+	}
+
+	kept := make([][]byte, 0, l.len)
+	for i := 0; i < l.len; i++ {
+		e := l.Index(i)
+		if bytes.Equal(e, v) && (count == 0 || removed < count) {
+			removed++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	if removed > 0 {
+		*l = *NewList(kept...)
+	}
+	return removed
+}
+
+// Range returns the elements from start to stop inclusive, the indexes are
+// taken as in LRANGE: negative ones count from the tail and they are clamped
+// to the list.
+func (l *List) Range(start, stop int) [][]byte {
+	start, stop, ok := normalizeRange(start, stop, l.len)
+	if !ok {
+		return [][]byte{}
+	}
+	res := make([][]byte, 0, stop-start+1)
+	for i := start; i <= stop; i++ {
+		res = append(res, l.Index(i))
+	}
+	return res
+}
+
+// Trim keeps only the elements from start to stop inclusive, the indexes are
+// taken as in Range.
+func (l *List) Trim(start, stop int) {
+	start, stop, ok := normalizeRange(start, stop, l.len)
+	if !ok {
+		*l = List{}
+		return
+	}
+	for l.len > stop+1 {
+		l.PopBack()
+	}
+	for i := 0; i < start; i++ {
+		l.PopFront()
+	}
+}
+
+// normalizeRange turns the indexes of a range as in LRANGE into indexes in
+// [0, length), ok is false if the range is empty.
+func normalizeRange(start, stop, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, start <= stop && start < length
+}
+
+// Clone returns a copy of the list that shares the elements, which are never
+// modified in place.
+func (l *List) Clone() *List {
+	clone := &List{}
+	clone.resize(len(l.buf))
+	for i := 0; i < l.len; i++ {
+		clone.buf[i] = l.Index(i)
+	}
+	clone.len = l.len
+	return clone
+}
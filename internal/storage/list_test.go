@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func listStrings(l *List) []string {
+	res := []string{}
+	for _, e := range l.Range(0, -1) {
+		res = append(res, string(e))
+	}
+	return res
+}
+
+func TestListDeque(t *testing.T) {
+	l := NewList()
+	for i := 0; i < 20; i++ {
+		l.PushBack([]byte(fmt.Sprint(i)))
+		l.PushFront([]byte(fmt.Sprint(-i - 1)))
+	}
+	for i := 0; i < 15; i++ {
+		l.PopFront()
+		l.PopBack()
+	}
+
+	want := []string{"-5", "-4", "-3", "-2", "-1", "0", "1", "2", "3", "4"}
+	if have := listStrings(l); !cmp.Equal(have, want) {
+		t.Errorf("Wrong list. Have: %v, want: %v", have, want)
+	}
+}
+
+func TestListEdits(t *testing.T) {
+	l := NewList([]byte("a"), []byte("b"), []byte("a"), []byte("c"), []byte("a"))
+
+	l.Insert(1, []byte("x"))
+	l.RemoveAt(0)
+	if removed := l.Remove([]byte("a"), -1); removed != 1 {
+		t.Errorf("Wrong number of removed elements. Have: %d, want: 1", removed)
+	}
+	want := []string{"x", "b", "a", "c"}
+	if have := listStrings(l); !cmp.Equal(have, want) {
+		t.Errorf("Wrong list. Have: %v, want: %v", have, want)
+	}
+
+	l.Trim(1, -2)
+	want = []string{"b", "a"}
+	if have := listStrings(l); !cmp.Equal(have, want) {
+		t.Errorf("Wrong list after trim. Have: %v, want: %v", have, want)
+	}
+
+	l.Trim(5, 10)
+	if l.Len() != 0 {
+		t.Errorf("Trim out of range left %d elements", l.Len())
+	}
+}
+
+func TestListRange(t *testing.T) {
+	l := NewList([]byte("a"), []byte("b"), []byte("c"))
+	tests := map[[2]int][]string{
+		{0, -1}:   {"a", "b", "c"},
+		{-2, 10}:  {"b", "c"},
+		{-10, 0}:  {"a"},
+		{2, 1}:    {},
+		{5, 10}:   {},
+		{-1, -1}:  {"c"},
+		{-10, -5}: {},
+	}
+	for input, want := range tests {
+		have := []string{}
+		for _, e := range l.Range(input[0], input[1]) {
+			have = append(have, string(e))
+		}
+		if !cmp.Equal(have, want) {
+			t.Errorf("Wrong range %v. Have: %v, want: %v", input, have, want)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// EvictionPolicy tells which keys are evicted when the memory limit is
+// reached: all keys or the volatile ones, that have an expiry, picked by least
+// recent access, least frequent access, nearest expiry or randomly.
+type EvictionPolicy string
+
+const (
+	NoEviction     EvictionPolicy = "noeviction"
+	AllKeysLRU     EvictionPolicy = "allkeys-lru"
+	VolatileLRU    EvictionPolicy = "volatile-lru"
+	AllKeysLFU     EvictionPolicy = "allkeys-lfu"
+	VolatileLFU    EvictionPolicy = "volatile-lfu"
+	AllKeysRandom  EvictionPolicy = "allkeys-random"
+	VolatileRandom EvictionPolicy = "volatile-random"
+	VolatileTTL    EvictionPolicy = "volatile-ttl"
+)
+
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	p := EvictionPolicy(strings.ToLower(s))
+	switch p {
+	case NoEviction, AllKeysLRU, VolatileLRU, AllKeysLFU, VolatileLFU, AllKeysRandom, VolatileRandom, VolatileTTL:
+		return p, nil
+	}
+	return "", fmt.Errorf("Unknown eviction policy %q", s)
+}
+
+func (p EvictionPolicy) volatile() bool {
+	return strings.HasPrefix(string(p), "volatile-")
+}
+
+// ParseMemory parses a number of bytes with an optional unit, like redis: k,
+// m and g are powers of 1000, kb, mb and gb powers of 1024.
+func ParseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1},
+	}
+	lower := strings.ToLower(s)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mul = lower[:len(lower)-len(u.suffix)], u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mul {
+		return 0, fmt.Errorf("Invalid memory size %q", s)
+	}
+	return n * mul, nil
+}
+
+// The memory used by a key is estimated from the size of its value and fixed
+// overheads, the size of the elements of a container from a few of them.
+const (
+	keyOverhead     = 64
+	elementOverhead = 48
+	sizeSamples     = 5
+)
+
+// Like in redis the access frequency of a key is a logarithmic counter that
+// halves its growth rate every lfuLogFactor hits and decreases by one every
+// lfuDecayTime of idle time.
+const (
+	lfuInitVal   = 5
+	lfuLogFactor = 10
+	lfuDecayTime = 60 * 1000
+	// the number of best keys to evict kept between the samples
+	evictionPoolSize = 16
+)
+
+// access is when a key was last used and how often.
+type access struct {
+	// unix time in ms
+	last atomic.Int64
+	freq atomic.Uint32
+}
+
+func (a *access) init(ts int64) {
+	a.last.Store(ts)
+	a.freq.Store(lfuInitVal)
+}
+
+// touch records a use of the key. It is safe to call with the lock held for
+// reading only, concurrent touches may lose a hit.
+func (a *access) touch(ts int64) {
+	last := a.last.Swap(ts)
+	a.freq.Store(uint32(lfuIncr(lfuDecr(uint8(a.freq.Load()), ts-last))))
+}
+
+// frequency returns the counter decreased for the time the key is idle.
+func (a *access) frequency(ts int64) uint8 {
+	return lfuDecr(uint8(a.freq.Load()), ts-a.last.Load())
+}
+
+func lfuIncr(counter uint8) uint8 {
+	if counter == math.MaxUint8 {
+		return counter
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+func lfuDecr(counter uint8, idle int64) uint8 {
+	periods := idle / lfuDecayTime
+	if periods >= int64(counter) {
+		return 0
+	}
+	return counter - uint8(periods)
+}
+
+// MemoryStats are the memory used by the keys and the limit.
+type MemoryStats struct {
+	Used    int64          `mapstructure:"used_memory"`
+	Max     int64          `mapstructure:"maxmemory"`
+	Policy  EvictionPolicy `mapstructure:"maxmemory_policy"`
+	Evicted int64          `mapstructure:"evicted_keys"`
+}
+
+// SetMaxMemory limits the memory used by the keys of all the databases to
+// max bytes, 0 for no limit. FreeMemory evicts keys by the policy, comparing
+// samples keys at a time.
+func (d *Databases) SetMaxMemory(max int64, policy EvictionPolicy, samples int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.maxMemory = max
+	d.policy = policy
+	d.samples = samples
+	for _, db := range d.dbs {
+		db.mu.Lock()
+		db.pool = nil
+		db.mu.Unlock()
+	}
+}
+
+func (d *Databases) MemoryStats() MemoryStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return MemoryStats{Used: d.usedMemory(), Max: d.maxMemory, Policy: d.policy, Evicted: d.evicted}
+}
+
+func (d *Databases) usedMemory() int64 {
+	used := int64(0)
+	for _, db := range d.dbs {
+		db.mu.RLock()
+		used += db.used
+		db.mu.RUnlock()
+	}
+	return used
+}
+
+// EvictedKey is a key deleted to free memory.
+type EvictedKey struct {
+	DB  int
+	Key string
+}
+
+// FreeMemory evicts keys until the memory used is under the limit, and returns
+// them. The best candidates of every database are compared. ok is false if it
+// is still over the limit, because the policy doesn't allow evicting or there
+// is nothing left to evict.
+func (d *Databases) FreeMemory() (evicted []EvictedKey, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.maxMemory > 0 && d.usedMemory() > d.maxMemory {
+		best, bestKey, bestScore := -1, "", int64(0)
+		for i, db := range d.dbs {
+			key, score, found := db.evictionCandidate(d.policy, d.samples)
+			if found && (best < 0 || score > bestScore) {
+				best, bestKey, bestScore = i, key, score
+			}
+		}
+		if best < 0 {
+			return evicted, false
+		}
+		d.dbs[best].evict(bestKey)
+		d.evicted++
+		evicted = append(evicted, EvictedKey{DB: best, Key: bestKey})
+	}
+	return evicted, true
+}
+
+func (s *Storage) evict(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(key)
+}
+
+// evictionCandidate returns the key of the database that is the best to
+// evict, and how good it is. Like in redis the keys of the samples are kept
+// in a pool, sorted by how good they are to evict, so the best of several
+// samples is taken. The random policies pick a random key with a random
+// score.
+func (s *Storage) evictionCandidate(policy EvictionPolicy, samples int) (string, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch policy {
+	case NoEviction:
+		return "", 0, false
+	case AllKeysRandom:
+		for key := range s.storage {
+			return key, rand.Int63(), true
+		}
+		return "", 0, false
+	case VolatileRandom:
+		for key := range s.expires {
+			return key, rand.Int63(), true
+		}
+		return "", 0, false
+	}
+
+	ts := now()
+	sampled := 0
+	add := func(key string) bool {
+		if sampled == samples {
+			return false
+		}
+		sampled++
+		s.addToPool(key, evictionScore(policy, s.storage[key], s.expires[key], ts))
+		return true
+	}
+	if policy.volatile() {
+		for key := range s.expires {
+			if !add(key) {
+				break
+			}
+		}
+	} else {
+		for key := range s.storage {
+			if !add(key) {
+				break
+			}
+		}
+	}
+
+	// the best keys are at the end, the ones deleted since they were sampled
+	// are dropped
+	for len(s.pool) > 0 {
+		e := s.pool[len(s.pool)-1]
+		_, exists := s.storage[e.key]
+		_, volatile := s.expires[e.key]
+		if exists && (volatile || !policy.volatile()) {
+			return e.key, e.score, true
+		}
+		s.pool = s.pool[:len(s.pool)-1]
+	}
+	return "", 0, false
+}
+
+// evictionScore is higher for the keys that are better to evict.
+func evictionScore(policy EvictionPolicy, it *item, expireAt int64, ts int64) int64 {
+	switch policy {
+	case AllKeysLFU, VolatileLFU:
+		return math.MaxUint8 - int64(it.access.frequency(ts))
+	case VolatileTTL:
+		return math.MaxInt64 - expireAt
+	}
+	return ts - it.access.last.Load()
+}
+
+type poolEntry struct {
+	key   string
+	score int64
+}
+
+func (s *Storage) addToPool(key string, score int64) {
+	for i, e := range s.pool {
+		if e.key == key {
+			s.pool = append(s.pool[:i], s.pool[i+1:]...)
+			break
+		}
+	}
+	i := sort.Search(len(s.pool), func(i int) bool { return s.pool[i].score > score })
+	if len(s.pool) == evictionPoolSize {
+		if i == 0 {
+			return
+		}
+		// the worst key makes room
+		s.pool = s.pool[1:]
+		i--
+	}
+	s.pool = append(s.pool, poolEntry{})
+	copy(s.pool[i+1:], s.pool[i:])
+	s.pool[i] = poolEntry{key: key, score: score}
+}
+
+// account updates the memory used by the key after its value changed.
+func (s *Storage) account(key string) {
+	it, ok := s.storage[key]
+	if !ok {
+		return
+	}
+	size := valueSize(key, it.value)
+	s.used += size - it.size
+	it.size = size
+}
+
+// valueSize estimates the memory used by a key and its value.
+func valueSize(key string, value any) int64 {
+	size := int64(keyOverhead + len(key))
+	switch v := value.(type) {
+	case []byte:
+		return size + int64(len(v))
+	case *List:
+		return size + sampledSize(v.Len(), func(sample func(n int) bool) {
+			for i := 0; i < v.len; i++ {
+				if !sample(len(v.buf[v.pos(i)])) {
+					return
+				}
+			}
+		})
+	case *Hash:
+		return size + sampledSize(v.Len(), func(sample func(n int) bool) {
+			for field, f := range v.fields {
+				if !sample(len(field) + len(f.value)) {
+					return
+				}
+			}
+		})
+	case *Set:
+		return size + sampledSize(v.Len(), func(sample func(n int) bool) {
+			for member := range v.members {
+				if !sample(len(member)) {
+					return
+				}
+			}
+		})
+	case *ZSet:
+		return size + sampledSize(v.Len(), func(sample func(n int) bool) {
+			for member := range v.scores {
+				// the member is in the map and in the skiplist
+				if !sample(2*len(member) + 8) {
+					return
+				}
+			}
+		})
+	case *Stream:
+		return size + sampledSize(v.Len(), func(sample func(n int) bool) {
+			for _, e := range v.entries {
+				n := 16
+				for _, f := range e.Fields {
+					n += len(f) + 24
+				}
+				if !sample(n) {
+					return
+				}
+			}
+		})
+	}
+	return size
+}
+
+// sampledSize estimates the size of n elements from the ones iterate passes to
+// sample until it returns false.
+func sampledSize(n int, iterate func(sample func(size int) bool)) int64 {
+	sampled, total := 0, 0
+	iterate(func(size int) bool {
+		sampled++
+		total += size
+		return sampled < sizeSamples
+	})
+	if sampled == 0 {
+		return 0
+	}
+	return int64(n) * (int64(total)/int64(sampled) + elementOverhead)
+}
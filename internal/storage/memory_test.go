@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []utils.Test[string, int64]{
+		{Name: "Bytes", Input: "100", Want: 100},
+		{Name: "Kilobytes", Input: "1k", Want: 1000},
+		{Name: "Kibibytes", Input: "1KB", Want: 1024},
+		{Name: "Megabytes", Input: "2mb", Want: 2 << 20},
+		{Name: "Gigabytes", Input: "1g", Want: 1000 * 1000 * 1000},
+		{Name: "Invalid", Input: "1tb", Want: -1},
+		{Name: "Negative", Input: "-1", Want: -1},
+	}
+	for _, test := range tests {
+		res, err := ParseMemory(test.Input)
+		if err != nil {
+			res = -1
+		}
+		if res != test.Want {
+			t.Errorf(test.ToString(res))
+		}
+	}
+}
+
+func TestMemoryAccounting(t *testing.T) {
+	s := NewStorage()
+	s.Set("string", make([]byte, 1000))
+	s.UpdateList("list", true, func(l *List) {
+		for i := 0; i < 100; i++ {
+			l.PushBack(make([]byte, 100))
+		}
+	})
+	s.UpdateZSet("zset", true, func(z *ZSet) {
+		for i := 0; i < 100; i++ {
+			z.Set(strconv.Itoa(i), float64(i))
+		}
+	})
+	if used := s.used; used < 1000+100*100 {
+		t.Errorf("Memory used is too low. Have: %d", used)
+	}
+
+	s.UpdateList("list", false, func(l *List) {
+		for l.Len() > 0 {
+			l.PopBack()
+		}
+	})
+	s.Delete("string")
+	s.Rename("zset", "other", false)
+	s.Delete("other")
+	if used := s.used; used != 0 {
+		t.Errorf("Memory used after deleting everything. Have: %d, want: 0", used)
+	}
+}
+
+// TestEviction fills two databases with keys of the same size over the
+// limit, where the keys to evict are the odd ones for every policy, and with
+// enough samples they are evicted first.
+func TestEviction(t *testing.T) {
+	policies := []EvictionPolicy{AllKeysLRU, VolatileLRU, AllKeysLFU, VolatileLFU, VolatileTTL, VolatileRandom}
+	for _, policy := range policies {
+		d := NewDatabases(2)
+		for i := 10; i < 30; i++ {
+			key := strconv.Itoa(i)
+			s := d.DB(i / 2 % 2)
+			args := SetArgs{}
+			if i%2 == 1 || !policy.volatile() {
+				// the odd keys expire first
+				args.ExpireAt = now() + 60_000 - int64(i%2)*1000
+			}
+			s.SetWithArgs(key, make([]byte, 100), args)
+			if i%2 == 0 {
+				// a few hits are enough to get over the initial frequency
+				for j := 0; j < 100; j++ {
+					s.Get(key)
+				}
+			} else {
+				s.storage[key].access.last.Add(-10_000)
+			}
+		}
+		size := d.MemoryStats().Used / 20
+		d.SetMaxMemory(size*15, policy, 20)
+
+		evicted, ok := d.FreeMemory()
+		if !ok {
+			t.Fatalf("%s: FreeMemory failed", policy)
+		}
+		if n := len(evicted); n != 5 {
+			t.Errorf("%s: wrong number of evicted keys. Have: %d, want: 5", policy, n)
+		}
+		for _, e := range evicted {
+			if i, _ := strconv.Atoi(e.Key); i%2 == 0 || e.DB != i/2%2 {
+				t.Errorf("%s: evicted the wrong key %d %s", policy, e.DB, e.Key)
+			}
+		}
+		if stats := d.MemoryStats(); stats.Used > stats.Max || stats.Evicted != 5 {
+			t.Errorf("%s: wrong stats after the eviction: %+v", policy, stats)
+		}
+	}
+}
+
+func TestNoEviction(t *testing.T) {
+	d := NewDatabases(2)
+	d.DB(1).Set("persistent", make([]byte, 100))
+	d.SetMaxMemory(10, NoEviction, 5)
+	if evicted, ok := d.FreeMemory(); ok || len(evicted) != 0 {
+		t.Errorf("noeviction evicted keys: %v, %v", evicted, ok)
+	}
+
+	// there is nothing volatile to evict
+	d.SetMaxMemory(10, VolatileLRU, 5)
+	if evicted, ok := d.FreeMemory(); ok || len(evicted) != 0 {
+		t.Errorf("volatile-lru evicted keys: %v, %v", evicted, ok)
+	}
+
+	d.SetMaxMemory(10, AllKeysRandom, 5)
+	evicted, ok := d.FreeMemory()
+	if !ok || !cmp.Equal(evicted, []EvictedKey{{DB: 1, Key: "persistent"}}) {
+		t.Errorf("allkeys-random didn't evict every key: %v, %v", evicted, ok)
+	}
+}
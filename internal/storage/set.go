@@ -0,0 +1,142 @@
+package storage
+
+// Set is the value of a set key: an unordered collection of distinct byte
+// strings.
+type Set struct {
+	// every member owns a slot until it is removed, for SSCAN
+	members map[string]int
+	table   slotTable
+}
+
+func NewSet(members ...string) *Set {
+	set := &Set{members: make(map[string]int)}
+	for _, m := range members {
+		set.Add(m)
+	}
+	return set
+}
+
+func (set *Set) Len() int {
+	return len(set.members)
+}
+
+// Add returns whether the member is new.
+func (set *Set) Add(member string) bool {
+	if _, ok := set.members[member]; ok {
+		return false
+	}
+	set.members[member] = set.table.add(member)
+	return true
+}
+
+// Remove returns whether the member existed.
+func (set *Set) Remove(member string) bool {
+	n, ok := set.members[member]
+	if !ok {
+		return false
+	}
+	set.table.release(n)
+	delete(set.members, member)
+	return true
+}
+
+func (set *Set) Has(member string) bool {
+	_, ok := set.members[member]
+	return ok
+}
+
+// Members returns all the members, in no particular order.
+func (set *Set) Members() []string {
+	members := make([]string, 0, len(set.members))
+	for m := range set.members {
+		members = append(members, m)
+	}
+	return members
+}
+
+// Random returns a random member, the set must not be empty.
+func (set *Set) Random() string {
+	// slots are mostly used, unless many members were removed
+	for i := 0; i < 16; i++ {
+		if m, used := set.table.random(); used {
+			return m
+		}
+	}
+	for m := range set.members {
+		return m
+	}
+	return ""
+}
+
+// Scan returns about count members starting from cursor, and the cursor to
+// pass to the next call, like Storage.Scan.
+func (set *Set) Scan(cursor uint64, count int) ([]string, uint64) {
+	members := []string{}
+	next := set.table.scan(cursor, count, func(member string) bool {
+		members = append(members, member)
+		return true
+	})
+	return members, next
+}
+
+func (set *Set) Clone() *Set {
+	clone := NewSet()
+	for m := range set.members {
+		clone.Add(m)
+	}
+	return clone
+}
+
+// InterSets returns the members that are in all the sets.
+func InterSets(sets []*Set) *Set {
+	res := NewSet()
+	if len(sets) == 0 {
+		return res
+	}
+	smallest := sets[0]
+	for _, set := range sets[1:] {
+		if set.Len() < smallest.Len() {
+			smallest = set
+		}
+	}
+
+	for m := range smallest.members {
+		inAll := true
+		for _, set := range sets {
+			if !set.Has(m) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			res.Add(m)
+		}
+	}
+	return res
+}
+
+// UnionSets returns the members that are in any of the sets.
+func UnionSets(sets []*Set) *Set {
+	res := NewSet()
+	for _, set := range sets {
+		for m := range set.members {
+			res.Add(m)
+		}
+	}
+	return res
+}
+
+// DiffSets returns the members of the first set that are in none of the
+// others.
+func DiffSets(sets []*Set) *Set {
+	if len(sets) == 0 {
+		return NewSet()
+	}
+	res := sets[0].Clone()
+	for _, set := range sets[1:] {
+		for m := range set.members {
+			res.Remove(m)
+		}
+	}
+	return res
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func sortedMembers(set *Set) []string {
+	members := set.Members()
+	sort.Strings(members)
+	return members
+}
+
+func TestSetAlgebra(t *testing.T) {
+	sets := []*Set{
+		NewSet("a", "b", "c", "d"),
+		NewSet("b", "c", "e"),
+		NewSet("c", "b", "f"),
+	}
+	tests := []utils.Test[func([]*Set) *Set, []string]{
+		{Name: "Inter", Input: InterSets, Want: []string{"b", "c"}},
+		{Name: "Union", Input: UnionSets, Want: []string{"a", "b", "c", "d", "e", "f"}},
+		{Name: "Diff", Input: DiffSets, Want: []string{"a", "d"}},
+	}
+
+	for _, test := range tests {
+		if res := sortedMembers(test.Input(sets)); !cmp.Equal(res, test.Want) {
+			t.Errorf(test.ToString(res))
+		}
+	}
+	if sets[0].Len() != 4 {
+		t.Errorf("Diff modified the first set")
+	}
+}
+
+func TestStoreAndMoveSets(t *testing.T) {
+	s := NewStorage()
+	s.UpdateSet("a", true, func(set *Set) { set.Add("1"); set.Add("2") })
+	s.UpdateSet("b", true, func(set *Set) { set.Add("2") })
+	s.Set("str", []byte("v"))
+
+	if n, err := s.StoreSets("dst", []string{"a", "missing"}, InterSets); err != nil || n != 0 {
+		t.Errorf("Wrong result of an empty intersection. Have: %d, %v", n, err)
+	}
+	if s.Exists("dst") != 0 {
+		t.Errorf("Empty result was stored")
+	}
+	if _, err := s.StoreSets("dst", []string{"a", "str"}, UnionSets); err != ErrWrongType {
+		t.Errorf("Wrong error. Have: %v, want: %v", err, ErrWrongType)
+	}
+
+	for _, m := range []string{"2", "1"} {
+		if moved, err := s.MoveSet("b", "c", m); err != nil || moved != (m == "2") {
+			t.Errorf("Wrong result moving %q. Have: %v, %v", m, moved, err)
+		}
+	}
+	s.MoveSet("a", "c", "1")
+	if s.Exists("b") != 0 {
+		t.Errorf("Set left empty by a move was not deleted")
+	}
+	s.ReadSet("c", func(set *Set) {
+		if res, want := sortedMembers(set), []string{"1", "2"}; !cmp.Equal(res, want) {
+			t.Errorf("Wrong destination set. Have: %v, want: %v", res, want)
+		}
+	})
+}
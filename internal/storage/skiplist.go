@@ -0,0 +1,223 @@
+package storage
+
+import "math/rand"
+
+// Like zskiplist in redis: the nodes are sorted by score then member, and
+// every link knows how many nodes it skips so ranks are found in O(log n).
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int
+}
+
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+// rangeSpec is an interval of nodes, by score or by member.
+type rangeSpec interface {
+	empty() bool
+	aboveMin(n *skiplistNode) bool
+	belowMax(n *skiplistNode) bool
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// before tells whether the node sorts before the score and member.
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.score < score || (n.score == score && n.member < member)
+}
+
+func (n *skiplistNode) next() *skiplistNode {
+	return n.level[0].forward
+}
+
+// insert adds a node, the member must not be in the list already.
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// delete removes the node with the score and member, returns false if there
+// is none.
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// rank returns the 1-based rank of the node with the score and member, 0 if
+// there is none.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) || (x.level[i].forward.score == score && x.level[i].forward.member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node with the 1-based rank, nil if it is out of range.
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// inRange tells whether some part of the list is in the range.
+func (zsl *skiplist) inRange(r rangeSpec) bool {
+	if r.empty() || zsl.tail == nil {
+		return false
+	}
+	return r.aboveMin(zsl.tail) && r.belowMax(zsl.header.level[0].forward)
+}
+
+// firstInRange returns the first node in the range, nil if there is none.
+func (zsl *skiplist) firstInRange(r rangeSpec) *skiplistNode {
+	if !zsl.inRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if !r.belowMax(x) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange returns the last node in the range, nil if there is none.
+func (zsl *skiplist) lastInRange(r rangeSpec) *skiplistNode {
+	if !zsl.inRange(r) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && r.belowMax(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if !r.aboveMin(x) {
+		return nil
+	}
+	return x
+}
@@ -0,0 +1,70 @@
+package storage
+
+import "math/rand"
+
+// how many empty slots a scan skips per element it was asked for before
+// returning
+const scanEmptyVisits = 10
+
+// slotTable gives every member of a collection a slot that isn't moved until
+// the member is deleted, so slot numbers can serve as SCAN cursors.
+type slotTable struct {
+	slots []slot
+	free  []int
+}
+
+type slot struct {
+	key  string
+	used bool
+}
+
+// add takes a slot for the key and returns its number.
+func (t *slotTable) add(key string) int {
+	var n int
+	if len(t.free) > 0 {
+		n = t.free[len(t.free)-1]
+		t.free = t.free[:len(t.free)-1]
+	} else {
+		n = len(t.slots)
+		t.slots = append(t.slots, slot{})
+	}
+	t.slots[n] = slot{key: key, used: true}
+	return n
+}
+
+func (t *slotTable) release(n int) {
+	t.slots[n] = slot{}
+	t.free = append(t.free, n)
+}
+
+// random returns the key of a random slot, ok is false if the slot is free.
+func (t *slotTable) random() (key string, ok bool) {
+	if len(t.slots) == 0 {
+		return "", false
+	}
+	sl := t.slots[rand.Intn(len(t.slots))]
+	return sl.key, sl.used
+}
+
+// scan calls take with the keys from cursor on, until it accepted about count
+// of them, and returns the cursor to pass to the next call, 0 once the
+// iteration is complete. Keys that exist for the whole iteration are visited
+// at least once.
+func (t *slotTable) scan(cursor uint64, count int, take func(key string) bool) uint64 {
+	if count < 1 {
+		count = 1
+	}
+
+	i, taken := cursor, 0
+	for visited := 0; i < uint64(len(t.slots)) && taken < count && visited < count*scanEmptyVisits; i++ {
+		visited++
+		if sl := t.slots[i]; sl.used && take(sl.key) {
+			taken++
+		}
+	}
+
+	if i >= uint64(len(t.slots)) {
+		return 0
+	}
+	return i
+}
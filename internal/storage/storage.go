@@ -4,63 +4,238 @@ import (
 	"errors"
 	"log"
 	"sync"
-	"time"
+)
+
+var (
+	ErrNoSuchKey = errors.New("No such key")
+	ErrWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 )
 
 type Storage struct {
 	mu      sync.RWMutex
-	storage map[string]string
+	storage map[string]*item
+	expires map[string]int64
+	// every key owns a slot until it is deleted, for SCAN
+	table slotTable
+	// keys of the hashes with fields that expire
+	volatileHashes map[string]struct{}
+	// called with every key that is written or deleted
+	listener func(key string)
+
+	// the estimated memory used by the keys, and the best keys to evict
+	used int64
+	pool []poolEntry
+}
+
+// item holds the value of a key: []byte for strings or a pointer to one of
+// the container types, like *List or *Hash.
+type item struct {
+	value  any
+	slot   int
+	size   int64
+	access access
 }
 
 func NewStorage() *Storage {
 	return &Storage{
-		storage: make(map[string]string),
+		storage:        make(map[string]*item),
+		expires:        make(map[string]int64),
+		volatileHashes: make(map[string]struct{}),
 	}
 }
 
-func (s *Storage) SetWithTimer(key string, value string, expire int) error {
-	err := s.Set(key, value)
-	if err != nil {
-		return err
-	}
+// SetArgs are the conditions and the expiry of a SET.
+type SetArgs struct {
+	NX       bool  // only set the key if it doesn't exist
+	XX       bool  // only set the key if it already exists
+	KeepTTL  bool  // keep the expiry of the key being overwritten
+	Get      bool  // fail if the key being overwritten isn't a string
+	ExpireAt int64 // unix time in ms, 0 if the key doesn't expire
+}
 
-	go func(expire int, key string) {
-		expiryMs := time.Millisecond * time.Duration(expire)
-		timer := time.After(expiryMs)
-		log.Printf("Expiry (ms): %d", expire)
-		<-timer
-		s.mu.Lock()
-		delete(s.storage, key)
-		s.mu.Unlock()
-	}(expire, key)
+// Set stores the value, replacing the key and its expiry if it exists.
+func (s *Storage) Set(key string, value []byte) error {
+	s.SetWithArgs(key, value, SetArgs{})
 	return nil
 }
 
-func (s *Storage) Set(key string, value string) error {
-	log.Printf("SET: %s - %s", key, value)
+// SetWithArgs returns the string the key had before and whether the new value
+// was set. A deadline in the past deletes the key instead.
+func (s *Storage) SetWithArgs(key string, value []byte, args SetArgs) ([]byte, bool, error) {
+	log.Printf("SET: %q (%d bytes)", key, len(value))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, exists := s.lookup(key)
+	prev, isString := v.([]byte)
+	if exists && !isString && args.Get {
+		return nil, false, ErrWrongType
+	}
+	if (args.NX && exists) || (args.XX && !exists) {
+		return prev, false, nil
+	}
+
+	s.put(key, value)
+	switch {
+	case args.ExpireAt != 0:
+		s.expires[key] = args.ExpireAt
+		s.expireIfNeeded(key, now())
+	case !args.KeepTTL:
+		delete(s.expires, key)
+	}
+	return prev, true, nil
+}
+
+func (s *Storage) Get(key string) ([]byte, error) {
+	log.Printf("GET: %q", key)
 
 	s.mu.RLock()
-	_, ok := s.storage[key]
+	it, ok := s.storage[key]
+	expired := ok && s.isExpired(key, now())
 	s.mu.RUnlock()
-	if ok {
-		return errors.New("Key already exists")
+
+	if expired {
+		s.mu.Lock()
+		s.expireIfNeeded(key, now())
+		s.mu.Unlock()
+		ok = false
+	}
+	if !ok {
+		return nil, ErrNoSuchKey
 	}
+	it.access.touch(now())
+	value, ok := it.value.([]byte)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return value, nil
+}
 
+// Restore stores a value of any type, as loaded from a snapshot.
+func (s *Storage) Restore(key string, value any, expireAt int64) {
 	s.mu.Lock()
-	s.storage[key] = value
-	s.mu.Unlock()
-	return nil
+	defer s.mu.Unlock()
+
+	s.remove(key)
+	s.put(key, value)
+	if expireAt != 0 {
+		s.expires[key] = expireAt
+	}
+	// drops the key, or the fields, that already expired
+	s.lookup(key)
 }
 
-func (s *Storage) Get(key string) (string, error) {
-	log.Printf("GET: %s", key)
+// SetListener registers fn to be called with every key that is written or
+// deleted. fn is called with the storage locked, so it must not use it.
+func (s *Storage) SetListener(fn func(key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listener = fn
+}
+
+func (s *Storage) modified(key string) {
+	s.account(key)
+	if s.listener != nil {
+		s.listener(key)
+	}
+}
 
+// Len returns the number of keys and the number of keys with an expiry set.
+func (s *Storage) Len() (int, int) {
 	s.mu.RLock()
-	value, ok := s.storage[key]
-	s.mu.RUnlock()
+	defer s.mu.RUnlock()
+	return len(s.storage), len(s.expires)
+}
+
+// ForEach calls fn for every key until it returns false. expireAt is a unix
+// time in ms, 0 if the key doesn't expire. The storage is locked for reading
+// for the whole iteration, so fn must not modify it.
+func (s *Storage) ForEach(fn func(key string, value any, expireAt int64) bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for k, it := range s.storage {
+		if !fn(k, it.value, s.expires[k]) {
+			return
+		}
+	}
+}
+
+// Clone returns a point-in-time copy of the keyspace.
+func (s *Storage) Clone() *Storage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clone := NewStorage()
+	for k, it := range s.storage {
+		clone.put(k, cloneValue(it.value))
+	}
+	for k, v := range s.expires {
+		clone.expires[k] = v
+	}
+	return clone
+}
+
+// cloneValue copies the containers, strings are never modified in place.
+func cloneValue(value any) any {
+	switch v := value.(type) {
+	case *List:
+		return v.Clone()
+	case *Hash:
+		return v.Clone()
+	case *Set:
+		return v.Clone()
+	case *ZSet:
+		return v.Clone()
+	case *Stream:
+		return v.Clone()
+	}
+	return value
+}
+
+// lookup returns the value of the key, deleting it first if it expired, or
+// the fields of a hash that expired. Must be called with the lock held for
+// writing.
+func (s *Storage) lookup(key string) (any, bool) {
+	ts := now()
+	if s.expireIfNeeded(key, ts) || s.expireFieldsIfNeeded(key, ts) {
+		if _, ok := s.storage[key]; !ok {
+			return nil, false
+		}
+	}
+	it, ok := s.storage[key]
 	if !ok {
-		log.Printf("%v", s.storage)
-		return "", errors.New("No such key")
+		return nil, false
 	}
-	return value, nil
+	it.access.touch(ts)
+	return it.value, true
+}
+
+// put stores the value keeping the expiry, and the slot, of an existing key.
+func (s *Storage) put(key string, value any) {
+	defer s.modified(key)
+	defer s.trackFieldExpires(key, value)
+	if it, ok := s.storage[key]; ok {
+		it.value = value
+		return
+	}
+	it := &item{value: value, slot: s.table.add(key)}
+	it.access.init(now())
+	s.storage[key] = it
+}
+
+// remove deletes the key with its expiry and tells whether it existed.
+func (s *Storage) remove(key string) bool {
+	it, ok := s.storage[key]
+	if !ok {
+		return false
+	}
+	s.table.release(it.slot)
+	s.used -= it.size
+	delete(s.storage, key)
+	delete(s.expires, key)
+	delete(s.volatileHashes, key)
+	s.modified(key)
+	return true
 }
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestBinaryValues(t *testing.T) {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	values := map[string][]byte{
+		"crlf":     []byte("line\r\nline\r\n"),
+		"nul":      {0, 1, 0, 2},
+		"invalid":  {0xc3, 0x28, 0xa0, 0xa1},
+		"random":   random,
+		"\x00\xff": []byte("binary key"),
+	}
+
+	s := NewStorage()
+	for k, v := range values {
+		if err := s.Set(k, v); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	for k, v := range values {
+		res, err := s.Get(k)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !bytes.Equal(res, v) {
+			t.Errorf("Wrong value for %q. Have: %q, want: %q", k, res, v)
+		}
+	}
+}
+
+func TestSetWithArgs(t *testing.T) {
+	s := NewStorage()
+	future := time.Now().Add(time.Hour).UnixMilli()
+
+	if _, ok, _ := s.SetWithArgs("key", []byte("a"), SetArgs{XX: true}); ok {
+		t.Errorf("XX set a missing key")
+	}
+	if prev, ok, _ := s.SetWithArgs("key", []byte("a"), SetArgs{NX: true, ExpireAt: future}); !ok || prev != nil {
+		t.Errorf("Wrong NX result. Have: %q, %v, want: nil, true", prev, ok)
+	}
+	if prev, ok, _ := s.SetWithArgs("key", []byte("b"), SetArgs{NX: true}); ok || string(prev) != "a" {
+		t.Errorf("Wrong NX result. Have: %q, %v, want: \"a\", false", prev, ok)
+	}
+
+	s.SetWithArgs("key", []byte("b"), SetArgs{XX: true, KeepTTL: true})
+	if _, expires := s.Len(); expires != 1 {
+		t.Errorf("KEEPTTL dropped the expiry")
+	}
+	s.SetWithArgs("key", []byte("c"), SetArgs{})
+	if _, expires := s.Len(); expires != 0 {
+		t.Errorf("Overwrite kept the expiry")
+	}
+
+	s.SetWithArgs("key", []byte("d"), SetArgs{ExpireAt: time.Now().UnixMilli() - 1})
+	if _, err := s.Get("key"); err == nil {
+		t.Errorf("Key with a deadline in the past still exists")
+	}
+}
+
+func TestWrongType(t *testing.T) {
+	s := NewStorage()
+	s.UpdateList("list", true, func(l *List) {
+		l.PushBack([]byte("a"))
+	})
+
+	if _, err := s.Get("list"); err != ErrWrongType {
+		t.Errorf("Wrong error for GET on a list. Have: %v, want: %v", err, ErrWrongType)
+	}
+	if _, _, err := s.SetWithArgs("list", []byte("v"), SetArgs{Get: true}); err != ErrWrongType {
+		t.Errorf("Wrong error for SET GET on a list. Have: %v, want: %v", err, ErrWrongType)
+	}
+	if _, _, err := s.SetWithArgs("list", []byte("v"), SetArgs{}); err != nil {
+		t.Errorf("SET didn't overwrite a list: %v", err)
+	}
+	if err := s.ReadList("list", func(l *List) {}); err != ErrWrongType {
+		t.Errorf("Wrong error for a list read on a string. Have: %v, want: %v", err, ErrWrongType)
+	}
+}
+
+func TestStringUpdates(t *testing.T) {
+	s := NewStorage()
+	future := time.Now().Add(time.Hour).UnixMilli()
+	s.SetWithArgs("key", []byte("a"), SetArgs{ExpireAt: future})
+
+	s.UpdateString("key", func(value []byte, exists bool) ([]byte, bool) {
+		return append(append([]byte{}, value...), 'b'), exists
+	})
+	if res, _ := s.Get("key"); string(res) != "ab" {
+		t.Errorf("Wrong updated value. Have: %q, want: \"ab\"", res)
+	}
+	if at, _ := s.ExpireTime("key"); at != future {
+		t.Errorf("Update dropped the expiry")
+	}
+
+	if s.MSet([]string{"other", "key"}, [][]byte{[]byte("x"), []byte("y")}, true) {
+		t.Errorf("MSET NX set an existing key")
+	}
+	if _, err := s.Get("other"); err != ErrNoSuchKey {
+		t.Errorf("MSET NX set some of the keys")
+	}
+	s.MSet([]string{"other", "key"}, [][]byte{[]byte("x"), []byte("y")}, false)
+	if at, _ := s.ExpireTime("key"); at != 0 {
+		t.Errorf("MSET kept the expiry")
+	}
+
+	if res, err := s.GetDel("key"); err != nil || string(res) != "y" {
+		t.Errorf("Wrong GETDEL result. Have: %q, %v, want: \"y\"", res, err)
+	}
+	if _, err := s.GetDel("key"); err != ErrNoSuchKey {
+		t.Errorf("GETDEL didn't delete the key")
+	}
+}
+
+func TestStoreStrings(t *testing.T) {
+	s := NewStorage()
+	s.Set("a", []byte("ab"))
+	s.Set("dst", []byte("old"))
+	s.UpdateList("list", true, func(list *List) { list.PushBack([]byte("x")) })
+
+	concat := func(values [][]byte) []byte {
+		var res []byte
+		for _, value := range values {
+			res = append(res, value...)
+		}
+		return res
+	}
+	if n, err := s.StoreStrings("dst", []string{"a", "missing", "a"}, concat); err != nil || n != 4 {
+		t.Errorf("Wrong result. Have: %d, %v, want: 4", n, err)
+	}
+	if res, _ := s.Get("dst"); string(res) != "abab" {
+		t.Errorf("Wrong destination. Have: %q, want: \"abab\"", res)
+	}
+	if _, err := s.StoreStrings("dst", []string{"a", "list"}, concat); err != ErrWrongType {
+		t.Errorf("Wrong error. Have: %v, want: %v", err, ErrWrongType)
+	}
+	s.StoreStrings("dst", []string{"missing"}, concat)
+	if s.Exists("dst") != 0 {
+		t.Errorf("Empty result was stored")
+	}
+}
@@ -0,0 +1,506 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// StreamID identifies an entry of a stream: the unix time in ms it was added
+// at, and a sequence number for the entries added in the same ms.
+type StreamID struct {
+	Ms, Seq uint64
+}
+
+// MaxStreamID is the highest possible ID, 0-0 is the lowest one.
+var MaxStreamID = StreamID{math.MaxUint64, math.MaxUint64}
+
+func (id StreamID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) Less(other StreamID) bool {
+	return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+func (id StreamID) IsZero() bool {
+	return id.Ms == 0 && id.Seq == 0
+}
+
+// Next returns the ID right after id, false if id is MaxStreamID.
+func (id StreamID) Next() (StreamID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return StreamID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return StreamID{id.Ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// Prev returns the ID right before id, false if id is 0-0.
+func (id StreamID) Prev() (StreamID, bool) {
+	switch {
+	case id.Seq > 0:
+		return StreamID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return StreamID{id.Ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// StreamEntry is an entry of a stream, Fields holds its fields and values in
+// turn.
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+// Stream is the value of a stream key: entries sorted by ID and the consumer
+// groups that read them. Unlike the containers, a stream is kept when its
+// last entry is deleted.
+type Stream struct {
+	entries []StreamEntry
+	lastID  StreamID
+	// the highest ID deleted from the middle of the stream, while it is in
+	// the stream the number of entries before an ID is unknown
+	maxDeletedID StreamID
+	entriesAdded int64
+	groups       map[string]*ConsumerGroup
+}
+
+// InvalidEntriesRead is the entries read counter of a group when it can't be
+// told how many entries the group read.
+const InvalidEntriesRead = -1
+
+// ConsumerGroup delivers every entry of a stream once, to one of its
+// consumers, and keeps the delivered entries until they are acknowledged.
+type ConsumerGroup struct {
+	Name   string
+	LastID StreamID
+	// the number of entries delivered to the group since the stream was
+	// created, or InvalidEntriesRead
+	EntriesRead int64
+	pending     []*PendingEntry // sorted by ID
+	consumers   map[string]*Consumer
+}
+
+// PendingEntry is an entry delivered to a consumer and not acknowledged.
+type PendingEntry struct {
+	ID            StreamID
+	Consumer      string
+	DeliveryTime  int64 // unix time in ms of the last delivery
+	DeliveryCount int64
+}
+
+type Consumer struct {
+	Name       string
+	SeenTime   int64 // unix time in ms of the last attempt to read or claim
+	ActiveTime int64 // unix time in ms of the last successful one, -1 if none
+}
+
+func NewStream() *Stream {
+	return &Stream{groups: make(map[string]*ConsumerGroup)}
+}
+
+func (st *Stream) Len() int {
+	return len(st.entries)
+}
+
+func (st *Stream) LastID() StreamID {
+	return st.lastID
+}
+
+// FirstID returns the ID of the first entry, 0-0 if the stream is empty.
+func (st *Stream) FirstID() StreamID {
+	if len(st.entries) == 0 {
+		return StreamID{}
+	}
+	return st.entries[0].ID
+}
+
+func (st *Stream) MaxDeletedID() StreamID {
+	return st.maxDeletedID
+}
+
+// EntriesAdded returns the number of entries added since the stream was
+// created, deleted ones included.
+func (st *Stream) EntriesAdded() int64 {
+	return st.entriesAdded
+}
+
+// Add appends the entry, its ID must be greater than LastID.
+func (st *Stream) Add(id StreamID, fields [][]byte) {
+	st.entries = append(st.entries, StreamEntry{ID: id, Fields: fields})
+	st.lastID = id
+	st.entriesAdded++
+}
+
+// SetID replaces the metadata of the stream, like XSETID.
+func (st *Stream) SetID(lastID StreamID, entriesAdded int64, maxDeletedID StreamID) {
+	st.lastID = lastID
+	st.entriesAdded = entriesAdded
+	st.maxDeletedID = maxDeletedID
+}
+
+// search returns the index of the first entry with an ID not lower than id.
+func (st *Stream) search(id StreamID) int {
+	return sort.Search(len(st.entries), func(i int) bool {
+		return !st.entries[i].ID.Less(id)
+	})
+}
+
+func (st *Stream) Entry(id StreamID) (StreamEntry, bool) {
+	i := st.search(id)
+	if i == len(st.entries) || st.entries[i].ID != id {
+		return StreamEntry{}, false
+	}
+	return st.entries[i], true
+}
+
+// Range returns the entries with an ID from start to end inclusive, the last
+// ones first if reverse is set. A negative count returns all of them.
+func (st *Stream) Range(start, end StreamID, count int, reverse bool) []StreamEntry {
+	lo := st.search(start)
+	hi := sort.Search(len(st.entries), func(i int) bool {
+		return end.Less(st.entries[i].ID)
+	})
+
+	res := []StreamEntry{}
+	if reverse {
+		for i := hi - 1; i >= lo && count != 0; i-- {
+			res = append(res, st.entries[i])
+			count--
+		}
+		return res
+	}
+	for i := lo; i < hi && count != 0; i++ {
+		res = append(res, st.entries[i])
+		count--
+	}
+	return res
+}
+
+// Delete removes the entry and returns whether it existed.
+func (st *Stream) Delete(id StreamID) bool {
+	i := st.search(id)
+	if i == len(st.entries) || st.entries[i].ID != id {
+		return false
+	}
+	copy(st.entries[i:], st.entries[i+1:])
+	st.entries[len(st.entries)-1] = StreamEntry{}
+	st.entries = st.entries[:len(st.entries)-1]
+	if st.maxDeletedID.Less(id) {
+		st.maxDeletedID = id
+	}
+	return true
+}
+
+// TrimMaxLen deletes the oldest entries until maxLen are left, or until limit
+// of them are deleted if limit is positive. Returns how many were deleted.
+func (st *Stream) TrimMaxLen(maxLen int, limit int) int {
+	return st.trim(len(st.entries)-maxLen, limit)
+}
+
+// TrimMinID deletes the entries with an ID lower than id, up to limit of them
+// if limit is positive. Returns how many were deleted.
+func (st *Stream) TrimMinID(id StreamID, limit int) int {
+	return st.trim(st.search(id), limit)
+}
+
+func (st *Stream) trim(n int, limit int) int {
+	if n <= 0 {
+		return 0
+	}
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	for i := 0; i < n; i++ {
+		st.entries[i] = StreamEntry{}
+	}
+	st.entries = st.entries[n:]
+	return n
+}
+
+// CreateGroup adds a group that delivers the entries after lastID, returns
+// false if there is already a group with the name.
+func (st *Stream) CreateGroup(name string, lastID StreamID, entriesRead int64) bool {
+	if _, ok := st.groups[name]; ok {
+		return false
+	}
+	st.groups[name] = &ConsumerGroup{
+		Name:        name,
+		LastID:      lastID,
+		EntriesRead: entriesRead,
+		consumers:   make(map[string]*Consumer),
+	}
+	return true
+}
+
+// Group returns the group with the name, nil if there is none.
+func (st *Stream) Group(name string) *ConsumerGroup {
+	return st.groups[name]
+}
+
+func (st *Stream) DestroyGroup(name string) bool {
+	if _, ok := st.groups[name]; !ok {
+		return false
+	}
+	delete(st.groups, name)
+	return true
+}
+
+// Groups returns the groups sorted by name.
+func (st *Stream) Groups() []*ConsumerGroup {
+	groups := make([]*ConsumerGroup, 0, len(st.groups))
+	for _, g := range st.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups
+}
+
+// ReadGroup delivers to the consumer the entries the group didn't deliver
+// yet, up to count of them unless count is negative. They are added to the
+// pending entries of the consumer unless noAck is set.
+func (st *Stream) ReadGroup(g *ConsumerGroup, consumer *Consumer, count int, noAck bool, now int64) []StreamEntry {
+	start, ok := g.LastID.Next()
+	if !ok {
+		return []StreamEntry{}
+	}
+	entries := st.Range(start, MaxStreamID, count, false)
+	for _, entry := range entries {
+		if g.EntriesRead != InvalidEntriesRead && !st.hasTombstones(entry.ID, MaxStreamID) {
+			g.EntriesRead++
+		} else if st.entriesAdded > 0 {
+			g.EntriesRead = st.estimateEntriesRead(entry.ID)
+		}
+		g.LastID = entry.ID
+
+		// the entry can already be pending if the group was set back to
+		// an earlier ID, then it is delivered again from scratch
+		if !noAck {
+			g.Claim(entry.ID, consumer.Name, now, 1)
+		}
+	}
+	if len(entries) > 0 {
+		consumer.ActiveTime = now
+	}
+	return entries
+}
+
+// Lag returns the number of entries the group has yet to deliver, false if
+// it can't be told because entries were deleted.
+func (st *Stream) Lag(g *ConsumerGroup) (int64, bool) {
+	switch {
+	case st.entriesAdded == 0:
+		return 0, true
+	case g.EntriesRead != InvalidEntriesRead && !st.hasTombstones(g.LastID, MaxStreamID):
+		return st.entriesAdded - g.EntriesRead, true
+	}
+	read := st.estimateEntriesRead(g.LastID)
+	if read == InvalidEntriesRead {
+		return 0, false
+	}
+	return st.entriesAdded - read, true
+}
+
+// hasTombstones tells whether an entry was deleted between start and end,
+// as far as it can be told from the highest deleted ID.
+func (st *Stream) hasTombstones(start, end StreamID) bool {
+	if len(st.entries) == 0 || st.maxDeletedID.IsZero() {
+		return false
+	}
+	return !st.maxDeletedID.Less(start) && !end.Less(st.maxDeletedID)
+}
+
+// estimateEntriesRead returns the number of entries added up to id, like
+// streamEstimateDistanceFromFirstEverEntry in redis, or InvalidEntriesRead
+// if there's no telling.
+func (st *Stream) estimateEntriesRead(id StreamID) int64 {
+	if st.entriesAdded == 0 {
+		return 0
+	}
+	if len(st.entries) == 0 && !st.lastID.Less(id) {
+		return st.entriesAdded
+	}
+	if id == st.lastID {
+		return st.entriesAdded
+	}
+	if st.lastID.Less(id) {
+		return InvalidEntriesRead
+	}
+
+	first := st.FirstID()
+	if st.maxDeletedID.IsZero() || st.maxDeletedID.Less(first) {
+		// no entries were deleted after the first one
+		switch {
+		case id.Less(first):
+			return st.entriesAdded - int64(len(st.entries))
+		case id == first:
+			return st.entriesAdded - int64(len(st.entries)) + 1
+		}
+	}
+	return InvalidEntriesRead
+}
+
+func (st *Stream) Clone() *Stream {
+	clone := *st
+	clone.entries = append([]StreamEntry(nil), st.entries...)
+	clone.groups = make(map[string]*ConsumerGroup, len(st.groups))
+	for name, g := range st.groups {
+		clone.groups[name] = g.clone()
+	}
+	return &clone
+}
+
+// SetID moves the group to lastID, like XGROUP SETID.
+func (g *ConsumerGroup) SetID(lastID StreamID, entriesRead int64) {
+	g.LastID = lastID
+	g.EntriesRead = entriesRead
+}
+
+func (g *ConsumerGroup) Consumer(name string) *Consumer {
+	return g.consumers[name]
+}
+
+// CreateConsumer returns the consumer with the name and whether it was
+// created.
+func (g *ConsumerGroup) CreateConsumer(name string, now int64) (*Consumer, bool) {
+	if c, ok := g.consumers[name]; ok {
+		return c, false
+	}
+	c := &Consumer{Name: name, SeenTime: now, ActiveTime: -1}
+	g.consumers[name] = c
+	return c, true
+}
+
+// DeleteConsumer deletes the consumer with its pending entries, returns the
+// number of pending entries it had and whether it existed.
+func (g *ConsumerGroup) DeleteConsumer(name string) (int, bool) {
+	if _, ok := g.consumers[name]; !ok {
+		return 0, false
+	}
+	delete(g.consumers, name)
+
+	deleted := 0
+	pending := g.pending[:0]
+	for _, p := range g.pending {
+		if p.Consumer == name {
+			deleted++
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	for i := len(pending); i < len(g.pending); i++ {
+		g.pending[i] = nil
+	}
+	g.pending = pending
+	return deleted, true
+}
+
+// Consumers returns the consumers sorted by name.
+func (g *ConsumerGroup) Consumers() []*Consumer {
+	consumers := make([]*Consumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		consumers = append(consumers, c)
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].Name < consumers[j].Name
+	})
+	return consumers
+}
+
+func (g *ConsumerGroup) pendingIndex(id StreamID) int {
+	return sort.Search(len(g.pending), func(i int) bool {
+		return !g.pending[i].ID.Less(id)
+	})
+}
+
+// Pending returns the pending entry with the ID, nil if there is none.
+func (g *ConsumerGroup) Pending(id StreamID) *PendingEntry {
+	i := g.pendingIndex(id)
+	if i == len(g.pending) || g.pending[i].ID != id {
+		return nil
+	}
+	return g.pending[i]
+}
+
+func (g *ConsumerGroup) PendingLen() int {
+	return len(g.pending)
+}
+
+// PendingRange returns the pending entries with an ID from start to end
+// inclusive, only those of the consumer unless it's empty. A negative count
+// returns all of them.
+func (g *ConsumerGroup) PendingRange(start, end StreamID, count int, consumer string) []*PendingEntry {
+	res := []*PendingEntry{}
+	for i := g.pendingIndex(start); i < len(g.pending) && count != 0; i++ {
+		p := g.pending[i]
+		if end.Less(p.ID) {
+			break
+		}
+		if consumer == "" || p.Consumer == consumer {
+			res = append(res, p)
+			count--
+		}
+	}
+	return res
+}
+
+// PendingCount returns the number of pending entries of the consumer.
+func (g *ConsumerGroup) PendingCount(consumer string) int {
+	n := 0
+	for _, p := range g.pending {
+		if p.Consumer == consumer {
+			n++
+		}
+	}
+	return n
+}
+
+// Ack removes the entry from the pending ones, returns whether it was
+// pending.
+func (g *ConsumerGroup) Ack(id StreamID) bool {
+	i := g.pendingIndex(id)
+	if i == len(g.pending) || g.pending[i].ID != id {
+		return false
+	}
+	copy(g.pending[i:], g.pending[i+1:])
+	g.pending[len(g.pending)-1] = nil
+	g.pending = g.pending[:len(g.pending)-1]
+	return true
+}
+
+// Claim gives the pending entry to the consumer, adding it to the pending
+// entries if it isn't there yet.
+func (g *ConsumerGroup) Claim(id StreamID, consumer string, deliveryTime int64, deliveryCount int64) *PendingEntry {
+	i := g.pendingIndex(id)
+	if i == len(g.pending) || g.pending[i].ID != id {
+		g.pending = append(g.pending, nil)
+		copy(g.pending[i+1:], g.pending[i:])
+		g.pending[i] = &PendingEntry{ID: id}
+	}
+	p := g.pending[i]
+	p.Consumer = consumer
+	p.DeliveryTime = deliveryTime
+	p.DeliveryCount = deliveryCount
+	return p
+}
+
+func (g *ConsumerGroup) clone() *ConsumerGroup {
+	clone := *g
+	clone.pending = make([]*PendingEntry, len(g.pending))
+	for i, p := range g.pending {
+		cp := *p
+		clone.pending[i] = &cp
+	}
+	clone.consumers = make(map[string]*Consumer, len(g.consumers))
+	for name, c := range g.consumers {
+		cc := *c
+		clone.consumers[name] = &cc
+	}
+	return &clone
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func streamIDs(entries []StreamEntry) []StreamID {
+	ids := []StreamID{}
+	for _, e := range entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func testStream() *Stream {
+	st := NewStream()
+	for _, id := range []StreamID{{1, 0}, {1, 1}, {2, 0}, {3, 5}, {4, 0}} {
+		st.Add(id, [][]byte{[]byte("f"), []byte(id.String())})
+	}
+	return st
+}
+
+func TestStreamRange(t *testing.T) {
+	st := testStream()
+
+	tests := []utils.Test[func() []StreamEntry, []StreamID]{
+		{Name: "All", Input: func() []StreamEntry { return st.Range(StreamID{}, MaxStreamID, -1, false) }, Want: []StreamID{{1, 0}, {1, 1}, {2, 0}, {3, 5}, {4, 0}}},
+		{Name: "Bounds between entries", Input: func() []StreamEntry { return st.Range(StreamID{1, 1}, StreamID{3, 4}, -1, false) }, Want: []StreamID{{1, 1}, {2, 0}}},
+		{Name: "Count", Input: func() []StreamEntry { return st.Range(StreamID{2, 0}, MaxStreamID, 1, false) }, Want: []StreamID{{2, 0}}},
+		{Name: "Reverse", Input: func() []StreamEntry { return st.Range(StreamID{1, 1}, MaxStreamID, 2, true) }, Want: []StreamID{{4, 0}, {3, 5}}},
+		{Name: "Empty", Input: func() []StreamEntry { return st.Range(StreamID{5, 0}, MaxStreamID, -1, false) }, Want: []StreamID{}},
+	}
+	for _, test := range tests {
+		if res := streamIDs(test.Input()); !cmp.Equal(res, test.Want) {
+			t.Errorf(test.ToString(res))
+		}
+	}
+}
+
+func TestStreamTrim(t *testing.T) {
+	st := testStream()
+	if !st.Delete(StreamID{2, 0}) || st.Delete(StreamID{2, 0}) {
+		t.Error("Wrong result deleting an entry twice")
+	}
+	if st.MaxDeletedID() != (StreamID{2, 0}) {
+		t.Errorf("Wrong max deleted ID. Have: %v", st.MaxDeletedID())
+	}
+
+	if n := st.TrimMaxLen(1, 2); n != 2 {
+		t.Errorf("Wrong number of trimmed entries with a limit. Have: %d, want: 2", n)
+	}
+	if n := st.TrimMinID(StreamID{4, 0}, 0); n != 1 {
+		t.Errorf("Wrong number of trimmed entries. Have: %d, want: 1", n)
+	}
+	if st.Len() != 1 || st.FirstID() != (StreamID{4, 0}) || st.EntriesAdded() != 5 {
+		t.Errorf("Wrong stream after trimming: %d entries from %v", st.Len(), st.FirstID())
+	}
+}
+
+func TestConsumerGroup(t *testing.T) {
+	st := testStream()
+	st.CreateGroup("g", StreamID{}, 0)
+	g := st.Group("g")
+	alice, _ := g.CreateConsumer("alice", 100)
+	bob, _ := g.CreateConsumer("bob", 100)
+
+	if res := streamIDs(st.ReadGroup(g, alice, 2, false, 200)); !cmp.Equal(res, []StreamID{{1, 0}, {1, 1}}) {
+		t.Errorf("Wrong entries delivered. Have: %v", res)
+	}
+	st.ReadGroup(g, bob, 1, false, 300)
+	st.ReadGroup(g, bob, 1, true, 300)
+	if g.LastID != (StreamID{3, 5}) || g.EntriesRead != 4 {
+		t.Errorf("Wrong group position. Have: %v after %d entries", g.LastID, g.EntriesRead)
+	}
+	if lag, ok := st.Lag(g); !ok || lag != 1 {
+		t.Errorf("Wrong lag. Have: %d, %v, want: 1", lag, ok)
+	}
+
+	if n := g.PendingCount("alice"); n != 2 {
+		t.Errorf("Wrong pending count. Have: %d, want: 2", n)
+	}
+	if !g.Ack(StreamID{1, 0}) || g.Ack(StreamID{1, 0}) {
+		t.Error("Wrong result acknowledging an entry twice")
+	}
+	g.Claim(StreamID{1, 1}, "bob", 400, 2)
+	pending := g.PendingRange(StreamID{}, MaxStreamID, -1, "bob")
+	want := []*PendingEntry{{StreamID{1, 1}, "bob", 400, 2}, {StreamID{2, 0}, "bob", 300, 1}}
+	if !cmp.Equal(pending, want) {
+		t.Errorf("Wrong pending entries. Have: %v, want: %v", pending, want)
+	}
+
+	if n, _ := g.DeleteConsumer("bob"); n != 2 || g.PendingLen() != 0 {
+		t.Errorf("Wrong pending entries deleted with the consumer. Have: %d, left: %d", n, g.PendingLen())
+	}
+
+	// the counter can't be told once an entry after the group is deleted
+	st.Delete(StreamID{4, 0})
+	if _, ok := st.Lag(g); ok {
+		t.Error("Expected an unknown lag after a deletion")
+	}
+}
@@ -0,0 +1,111 @@
+package storage
+
+// UpdateString calls fn with the string at key, nil if the key doesn't exist,
+// and stores the value fn returns unless it returns false. The expiry of the
+// key is kept.
+func (s *Storage) UpdateString(key string, fn func(value []byte, exists bool) ([]byte, bool)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, exists := s.lookup(key)
+	value, ok := v.([]byte)
+	if exists && !ok {
+		return ErrWrongType
+	}
+	if res, store := fn(value, exists); store {
+		s.put(key, res)
+	}
+	return nil
+}
+
+// GetDel deletes the string at key and returns it.
+func (s *Storage) GetDel(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	value, ok := v.([]byte)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	s.remove(key)
+	return value, nil
+}
+
+// GetEx returns the string at key and sets its deadline to expireAt, or
+// removes it if persist is set. A deadline in the past deletes the key.
+func (s *Storage) GetEx(key string, expireAt int64, persist bool) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.lookup(key)
+	if !ok {
+		return nil, ErrNoSuchKey
+	}
+	value, ok := v.([]byte)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	switch {
+	case expireAt != 0:
+		s.expires[key] = expireAt
+		if !s.expireIfNeeded(key, now()) {
+			s.modified(key)
+		}
+	case persist:
+		if _, ok := s.expires[key]; ok {
+			delete(s.expires, key)
+			s.modified(key)
+		}
+	}
+	return value, nil
+}
+
+// MSet sets the keys to the values, dropping their expiry. With nx nothing is
+// set if one of the keys exists, and the result tells whether they were set.
+func (s *Storage) MSet(keys []string, values [][]byte, nx bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if nx {
+		for _, key := range keys {
+			if _, ok := s.lookup(key); ok {
+				return false
+			}
+		}
+	}
+	for i, key := range keys {
+		s.put(key, values[i])
+		delete(s.expires, key)
+	}
+	return true
+}
+
+// StoreStrings replaces dst with the result of op on the strings at keys, nil
+// for the missing ones. An empty result deletes dst. Returns the length of
+// the result.
+func (s *Storage) StoreStrings(dst string, keys []string, op func(values [][]byte) []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		v, ok := s.lookup(key)
+		if !ok {
+			continue
+		}
+		if values[i], ok = v.([]byte); !ok {
+			return 0, ErrWrongType
+		}
+	}
+	res := op(values)
+	s.remove(dst)
+	if len(res) > 0 {
+		s.put(dst, res)
+	}
+	return len(res), nil
+}
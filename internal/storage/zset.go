@@ -0,0 +1,358 @@
+package storage
+
+import (
+	"math"
+	"strings"
+)
+
+// ZSet is the value of a sorted set key: distinct members with a score,
+// ordered by score then member. A skiplist keeps the order and a map the
+// score of every member.
+type ZSet struct {
+	scores map[string]float64
+	zsl    *skiplist
+}
+
+// ZMember is a member of a sorted set with its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ScoreRange is an interval of scores, each end can be excluded.
+type ScoreRange struct {
+	Min, Max     float64
+	MinEx, MaxEx bool
+}
+
+// LexBound is an end of a LexRange: a member, or one of the infinities that
+// sort before and after every member.
+type LexBound struct {
+	Value     string
+	Exclusive bool
+	Inf       int // -1 or 1 for the infinities, 0 for a member
+}
+
+// LexRange is an interval of members, for sorted sets where all the members
+// have the same score.
+type LexRange struct {
+	Min, Max LexBound
+}
+
+// Aggregate is how the union and the intersection of sorted sets combine the
+// scores of a member that is in more than one of them.
+type Aggregate int
+
+const (
+	AggregateSum Aggregate = iota
+	AggregateMin
+	AggregateMax
+)
+
+func NewZSet() *ZSet {
+	return &ZSet{
+		scores: make(map[string]float64),
+		zsl:    newSkiplist(),
+	}
+}
+
+func (z *ZSet) Len() int {
+	return len(z.scores)
+}
+
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// Set adds the member or changes its score, returns whether it is new.
+func (z *ZSet) Set(member string, score float64) bool {
+	current, exists := z.scores[member]
+	if exists {
+		if current == score {
+			return false
+		}
+		z.zsl.delete(current, member)
+	}
+	z.zsl.insert(score, member)
+	z.scores[member] = score
+	return !exists
+}
+
+// Remove returns whether the member existed.
+func (z *ZSet) Remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.scores, member)
+	return true
+}
+
+// Rank returns the 0-based rank of the member, counted from the highest
+// score if reverse is set.
+func (z *ZSet) Rank(member string, reverse bool) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	rank := z.zsl.rank(score, member)
+	if reverse {
+		return z.Len() - rank, true
+	}
+	return rank - 1, true
+}
+
+// Range returns the members from rank start to stop inclusive, the indexes
+// are taken as in LRANGE. With reverse the ranks count from the highest
+// score.
+func (z *ZSet) Range(start, stop int, reverse bool) []ZMember {
+	start, stop, ok := normalizeRange(start, stop, z.Len())
+	if !ok {
+		return []ZMember{}
+	}
+
+	res := make([]ZMember, 0, stop-start+1)
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.byRank(z.Len() - start)
+	} else {
+		x = z.zsl.byRank(start + 1)
+	}
+	for i := start; i <= stop; i++ {
+		res = append(res, ZMember{x.member, x.score})
+		if reverse {
+			x = x.backward
+		} else {
+			x = x.next()
+		}
+	}
+	return res
+}
+
+// RangeByScore returns the members in the range, from the highest score if
+// reverse is set, skipping offset of them. A negative count returns all of
+// them.
+func (z *ZSet) RangeByScore(r ScoreRange, reverse bool, offset, count int) []ZMember {
+	return z.rangeBy(r, reverse, offset, count)
+}
+
+// RangeByLex is like RangeByScore, for members in a range of strings.
+func (z *ZSet) RangeByLex(r LexRange, reverse bool, offset, count int) []ZMember {
+	return z.rangeBy(r, reverse, offset, count)
+}
+
+func (z *ZSet) rangeBy(r rangeSpec, reverse bool, offset, count int) []ZMember {
+	var x *skiplistNode
+	if reverse {
+		x = z.zsl.lastInRange(r)
+	} else {
+		x = z.zsl.firstInRange(r)
+	}
+
+	step := func(x *skiplistNode) *skiplistNode {
+		if reverse {
+			return x.backward
+		}
+		return x.next()
+	}
+	for ; x != nil && offset > 0; offset-- {
+		x = step(x)
+	}
+
+	res := []ZMember{}
+	for ; x != nil && count != 0; count-- {
+		if (reverse && !r.aboveMin(x)) || (!reverse && !r.belowMax(x)) {
+			break
+		}
+		res = append(res, ZMember{x.member, x.score})
+		x = step(x)
+	}
+	return res
+}
+
+// Count returns the number of members in the range.
+func (z *ZSet) Count(r ScoreRange) int {
+	return z.count(r)
+}
+
+// LexCount returns the number of members in the range.
+func (z *ZSet) LexCount(r LexRange) int {
+	return z.count(r)
+}
+
+func (z *ZSet) count(r rangeSpec) int {
+	first := z.zsl.firstInRange(r)
+	if first == nil {
+		return 0
+	}
+	last := z.zsl.lastInRange(r)
+	return z.zsl.rank(last.score, last.member) - z.zsl.rank(first.score, first.member) + 1
+}
+
+// Pop removes up to count members with the lowest scores, or the highest if
+// max is set.
+func (z *ZSet) Pop(count int, max bool) []ZMember {
+	res := []ZMember{}
+	for len(res) < count && z.Len() > 0 {
+		x := z.zsl.header.level[0].forward
+		if max {
+			x = z.zsl.tail
+		}
+		res = append(res, ZMember{x.member, x.score})
+		z.Remove(x.member)
+	}
+	return res
+}
+
+// ForEach calls fn for every member, from the lowest score, until it returns
+// false.
+func (z *ZSet) ForEach(fn func(member string, score float64) bool) {
+	for x := z.zsl.header.level[0].forward; x != nil; x = x.next() {
+		if !fn(x.member, x.score) {
+			return
+		}
+	}
+}
+
+func (z *ZSet) Clone() *ZSet {
+	return zsetFromScores(z.scores)
+}
+
+func zsetFromScores(scores map[string]float64) *ZSet {
+	z := NewZSet()
+	for member, score := range scores {
+		z.Set(member, score)
+	}
+	return z
+}
+
+func (r ScoreRange) empty() bool {
+	return r.Min > r.Max || (r.Min == r.Max && (r.MinEx || r.MaxEx))
+}
+
+func (r ScoreRange) aboveMin(n *skiplistNode) bool {
+	if r.MinEx {
+		return n.score > r.Min
+	}
+	return n.score >= r.Min
+}
+
+func (r ScoreRange) belowMax(n *skiplistNode) bool {
+	if r.MaxEx {
+		return n.score < r.Max
+	}
+	return n.score <= r.Max
+}
+
+// compare compares the bound with a member, infinities first.
+func (b LexBound) compare(member string) int {
+	if b.Inf != 0 {
+		return b.Inf
+	}
+	return strings.Compare(b.Value, member)
+}
+
+func (r LexRange) empty() bool {
+	if r.Min.Inf == 1 || r.Max.Inf == -1 {
+		return true
+	}
+	if r.Min.Inf == -1 || r.Max.Inf == 1 {
+		return false
+	}
+	cmp := strings.Compare(r.Min.Value, r.Max.Value)
+	return cmp > 0 || (cmp == 0 && (r.Min.Exclusive || r.Max.Exclusive))
+}
+
+func (r LexRange) aboveMin(n *skiplistNode) bool {
+	cmp := r.Min.compare(n.member)
+	if r.Min.Exclusive {
+		return cmp < 0
+	}
+	return cmp <= 0
+}
+
+func (r LexRange) belowMax(n *skiplistNode) bool {
+	cmp := r.Max.compare(n.member)
+	if r.Max.Exclusive {
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+func (a Aggregate) apply(x, y float64) float64 {
+	switch a {
+	case AggregateMin:
+		return math.Min(x, y)
+	case AggregateMax:
+		return math.Max(x, y)
+	}
+	// like redis, the sum of opposite infinities is 0
+	if sum := x + y; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+func weighted(score float64, weight float64) float64 {
+	// like redis, an infinity times 0 is 0
+	if res := score * weight; !math.IsNaN(res) {
+		return res
+	}
+	return 0
+}
+
+// UnionZSets returns the members of any of the sorted sets, with the score
+// given by agg over their weighted scores. weights has one element for every
+// sorted set.
+func UnionZSets(zsets []*ZSet, weights []float64, agg Aggregate) *ZSet {
+	scores := make(map[string]float64)
+	for i, z := range zsets {
+		for member, score := range z.scores {
+			score = weighted(score, weights[i])
+			if current, ok := scores[member]; ok {
+				score = agg.apply(current, score)
+			}
+			scores[member] = score
+		}
+	}
+	return zsetFromScores(scores)
+}
+
+// InterZSets returns the members that are in all the sorted sets, with the
+// score computed like in UnionZSets.
+func InterZSets(zsets []*ZSet, weights []float64, agg Aggregate) *ZSet {
+	scores := make(map[string]float64)
+	if len(zsets) == 0 {
+		return NewZSet()
+	}
+	smallest := zsets[0]
+	for _, z := range zsets[1:] {
+		if z.Len() < smallest.Len() {
+			smallest = z
+		}
+	}
+
+	for member := range smallest.scores {
+		var res float64
+		inAll := true
+		for i, z := range zsets {
+			score, ok := z.scores[member]
+			if !ok {
+				inAll = false
+				break
+			}
+			score = weighted(score, weights[i])
+			if i == 0 {
+				res = score
+			} else {
+				res = agg.apply(res, score)
+			}
+		}
+		if inAll {
+			scores[member] = res
+		}
+	}
+	return zsetFromScores(scores)
+}
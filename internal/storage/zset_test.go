@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func zmembers(res []ZMember) []string {
+	members := []string{}
+	for _, m := range res {
+		members = append(members, m.Member)
+	}
+	return members
+}
+
+// TestSkiplistRanks checks the order and the ranks against a sorted slice,
+// through random inserts, updates and removals.
+func TestSkiplistRanks(t *testing.T) {
+	z := NewZSet()
+	for i := 0; i < 2000; i++ {
+		member := fmt.Sprint(rand.Intn(500))
+		if rand.Intn(4) == 0 {
+			z.Remove(member)
+		} else {
+			z.Set(member, float64(rand.Intn(50)))
+		}
+	}
+
+	want := []ZMember{}
+	for member, score := range z.scores {
+		want = append(want, ZMember{member, score})
+	}
+	sort.Slice(want, func(i, j int) bool {
+		return want[i].Score < want[j].Score || (want[i].Score == want[j].Score && want[i].Member < want[j].Member)
+	})
+
+	if res := z.Range(0, -1, false); !cmp.Equal(res, want) {
+		t.Fatalf("Wrong order. Have: %v, want: %v", res, want)
+	}
+	for i, m := range want {
+		if rank, _ := z.Rank(m.Member, false); rank != i {
+			t.Fatalf("Wrong rank of %q. Have: %d, want: %d", m.Member, rank, i)
+		}
+		if rank, _ := z.Rank(m.Member, true); rank != len(want)-1-i {
+			t.Fatalf("Wrong reverse rank of %q. Have: %d, want: %d", m.Member, rank, len(want)-1-i)
+		}
+	}
+}
+
+func TestZSetRanges(t *testing.T) {
+	z := NewZSet()
+	for i, member := range []string{"a", "b", "c", "d", "e"} {
+		z.Set(member, float64(i+1))
+	}
+	inf := math.Inf(1)
+
+	tests := []utils.Test[func() []ZMember, []string]{
+		{Name: "Rank", Input: func() []ZMember { return z.Range(1, -2, false) }, Want: []string{"b", "c", "d"}},
+		{Name: "Rank reverse", Input: func() []ZMember { return z.Range(0, 1, true) }, Want: []string{"e", "d"}},
+		{Name: "Score", Input: func() []ZMember { return z.RangeByScore(ScoreRange{Min: 2, Max: 4, MinEx: true}, false, 0, -1) }, Want: []string{"c", "d"}},
+		{Name: "Score infinite", Input: func() []ZMember { return z.RangeByScore(ScoreRange{Min: -inf, Max: inf}, true, 1, 2) }, Want: []string{"d", "c"}},
+		{Name: "Score empty", Input: func() []ZMember { return z.RangeByScore(ScoreRange{Min: 3, Max: 3, MaxEx: true}, false, 0, -1) }, Want: []string{}},
+		{Name: "Lex", Input: func() []ZMember {
+			return z.RangeByLex(LexRange{Min: LexBound{Value: "b"}, Max: LexBound{Value: "d", Exclusive: true}}, false, 0, -1)
+		}, Want: []string{"b", "c"}},
+		{Name: "Lex infinite", Input: func() []ZMember {
+			return z.RangeByLex(LexRange{Min: LexBound{Inf: -1}, Max: LexBound{Inf: 1}}, true, 0, 2)
+		}, Want: []string{"e", "d"}},
+	}
+	for _, test := range tests {
+		if res := zmembers(test.Input()); !cmp.Equal(res, test.Want) {
+			t.Errorf(test.ToString(res))
+		}
+	}
+
+	if n := z.Count(ScoreRange{Min: 1.5, Max: inf}); n != 4 {
+		t.Errorf("Wrong count. Have: %d, want: 4", n)
+	}
+	if popped := zmembers(z.Pop(2, true)); !cmp.Equal(popped, []string{"e", "d"}) {
+		t.Errorf("Wrong popped members. Have: %v", popped)
+	}
+}
+
+func TestZSetAlgebra(t *testing.T) {
+	a, b := NewZSet(), NewZSet()
+	a.Set("x", 1)
+	a.Set("y", 2)
+	b.Set("y", 10)
+	b.Set("z", math.Inf(1))
+
+	union := UnionZSets([]*ZSet{a, b}, []float64{2, 1}, AggregateSum)
+	want := []ZMember{{"x", 2}, {"y", 14}, {"z", math.Inf(1)}}
+	if res := union.Range(0, -1, false); !cmp.Equal(res, want) {
+		t.Errorf("Wrong union. Have: %v, want: %v", res, want)
+	}
+
+	inter := InterZSets([]*ZSet{a, b}, []float64{1, 0}, AggregateMax)
+	want = []ZMember{{"y", 2}}
+	if res := inter.Range(0, -1, false); !cmp.Equal(res, want) {
+		t.Errorf("Wrong intersection. Have: %v, want: %v", res, want)
+	}
+}
@@ -0,0 +1,130 @@
+// Package glob implements the glob-style patterns redis uses for KEYS, SCAN
+// and pattern subscriptions.
+package glob
+
+// maxNesting protects against abusive patterns like "*****...".
+const maxNesting = 1000
+
+// Match reports whether str matches the pattern. Supported are *, ?, [abc],
+// [^abc], [a-z] and \ to escape special characters.
+func Match(pattern, str []byte, nocase bool) bool {
+	skipLonger := false
+	return match(pattern, str, nocase, &skipLonger, 0)
+}
+
+// MatchString is Match for strings, case sensitive.
+func MatchString(pattern, str string) bool {
+	return Match([]byte(pattern), []byte(str), false)
+}
+
+// match is a port of stringmatchlen_impl from redis.
+func match(pattern, str []byte, nocase bool, skipLonger *bool, nesting int) bool {
+	if nesting > maxNesting {
+		return false
+	}
+
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for len(str) > 0 {
+				if match(pattern[1:], str, nocase, skipLonger, nesting+1) {
+					return true
+				}
+				if *skipLonger {
+					return false
+				}
+				str = str[1:]
+			}
+			// the rest of the pattern matches nowhere in the rest of the
+			// string, so earlier stars can't match anything longer either
+			*skipLonger = true
+			return false
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+
+			matched := false
+			for {
+				if len(pattern) == 0 {
+					// unterminated class, stay on the last character
+					pattern = []byte{']'}
+					break
+				}
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						matched = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end, c := pattern[0], pattern[2], str[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = lower(start), lower(end), lower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						matched = true
+					}
+				} else if equal(pattern[0], str[0], nocase) {
+					matched = true
+				}
+				pattern = pattern[1:]
+			}
+			if not {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if !equal(pattern[0], str[0], nocase) {
+				return false
+			}
+			str = str[1:]
+		}
+
+		pattern = pattern[1:]
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
+
+func equal(a, b byte, nocase bool) bool {
+	if nocase {
+		return lower(a) == lower(b)
+	}
+	return a == b
+}
+
+func lower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
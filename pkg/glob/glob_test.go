@@ -0,0 +1,55 @@
+package glob
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []utils.Test[[2]string, bool]{
+		{Name: "Star matches everything", Input: [2]string{"*", "anything"}, Want: true},
+		{Name: "Star doesn't match empty, as in redis", Input: [2]string{"*", ""}, Want: false},
+		{Name: "Prefix", Input: [2]string{"user:*", "user:1000"}, Want: true},
+		{Name: "Prefix mismatch", Input: [2]string{"user:*", "users:1000"}, Want: false},
+		{Name: "Question mark", Input: [2]string{"h?llo", "hallo"}, Want: true},
+		{Name: "Question mark needs a character", Input: [2]string{"h?llo", "hllo"}, Want: false},
+		{Name: "Class", Input: [2]string{"h[ae]llo", "hello"}, Want: true},
+		{Name: "Class mismatch", Input: [2]string{"h[ae]llo", "hillo"}, Want: false},
+		{Name: "Negated class", Input: [2]string{"h[^e]llo", "hallo"}, Want: true},
+		{Name: "Negated class mismatch", Input: [2]string{"h[^e]llo", "hello"}, Want: false},
+		{Name: "Range", Input: [2]string{"h[a-b]llo", "hbllo"}, Want: true},
+		{Name: "Reversed range", Input: [2]string{"h[b-a]llo", "hallo"}, Want: true},
+		{Name: "Escaped star", Input: [2]string{`a\*b`, "a*b"}, Want: true},
+		{Name: "Escaped star is literal", Input: [2]string{`a\*b`, "axb"}, Want: false},
+		{Name: "Trailing stars", Input: [2]string{"abc**", "abc"}, Want: true},
+		{Name: "Stars in the middle", Input: [2]string{"a*b*c", "axxbyyc"}, Want: true},
+		{Name: "Stars in the middle mismatch", Input: [2]string{"a*b*c", "axxbyy"}, Want: false},
+		{Name: "Unterminated class", Input: [2]string{"a[bc", "ab"}, Want: true},
+	}
+
+	for _, test := range tests {
+		res := MatchString(test.Input[0], test.Input[1])
+		if res != test.Want {
+			t.Errorf(test.ToString(res))
+		}
+	}
+}
+
+func TestMatchNocase(t *testing.T) {
+	if !Match([]byte("H[A-C]LLO*"), []byte("hbllo world"), true) {
+		t.Errorf("Case insensitive match failed")
+	}
+	if Match([]byte("H[A-C]LLO*"), []byte("hbllo world"), false) {
+		t.Errorf("Case sensitive match succeeded")
+	}
+}
+
+func TestMatchAbusivePattern(t *testing.T) {
+	pattern := strings.Repeat("a*", 50) + "b"
+	str := strings.Repeat("a", 100)
+	if MatchString(pattern, str) {
+		t.Errorf("Wrong match for an abusive pattern")
+	}
+}
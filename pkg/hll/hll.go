@@ -0,0 +1,522 @@
+// Package hll implements the HyperLogLog of redis on its string format, so
+// the values are interchangeable with the ones of redis, byte for byte.
+//
+// A value is a 16 byte header, "HYLL", the encoding, 3 unused bytes and the
+// cached cardinality, followed by the registers. The dense encoding packs
+// the 6 bit registers, the sparse one run-length encodes them with the
+// opcodes:
+//
+//	ZERO  00xxxxxx           1 to 64 zero registers
+//	XZERO 01xxxxxx xxxxxxxx  1 to 16384 zero registers
+//	VAL   1vvvvvxx           1 to 4 registers set to 1 to 32
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	precision = 14
+	// NumRegisters is the number of registers of an HLL.
+	NumRegisters = 1 << precision
+	registerBits = 6
+	registerMax  = 1<<registerBits - 1
+	// bits of the hash left after the index, where the run of zeros is
+	// counted
+	q = 64 - precision
+
+	headerSize = 16
+	encDense   = 0
+	encSparse  = 1
+	denseSize  = headerSize + (NumRegisters*registerBits+7)/8
+
+	// a sparse HLL that would grow past this size is made dense, like the
+	// default hll-sparse-max-bytes
+	sparseMaxBytes = 3000
+
+	zeroMaxLen  = 64
+	valMaxValue = 32
+	valMaxLen   = 4
+
+	alphaInf = 0.721347520444481703680
+	hashSeed = 0xadc83b19
+)
+
+// ErrCorrupted is returned for a value with the header of an HLL but invalid
+// registers.
+var ErrCorrupted = errors.New("INVALIDOBJ Corrupted HLL object detected")
+
+// New returns an empty HLL, sparse.
+func New() []byte {
+	data := make([]byte, headerSize+2)
+	copy(data, "HYLL")
+	data[4] = encSparse
+	data[headerSize], data[headerSize+1] = xzero(NumRegisters)
+	return data
+}
+
+// Valid reports whether data has the header of an HLL, and the size of its
+// encoding when dense.
+func Valid(data []byte) bool {
+	if len(data) < headerSize || string(data[:4]) != "HYLL" || data[4] > encSparse {
+		return false
+	}
+	return data[4] == encSparse || len(data) == denseSize
+}
+
+// Dense reports whether the HLL uses the dense encoding.
+func Dense(data []byte) bool {
+	return data[4] == encDense
+}
+
+// Add adds the elements to the HLL, that is changed in place or reallocated.
+// changed tells whether a register was updated.
+func Add(data []byte, elements ...[]byte) (res []byte, changed bool, err error) {
+	if !Dense(data) {
+		if err := checkSparse(data); err != nil {
+			return nil, false, err
+		}
+	}
+	for _, element := range elements {
+		index, count := patLen(element)
+		var updated bool
+		if Dense(data) {
+			updated = denseAdd(data[headerSize:], index, count)
+		} else if data, updated, err = sparseSet(data, index, count); err != nil {
+			return nil, false, err
+		}
+		changed = changed || updated
+	}
+	if changed {
+		invalidate(data)
+	}
+	return data, changed, nil
+}
+
+// Count returns the cardinality cached in the header of the HLL, or
+// estimates it when the cache is stale. cached tells which one it is.
+func Count(data []byte) (n uint64, cached bool, err error) {
+	if data[15]&0x80 == 0 {
+		// the cache of a sparse HLL doesn't make its registers valid
+		if !Dense(data) {
+			if err := checkSparse(data); err != nil {
+				return 0, false, err
+			}
+		}
+		return binary.LittleEndian.Uint64(data[8:headerSize]), true, nil
+	}
+
+	var hist [64]int
+	if Dense(data) {
+		registers := data[headerSize:]
+		for i := 0; i < NumRegisters; i++ {
+			hist[denseGet(registers, i)]++
+		}
+	} else {
+		err := forEachRun(data, func(first, n int, value uint8) {
+			hist[value] += n
+		})
+		if err != nil {
+			return 0, false, err
+		}
+	}
+	return estimate(&hist), false, nil
+}
+
+// SetCache stores the cardinality in the header of the HLL.
+func SetCache(data []byte, n uint64) {
+	binary.LittleEndian.PutUint64(data[8:headerSize], n)
+}
+
+// Merge raises the registers to the ones of the HLL, where they are lower.
+// registers are NumRegisters long, to count or store a union.
+func Merge(registers []uint8, data []byte) error {
+	if Dense(data) {
+		for i := range registers {
+			if v := denseGet(data[headerSize:], i); v > registers[i] {
+				registers[i] = v
+			}
+		}
+		return nil
+	}
+	return forEachRun(data, func(first, n int, value uint8) {
+		for i := first; i < first+n; i++ {
+			if value > registers[i] {
+				registers[i] = value
+			}
+		}
+	})
+}
+
+// CountRegisters estimates the cardinality of merged registers.
+func CountRegisters(registers []uint8) uint64 {
+	var hist [64]int
+	for _, v := range registers {
+		hist[v]++
+	}
+	return estimate(&hist)
+}
+
+// Store raises the registers of the HLL to the merged ones, converting it to
+// the dense encoding first if toDense is set.
+func Store(data []byte, registers []uint8, toDense bool) ([]byte, error) {
+	var err error
+	if toDense && !Dense(data) {
+		if data, err = sparseToDense(data); err != nil {
+			return nil, err
+		}
+	}
+	for i, v := range registers {
+		if v == 0 {
+			continue
+		}
+		if Dense(data) {
+			denseAdd(data[headerSize:], i, v)
+		} else if data, _, err = sparseSet(data, i, v); err != nil {
+			return nil, err
+		}
+	}
+	invalidate(data)
+	return data, nil
+}
+
+func invalidate(data []byte) {
+	data[15] |= 0x80
+}
+
+// patLen hashes the element, returning the register it goes to and the
+// length of the run of zeros of the rest of the hash, plus one.
+func patLen(element []byte) (index int, count uint8) {
+	hash := murmurHash64A(element, hashSeed)
+	index = int(hash & (NumRegisters - 1))
+	hash >>= precision
+	// stops the count at q+1
+	hash |= 1 << q
+	count = 1
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+// murmurHash64A is the 64 bit MurmurHash2 by Austin Appleby, on little
+// endian like redis uses it.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(key))*m
+
+	n := len(key) - len(key)%8
+	for i := 0; i < n; i += 8 {
+		k := binary.LittleEndian.Uint64(key[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+	if rest := key[n:]; len(rest) > 0 {
+		for i := len(rest) - 1; i >= 0; i-- {
+			h ^= uint64(rest[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// estimate is the estimator of Otmar Ertl, from the histogram of the
+// register values.
+func estimate(hist *[64]int) uint64 {
+	m := float64(NumRegisters)
+	z := m * tau((m-float64(hist[q+1]))/m)
+	for j := q; j >= 1; j-- {
+		z += float64(hist[j])
+		z *= 0.5
+	}
+	z += m * sigma(float64(hist[0])/m)
+	return uint64(math.Round(alphaInf * m * m / z))
+}
+
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if prev == z {
+			return z
+		}
+	}
+}
+
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if prev == z {
+			return z / 3
+		}
+	}
+}
+
+func denseGet(registers []byte, i int) uint8 {
+	b := i * registerBits / 8
+	fb := uint(i * registerBits & 7)
+	v := uint(registers[b]) >> fb
+	// the last register doesn't reach the next byte
+	if b+1 < len(registers) {
+		v |= uint(registers[b+1]) << (8 - fb)
+	}
+	return uint8(v & registerMax)
+}
+
+func denseSet(registers []byte, i int, v uint8) {
+	b := i * registerBits / 8
+	fb := uint(i * registerBits & 7)
+	registers[b] &^= byte(uint(registerMax) << fb)
+	registers[b] |= byte(uint(v) << fb)
+	if b+1 < len(registers) {
+		registers[b+1] &^= byte(uint(registerMax) >> (8 - fb))
+		registers[b+1] |= byte(uint(v) >> (8 - fb))
+	}
+}
+
+// denseAdd sets the register to count if it's lower.
+func denseAdd(registers []byte, i int, count uint8) bool {
+	if denseGet(registers, i) >= count {
+		return false
+	}
+	denseSet(registers, i, count)
+	return true
+}
+
+func isZero(op byte) bool {
+	return op&0xc0 == 0
+}
+
+func isXZero(op byte) bool {
+	return op&0xc0 == 0x40
+}
+
+func isVal(op byte) bool {
+	return op&0x80 != 0
+}
+
+func zeroLen(op byte) int {
+	return int(op&0x3f) + 1
+}
+
+func xzeroLen(op, next byte) int {
+	return (int(op&0x3f)<<8 | int(next)) + 1
+}
+
+func valValue(op byte) uint8 {
+	return (op>>2)&0x1f + 1
+}
+
+func valLen(op byte) int {
+	return int(op&3) + 1
+}
+
+func xzero(n int) (byte, byte) {
+	n--
+	return byte(n>>8) | 0x40, byte(n)
+}
+
+func val(v uint8, n int) byte {
+	return 0x80 | (v-1)<<2 | byte(n-1)
+}
+
+// appendZeros appends the opcode for n zero registers.
+func appendZeros(seq []byte, n int) []byte {
+	if n > zeroMaxLen {
+		op, next := xzero(n)
+		return append(seq, op, next)
+	}
+	return append(seq, byte(n-1))
+}
+
+// forEachRun calls fn for every run of registers of a sparse HLL, checking
+// they are all there.
+func forEachRun(data []byte, fn func(first, n int, value uint8)) error {
+	i := 0
+	for p := headerSize; p < len(data); p++ {
+		op := data[p]
+		var n int
+		var value uint8
+		switch {
+		case isZero(op):
+			n = zeroLen(op)
+		case isXZero(op):
+			if p+1 >= len(data) {
+				return ErrCorrupted
+			}
+			n = xzeroLen(op, data[p+1])
+			p++
+		default:
+			n, value = valLen(op), valValue(op)
+		}
+		if i+n > NumRegisters {
+			return ErrCorrupted
+		}
+		fn(i, n, value)
+		i += n
+	}
+	if i != NumRegisters {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// checkSparse checks that the runs of a sparse HLL cover all the registers.
+func checkSparse(data []byte) error {
+	return forEachRun(data, func(first, n int, value uint8) {})
+}
+
+func sparseToDense(data []byte) ([]byte, error) {
+	dense := make([]byte, denseSize)
+	copy(dense, data[:headerSize])
+	dense[4] = encDense
+	registers := dense[headerSize:]
+	err := forEachRun(data, func(first, n int, value uint8) {
+		if value == 0 {
+			return
+		}
+		for i := first; i < first+n; i++ {
+			denseSet(registers, i, value)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dense, nil
+}
+
+// sparseSet sets the register to count if it's lower, splitting the opcode
+// that covers it, and merging the VAL opcodes around it afterwards. It's a
+// port of hllSparseSet from redis, so the values end up the same. The HLL
+// is made dense if the count doesn't fit or it grows too big.
+func sparseSet(data []byte, index int, count uint8) ([]byte, bool, error) {
+	if count > valMaxValue {
+		return promote(data, index, count)
+	}
+
+	// finds the opcode covering the register
+	p, prev := headerSize, -1
+	first, span := 0, 0
+	for p < len(data) {
+		oplen := 1
+		switch op := data[p]; {
+		case isZero(op):
+			span = zeroLen(op)
+		case isVal(op):
+			span = valLen(op)
+		default:
+			if p+1 >= len(data) {
+				return nil, false, ErrCorrupted
+			}
+			span = xzeroLen(op, data[p+1])
+			oplen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= len(data) {
+		return nil, false, ErrCorrupted
+	}
+
+	op := data[p]
+	switch {
+	case isVal(op) && valValue(op) >= count:
+		return data, false, nil
+	case (isVal(op) && valLen(op) == 1) || (isZero(op) && zeroLen(op) == 1):
+		data[p] = val(count, 1)
+	default:
+		last := first + span - 1
+		var seq []byte
+		if isVal(op) {
+			if index != first {
+				seq = append(seq, val(valValue(op), index-first))
+			}
+			seq = append(seq, val(count, 1))
+			if index != last {
+				seq = append(seq, val(valValue(op), last-index))
+			}
+		} else {
+			if index != first {
+				seq = appendZeros(seq, index-first)
+			}
+			seq = append(seq, val(count, 1))
+			if index != last {
+				seq = appendZeros(seq, last-index)
+			}
+		}
+
+		oldLen := 1
+		if isXZero(op) {
+			oldLen = 2
+		}
+		if len(seq) > oldLen && len(data)+len(seq)-oldLen > sparseMaxBytes {
+			return promote(data, index, count)
+		}
+		data = append(data[:p], append(seq, data[p+oldLen:]...)...)
+	}
+
+	// merges the adjacent VAL opcodes with the same value, scanning up to
+	// 5 opcodes from the one before the change
+	p = prev
+	if p < 0 {
+		p = headerSize
+	}
+	for scan := 5; p < len(data) && scan > 0; scan-- {
+		switch {
+		case isXZero(data[p]):
+			p += 2
+			continue
+		case isZero(data[p]):
+			p++
+			continue
+		}
+		if p+1 < len(data) && isVal(data[p+1]) && valValue(data[p]) == valValue(data[p+1]) {
+			if n := valLen(data[p]) + valLen(data[p+1]); n <= valMaxLen {
+				data[p+1] = val(valValue(data[p]), n)
+				data = append(data[:p], data[p+1:]...)
+				// the merged opcode may merge with the next one
+				continue
+			}
+		}
+		p++
+	}
+	return data, true, nil
+}
+
+func promote(data []byte, index int, count uint8) ([]byte, bool, error) {
+	dense, err := sparseToDense(data)
+	if err != nil {
+		return nil, false, err
+	}
+	denseAdd(dense[headerSize:], index, count)
+	return dense, true, nil
+}
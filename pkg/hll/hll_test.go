@@ -0,0 +1,136 @@
+package hll
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNew(t *testing.T) {
+	want := []byte("HYLL\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x7f\xff")
+	if res := New(); !cmp.Equal(res, want) {
+		t.Errorf("Wrong empty HLL. Have: %q, want: %q", res, want)
+	}
+	if n, cached, err := Count(New()); n != 0 || !cached || err != nil {
+		t.Errorf("Wrong count of an empty HLL. Have: %d, %v, %v", n, cached, err)
+	}
+}
+
+// TestEncodings adds elements until the HLL gets dense, checking the
+// registers against the ones computed directly.
+func TestEncodings(t *testing.T) {
+	data := New()
+	want := make([]uint8, NumRegisters)
+	for i := 0; i < 5000; i++ {
+		element := []byte("element:" + strconv.Itoa(i))
+		index, count := patLen(element)
+		if count > want[index] {
+			want[index] = count
+		}
+
+		var err error
+		if data, _, err = Add(data, element); err != nil {
+			t.Fatalf("Add failed on element %d: %v", i, err)
+		}
+		if i == 200 && Dense(data) {
+			t.Errorf("HLL got dense too early")
+		}
+		if i%100 != 0 {
+			continue
+		}
+
+		res := make([]uint8, NumRegisters)
+		if err := Merge(res, data); err != nil {
+			t.Fatalf("Merge failed on element %d: %v", i, err)
+		}
+		if !cmp.Equal(res, want) {
+			t.Fatalf("Wrong registers after element %d, dense: %v", i, Dense(data))
+		}
+	}
+	if !Dense(data) {
+		t.Errorf("HLL didn't get dense")
+	}
+}
+
+func TestCount(t *testing.T) {
+	for _, size := range []int{10, 1000, 100000} {
+		data := New()
+		for i := 0; i < size; i++ {
+			data, _, _ = Add(data, []byte(strconv.Itoa(i)))
+		}
+		n, cached, err := Count(data)
+		if err != nil || cached {
+			t.Fatalf("Wrong count of %d elements. Have: %v, %v", size, cached, err)
+		}
+		if math.Abs(float64(n)-float64(size)) > float64(size)*0.02 {
+			t.Errorf("Wrong estimate. Have: %d, want: about %d", n, size)
+		}
+
+		SetCache(data, n)
+		if res, cached, _ := Count(data); res != n || !cached {
+			t.Errorf("Wrong cached count. Have: %d, %v, want: %d", res, cached, n)
+		}
+		// not every element raises a register
+		for i, changed := 0, false; !changed; i++ {
+			data, changed, _ = Add(data, []byte("new:"+strconv.Itoa(i)))
+		}
+		if _, cached, _ := Count(data); cached {
+			t.Errorf("Add didn't invalidate the cache")
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	for i := 0; i < 3000; i++ {
+		a, _, _ = Add(a, []byte(strconv.Itoa(i)))
+		b, _, _ = Add(b, []byte(strconv.Itoa(i+2000)))
+	}
+
+	registers := make([]uint8, NumRegisters)
+	for _, data := range [][]byte{a, b} {
+		if err := Merge(registers, data); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+	}
+	if n := CountRegisters(registers); math.Abs(float64(n)-5000) > 100 {
+		t.Errorf("Wrong union estimate. Have: %d, want: about 5000", n)
+	}
+
+	stored, err := Store(New(), registers, false)
+	if err != nil {
+		t.Fatalf("Store failed: %v", err)
+	}
+	res := make([]uint8, NumRegisters)
+	Merge(res, stored)
+	if !cmp.Equal(res, registers) {
+		t.Errorf("Wrong stored registers")
+	}
+}
+
+func TestCorrupted(t *testing.T) {
+	tests := map[string][]byte{
+		"Too few registers": append(New()[:headerSize], 0x3f),
+		"Too many":          append(New(), 0x80),
+		"Too many first":    append(append(New()[:headerSize], 0x80), New()[headerSize:]...),
+		"Truncated XZERO":   New()[:headerSize+1],
+	}
+	for name, data := range tests {
+		// with a cached count too
+		if _, _, err := Count(data); err != ErrCorrupted {
+			t.Errorf("%s: wrong error with the cache. Have: %v, want: %v", name, err, ErrCorrupted)
+		}
+		if _, _, err := Add(append([]byte(nil), data...), []byte("a")); err != ErrCorrupted {
+			t.Errorf("%s: wrong add error. Have: %v, want: %v", name, err, ErrCorrupted)
+		}
+		invalidate(data)
+		if _, _, err := Count(data); err != ErrCorrupted {
+			t.Errorf("%s: wrong error. Have: %v, want: %v", name, err, ErrCorrupted)
+		}
+		if err := Merge(make([]uint8, NumRegisters), data); err != ErrCorrupted {
+			t.Errorf("%s: wrong merge error. Have: %v, want: %v", name, err, ErrCorrupted)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+)
+
+const (
+	DefaultMaxBulkLen   = 512 * 1024 * 1024
+	DefaultMaxArrayLen  = 1024 * 1024
+	DefaultMaxLineLen   = 64 * 1024
+	DefaultMaxDepth     = 128
+	defaultReadBufSize  = 16 * 1024
+	maxArrayPreallocLen = 1024
+	// the length of the mark around a payload of unknown length
+	EOFMarkLen = 40
+)
+
+// ProtocolError is returned when the stream contains data that can't be a
+// valid RESP frame. The stream is out of sync after it and should be closed.
+type ProtocolError struct {
+	msg string
+}
+
+func (e ProtocolError) Error() string {
+	return "Protocol error: " + e.msg
+}
+
+func IsProtocolError(err error) bool {
+	var protoErr ProtocolError
+	return errors.As(err, &protoErr)
+}
+
+// Decoder reads RESP frames from a stream. Frames that arrive split across
+// several reads are buffered until they are complete.
+//
+// With Inline set, lines that don't start with a type byte are decoded as
+// inline commands, the way redis accepts commands typed into telnet.
+//
+// With Requests set, only the frames a client sends are accepted: arrays of
+// bulk strings, or inline commands for anything else with Inline.
+type Decoder struct {
+	r           *bufio.Reader
+	MaxBulkLen  int
+	MaxArrayLen int
+	MaxLineLen  int
+	// how many aggregates can be nested in each other
+	MaxDepth int
+	Inline   bool
+	Requests bool
+	depth    int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:           bufio.NewReaderSize(r, defaultReadBufSize),
+		MaxBulkLen:  DefaultMaxBulkLen,
+		MaxArrayLen: DefaultMaxArrayLen,
+		MaxLineLen:  DefaultMaxLineLen,
+		MaxDepth:    DefaultMaxDepth,
+	}
+}
+
+// Decode blocks until a whole frame is read. io.EOF is returned only if the
+// stream ended between frames, io.ErrUnexpectedEOF if it ended inside one.
+func (d *Decoder) Decode() (*Data, error) {
+	typeChar, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	for d.Inline && (!isType(DataType(typeChar)) || d.Requests && DataType(typeChar) != Array) {
+		d.r.UnreadByte()
+		args, err := d.decodeInline()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if len(args) != 0 {
+			arr := make([]Data, len(args))
+			for i, arg := range args {
+				arr[i] = BulkStringData(arg)
+			}
+			data := ArrayData(arr)
+			return &data, nil
+		}
+
+		// empty lines are skipped
+		typeChar, err = d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var data *Data
+	if d.Requests {
+		data, err = d.decodeRequest(DataType(typeChar))
+	} else {
+		data, err = d.decodeValue(DataType(typeChar))
+	}
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return data, nil
+}
+
+// DecodeBulkPayload reads a bulk string that is not terminated with CRLF,
+// the way a master sends an RDB file during a full resync. A master that
+// doesn't know the length in advance sends $EOF:<mark> instead, and the mark
+// again after the payload.
+func (d *Decoder) DecodeBulkPayload() ([]byte, error) {
+	typeChar, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if DataType(typeChar) != BulkString {
+		return nil, ProtocolError{fmt.Sprintf("expected '$', got '%c'", typeChar)}
+	}
+
+	line, err := d.readLine()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if bytes.HasPrefix(line, []byte("EOF:")) {
+		return d.readUntilMark(line[len("EOF:"):])
+	}
+	length, err := strconv.Atoi(string(line))
+	if err != nil || length < 0 || length > d.MaxBulkLen {
+		return nil, ProtocolError{"invalid bulk length"}
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(d.r, payload)
+	return payload, unexpectedEOF(err)
+}
+
+func (d *Decoder) readUntilMark(mark []byte) ([]byte, error) {
+	if len(mark) != EOFMarkLen {
+		return nil, ProtocolError{"invalid EOF mark"}
+	}
+	var payload []byte
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		payload = append(payload, b)
+		// the whole mark is compared only when its last byte matches
+		if b == mark[len(mark)-1] && bytes.HasSuffix(payload, mark) {
+			return payload[:len(payload)-len(mark)], nil
+		}
+		if len(payload) > d.MaxBulkLen+len(mark) {
+			return nil, ProtocolError{"invalid bulk length"}
+		}
+	}
+}
+
+// decodeRequest reads a command sent as an array of bulk strings.
+func (d *Decoder) decodeRequest(dataType DataType) (*Data, error) {
+	if dataType != Array {
+		return nil, ProtocolError{fmt.Sprintf("expected '*', got '%c'", dataType)}
+	}
+	length, err := d.readLength(d.MaxArrayLen, "invalid multibulk length")
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		data := NullArrayData()
+		return &data, nil
+	}
+
+	prealloc := length
+	if prealloc > maxArrayPreallocLen {
+		prealloc = maxArrayPreallocLen
+	}
+	args := make([]Data, 0, prealloc)
+	for i := 0; i < length; i++ {
+		typeChar, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if DataType(typeChar) != BulkString {
+			return nil, ProtocolError{fmt.Sprintf("expected '$', got '%c'", typeChar)}
+		}
+		length, err := d.readLength(d.MaxBulkLen, "invalid bulk length")
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, ProtocolError{"invalid bulk length"}
+		}
+		value, err := d.readBulk(length)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, BulkStringData(value))
+	}
+	data := ArrayData(args)
+	return &data, nil
+}
+
+func (d *Decoder) decodeValue(dataType DataType) (*Data, error) {
+	switch dataType {
+	case Array, Set, Push, Map, Attribute:
+		// every level is a call, so a frame nested deep enough would
+		// overflow the stack
+		if d.depth >= d.MaxDepth {
+			return nil, ProtocolError{"too many nested aggregates"}
+		}
+		d.depth++
+		defer func() { d.depth-- }()
+	}
+
+	data := Data{dataType: dataType}
+	switch dataType {
+	case String, Error:
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		data.bytes = line
+	case Integer:
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.Atoi(string(line))
+		if err != nil {
+			return nil, ProtocolError{"invalid integer"}
+		}
+		data.integer = value
+	case BulkString:
+		length, err := d.readLength(d.MaxBulkLen, "invalid bulk length")
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			data.null = true
+			break
+		}
+
+		value, err := d.readBulk(length)
+		if err != nil {
+			return nil, err
+		}
+		data.bytes = value
+	case Array:
+		length, err := d.readLength(d.MaxArrayLen, "invalid multibulk length")
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			data.null = true
+			break
+		}
+
+		data.array, err = d.decodeArray(length)
+		if err != nil {
+			return nil, err
+		}
+	case Null:
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) != 0 {
+			return nil, ProtocolError{"invalid null"}
+		}
+		data.null = true
+	case Boolean:
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) != 1 || (line[0] != 't' && line[0] != 'f') {
+			return nil, ProtocolError{"invalid boolean"}
+		}
+		data.boolean = line[0] == 't'
+	case Double:
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		value, err := strconv.ParseFloat(string(line), 64)
+		if err != nil {
+			return nil, ProtocolError{"invalid double"}
+		}
+		data.double = value
+	case BigNumber:
+		line, err := d.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !isBigNumber(line) {
+			return nil, ProtocolError{"invalid big number"}
+		}
+		data.bytes = line
+	case BlobError, VerbatimString:
+		length, err := d.readLength(d.MaxBulkLen, "invalid bulk length")
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, ProtocolError{"invalid bulk length"}
+		}
+
+		value, err := d.readBulk(length)
+		if err != nil {
+			return nil, err
+		}
+		if dataType == VerbatimString && (len(value) < 4 || value[3] != ':') {
+			return nil, ProtocolError{"invalid verbatim string"}
+		}
+		data.bytes = value
+	case Set, Push:
+		length, err := d.readLength(d.MaxArrayLen, "invalid multibulk length")
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, ProtocolError{"invalid multibulk length"}
+		}
+
+		data.array, err = d.decodeArray(length)
+		if err != nil {
+			return nil, err
+		}
+	case Map, Attribute:
+		length, err := d.readLength(d.MaxArrayLen/2, "invalid multibulk length")
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, ProtocolError{"invalid multibulk length"}
+		}
+
+		pairs, err := d.decodeArray(length * 2)
+		if err != nil {
+			return nil, err
+		}
+		if dataType == Map {
+			data.array = pairs
+			break
+		}
+
+		// attributes describe the value that follows them
+		typeChar, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.decodeValue(DataType(typeChar))
+		if err != nil {
+			return nil, err
+		}
+		value.attributes = pairs
+		return value, nil
+	default:
+		return nil, ProtocolError{fmt.Sprintf("Unknown type: %s", string(dataType))}
+	}
+	return &data, nil
+}
+
+func (d *Decoder) decodeArray(length int) ([]Data, error) {
+	prealloc := length
+	if prealloc > maxArrayPreallocLen {
+		prealloc = maxArrayPreallocLen
+	}
+
+	value := make([]Data, 0, prealloc)
+	for i := 0; i < length; i++ {
+		typeChar, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := d.decodeValue(DataType(typeChar))
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, *parsed)
+	}
+	return value, nil
+}
+
+func (d *Decoder) readLength(max int, errMsg string) (int, error) {
+	line, err := d.readLine()
+	if err != nil {
+		return 0, err
+	}
+
+	length, err := strconv.Atoi(string(line))
+	if err != nil || length < -1 || length > max {
+		return 0, ProtocolError{errMsg}
+	}
+	return length, nil
+}
+
+func (d *Decoder) readBulk(length int) ([]byte, error) {
+	value := make([]byte, length+2)
+	if _, err := io.ReadFull(d.r, value); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(value, []byte("\r\n")) {
+		return nil, ProtocolError{"expected CRLF after bulk string"}
+	}
+	return value[:length:length], nil
+}
+
+// readLine returns the next CRLF terminated line without the terminator.
+func (d *Decoder) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := d.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > d.MaxLineLen {
+			return nil, ProtocolError{"too big line"}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ProtocolError{"expected CRLF"}
+	}
+	return line[:len(line)-2], nil
+}
+
+func isBigNumber(line []byte) bool {
+	if len(line) != 0 && (line[0] == '-' || line[0] == '+') {
+		line = line[1:]
+	}
+	if len(line) == 0 {
+		return false
+	}
+	for _, c := range line {
+		if !utils.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
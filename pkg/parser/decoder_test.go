@@ -0,0 +1,284 @@
+package parser
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDecodeSplitFrames(t *testing.T) {
+	input := "*2\r\n$4\r\nECHO\r\n$3\r\nABC\r\n:42\r\n"
+	want := []Data{
+		ArrayData([]Data{BulkStringData([]byte("ECHO")), BulkStringData([]byte("ABC"))}),
+		IntegerData(42),
+	}
+
+	dec := NewDecoder(iotest.OneByteReader(strings.NewReader(input)))
+	for _, w := range want {
+		data, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !cmp.Equal(*data, w, cmp.AllowUnexported(Data{})) {
+			t.Errorf("Wrong decoded frame. Have: %v, want: %v", *data, w)
+		}
+	}
+
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Wrong error at the end of stream. Have: %v, want: %v", err, io.EOF)
+	}
+}
+
+func TestDecodeOversizedBulk(t *testing.T) {
+	value := strings.Repeat("x", 3*defaultReadBufSize+17)
+	input := string(ArrayData([]Data{BulkStringData([]byte("SET")), BulkStringData([]byte("k")), BulkStringData([]byte(value))}).Marshal())
+
+	dec := NewDecoder(iotest.HalfReader(strings.NewReader(input)))
+	data, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	res := data.Flat()
+	if len(res) != 3 || string(res[2]) != value {
+		t.Errorf("Wrong decoded bulk string of length %d", len(value))
+	}
+}
+
+func TestDecodeNull(t *testing.T) {
+	tests := []utils.Test[string, Data]{
+		{Name: "Null bulk string", Input: "$-1\r\n", Want: NullBulkStringData()},
+		{Name: "Null array", Input: "*-1\r\n", Want: NullArrayData()},
+		{Name: "Empty bulk string", Input: "$0\r\n\r\n", Want: BulkStringData([]byte(""))},
+	}
+
+	for _, e := range tests {
+		data, err := NewDecoder(strings.NewReader(e.Input)).Decode()
+		if err != nil {
+			t.Errorf("%s: %s", e.Name, err.Error())
+			continue
+		}
+		if !cmp.Equal(*data, e.Want, cmp.AllowUnexported(Data{})) {
+			t.Errorf(e.ToString(*data))
+		}
+		if string(data.Marshal()) != e.Input {
+			t.Errorf("%s: wrong marshal result. Have: %q, want: %q", e.Name, data.Marshal(), e.Input)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []utils.Test[string, bool]{
+		{Name: "Bulk string over the limit", Input: "$11\r\nhello world\r\n", Want: true},
+		{Name: "Array over the limit", Input: "*5\r\n", Want: true},
+		{Name: "Unknown type", Input: "?1\r\n", Want: true},
+		{Name: "Missing CRLF after bulk", Input: "$2\r\nhiXX", Want: true},
+		{Name: "Truncated frame", Input: "*2\r\n$4\r\nECHO\r\n", Want: false},
+	}
+
+	for _, e := range tests {
+		dec := NewDecoder(strings.NewReader(e.Input))
+		dec.MaxBulkLen = 10
+		dec.MaxArrayLen = 4
+
+		_, err := dec.Decode()
+		if err == nil {
+			t.Errorf("%s: expected an error", e.Name)
+			continue
+		}
+		if IsProtocolError(err) != e.Want {
+			t.Errorf(e.ToString(IsProtocolError(err)))
+		}
+		if !e.Want && err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: wrong error. Have: %v, want: %v", e.Name, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestDecodeBulkPayload(t *testing.T) {
+	input := "+FULLRESYNC abc 0\r\n$5\r\nREDIS+PONG\r\n"
+	dec := NewDecoder(iotest.OneByteReader(strings.NewReader(input)))
+
+	if _, err := dec.Decode(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	payload, err := dec.DecodeBulkPayload()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(payload) != "REDIS" {
+		t.Errorf("Wrong payload. Have: %q, want: %q", payload, "REDIS")
+	}
+
+	data, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !cmp.Equal(*data, StringData("PONG"), cmp.AllowUnexported(Data{})) {
+		t.Errorf("Wrong frame after payload. Have: %v, want: %v", *data, StringData("PONG"))
+	}
+}
+
+func TestDecodeBulkPayloadEOFMark(t *testing.T) {
+	mark := strings.Repeat("0123456789", 4)
+	input := "$EOF:" + mark + "\r\nREDIS" + mark[:39] + "x" + mark + "+PONG\r\n"
+	dec := NewDecoder(iotest.OneByteReader(strings.NewReader(input)))
+
+	payload, err := dec.DecodeBulkPayload()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := "REDIS" + mark[:39] + "x"; string(payload) != want {
+		t.Errorf("Wrong payload. Have: %q, want: %q", payload, want)
+	}
+
+	data, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !cmp.Equal(*data, StringData("PONG"), cmp.AllowUnexported(Data{})) {
+		t.Errorf("Wrong frame after payload. Have: %v, want: %v", *data, StringData("PONG"))
+	}
+
+	dec = NewDecoder(strings.NewReader("$EOF:short\r\nREDIS"))
+	if _, err := dec.DecodeBulkPayload(); !IsProtocolError(err) {
+		t.Errorf("Expected a protocol error for a short mark, got: %v", err)
+	}
+	dec = NewDecoder(strings.NewReader("$EOF:" + mark + "\r\nREDIS"))
+	if _, err := dec.DecodeBulkPayload(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Wrong error for a missing mark. Have: %v, want: %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDecodeInline(t *testing.T) {
+	tests := []utils.Test[string, [][]byte]{
+		{Name: "Plain", Input: "SET a b\r\n", Want: [][]byte{[]byte("SET"), []byte("a"), []byte("b")}},
+		{Name: "LF only", Input: "PING\n", Want: [][]byte{[]byte("PING")}},
+		{Name: "Extra spaces", Input: "  GET \t key  \n", Want: [][]byte{[]byte("GET"), []byte("key")}},
+		{Name: "Double quotes", Input: "SET k \"hello world\"\n", Want: [][]byte{[]byte("SET"), []byte("k"), []byte("hello world")}},
+		{Name: "Escapes", Input: "SET k \"a\\r\\n\\x00\\\"\"\n", Want: [][]byte{[]byte("SET"), []byte("k"), {'a', '\r', '\n', 0, '"'}}},
+		{Name: "Single quotes", Input: "SET k 'it\\'s \\n'\n", Want: [][]byte{[]byte("SET"), []byte("k"), []byte("it's \\n")}},
+		{Name: "Empty quoted", Input: "SET k \"\"\n", Want: [][]byte{[]byte("SET"), []byte("k"), {}}},
+		{Name: "Empty lines skipped", Input: "\r\n\nPING\r\n", Want: [][]byte{[]byte("PING")}},
+	}
+
+	for _, e := range tests {
+		dec := NewDecoder(strings.NewReader(e.Input))
+		dec.Inline = true
+
+		data, err := dec.Decode()
+		if err != nil {
+			t.Errorf("%s: %s", e.Name, err.Error())
+			continue
+		}
+		if data.Type() != Array {
+			t.Errorf("%s: wrong type. Have: %c, want: %c", e.Name, data.Type(), Array)
+		}
+		if res := data.Flat(); !cmp.Equal(res, e.Want) {
+			t.Errorf(e.ToString(res))
+		}
+	}
+}
+
+func TestDecodeInlineErrors(t *testing.T) {
+	tests := []string{
+		"SET k \"unterminated\n",
+		"SET k 'unterminated\n",
+		"SET k \"closing\"quote\n",
+	}
+
+	for _, input := range tests {
+		dec := NewDecoder(strings.NewReader(input))
+		dec.Inline = true
+		if _, err := dec.Decode(); !IsProtocolError(err) {
+			t.Errorf("Expected protocol error for %q, have: %v", input, err)
+		}
+	}
+}
+
+func TestDecodeInlineMixed(t *testing.T) {
+	input := "PING\r\n*1\r\n$4\r\nPING\r\nECHO hi\n"
+	dec := NewDecoder(iotest.OneByteReader(strings.NewReader(input)))
+	dec.Inline = true
+
+	for i := 0; i < 3; i++ {
+		data, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if data.Type() != Array {
+			t.Errorf("Frame %d: wrong type. Have: %c, want: %c", i, data.Type(), Array)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("Wrong error at the end of stream. Have: %v, want: %v", err, io.EOF)
+	}
+}
+
+func TestDecodeDepth(t *testing.T) {
+	tests := []utils.Test[string, bool]{
+		{Name: "Nested arrays", Input: strings.Repeat("*1\r\n", 5) + ":1\r\n", Want: true},
+		{Name: "Nested maps", Input: strings.Repeat("%1\r\n+k\r\n", 5) + ":1\r\n", Want: true},
+		{Name: "Chained attributes", Input: strings.Repeat("|1\r\n+k\r\n+v\r\n", 5) + ":1\r\n", Want: true},
+		{Name: "Arrays at the limit", Input: strings.Repeat("*1\r\n", 4) + ":1\r\n", Want: false},
+		{Name: "Siblings at the limit", Input: "*2\r\n" + strings.Repeat("*1\r\n*1\r\n*1\r\n:1\r\n", 2), Want: false},
+	}
+
+	for _, e := range tests {
+		dec := NewDecoder(strings.NewReader(e.Input))
+		dec.MaxDepth = 4
+		_, err := dec.Decode()
+		if res := IsProtocolError(err); res != e.Want {
+			t.Errorf(e.ToString(res))
+		}
+		if !e.Want && err != nil {
+			t.Errorf("%s: %s", e.Name, err.Error())
+		}
+	}
+
+	// the default limit stops a frame that would overflow the stack
+	_, err := NewDecoder(strings.NewReader(strings.Repeat("*1\r\n", 1_000_000))).Decode()
+	if !IsProtocolError(err) {
+		t.Errorf("Wrong error for a deeply nested frame. Have: %v", err)
+	}
+}
+
+func TestDecodeRequests(t *testing.T) {
+	tests := []utils.Test[string, string]{
+		{Name: "Nested array", Input: "*1\r\n*1\r\n$4\r\nPING\r\n", Want: "Protocol error: expected '$', got '*'"},
+		{Name: "Integer argument", Input: "*2\r\n$4\r\nECHO\r\n:1\r\n", Want: "Protocol error: expected '$', got ':'"},
+		{Name: "Null bulk argument", Input: "*2\r\n$4\r\nECHO\r\n$-1\r\n", Want: "Protocol error: invalid bulk length"},
+		{Name: "Map", Input: "%1\r\n$1\r\nk\r\n$1\r\nv\r\n", Want: "Protocol error: expected '*', got '%'"},
+	}
+
+	for _, e := range tests {
+		dec := NewDecoder(strings.NewReader(e.Input))
+		dec.Requests = true
+		res := ""
+		if _, err := dec.Decode(); err != nil {
+			res = err.Error()
+		}
+		if res != e.Want {
+			t.Errorf(e.ToString(res))
+		}
+	}
+
+	// with inline commands anything but an array is one
+	dec := NewDecoder(strings.NewReader("+PING\r\n*1\r\n$4\r\nPING\r\n"))
+	dec.Requests = true
+	dec.Inline = true
+	for _, want := range []string{"+PING", "PING"} {
+		data, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if res := data.Flat(); len(res) != 1 || string(res[0]) != want {
+			t.Errorf("Wrong request. Have: %q, want: %q", res, want)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package parser
+
+import (
+	"bufio"
+)
+
+func isType(t DataType) bool {
+	switch t {
+	case String, Array, BulkString, Integer, Error,
+		Null, Boolean, Double, BigNumber, BlobError, VerbatimString, Map, Set, Attribute, Push:
+		return true
+	}
+	return false
+}
+
+// decodeInline reads a telnet-style command line and returns its arguments.
+// The line is terminated by LF with an optional CR before it.
+func (d *Decoder) decodeInline() ([][]byte, error) {
+	var line []byte
+	for {
+		chunk, err := d.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > d.MaxLineLen {
+			return nil, ProtocolError{"too big inline request"}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	line = line[:len(line)-1]
+	if len(line) != 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return SplitArgs(line)
+}
+
+// SplitArgs splits a line into arguments separated by spaces. Arguments can
+// be quoted: double quotes support escape sequences like \n or \x00 and
+// single quotes only support \'.
+func SplitArgs(line []byte) ([][]byte, error) {
+	args := [][]byte{}
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		current := []byte{}
+		inDoubleQuotes, inSingleQuotes, done := false, false, false
+		for !done {
+			switch {
+			case inDoubleQuotes:
+				if i >= len(line) {
+					return nil, ProtocolError{"unbalanced quotes in request"}
+				}
+				c := line[i]
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHexDigit(line[i+2]) && isHexDigit(line[i+3]) {
+					current = append(current, hexValue(line[i+2])<<4|hexValue(line[i+3]))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					current = append(current, unescape(line[i]))
+				} else if c == '"' {
+					// the closing quote must be followed by a space or nothing
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ProtocolError{"unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			case inSingleQuotes:
+				if i >= len(line) {
+					return nil, ProtocolError{"unbalanced quotes in request"}
+				}
+				c := line[i]
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					current = append(current, '\'')
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, ProtocolError{"unbalanced quotes in request"}
+					}
+					done = true
+				} else {
+					current = append(current, c)
+				}
+			default:
+				if i >= len(line) {
+					done = true
+					break
+				}
+				switch line[i] {
+				case ' ', '\n', '\r', '\t', 0:
+					done = true
+				case '"':
+					inDoubleQuotes = true
+				case '\'':
+					inSingleQuotes = true
+				default:
+					current = append(current, line[i])
+				}
+			}
+			if i < len(line) {
+				i++
+			}
+		}
+		args = append(args, current)
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func hexValue(c byte) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0'
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+func unescape(c byte) byte {
+	switch c {
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'b':
+		return '\b'
+	case 'a':
+		return '\a'
+	default:
+		return c
+	}
+}
@@ -1,11 +1,9 @@
 package parser
 
 import (
-	"errors"
-	"fmt"
 	"strconv"
+	"strings"
 
-	"github.com/codecrafters-io/redis-starter-go/utils"
 	"github.com/mitchellh/mapstructure"
 )
 
@@ -17,14 +15,29 @@ const (
 	BulkString DataType = '$'
 	Integer    DataType = ':'
 	Error      DataType = '-'
+
+	// RESP3
+	Null           DataType = '_'
+	Boolean        DataType = '#'
+	Double         DataType = ','
+	BigNumber      DataType = '('
+	BlobError      DataType = '!'
+	VerbatimString DataType = '='
+	Map            DataType = '%'
+	Set            DataType = '~'
+	Attribute      DataType = '|'
+	Push           DataType = '>'
 )
 
 type Data struct {
-	dataType DataType
-	string   string
-	integer  int
-	array    []Data
-	null     bool
+	dataType   DataType
+	bytes      []byte
+	integer    int
+	double     float64
+	boolean    bool
+	array      []Data
+	attributes []Data
+	null       bool
 }
 
 type TypeHeader struct {
@@ -32,17 +45,14 @@ type TypeHeader struct {
 	length   int
 }
 
+// Parser decodes RESP frames from a complete, in-memory source.
 type Parser struct {
-	source  string
-	start   int
-	current int
+	dec *Decoder
 }
 
 func NewParser(source string) *Parser {
 	return &Parser{
-		source:  source,
-		start:   0,
-		current: 0,
+		dec: NewDecoder(strings.NewReader(source)),
 	}
 }
 
@@ -51,158 +61,59 @@ func (d Data) ToMap() (out map[string]any, err error) {
 	return
 }
 
-func (data Data) Flat() (res []string) {
+func (data Data) Flat() (res [][]byte) {
 	switch data.dataType {
-	case Array:
+	case Array, Map, Set, Push:
 		arrData := data.array
 		for _, d := range arrData {
 			res = append(res, d.Flat()...)
 		}
-	case BulkString, String:
-		strData := data.string
-		res = append(res, strData)
+	case BulkString, String, BigNumber, BlobError:
+		res = append(res, data.bytes)
+	case VerbatimString:
+		res = append(res, data.verbatimText())
 	case Integer:
-		res = append(res, strconv.Itoa(data.integer))
+		res = append(res, []byte(strconv.Itoa(data.integer)))
+	case Double:
+		res = append(res, []byte(FormatDouble(data.double)))
+	case Boolean:
+		res = append(res, []byte(strconv.Itoa(boolToInt(data.boolean))))
 	}
 	return res
 }
 
-func IsSimple(t DataType) bool {
-	return t == String || t == Error || t == Integer
+func (d Data) Type() DataType {
+	return d.dataType
 }
 
-func (p *Parser) Parse() (*Data, error) {
-	typeHeader, err := p.parseTypeHeader()
-	if err != nil {
-		return nil, err
-	}
-
-	var value any
-	data := Data{dataType: typeHeader.dataType}
-	switch typeHeader.dataType {
-	case Array:
-		value, err = p.parseArray(typeHeader.length)
-		if err != nil {
-			return nil, err
-		}
-		data.array = value.([]Data)
-	case BulkString, String, Error:
-		value, err = p.scanString(typeHeader.length)
-		if err != nil {
-			return nil, err
-		}
-		err = p.consume('\r', '\n')
-		data.string = value.(string)
-	case Integer:
-		value := p.parseNumber()
-		data.integer = value
-		err = p.consume('\r', '\n')
-	default:
-		err = errors.New(fmt.Sprintf("Unknown type: %s", string(typeHeader.dataType)))
-	}
-	return &data, err
-}
-
-func (p *Parser) parseTypeHeader() (TypeHeader, error) {
-	typeChar := p.peek()
-	length := 0
-	p.current++
-	p.start = p.current
-
-	if !IsSimple(DataType(typeChar)) {
-		length = p.parseNumber()
-		err := p.consume('\r', '\n')
-		if err != nil {
-			return TypeHeader{}, errors.New("Expected CRLF after type header")
-		}
-	}
-
-	return TypeHeader{DataType(typeChar), length}, nil
-}
-
-func (p *Parser) parseArray(length int) ([]Data, error) {
-	value := make([]Data, length)
-	for i := 0; i < length; i++ {
-		parsed, err := p.Parse()
-		if err != nil {
-			return value, err
-		}
-		value[i] = *parsed
-	}
-	return value, nil
-}
-
-func (p *Parser) scanString(length int) (string, error) {
-	p.start = p.current
-	if length == 0 {
-		for (p.peek() != '\r' && p.peekNext() != '\n') && !p.IsAtEnd() {
-			p.current++
-			length++
-		}
-	}
-	if p.start+length > len(p.source) {
-		return "", errors.New("Provided length is larger than a source string")
-	}
-
-	literal := p.source[p.start : p.start+length]
-	p.current = p.start + length
-	return literal, nil
-}
-
-func (p *Parser) parseNumber() int {
-	p.start = p.current
-	for utils.IsDigit(p.peek()) {
-		p.current++
-	}
-
-	value, err := strconv.Atoi(p.source[p.start:p.current])
-
-	if err != nil {
-		return -1
-	}
-
-	return value
-}
-
-func (p *Parser) consume(seq ...byte) error {
-	for _, value := range seq {
-		toConsume := p.peek()
-		if toConsume != value {
-			return errors.New(fmt.Sprintf("Unexpected char: %s", string(toConsume)))
-		}
-		p.current++
-	}
-	return nil
+func IsSimple(t DataType) bool {
+	return t == String || t == Error || t == Integer ||
+		t == Null || t == Boolean || t == Double || t == BigNumber
 }
 
-func (p *Parser) peek() byte {
-	if p.IsAtEnd() {
-		return '\000'
-	}
-	return p.source[p.current]
+func IsAggregate(t DataType) bool {
+	return t == Array || t == Map || t == Set || t == Attribute || t == Push
 }
 
-func (p *Parser) peekNext() byte {
-	if p.current+1 > len(p.source)-1 {
-		return '\000'
-	}
-	return p.source[p.current+1]
+func (p *Parser) Parse() (*Data, error) {
+	return p.dec.Decode()
 }
 
 func (p Parser) IsAtEnd() bool {
-	return p.current >= len(p.source)
+	_, err := p.dec.r.Peek(1)
+	return err != nil
 }
 
 func StringData(str string) Data {
-	return Data{dataType: String, string: str}
+	return Data{dataType: String, bytes: []byte(str)}
 }
 
 func IntegerData(integer int) Data {
 	return Data{dataType: Integer, integer: integer}
 }
 
-func BulkStringData(str string) Data {
-	return Data{dataType: BulkString, string: str}
+func BulkStringData(bytes []byte) Data {
+	return Data{dataType: BulkString, bytes: bytes}
 }
 
 func NullBulkStringData() Data {
@@ -213,20 +124,36 @@ func ArrayData(arr []Data) Data {
 	return Data{dataType: Array, array: arr}
 }
 
+func NullArrayData() Data {
+	return Data{dataType: Array, null: true}
+}
+
 func ErrorData(str string) Data {
-	return Data{dataType: Error, string: str}
+	return Data{dataType: Error, bytes: []byte(str)}
 }
 
-func (d Data) Marshal() []byte {
+// Marshal encodes the data as is, so RESP3 types are only understood by
+// clients that negotiated protocol version 3. See MarshalProto.
+func (d Data) Marshal() (res []byte) {
+	if len(d.attributes) != 0 {
+		res = append(res, d.marshalAggregate(Attribute, d.attributes)...)
+	}
+
 	switch d.dataType {
 	case String, Error:
-		return d.marshalSimple()
+		return append(res, d.marshalSimple()...)
 	case Integer:
-		return d.marshalInteger()
+		return append(res, d.marshalInteger()...)
 	case BulkString:
-		return d.marshalBulk()
+		return append(res, d.marshalBulk()...)
 	case Array:
-		return d.marshalArray()
+		return append(res, d.marshalArray()...)
+	case Null, Boolean, Double, BigNumber:
+		return append(res, d.marshalSimple3()...)
+	case BlobError, VerbatimString:
+		return append(res, d.marshalBlob()...)
+	case Map, Set, Push:
+		return append(res, d.marshalAggregate(d.dataType, d.array)...)
 	default:
 		return nil
 	}
@@ -234,9 +161,12 @@ func (d Data) Marshal() []byte {
 
 func (d Data) marshalSimple() (res []byte) {
 	res = append(res, byte(d.dataType))
-	value := d.string
-	for _, b := range value {
-		res = append(res, byte(b))
+	for _, b := range d.bytes {
+		// simple strings can't span lines
+		if b == '\r' || b == '\n' {
+			b = ' '
+		}
+		res = append(res, b)
 	}
 	res = append(res, '\r', '\n')
 	return
@@ -256,14 +186,19 @@ func (d Data) marshalBulk() (res []byte) {
 		return
 	}
 
-	value := d.string
+	value := d.bytes
 	res = append(res, d.marshalTypeHeader(TypeHeader{length: len(value), dataType: BulkString})...)
-	res = append(res, []byte(value)...)
+	res = append(res, value...)
 	res = append(res, '\r', '\n')
 	return
 }
 
 func (d Data) marshalArray() (res []byte) {
+	if d.null {
+		res = append(res, d.marshalTypeHeader(TypeHeader{length: -1, dataType: Array})...)
+		return
+	}
+
 	value := d.array
 	res = append(res, d.marshalTypeHeader(TypeHeader{length: len(value), dataType: Array})...)
 	for _, v := range value {
@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"bytes"
+	"math/rand"
 	"testing"
 
 	"github.com/codecrafters-io/redis-starter-go/utils"
@@ -14,11 +16,11 @@ func TestParse(t *testing.T) {
 			array: []Data{
 				{
 					dataType: BulkString,
-					string:   "ECHO",
+					bytes:    []byte("ECHO"),
 				},
 				{
 					dataType: BulkString,
-					string:   "ABC",
+					bytes:    []byte("ABC"),
 				},
 			},
 		}},
@@ -29,10 +31,7 @@ func TestParse(t *testing.T) {
 	}
 
 	for _, e := range tests {
-		parser := Parser{
-			source:  e.Input,
-			current: 0,
-		}
+		parser := NewParser(e.Input)
 
 		data, err := parser.Parse()
 
@@ -56,7 +55,7 @@ func TestToMap(t *testing.T) {
 		array: []Data{
 			{
 				dataType: String,
-				string:   "Hi",
+				bytes:    []byte("Hi"),
 			},
 		},
 	}
@@ -74,12 +73,12 @@ func TestFlat(t *testing.T) {
 		array: []Data{
 			{
 				dataType: String,
-				string:   "Hi",
+				bytes:    []byte("Hi"),
 			},
 		},
 	}
 	res := data.Flat()
-	expected := []string{"Hi"}
+	expected := [][]byte{[]byte("Hi")}
 
 	if !cmp.Equal(res, expected) {
 		t.Errorf("Wrong flat result. Have: %v, want: %v", res, expected)
@@ -89,7 +88,7 @@ func TestFlat(t *testing.T) {
 func TestMarshalSimple(t *testing.T) {
 	data := Data{
 		dataType: String,
-		string:   "Hello",
+		bytes:    []byte("Hello"),
 	}
 	want := "+Hello\r\n"
 	res := data.marshalSimple()
@@ -101,7 +100,7 @@ func TestMarshalSimple(t *testing.T) {
 func TestMarshalBulk(t *testing.T) {
 	data := Data{
 		dataType: BulkString,
-		string:   "Hello",
+		bytes:    []byte("Hello"),
 	}
 	want := "$5\r\nHello\r\n"
 	res := data.marshalBulk()
@@ -109,3 +108,37 @@ func TestMarshalBulk(t *testing.T) {
 		t.Errorf("Wrong marshal result. Have: %s, want: %s", string(res), want)
 	}
 }
+
+func TestBinaryRoundTrip(t *testing.T) {
+	random := make([]byte, 8192)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []utils.Test[[]byte, []byte]{
+		{Name: "CRLF inside", Input: []byte("a\r\nb\r\n"), Want: []byte("a\r\nb\r\n")},
+		{Name: "NUL bytes", Input: []byte{0, 0, 'x', 0}, Want: []byte{0, 0, 'x', 0}},
+		{Name: "Invalid UTF-8", Input: []byte{0xc3, 0x28, 0xff, 0xfe}, Want: []byte{0xc3, 0x28, 0xff, 0xfe}},
+		{Name: "Random bytes", Input: random, Want: random},
+	}
+
+	for _, e := range tests {
+		frame := ArrayData([]Data{BulkStringData([]byte("SET")), BulkStringData(e.Input)}).Marshal()
+		data, err := NewParser(string(frame)).Parse()
+		if err != nil {
+			t.Errorf("%s: %s", e.Name, err.Error())
+			continue
+		}
+
+		res := data.Flat()
+		if len(res) != 2 || !bytes.Equal(res[1], e.Want) {
+			t.Errorf("%s: payload was corrupted", e.Name)
+		}
+	}
+}
+
+func TestMarshalSimpleMultiline(t *testing.T) {
+	want := "-ERR bad  input\r\n"
+	res := ErrorData("ERR bad\r\ninput").Marshal()
+	if string(res) != want {
+		t.Errorf("Wrong marshal result. Have: %q, want: %q", res, want)
+	}
+}
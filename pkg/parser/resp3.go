@@ -0,0 +1,174 @@
+package parser
+
+import (
+	"math"
+	"strconv"
+)
+
+const (
+	Resp2 = 2
+	Resp3 = 3
+)
+
+func NullData() Data {
+	return Data{dataType: Null, null: true}
+}
+
+func BooleanData(boolean bool) Data {
+	return Data{dataType: Boolean, boolean: boolean}
+}
+
+func DoubleData(double float64) Data {
+	return Data{dataType: Double, double: double}
+}
+
+func BigNumberData(number []byte) Data {
+	return Data{dataType: BigNumber, bytes: number}
+}
+
+func BlobErrorData(bytes []byte) Data {
+	return Data{dataType: BlobError, bytes: bytes}
+}
+
+// VerbatimStringData creates a verbatim string, format is a three letter
+// hint for the client like "txt" or "mkd".
+func VerbatimStringData(format string, text []byte) Data {
+	value := make([]byte, 0, len(format)+1+len(text))
+	value = append(value, format...)
+	value = append(value, ':')
+	value = append(value, text...)
+	return Data{dataType: VerbatimString, bytes: value}
+}
+
+// MapData creates a map from a flat list of alternating keys and values.
+func MapData(pairs []Data) Data {
+	return Data{dataType: Map, array: pairs}
+}
+
+func SetData(arr []Data) Data {
+	return Data{dataType: Set, array: arr}
+}
+
+func PushData(arr []Data) Data {
+	return Data{dataType: Push, array: arr}
+}
+
+// WithAttributes attaches auxiliary key-value pairs that are sent before the
+// reply itself. RESP2 clients never see them.
+func (d Data) WithAttributes(pairs []Data) Data {
+	d.attributes = pairs
+	return d
+}
+
+func (d Data) Attributes() []Data {
+	return d.attributes
+}
+
+// MarshalProto encodes the data for a client that speaks the given protocol
+// version, downgrading RESP3 types to their RESP2 counterparts if needed.
+func (d Data) MarshalProto(proto int) []byte {
+	if proto >= Resp3 {
+		return d.Marshal()
+	}
+	return d.ToResp2().Marshal()
+}
+
+func (d Data) ToResp2() Data {
+	switch d.dataType {
+	case Null:
+		return NullBulkStringData()
+	case Boolean:
+		return IntegerData(boolToInt(d.boolean))
+	case Double:
+		return BulkStringData([]byte(FormatDouble(d.double)))
+	case BigNumber:
+		return BulkStringData(d.bytes)
+	case VerbatimString:
+		return BulkStringData(d.verbatimText())
+	case BlobError:
+		return ErrorData(string(d.bytes))
+	case Array, Map, Set, Push:
+		if d.null {
+			return NullArrayData()
+		}
+		arr := make([]Data, len(d.array))
+		for i, e := range d.array {
+			arr[i] = e.ToResp2()
+		}
+		return ArrayData(arr)
+	default:
+		d.attributes = nil
+		return d
+	}
+}
+
+// FormatDouble formats a float the way doubles are sent over the wire: the
+// shortest representation that parses back to the same value.
+func FormatDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+
+	abs := math.Abs(f)
+	if f == 0 || (abs >= 1e-4 && abs < 1e17) {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func (d Data) verbatimText() []byte {
+	if len(d.bytes) < 4 {
+		return d.bytes
+	}
+	return d.bytes[4:]
+}
+
+func (d Data) marshalSimple3() (res []byte) {
+	res = append(res, byte(d.dataType))
+	switch d.dataType {
+	case Boolean:
+		if d.boolean {
+			res = append(res, 't')
+		} else {
+			res = append(res, 'f')
+		}
+	case Double:
+		res = append(res, FormatDouble(d.double)...)
+	case BigNumber:
+		res = append(res, d.bytes...)
+	}
+	res = append(res, '\r', '\n')
+	return
+}
+
+func (d Data) marshalBlob() (res []byte) {
+	res = append(res, d.marshalTypeHeader(TypeHeader{length: len(d.bytes), dataType: d.dataType})...)
+	res = append(res, d.bytes...)
+	res = append(res, '\r', '\n')
+	return
+}
+
+func (d Data) marshalAggregate(dataType DataType, value []Data) (res []byte) {
+	length := len(value)
+	if dataType == Map || dataType == Attribute {
+		length /= 2
+	}
+
+	res = append(res, d.marshalTypeHeader(TypeHeader{length: length, dataType: dataType})...)
+	for _, v := range value {
+		res = append(res, v.Marshal()...)
+	}
+	return
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
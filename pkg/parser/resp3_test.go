@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResp3RoundTrip(t *testing.T) {
+	tests := []utils.Test[string, Data]{
+		{Name: "Null", Input: "_\r\n", Want: NullData()},
+		{Name: "Boolean", Input: "#t\r\n", Want: BooleanData(true)},
+		{Name: "Double", Input: ",1.5\r\n", Want: DoubleData(1.5)},
+		{Name: "Negative infinity", Input: ",-inf\r\n", Want: DoubleData(math.Inf(-1))},
+		{Name: "Big number", Input: "(-3492890328409238509324850943850943825024385\r\n",
+			Want: BigNumberData([]byte("-3492890328409238509324850943850943825024385"))},
+		{Name: "Blob error", Input: "!22\r\nSYNTAX invalid\r\nsyntax\r\n", Want: BlobErrorData([]byte("SYNTAX invalid\r\nsyntax"))},
+		{Name: "Verbatim string", Input: "=15\r\ntxt:Some string\r\n", Want: VerbatimStringData("txt", []byte("Some string"))},
+		{Name: "Map", Input: "%2\r\n+first\r\n:1\r\n+second\r\n#f\r\n", Want: MapData([]Data{
+			StringData("first"), IntegerData(1),
+			StringData("second"), BooleanData(false),
+		})},
+		{Name: "Set", Input: "~2\r\n$1\r\na\r\n,2.25\r\n", Want: SetData([]Data{BulkStringData([]byte("a")), DoubleData(2.25)})},
+		{Name: "Push", Input: ">2\r\n$7\r\nmessage\r\n$2\r\nhi\r\n", Want: PushData([]Data{
+			BulkStringData([]byte("message")), BulkStringData([]byte("hi")),
+		})},
+		{Name: "Attribute", Input: "|1\r\n+ttl\r\n:3600\r\n$3\r\nval\r\n",
+			Want: BulkStringData([]byte("val")).WithAttributes([]Data{StringData("ttl"), IntegerData(3600)})},
+	}
+
+	for _, e := range tests {
+		data, err := NewDecoder(strings.NewReader(e.Input)).Decode()
+		if err != nil {
+			t.Errorf("%s: %s", e.Name, err.Error())
+			continue
+		}
+		if !cmp.Equal(*data, e.Want, cmp.AllowUnexported(Data{})) {
+			t.Errorf(e.ToString(*data))
+		}
+		if string(data.Marshal()) != e.Input {
+			t.Errorf("%s: wrong marshal result. Have: %q, want: %q", e.Name, data.Marshal(), e.Input)
+		}
+	}
+}
+
+func TestMarshalProto2(t *testing.T) {
+	tests := []utils.Test[Data, string]{
+		{Name: "Null", Input: NullData(), Want: "$-1\r\n"},
+		{Name: "Boolean", Input: BooleanData(true), Want: ":1\r\n"},
+		{Name: "Double", Input: DoubleData(3.0), Want: "$1\r\n3\r\n"},
+		{Name: "Verbatim string", Input: VerbatimStringData("txt", []byte("hi")), Want: "$2\r\nhi\r\n"},
+		{Name: "Map", Input: MapData([]Data{StringData("proto"), IntegerData(2)}), Want: "*2\r\n+proto\r\n:2\r\n"},
+		{Name: "Nested set", Input: ArrayData([]Data{SetData([]Data{NullData()})}), Want: "*1\r\n*1\r\n$-1\r\n"},
+		{Name: "Attribute", Input: IntegerData(1).WithAttributes([]Data{StringData("a"), StringData("b")}), Want: ":1\r\n"},
+	}
+
+	for _, e := range tests {
+		res := string(e.Input.MarshalProto(Resp2))
+		if res != e.Want {
+			t.Errorf(e.ToString(res))
+		}
+	}
+}
+
+func TestFormatDouble(t *testing.T) {
+	tests := []utils.Test[float64, string]{
+		{Name: "Integral", Input: 1000000, Want: "1000000"},
+		{Name: "Fraction", Input: 0.1, Want: "0.1"},
+		{Name: "Large", Input: 1e300, Want: "1e+300"},
+		{Name: "Infinity", Input: math.Inf(1), Want: "inf"},
+	}
+
+	for _, e := range tests {
+		res := FormatDouble(e.Input)
+		if res != e.Want {
+			t.Errorf(e.ToString(res))
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package rdb
+
+// Redis checksums RDB files with the Jones CRC-64 variant: reflected
+// polynomial 0xad93d23594c935a9, zero initial value and no final xor, which
+// is why hash/crc64 can't be used here.
+const jonesPoly = 0x95ac9329ac4bc9b5
+
+var crcTable = makeCrcTable()
+
+func makeCrcTable() *[256]uint64 {
+	var table [256]uint64
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ jonesPoly
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return &table
+}
+
+func crc64(crc uint64, p []byte) uint64 {
+	for _, b := range p {
+		crc = crcTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
@@ -0,0 +1,558 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+)
+
+// readChunk is how much of a string is allocated before its bytes arrive, a
+// longer one grows as it is read.
+const readChunk = 64 * 1024
+
+// Decoder reads keys from an RDB file one by one.
+type Decoder struct {
+	r          *bufio.Reader
+	crc        uint64
+	version    int
+	headerRead bool
+	done       bool
+	db         int
+	// the length of the input if it is known, -1 otherwise, and how much
+	// of it was read
+	size int64
+	read int64
+	Aux  map[string][]byte
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:    bufio.NewReader(r),
+		size: inputSize(r),
+		Aux:  make(map[string][]byte),
+	}
+}
+
+// inputSize returns what is left to read of in-memory readers and regular
+// files, -1 for streams.
+func inputSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		stat, err := r.Stat()
+		if err != nil || !stat.Mode().IsRegular() {
+			return -1
+		}
+		pos, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return stat.Size() - pos
+	}
+	return -1
+}
+
+// Next returns the next key in the file. After the last key it verifies the
+// checksum and returns io.EOF.
+func (d *Decoder) Next() (*Entry, error) {
+	if d.done {
+		return nil, io.EOF
+	}
+	if !d.headerRead {
+		if err := d.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+
+	var expireAt int64
+	for {
+		opcode, err := d.readByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		switch opcode {
+		case opEOF:
+			d.done = true
+			return nil, d.readChecksum()
+		case opSelectDB:
+			db, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			d.db = int(db)
+		case opResizeDB:
+			if _, err := d.readLen(); err != nil {
+				return nil, err
+			}
+			if _, err := d.readLen(); err != nil {
+				return nil, err
+			}
+		case opAux:
+			key, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			d.Aux[string(key)] = value
+		case opExpireTimeMs:
+			buf, err := d.readBytes(8)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(buf))
+		case opExpireTime:
+			buf, err := d.readBytes(4)
+			if err != nil {
+				return nil, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(buf)) * 1000
+		case opIdle:
+			if _, err := d.readLen(); err != nil {
+				return nil, err
+			}
+		case opFreq:
+			if _, err := d.readByte(); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+		case opModuleAux, opFunction2:
+			return nil, fmt.Errorf("Unsupported RDB opcode: 0x%x", opcode)
+		default:
+			key, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readObject(Type(opcode))
+			if err != nil {
+				return nil, err
+			}
+			return &Entry{
+				DB:       d.db,
+				Key:      key,
+				Value:    value,
+				ExpireAt: expireAt,
+			}, nil
+		}
+	}
+}
+
+func (d *Decoder) readHeader() error {
+	header, err := d.readBytes(uint64(len(Magic) + 4))
+	if err != nil {
+		return err
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return errors.New("Wrong signature trying to load DB from file")
+	}
+
+	version, err := strconv.Atoi(string(header[len(Magic):]))
+	if err != nil || version < 1 || version > 12 {
+		return fmt.Errorf("Can't handle RDB format version %s", header[len(Magic):])
+	}
+	d.version = version
+	d.headerRead = true
+	return nil
+}
+
+func (d *Decoder) readChecksum() error {
+	if d.version < 5 {
+		return io.EOF
+	}
+
+	expected := d.crc
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return unexpectedEOF(err)
+	}
+
+	// a zero checksum means the file was saved with checksums disabled
+	checksum := binary.LittleEndian.Uint64(buf)
+	if checksum != 0 && checksum != expected {
+		return ErrChecksum
+	}
+	return io.EOF
+}
+
+func (d *Decoder) readObject(t Type) (any, error) {
+	switch t {
+	case TypeString:
+		value, err := d.readString()
+		return String(value), err
+	case TypeList:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		list := List{}
+		for i := uint64(0); i < n; i++ {
+			elem, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elem)
+		}
+		return list, nil
+	case TypeListQuicklist2:
+		return d.readQuicklist2()
+	case TypeSet:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		set := Set{}
+		for i := uint64(0); i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, member)
+		}
+		return set, nil
+	case TypeSetIntset, TypeSetListpack:
+		data, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if t == TypeSetIntset {
+			return parseIntset(data)
+		}
+		members, err := parseListpack(data)
+		return Set(members), err
+	case TypeZSet, TypeZSet2:
+		return d.readZSet(t == TypeZSet2)
+	case TypeZSetListpack:
+		data, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseListpack(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(elems)%2 != 0 {
+			return nil, errBadListpack
+		}
+		zset := make(ZSet, 0, len(elems)/2)
+		for i := 0; i < len(elems); i += 2 {
+			score, err := strconv.ParseFloat(string(elems[i+1]), 64)
+			if err != nil {
+				return nil, errBadListpack
+			}
+			zset = append(zset, ZSetMember{Member: elems[i], Score: score})
+		}
+		return zset, nil
+	case TypeHash:
+		return d.readHash(false)
+	case TypeHashMetadata:
+		return d.readHash(true)
+	case TypeHashListpack:
+		data, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseListpack(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(elems)%2 != 0 {
+			return nil, errBadListpack
+		}
+		hash := make(Hash, 0, len(elems)/2)
+		for i := 0; i < len(elems); i += 2 {
+			hash = append(hash, HashField{Field: elems[i], Value: elems[i+1]})
+		}
+		return hash, nil
+	case TypeStreamListpacks, TypeStreamListpacks2, TypeStreamListpacks3:
+		return d.readStream(t)
+	default:
+		return nil, UnsupportedTypeError{t}
+	}
+}
+
+// readQuicklist2 reads the list encoding of redis 7: a sequence of nodes
+// that are either a single element or a listpack of elements.
+func (d *Decoder) readQuicklist2() (List, error) {
+	nodes, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+
+	list := List{}
+	for i := uint64(0); i < nodes; i++ {
+		container, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+
+		switch container {
+		case quicklistPlain:
+			list = append(list, data)
+		case quicklistPacked:
+			elems, err := parseListpack(data)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, elems...)
+		default:
+			return nil, fmt.Errorf("Unknown quicklist container %d", container)
+		}
+	}
+	return list, nil
+}
+
+// readZSet reads a sorted set, where scores are binary doubles, or strings
+// in the old format.
+func (d *Decoder) readZSet(binaryScores bool) (ZSet, error) {
+	n, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	zset := ZSet{}
+	for i := uint64(0); i < n; i++ {
+		var m ZSetMember
+		if m.Member, err = d.readString(); err != nil {
+			return nil, err
+		}
+		if binaryScores {
+			buf, err := d.readBytes(8)
+			if err != nil {
+				return nil, err
+			}
+			m.Score = math.Float64frombits(binary.LittleEndian.Uint64(buf))
+		} else if m.Score, err = d.readDoubleString(); err != nil {
+			return nil, err
+		}
+		zset = append(zset, m)
+	}
+	return zset, nil
+}
+
+// readDoubleString reads a score of the old sorted set format: a length
+// byte, that stands for NaN and the infinities when it's over 252, then the
+// score as a string.
+func (d *Decoder) readDoubleString() (float64, error) {
+	length, err := d.readByte()
+	if err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := d.readBytes(uint64(length))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// readHash reads a hash as a plain sequence of fields and values, with
+// metadata every field is preceded by its deadline, see Encoder.writeHash.
+func (d *Decoder) readHash(metadata bool) (Hash, error) {
+	var minExpire int64
+	if metadata {
+		buf, err := d.readBytes(8)
+		if err != nil {
+			return nil, err
+		}
+		minExpire = int64(binary.LittleEndian.Uint64(buf))
+	}
+
+	n, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	hash := Hash{}
+	for i := uint64(0); i < n; i++ {
+		var f HashField
+		if metadata {
+			ttl, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			if ttl != 0 {
+				f.ExpireAt = minExpire + int64(ttl) - 1
+			}
+		}
+		if f.Field, err = d.readString(); err != nil {
+			return nil, err
+		}
+		if f.Value, err = d.readString(); err != nil {
+			return nil, err
+		}
+		hash = append(hash, f)
+	}
+	return hash, nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.read++
+	d.crc = crc64(d.crc, []byte{b})
+	return b, nil
+}
+
+// readBytes reads a string of length n. The length comes from the file, so
+// the buffer only grows as the bytes arrive and a bogus one fails at the end
+// of the input instead of allocating it all.
+func (d *Decoder) readBytes(n uint64) ([]byte, error) {
+	if n > MaxStringLen {
+		return nil, fmt.Errorf("String length %d is over the limit of %d bytes", n, MaxStringLen)
+	}
+	if err := d.checkRemaining(n); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if n <= readChunk {
+		buf.Grow(int(n))
+	}
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	d.read += int64(n)
+	d.crc = crc64(d.crc, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// readCount reads the number of elements of a collection. Each of them takes
+// at least a byte, so there can't be more than what is left of the input.
+func (d *Decoder) readCount() (uint64, error) {
+	n, err := d.readLen()
+	if err != nil {
+		return 0, err
+	}
+	return n, d.checkRemaining(n)
+}
+
+func (d *Decoder) checkRemaining(n uint64) error {
+	if d.size >= 0 && n > uint64(d.size-d.read) {
+		return fmt.Errorf("Length %d is past the end of the input", n)
+	}
+	return nil
+}
+
+// readLenEnc reads a length, or the kind of special encoding that follows
+// if encoded is set.
+func (d *Decoder) readLenEnc() (length uint64, encoded bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, unexpectedEOF(err)
+	}
+
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3f), false, nil
+	case len14Bit:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, unexpectedEOF(err)
+		}
+		return uint64(b&0x3f)<<8 | uint64(next), false, nil
+	case lenEncVal:
+		return uint64(b & 0x3f), true, nil
+	}
+
+	switch b {
+	case len32Bit:
+		buf, err := d.readBytes(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf)), false, nil
+	case len64Bit:
+		buf, err := d.readBytes(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf), false, nil
+	default:
+		return 0, false, fmt.Errorf("Unknown length encoding 0x%x", b)
+	}
+}
+
+func (d *Decoder) readLen() (uint64, error) {
+	length, encoded, err := d.readLenEnc()
+	if err == nil && encoded {
+		err = errors.New("Unexpected string encoding in place of length")
+	}
+	return length, err
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	length, encoded, err := d.readLenEnc()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return d.readBytes(length)
+	}
+
+	switch length {
+	case encInt8:
+		b, err := d.readBytes(1)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int8(b[0])))), nil
+	case encInt16:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b))))), nil
+	case encInt32:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b))))), nil
+	case encLzf:
+		compressedLen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		rawLen, err := d.readLen()
+		if err != nil {
+			return nil, err
+		}
+		if rawLen > MaxStringLen {
+			return nil, fmt.Errorf("String length %d is over the limit of %d bytes", rawLen, MaxStringLen)
+		}
+		compressed, err := d.readBytes(compressedLen)
+		if err != nil {
+			return nil, err
+		}
+		return lzfDecompress(compressed, int(rawLen))
+	default:
+		return nil, fmt.Errorf("Unknown string encoding %d", length)
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
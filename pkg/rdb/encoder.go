@@ -0,0 +1,221 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Encoder writes an RDB file: the header, any number of databases with
+// their keys and the footer with the checksum, in that order.
+type Encoder struct {
+	w       *bufio.Writer
+	crc     uint64
+	err     error
+	version int
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w), version: Version}
+}
+
+// SetVersion changes the version written by WriteHeader, which is Version
+// by default.
+func (e *Encoder) SetVersion(version int) {
+	e.version = version
+}
+
+func (e *Encoder) WriteHeader() error {
+	e.write([]byte(fmt.Sprintf("%s%04d", Magic, e.version)))
+	return e.err
+}
+
+func (e *Encoder) WriteAux(key string, value string) error {
+	e.write([]byte{opAux})
+	e.writeString([]byte(key))
+	e.writeString([]byte(value))
+	return e.err
+}
+
+// SelectDB starts a new database section, size and expires are hints for
+// the reader to presize its tables.
+func (e *Encoder) SelectDB(db int, size int, expires int) error {
+	e.write([]byte{opSelectDB})
+	e.writeLen(uint64(db))
+	e.write([]byte{opResizeDB})
+	e.writeLen(uint64(size))
+	e.writeLen(uint64(expires))
+	return e.err
+}
+
+func (e *Encoder) WriteEntry(entry Entry) error {
+	if entry.ExpireAt != 0 {
+		e.write([]byte{opExpireTimeMs})
+		e.writeUint64(uint64(entry.ExpireAt))
+	}
+
+	switch value := entry.Value.(type) {
+	case String:
+		e.write([]byte{byte(TypeString)})
+		e.writeString(entry.Key)
+		e.writeString(value)
+	case List:
+		e.write([]byte{byte(TypeList)})
+		e.writeString(entry.Key)
+		e.writeLen(uint64(len(value)))
+		for _, elem := range value {
+			e.writeString(elem)
+		}
+	case Set:
+		e.write([]byte{byte(TypeSet)})
+		e.writeString(entry.Key)
+		e.writeLen(uint64(len(value)))
+		for _, member := range value {
+			e.writeString(member)
+		}
+	case ZSet:
+		e.write([]byte{byte(TypeZSet2)})
+		e.writeString(entry.Key)
+		e.writeLen(uint64(len(value)))
+		for _, m := range value {
+			e.writeString(m.Member)
+			e.writeUint64(math.Float64bits(m.Score))
+		}
+	case Hash:
+		e.writeHash(entry.Key, value)
+	case Stream:
+		e.write([]byte{byte(TypeStreamListpacks3)})
+		e.writeString(entry.Key)
+		e.writeStream(value)
+	default:
+		return fmt.Errorf("Can't encode value of type %T", entry.Value)
+	}
+	return e.err
+}
+
+// writeHash writes hashes with fields that expire in the format of redis 7.4:
+// the earliest deadline, then the deadline of every field relative to it,
+// plus one so that 0 means no expiry.
+func (e *Encoder) writeHash(key []byte, h Hash) {
+	var minExpire int64
+	for _, f := range h {
+		if f.ExpireAt != 0 && (minExpire == 0 || f.ExpireAt < minExpire) {
+			minExpire = f.ExpireAt
+		}
+	}
+
+	if minExpire == 0 {
+		e.write([]byte{byte(TypeHash)})
+	} else if e.version < VersionHashTTL {
+		// older readers don't know the type
+		if e.err == nil {
+			e.err = fmt.Errorf("Hash fields with a TTL need RDB version %d", VersionHashTTL)
+		}
+		return
+	} else {
+		e.write([]byte{byte(TypeHashMetadata)})
+	}
+	e.writeString(key)
+	if minExpire != 0 {
+		e.writeUint64(uint64(minExpire))
+	}
+	e.writeLen(uint64(len(h)))
+	for _, f := range h {
+		if minExpire != 0 {
+			ttl := uint64(0)
+			if f.ExpireAt != 0 {
+				ttl = uint64(f.ExpireAt-minExpire) + 1
+			}
+			e.writeLen(ttl)
+		}
+		e.writeString(f.Field)
+		e.writeString(f.Value)
+	}
+}
+
+// Close writes the footer and flushes the underlying writer.
+func (e *Encoder) Close() error {
+	e.write([]byte{opEOF})
+	if e.err != nil {
+		return e.err
+	}
+
+	checksum := make([]byte, 8)
+	binary.LittleEndian.PutUint64(checksum, e.crc)
+	if _, err := e.w.Write(checksum); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *Encoder) write(p []byte) {
+	if e.err != nil {
+		return
+	}
+	e.crc = crc64(e.crc, p)
+	_, e.err = e.w.Write(p)
+}
+
+func (e *Encoder) writeUint64(v uint64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	e.write(buf)
+}
+
+func (e *Encoder) writeLen(length uint64) {
+	switch {
+	case length < 1<<6:
+		e.write([]byte{byte(length) | len6Bit<<6})
+	case length < 1<<14:
+		e.write([]byte{byte(length>>8) | len14Bit<<6, byte(length)})
+	case length <= math.MaxUint32:
+		buf := make([]byte, 5)
+		buf[0] = len32Bit
+		binary.BigEndian.PutUint32(buf[1:], uint32(length))
+		e.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = len64Bit
+		binary.BigEndian.PutUint64(buf[1:], length)
+		e.write(buf)
+	}
+}
+
+// writeString stores small integers in their binary form like redis does,
+// anything else is written as is.
+func (e *Encoder) writeString(s []byte) {
+	if len(s) <= 11 {
+		if v, err := strconv.ParseInt(string(s), 10, 32); err == nil && strconv.FormatInt(v, 10) == string(s) {
+			e.writeInt(v)
+			return
+		}
+	}
+
+	e.writeLen(uint64(len(s)))
+	e.write(s)
+}
+
+// writeRaw writes a string as is, for binary strings that can't be mistaken
+// for integers.
+func (e *Encoder) writeRaw(s []byte) {
+	e.writeLen(uint64(len(s)))
+	e.write(s)
+}
+
+func (e *Encoder) writeInt(v int64) {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		e.write([]byte{lenEncVal<<6 | encInt8, byte(v)})
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		buf := []byte{lenEncVal<<6 | encInt16, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(v))
+		e.write(buf)
+	default:
+		buf := []byte{lenEncVal<<6 | encInt32, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		e.write(buf)
+	}
+}
@@ -0,0 +1,39 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+const intsetHeaderSize = 8
+
+var errBadIntset = errors.New("Bad intset")
+
+// parseIntset returns the members of an intset in their decimal form: a
+// sorted array of integers that are all 2, 4 or 8 bytes wide.
+func parseIntset(is []byte) (Set, error) {
+	if len(is) < intsetHeaderSize {
+		return nil, errBadIntset
+	}
+	width := int(binary.LittleEndian.Uint32(is))
+	n := int(binary.LittleEndian.Uint32(is[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(is) != intsetHeaderSize+n*width {
+		return nil, errBadIntset
+	}
+
+	set := make(Set, 0, n)
+	for p := is[intsetHeaderSize:]; len(p) > 0; p = p[width:] {
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		set = append(set, []byte(strconv.FormatInt(v, 10)))
+	}
+	return set, nil
+}
@@ -0,0 +1,220 @@
+package rdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Quicklist node containers.
+const (
+	quicklistPlain  = 1
+	quicklistPacked = 2
+)
+
+const (
+	listpackHeaderSize = 6
+	listpackEnd        = 0xff
+)
+
+var errBadListpack = errors.New("Bad listpack")
+
+// parseListpack returns the elements of a listpack, integers are returned in
+// their decimal form.
+func parseListpack(lp []byte) ([][]byte, error) {
+	if len(lp) < listpackHeaderSize+1 {
+		return nil, errBadListpack
+	}
+	if int(binary.LittleEndian.Uint32(lp)) != len(lp) {
+		return nil, errBadListpack
+	}
+
+	elems := [][]byte{}
+	p := lp[listpackHeaderSize:]
+	for {
+		if len(p) == 0 {
+			return nil, errBadListpack
+		}
+		if p[0] == listpackEnd {
+			return elems, nil
+		}
+
+		elem, size, err := listpackEntry(p)
+		if err != nil {
+			return nil, err
+		}
+		size += listpackBacklenSize(size)
+		if size > len(p) {
+			return nil, errBadListpack
+		}
+		elems = append(elems, elem)
+		p = p[size:]
+	}
+}
+
+// listpackEntry decodes the entry at the start of p, size doesn't include
+// the backlen that follows it.
+func listpackEntry(p []byte) (elem []byte, size int, err error) {
+	b := p[0]
+	var n int64
+	switch {
+	case b&0x80 == 0: // 7 bit unsigned integer
+		return itoa(int64(b & 0x7f)), 1, nil
+	case b&0xc0 == 0x80: // string up to 63 bytes
+		return listpackString(p, 1, int(b&0x3f))
+	case b&0xe0 == 0xc0: // 13 bit signed integer
+		if len(p) < 2 {
+			return nil, 0, errBadListpack
+		}
+		n = int64(b&0x1f)<<8 | int64(p[1])
+		if n >= 1<<12 {
+			n -= 1 << 13
+		}
+		return itoa(n), 2, nil
+	case b&0xf0 == 0xe0: // string up to 4095 bytes
+		if len(p) < 2 {
+			return nil, 0, errBadListpack
+		}
+		return listpackString(p, 2, int(b&0x0f)<<8|int(p[1]))
+	}
+
+	switch b {
+	case 0xf0: // string with a 32 bit length
+		if len(p) < 5 {
+			return nil, 0, errBadListpack
+		}
+		return listpackString(p, 5, int(binary.LittleEndian.Uint32(p[1:])))
+	case 0xf1:
+		if len(p) < 3 {
+			return nil, 0, errBadListpack
+		}
+		return itoa(int64(int16(binary.LittleEndian.Uint16(p[1:])))), 3, nil
+	case 0xf2:
+		if len(p) < 4 {
+			return nil, 0, errBadListpack
+		}
+		n = int64(p[1]) | int64(p[2])<<8 | int64(int8(p[3]))<<16
+		return itoa(n), 4, nil
+	case 0xf3:
+		if len(p) < 5 {
+			return nil, 0, errBadListpack
+		}
+		return itoa(int64(int32(binary.LittleEndian.Uint32(p[1:])))), 5, nil
+	case 0xf4:
+		if len(p) < 9 {
+			return nil, 0, errBadListpack
+		}
+		return itoa(int64(binary.LittleEndian.Uint64(p[1:]))), 9, nil
+	}
+	return nil, 0, errBadListpack
+}
+
+// listpackBuilder builds a listpack, strings that are integers take the
+// integer encodings like lpAppend does in redis.
+type listpackBuilder struct {
+	buf   []byte
+	count int
+}
+
+func newListpackBuilder() *listpackBuilder {
+	return &listpackBuilder{buf: make([]byte, listpackHeaderSize)}
+}
+
+func (b *listpackBuilder) appendString(s []byte) {
+	if len(s) <= 20 {
+		if v, err := strconv.ParseInt(string(s), 10, 64); err == nil && strconv.FormatInt(v, 10) == string(s) {
+			b.appendInt(v)
+			return
+		}
+	}
+
+	start := len(b.buf)
+	switch n := len(s); {
+	case n < 1<<6:
+		b.buf = append(b.buf, 0x80|byte(n))
+	case n < 1<<12:
+		b.buf = append(b.buf, 0xe0|byte(n>>8), byte(n))
+	default:
+		b.buf = append(b.buf, 0xf0)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(n))
+	}
+	b.buf = append(b.buf, s...)
+	b.appendBacklen(len(b.buf) - start)
+}
+
+func (b *listpackBuilder) appendInt(v int64) {
+	start := len(b.buf)
+	switch {
+	case v >= 0 && v <= 127:
+		b.buf = append(b.buf, byte(v))
+	case v >= -1<<12 && v < 1<<12:
+		b.buf = append(b.buf, 0xc0|byte(v>>8)&0x1f, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		b.buf = append(b.buf, 0xf1)
+		b.buf = binary.LittleEndian.AppendUint16(b.buf, uint16(v))
+	case v >= -1<<23 && v < 1<<23:
+		b.buf = append(b.buf, 0xf2, byte(v), byte(v>>8), byte(v>>16))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		b.buf = append(b.buf, 0xf3)
+		b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(v))
+	default:
+		b.buf = append(b.buf, 0xf4)
+		b.buf = binary.LittleEndian.AppendUint64(b.buf, uint64(v))
+	}
+	b.appendBacklen(len(b.buf) - start)
+}
+
+// appendBacklen writes the size of the entry so that it can be read from
+// right to left, 7 bits per byte with the high bit set in all but the first.
+func (b *listpackBuilder) appendBacklen(size int) {
+	n := listpackBacklenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		c := byte(size>>(7*i)) & 0x7f
+		if i != n-1 {
+			c |= 0x80
+		}
+		b.buf = append(b.buf, c)
+	}
+	b.count++
+}
+
+// bytes terminates the listpack and fills its header.
+func (b *listpackBuilder) bytes() []byte {
+	b.buf = append(b.buf, listpackEnd)
+	binary.LittleEndian.PutUint32(b.buf, uint32(len(b.buf)))
+	count := b.count
+	if count > math.MaxUint16 {
+		// too many to count, readers have to walk the listpack
+		count = math.MaxUint16
+	}
+	binary.LittleEndian.PutUint16(b.buf[4:], uint16(count))
+	return b.buf
+}
+
+func listpackString(p []byte, header int, length int) ([]byte, int, error) {
+	if length < 0 || header+length > len(p) {
+		return nil, 0, errBadListpack
+	}
+	return p[header : header+length], header + length, nil
+}
+
+// listpackBacklenSize is the number of bytes lpEncodeBacklen uses for an
+// entry of the given size.
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+func itoa(n int64) []byte {
+	return []byte(strconv.FormatInt(n, 10))
+}
@@ -0,0 +1,58 @@
+package rdb
+
+import "errors"
+
+var errLzf = errors.New("Corrupted LZF compressed string")
+
+// lzfDecompress inflates LZF compressed data into exactly outLen bytes.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	// the longest back reference takes 3 bytes for 264 bytes of output, a
+	// larger outLen can't be right and isn't allocated
+	if outLen > len(in)*88 {
+		return nil, errLzf
+	}
+	out := make([]byte, 0, outLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+
+		if ctrl < 1<<5 {
+			// literal run
+			length := ctrl + 1
+			if ip+length > len(in) || len(out)+length > outLen {
+				return nil, errLzf
+			}
+			out = append(out, in[ip:ip+length]...)
+			ip += length
+			continue
+		}
+
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return nil, errLzf
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errLzf
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[ip]) - 1
+		ip++
+
+		length += 2
+		if ref < 0 || len(out)+length > outLen {
+			return nil, errLzf
+		}
+		for i := 0; i < length; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+
+	if len(out) != outLen {
+		return nil, errLzf
+	}
+	return out, nil
+}
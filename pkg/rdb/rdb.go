@@ -0,0 +1,163 @@
+// Package rdb reads and writes redis RDB snapshot files.
+package rdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	Magic = "REDIS"
+	// Version is written unless the file needs the features of a later one
+	Version = 11
+	// VersionHashTTL is the first version with hash fields that expire.
+	VersionHashTTL = 12
+	// MaxStringLen is the longest string the decoder accepts, like the
+	// largest string value of redis.
+	MaxStringLen = 512 * 1024 * 1024
+)
+
+// Object types as they are stored in the file.
+type Type byte
+
+const (
+	TypeString           Type = 0
+	TypeList             Type = 1
+	TypeSet              Type = 2
+	TypeZSet             Type = 3
+	TypeHash             Type = 4
+	TypeZSet2            Type = 5
+	TypeModule2          Type = 7
+	TypeHashZipmap       Type = 9
+	TypeListZiplist      Type = 10
+	TypeSetIntset        Type = 11
+	TypeZSetZiplist      Type = 12
+	TypeHashZiplist      Type = 13
+	TypeListQuicklist    Type = 14
+	TypeStreamListpacks  Type = 15
+	TypeHashListpack     Type = 16
+	TypeZSetListpack     Type = 17
+	TypeListQuicklist2   Type = 18
+	TypeStreamListpacks2 Type = 19
+	TypeSetListpack      Type = 20
+	TypeStreamListpacks3 Type = 21
+	TypeHashMetadata     Type = 24
+)
+
+// Opcodes that can appear in place of an object type.
+const (
+	opFunction2    byte = 0xf5
+	opModuleAux    byte = 0xf7
+	opIdle         byte = 0xf8
+	opFreq         byte = 0xf9
+	opAux          byte = 0xfa
+	opResizeDB     byte = 0xfb
+	opExpireTimeMs byte = 0xfc
+	opExpireTime   byte = 0xfd
+	opSelectDB     byte = 0xfe
+	opEOF          byte = 0xff
+)
+
+// Length encoding, see rdbSaveLen in redis.
+const (
+	len6Bit   = 0
+	len14Bit  = 1
+	len32Bit  = 0x80
+	len64Bit  = 0x81
+	lenEncVal = 3
+
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLzf   = 3
+)
+
+var ErrChecksum = errors.New("RDB checksum mismatch")
+
+// String is the value of a string key.
+type String []byte
+
+// List is the value of a list key, from head to tail.
+type List [][]byte
+
+// Set is the value of a set key, in no particular order.
+type Set [][]byte
+
+// ZSet is the value of a sorted set key.
+type ZSet []ZSetMember
+
+type ZSetMember struct {
+	Member []byte
+	Score  float64
+}
+
+// Hash is the value of a hash key.
+type Hash []HashField
+
+// HashField is a field of a hash with its value.
+type HashField struct {
+	Field    []byte
+	Value    []byte
+	ExpireAt int64 // unix time in ms, 0 if the field doesn't expire
+}
+
+// Stream is the value of a stream key, with its consumer groups.
+type Stream struct {
+	Entries      []StreamEntry
+	LastID       StreamID
+	MaxDeletedID StreamID
+	EntriesAdded uint64
+	Groups       []StreamGroup
+}
+
+type StreamID struct {
+	Ms, Seq uint64
+}
+
+// StreamEntry is an entry of a stream, Fields holds its fields and values in
+// turn.
+type StreamEntry struct {
+	ID     StreamID
+	Fields [][]byte
+}
+
+type StreamGroup struct {
+	Name        []byte
+	LastID      StreamID
+	EntriesRead int64 // -1 if unknown
+	Pending     []StreamPending
+	Consumers   []StreamConsumer
+}
+
+// StreamPending is an entry that was delivered to a consumer of the group
+// and not acknowledged yet.
+type StreamPending struct {
+	ID            StreamID
+	DeliveryTime  int64 // unix time in ms
+	DeliveryCount uint64
+}
+
+// StreamConsumer is a consumer of a group with the IDs of the pending
+// entries it owns.
+type StreamConsumer struct {
+	Name       []byte
+	SeenTime   int64 // unix time in ms
+	ActiveTime int64 // unix time in ms, -1 if it never read anything
+	Pending    []StreamID
+}
+
+// Entry is a single key of the keyspace.
+type Entry struct {
+	DB       int
+	Key      []byte
+	Value    any
+	ExpireAt int64 // unix time in ms, 0 if the key doesn't expire
+}
+
+type UnsupportedTypeError struct {
+	Type Type
+}
+
+func (e UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("Unsupported RDB object type: %d", e.Type)
+}
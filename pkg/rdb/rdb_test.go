@@ -0,0 +1,283 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/codecrafters-io/redis-starter-go/utils"
+	"github.com/google/go-cmp/cmp"
+)
+
+// empty dump saved by redis 7.2
+const emptyDump = "UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog=="
+
+func TestCrc64(t *testing.T) {
+	var want uint64 = 0xe9c6d914c4b8d9ca
+	if res := crc64(0, []byte("123456789")); res != want {
+		t.Errorf("Wrong checksum. Have: %x, want: %x", res, want)
+	}
+}
+
+func TestLzfDecompress(t *testing.T) {
+	compressed := []byte{0x02, 'a', 'b', 'c', 0x80, 0x02}
+	res, err := lzfDecompress(compressed, 9)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if string(res) != "abcabcabc" {
+		t.Errorf("Wrong decompressed string. Have: %q, want: %q", res, "abcabcabc")
+	}
+
+	if _, err := lzfDecompress(compressed, 10); err == nil {
+		t.Error("Expected an error for a wrong length")
+	}
+}
+
+func TestDecodeRedisDump(t *testing.T) {
+	dump, _ := base64.StdEncoding.DecodeString(emptyDump)
+	dec := NewDecoder(bytes.NewReader(dump))
+
+	entry, err := dec.Next()
+	if err != io.EOF {
+		t.Fatalf("Expected an empty dump, have: %v, %v", entry, err)
+	}
+
+	tests := []utils.Test[string, string]{
+		{Name: "redis-ver", Input: "redis-ver", Want: "7.2.0"},
+		{Name: "redis-bits", Input: "redis-bits", Want: "64"},
+		{Name: "aof-base", Input: "aof-base", Want: "0"},
+	}
+	for _, e := range tests {
+		if res := string(dec.Aux[e.Input]); res != e.Want {
+			t.Errorf(e.ToString(res))
+		}
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	dump, _ := base64.StdEncoding.DecodeString(emptyDump)
+	dump[len(dump)-1] ^= 0xff
+
+	_, err := NewDecoder(bytes.NewReader(dump)).Next()
+	if err != ErrChecksum {
+		t.Errorf("Wrong error. Have: %v, want: %v", err, ErrChecksum)
+	}
+}
+
+// corruptedDump starts a key of type t whose next length is n, and ends
+// there.
+func corruptedDump(t Type, n uint64) []byte {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteHeader()
+	enc.write([]byte{byte(t)})
+	enc.writeString([]byte("key"))
+	enc.writeLen(n)
+	enc.write([]byte("abc"))
+	enc.w.Flush()
+	return buf.Bytes()
+}
+
+func TestCorruptedLengths(t *testing.T) {
+	tests := []utils.Test[io.Reader, string]{
+		{
+			Name:  "string over the limit",
+			Input: bytes.NewReader(corruptedDump(TypeString, 1<<40)),
+			Want:  "String length 1099511627776 is over the limit of 536870912 bytes",
+		},
+		{
+			Name:  "string past the end of the file",
+			Input: bytes.NewReader(corruptedDump(TypeString, 1<<20)),
+			Want:  "Length 1048576 is past the end of the input",
+		},
+		{
+			Name:  "list past the end of the file",
+			Input: bytes.NewReader(corruptedDump(TypeList, 1<<32)),
+			Want:  "Length 4294967296 is past the end of the input",
+		},
+		{
+			Name:  "string past the end of a stream",
+			Input: io.MultiReader(bytes.NewReader(corruptedDump(TypeString, 1<<28))),
+			Want:  io.ErrUnexpectedEOF.Error(),
+		},
+		{
+			Name:  "list past the end of a stream",
+			Input: io.MultiReader(bytes.NewReader(corruptedDump(TypeSet, 1<<32))),
+			Want:  io.ErrUnexpectedEOF.Error(),
+		},
+	}
+
+	for _, e := range tests {
+		_, err := NewDecoder(e.Input).Next()
+		res := ""
+		if err != nil {
+			res = err.Error()
+		}
+		if res != e.Want {
+			t.Errorf(e.ToString(res))
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	entries := []Entry{
+		{Key: []byte("plain"), Value: String("value")},
+		{Key: []byte("int8"), Value: String("-12")},
+		{Key: []byte("int16"), Value: String("1000")},
+		{Key: []byte("int32"), Value: String("-2000000000")},
+		{Key: []byte("not canonical"), Value: String("007")},
+		{Key: []byte("binary\x00"), Value: String("\r\n\x00\xff")},
+		{Key: []byte("long"), Value: String(bytes.Repeat([]byte("x"), 20000))},
+		{Key: []byte("expiring"), Value: String("v"), ExpireAt: 1700000000123},
+		{Key: []byte("list"), Value: List{[]byte("a"), []byte("100"), []byte("")}},
+		{Key: []byte("set"), Value: Set{[]byte("x"), []byte("-5")}},
+		{Key: []byte("zset"), Value: ZSet{{Member: []byte("a"), Score: -1.5}, {Member: []byte("b"), Score: math.Inf(1)}}},
+		{Key: []byte("hash"), Value: Hash{{Field: []byte("f"), Value: []byte("1")}}},
+		{Key: []byte("hash ttl"), Value: Hash{
+			{Field: []byte("a"), Value: []byte("x"), ExpireAt: 1700000000500},
+			{Field: []byte("b"), Value: []byte("y")},
+			{Field: []byte("c"), Value: []byte("z"), ExpireAt: 1700000000123},
+		}},
+		{Key: []byte("stream"), Value: testStream()},
+		{Key: []byte("empty stream"), Value: Stream{LastID: StreamID{5, 1}, MaxDeletedID: StreamID{5, 1}, EntriesAdded: 1}},
+		{DB: 3, Key: []byte("other db"), Value: String("")},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetVersion(VersionHashTTL)
+	enc.WriteHeader()
+	enc.WriteAux("redis-ver", "7.2.0")
+	db := -1
+	for _, e := range entries {
+		if e.DB != db {
+			db = e.DB
+			enc.SelectDB(db, 1, 0)
+		}
+		if err := enc.WriteEntry(e); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range entries {
+		entry, err := dec.Next()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if !cmp.Equal(*entry, want) {
+			t.Errorf("Wrong entry. Have: %v, want: %v", *entry, want)
+		}
+	}
+	if _, err := dec.Next(); err != io.EOF {
+		t.Errorf("Wrong error at the end of file. Have: %v, want: %v", err, io.EOF)
+	}
+}
+
+func TestHashTTLVersion(t *testing.T) {
+	entry := Entry{Key: []byte("hash"), Value: Hash{{Field: []byte("f"), Value: []byte("v"), ExpireAt: 1700000000000}}}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.WriteHeader()
+	if err := enc.WriteEntry(entry); err == nil {
+		t.Errorf("Wrote hash fields with a TTL under version %d", Version)
+	}
+
+	buf.Reset()
+	enc = NewEncoder(&buf)
+	enc.SetVersion(VersionHashTTL)
+	enc.WriteHeader()
+	if err := enc.WriteEntry(entry); err != nil {
+		t.Fatal(err.Error())
+	}
+	enc.Close()
+	if header := string(buf.Bytes()[:9]); header != "REDIS0012" {
+		t.Errorf("Wrong header. Have: %q, want: %q", header, "REDIS0012")
+	}
+}
+
+// testStream has more entries than fit a node, some of them with fields that
+// differ from the first entry, and a group with pending entries.
+func testStream() Stream {
+	s := Stream{EntriesAdded: 160, MaxDeletedID: StreamID{1700000000000, 3}}
+	for i := 0; i < 150; i++ {
+		id := StreamID{Ms: 1700000000000 + uint64(i/7), Seq: uint64(i % 7)}
+		fields := [][]byte{[]byte("temp"), []byte(strconv.Itoa(i * 1000)), []byte("loc"), []byte("room " + strconv.Itoa(i))}
+		if i%10 == 3 {
+			fields = [][]byte{[]byte("other"), bytes.Repeat([]byte("x"), i*40)}
+		}
+		s.Entries = append(s.Entries, StreamEntry{ID: id, Fields: fields})
+		s.LastID = id
+	}
+	s.Groups = []StreamGroup{
+		{
+			Name:        []byte("workers"),
+			LastID:      s.Entries[20].ID,
+			EntriesRead: 21,
+			Pending: []StreamPending{
+				{ID: s.Entries[2].ID, DeliveryTime: 1700000001000, DeliveryCount: 3},
+				{ID: s.Entries[5].ID, DeliveryTime: 1700000002000, DeliveryCount: 1},
+			},
+			Consumers: []StreamConsumer{
+				{Name: []byte("alice"), SeenTime: 1700000002000, ActiveTime: 1700000002000, Pending: []StreamID{s.Entries[2].ID, s.Entries[5].ID}},
+				{Name: []byte("bob"), SeenTime: 1700000003000, ActiveTime: -1},
+			},
+		},
+		{Name: []byte("new"), EntriesRead: -1},
+	}
+	return s
+}
+
+func TestParseListpack(t *testing.T) {
+	lp := []byte{
+		20, 0, 0, 0, 4, 0, // total bytes and number of elements
+		0x81, 'a', 0x02, // 6 bit string
+		0x05, 0x01, // 7 bit uint
+		0xdf, 0x9c, 0x02, // 13 bit int
+		0xf2, 0xa0, 0x86, 0x01, 0x04, // 24 bit int
+		0xff,
+	}
+
+	res, err := parseListpack(lp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := [][]byte{[]byte("a"), []byte("5"), []byte("-100"), []byte("100000")}
+	if !cmp.Equal(res, want) {
+		t.Errorf("Wrong listpack elements. Have: %q, want: %q", res, want)
+	}
+
+	if _, err := parseListpack(lp[:len(lp)-1]); err == nil {
+		t.Error("Expected an error for a truncated listpack")
+	}
+}
+
+func TestParseIntset(t *testing.T) {
+	is := []byte{
+		2, 0, 0, 0, 3, 0, 0, 0, // 16 bit members, 3 of them
+		0x18, 0xfc, // -1000
+		0x07, 0x00,
+		0x10, 0x27, // 10000
+	}
+
+	res, err := parseIntset(is)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := Set{[]byte("-1000"), []byte("7"), []byte("10000")}
+	if !cmp.Equal(res, want) {
+		t.Errorf("Wrong intset members. Have: %q, want: %q", res, want)
+	}
+
+	if _, err := parseIntset(is[:len(is)-1]); err == nil {
+		t.Error("Expected an error for a truncated intset")
+	}
+}
@@ -0,0 +1,348 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Streams are stored like in redis: a radix tree of listpacks saved as the
+// ID of the first entry of every node and the listpack, the metadata of the
+// stream, then the consumer groups with their pending entries.
+const (
+	streamNodeMaxEntries = 100
+
+	streamFlagDeleted    = 1
+	streamFlagSameFields = 2
+)
+
+var errBadStream = errors.New("Bad stream listpack")
+
+// streamIDBytes is the 128 bit big endian form of the ID, that sorts like
+// the IDs themselves.
+func streamIDBytes(id StreamID) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, id.Ms)
+	binary.BigEndian.PutUint64(buf[8:], id.Seq)
+	return buf
+}
+
+func streamIDFromBytes(buf []byte) StreamID {
+	return StreamID{Ms: binary.BigEndian.Uint64(buf), Seq: binary.BigEndian.Uint64(buf[8:])}
+}
+
+func (e *Encoder) writeStream(s Stream) {
+	nodes := (len(s.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	e.writeLen(uint64(nodes))
+	for i := 0; i < len(s.Entries); i += streamNodeMaxEntries {
+		end := i + streamNodeMaxEntries
+		if end > len(s.Entries) {
+			end = len(s.Entries)
+		}
+		e.writeRaw(streamIDBytes(s.Entries[i].ID))
+		e.writeRaw(streamListpack(s.Entries[i:end]))
+	}
+
+	var first StreamID
+	if len(s.Entries) > 0 {
+		first = s.Entries[0].ID
+	}
+	e.writeLen(uint64(len(s.Entries)))
+	e.writeLen(s.LastID.Ms)
+	e.writeLen(s.LastID.Seq)
+	e.writeLen(first.Ms)
+	e.writeLen(first.Seq)
+	e.writeLen(s.MaxDeletedID.Ms)
+	e.writeLen(s.MaxDeletedID.Seq)
+	e.writeLen(s.EntriesAdded)
+
+	e.writeLen(uint64(len(s.Groups)))
+	for _, g := range s.Groups {
+		e.writeString(g.Name)
+		e.writeLen(g.LastID.Ms)
+		e.writeLen(g.LastID.Seq)
+		e.writeLen(uint64(g.EntriesRead))
+
+		e.writeLen(uint64(len(g.Pending)))
+		for _, p := range g.Pending {
+			e.write(streamIDBytes(p.ID))
+			e.writeUint64(uint64(p.DeliveryTime))
+			e.writeLen(p.DeliveryCount)
+		}
+		e.writeLen(uint64(len(g.Consumers)))
+		for _, c := range g.Consumers {
+			e.writeString(c.Name)
+			e.writeUint64(uint64(c.SeenTime))
+			e.writeUint64(uint64(c.ActiveTime))
+			e.writeLen(uint64(len(c.Pending)))
+			for _, id := range c.Pending {
+				e.write(streamIDBytes(id))
+			}
+		}
+	}
+}
+
+// streamListpack encodes a node: a master entry with the ID and the fields of
+// the first entry, then the entries with their ID relative to the master
+// one. Entries with the same fields as the master entry only store values.
+// Every entry ends with the number of elements it takes, so that the node
+// can be walked backwards.
+func streamListpack(entries []StreamEntry) []byte {
+	master := entries[0]
+	lp := newListpackBuilder()
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0) // deleted entries
+	lp.appendInt(int64(len(master.Fields) / 2))
+	for i := 0; i < len(master.Fields); i += 2 {
+		lp.appendString(master.Fields[i])
+	}
+	lp.appendInt(0)
+
+	for _, entry := range entries {
+		n := len(entry.Fields) / 2
+		same := sameFields(entry.Fields, master.Fields)
+		if same {
+			lp.appendInt(streamFlagSameFields)
+		} else {
+			lp.appendInt(0)
+		}
+		lp.appendInt(int64(entry.ID.Ms - master.ID.Ms))
+		lp.appendInt(int64(entry.ID.Seq - master.ID.Seq))
+		if same {
+			for i := 1; i < len(entry.Fields); i += 2 {
+				lp.appendString(entry.Fields[i])
+			}
+			lp.appendInt(int64(n + 3))
+		} else {
+			lp.appendInt(int64(n))
+			for _, elem := range entry.Fields {
+				lp.appendString(elem)
+			}
+			lp.appendInt(int64(2*n + 4))
+		}
+	}
+	return lp.bytes()
+}
+
+func sameFields(fields [][]byte, master [][]byte) bool {
+	if len(fields) != len(master) {
+		return false
+	}
+	for i := 0; i < len(fields); i += 2 {
+		if !bytes.Equal(fields[i], master[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// readStream reads the three versions of the format, the metadata of the
+// first one is limited to the length and the last ID.
+func (d *Decoder) readStream(t Type) (Stream, error) {
+	var s Stream
+	nodes, err := d.readCount()
+	if err != nil {
+		return s, err
+	}
+	for i := uint64(0); i < nodes; i++ {
+		key, err := d.readString()
+		if err != nil {
+			return s, err
+		}
+		if len(key) != 16 {
+			return s, errBadStream
+		}
+		data, err := d.readString()
+		if err != nil {
+			return s, err
+		}
+		elems, err := parseListpack(data)
+		if err != nil {
+			return s, err
+		}
+		if s.Entries, err = parseStreamListpack(s.Entries, streamIDFromBytes(key), elems); err != nil {
+			return s, err
+		}
+	}
+
+	lens := make([]uint64, 3)
+	if t != TypeStreamListpacks {
+		lens = make([]uint64, 8)
+	}
+	for i := range lens {
+		if lens[i], err = d.readLen(); err != nil {
+			return s, err
+		}
+	}
+	s.LastID = StreamID{Ms: lens[1], Seq: lens[2]}
+	s.EntriesAdded = lens[0]
+	if t != TypeStreamListpacks {
+		s.MaxDeletedID = StreamID{Ms: lens[5], Seq: lens[6]}
+		s.EntriesAdded = lens[7]
+	}
+
+	groups, err := d.readCount()
+	if err != nil {
+		return s, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		g, err := d.readStreamGroup(t)
+		if err != nil {
+			return s, err
+		}
+		s.Groups = append(s.Groups, g)
+	}
+	return s, nil
+}
+
+func (d *Decoder) readStreamGroup(t Type) (StreamGroup, error) {
+	g := StreamGroup{EntriesRead: -1}
+	var err error
+	if g.Name, err = d.readString(); err != nil {
+		return g, err
+	}
+	if g.LastID, err = d.readStreamID(); err != nil {
+		return g, err
+	}
+	if t != TypeStreamListpacks {
+		n, err := d.readLen()
+		if err != nil {
+			return g, err
+		}
+		g.EntriesRead = int64(n)
+	}
+
+	n, err := d.readCount()
+	if err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < n; i++ {
+		var p StreamPending
+		buf, err := d.readBytes(24)
+		if err != nil {
+			return g, err
+		}
+		p.ID = streamIDFromBytes(buf)
+		p.DeliveryTime = int64(binary.LittleEndian.Uint64(buf[16:]))
+		if p.DeliveryCount, err = d.readLen(); err != nil {
+			return g, err
+		}
+		g.Pending = append(g.Pending, p)
+	}
+
+	if n, err = d.readCount(); err != nil {
+		return g, err
+	}
+	for i := uint64(0); i < n; i++ {
+		var c StreamConsumer
+		if c.Name, err = d.readString(); err != nil {
+			return g, err
+		}
+		times := 1
+		if t == TypeStreamListpacks3 {
+			times = 2
+		}
+		buf, err := d.readBytes(uint64(8 * times))
+		if err != nil {
+			return g, err
+		}
+		c.SeenTime = int64(binary.LittleEndian.Uint64(buf))
+		// the older formats don't have it, the time it was last seen is
+		// the best guess
+		c.ActiveTime = c.SeenTime
+		if times == 2 {
+			c.ActiveTime = int64(binary.LittleEndian.Uint64(buf[8:]))
+		}
+
+		pending, err := d.readCount()
+		if err != nil {
+			return g, err
+		}
+		for j := uint64(0); j < pending; j++ {
+			id, err := d.readBytes(16)
+			if err != nil {
+				return g, err
+			}
+			c.Pending = append(c.Pending, streamIDFromBytes(id))
+		}
+		g.Consumers = append(g.Consumers, c)
+	}
+	return g, nil
+}
+
+func (d *Decoder) readStreamID() (StreamID, error) {
+	ms, err := d.readLen()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := d.readLen()
+	return StreamID{Ms: ms, Seq: seq}, err
+}
+
+// parseStreamListpack appends the entries of a node that aren't flagged as
+// deleted, see streamListpack for the layout.
+func parseStreamListpack(entries []StreamEntry, master StreamID, elems [][]byte) ([]StreamEntry, error) {
+	next := func() (int64, bool) {
+		if len(elems) == 0 {
+			return 0, false
+		}
+		v, err := strconv.ParseInt(string(elems[0]), 10, 64)
+		elems = elems[1:]
+		return v, err == nil
+	}
+	take := func(n int64) ([][]byte, bool) {
+		if n < 0 || n > int64(len(elems)) {
+			return nil, false
+		}
+		res := elems[:n:n]
+		elems = elems[n:]
+		return res, true
+	}
+
+	count, ok1 := next()
+	deleted, ok2 := next()
+	numFields, ok3 := next()
+	masterFields, ok4 := take(numFields)
+	_, ok5 := next()
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || count+deleted > math.MaxInt32 {
+		return nil, errBadStream
+	}
+
+	for i := int64(0); i < count+deleted; i++ {
+		flags, ok1 := next()
+		msDiff, ok2 := next()
+		seqDiff, ok3 := next()
+		if !ok1 || !ok2 || !ok3 {
+			return nil, errBadStream
+		}
+		entry := StreamEntry{ID: StreamID{Ms: master.Ms + uint64(msDiff), Seq: master.Seq + uint64(seqDiff)}}
+
+		if flags&streamFlagSameFields != 0 {
+			values, ok := take(numFields)
+			if !ok {
+				return nil, errBadStream
+			}
+			for j, field := range masterFields {
+				entry.Fields = append(entry.Fields, field, values[j])
+			}
+		} else {
+			n, ok := next()
+			if !ok {
+				return nil, errBadStream
+			}
+			if entry.Fields, ok = take(2 * n); !ok {
+				return nil, errBadStream
+			}
+		}
+		if _, ok := next(); !ok {
+			return nil, errBadStream
+		}
+
+		if flags&streamFlagDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -6,8 +6,9 @@ import (
 )
 
 type Node[T interface{}] struct {
-	value T
-	next  map[byte]*Node[T]
+	value    T
+	hasValue bool
+	next     map[byte]*Node[T]
 }
 
 type Trie[T interface{}] struct {
@@ -44,6 +45,7 @@ func (t *Trie[T]) Put(key string, value T) {
 		node = n
 	}
 	node.value = value
+	node.hasValue = true
 }
 
 func (t Trie[T]) Get(key string) (T, error) {
@@ -55,24 +57,33 @@ func (t Trie[T]) Get(key string) (T, error) {
 		}
 		node = v
 	}
+	if !node.hasValue {
+		return *new(T), errors.New(fmt.Sprintf("Can't get value with key %s: no such key", key))
+	}
 	return node.value, nil
 }
 
+// GetBestMatch returns the longest key stored in the trie that is a prefix of
+// the given key.
 func (t Trie[T]) GetBestMatch(key string) (string, *T, error) {
 	node := t.root
-	var resKey []byte
+	var best *Node[T]
+	bestLen := 0
 
-	for _, b := range []byte(key) {
+	for i, b := range []byte(key) {
 		v, ok := node.next[b]
 		if !ok {
 			break
 		}
-		resKey = append(resKey, b)
 		node = v
+		if node.hasValue {
+			best = node
+			bestLen = i + 1
+		}
 	}
 
-	if node == t.root {
+	if best == nil {
 		return "", nil, errors.New(fmt.Sprintf("No matches found for key %s", key))
 	}
-	return string(resKey), &node.value, nil
+	return key[:bestLen], &best.value, nil
 }
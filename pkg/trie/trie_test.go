@@ -8,7 +8,8 @@ func CreateTestTrie() *Trie[bool] {
 	trie.root.next[key[0]] = &Node[bool]{
 		next: map[byte]*Node[bool]{
 			key[1]: {
-				value: true,
+				value:    true,
+				hasValue: true,
 			},
 		},
 	}
@@ -48,3 +49,25 @@ func TestTrieBestMatch(t *testing.T) {
 		t.Fatal("Failed to get best match")
 	}
 }
+
+func TestTrieBestMatchSkipsInnerNodes(t *testing.T) {
+	trie := NewTrie[int]()
+	trie.Put("GET", 1)
+	trie.Put("GETRANGE", 2)
+
+	tests := map[string]string{
+		"GETR":     "GET",
+		"GETRANGE": "GETRANGE",
+		"GETRAN":   "GET",
+	}
+	for key, want := range tests {
+		k, _, err := trie.GetBestMatch(key)
+		if err != nil || k != want {
+			t.Errorf("Wrong best match for %s. Have: %s, want: %s", key, k, want)
+		}
+	}
+
+	if _, _, err := trie.GetBestMatch("GE"); err == nil {
+		t.Error("Expected no match for a prefix of a key")
+	}
+}